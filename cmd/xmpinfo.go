@@ -22,7 +22,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
+	_ "github.com/trimmer-io/go-xmp/formats"
 	_ "github.com/trimmer-io/go-xmp/models"
 	"github.com/trimmer-io/go-xmp/models/dc"
 	"github.com/trimmer-io/go-xmp/models/xmp_base"
@@ -69,12 +71,39 @@ func marshal(d *xmp.Document) []byte {
 	return b
 }
 
-func unmarshal(v []byte) *xmp.Document {
-	d := &xmp.Document{}
-	if err := xmp.Unmarshal(v, d); err != nil {
+// original returns the raw bytes of the main packet in filename. Sidecar
+// files are returned as is. It returns nil when the scanner finds no
+// packet, e.g. when the format stores it compressed.
+func original(filename string) []byte {
+	f, err := os.Open(filename)
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(filename)) == ".xmp" {
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			fail(err)
+		}
+		return b
+	}
+	l, err := xmp.FindPackets(f)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
 		fail(err)
 	}
-	return d
+	if fall {
+		for _, p := range l {
+			out(p.Data)
+		}
+		return nil
+	}
+	if p := xmp.MainPacket(l); p != nil {
+		return p.Data
+	}
+	return l[0].Data
 }
 
 func main() {
@@ -89,44 +118,31 @@ func main() {
 		forig = true
 	}
 
-	var b []byte
+	var model *xmp.Document
 
 	if flag.NArg() > 0 {
 		filename := flag.Arg(0)
-		f, err := os.Open(filename)
-		if err != nil {
-			fail(err)
-		}
-		defer f.Close()
-
-		switch filepath.Ext(filename) {
-		case ".xmp":
-			b, err = ioutil.ReadAll(f)
-			if err != nil {
-				fail(err)
-			}
-
-		default:
-			bb, err := xmp.ScanPackets(f)
-			if err != nil && err != io.EOF {
-				fail(err)
+		if forig {
+			if b := original(filename); b != nil {
+				out(b)
 			}
-			if err == io.EOF {
+			if fall || !fjson && !fxmp && !fpath {
 				return
 			}
-			if forig && fall {
-				for _, b := range bb {
-					out(b)
-				}
-				return
-			}
-			b = bb[0]
 		}
+		d, err := xmp.ReadFile(filename)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fail(err)
+		}
+		model = d
 
 	} else {
 		// fill the document with some info
-		s := xmp.NewDocument()
-		s.AddModel(&xmpbase.XmpBase{
+		model = xmp.NewDocument()
+		model.AddModel(&xmpbase.XmpBase{
 			CreatorTool: xmp.Agent,
 			CreateDate:  xmp.Now(),
 			ModifyDate:  xmp.Now(),
@@ -139,7 +155,7 @@ func main() {
 				},
 			},
 		})
-		s.AddModel(&dc.DublinCore{
+		model.AddModel(&dc.DublinCore{
 			Format:  "image/jpeg",
 			Title:   xmp.NewAltString("demo"),
 			Creator: xmp.NewStringList("Alexander Eichhorn"),
@@ -148,16 +164,12 @@ func main() {
 				xmp.AltItem{Value: "Go-XMP Beispiel Modell", Lang: "de", IsDefault: false},
 			),
 		})
-		b = marshal(s)
-		s.Close()
 	}
 
-	if forig {
-		out(b)
+	if forig && flag.NArg() == 0 {
+		out(marshal(model))
 	}
 
-	model := unmarshal(b)
-
 	if fjson {
 		b, err := json.MarshalIndent(model, "", "  ")
 		if err != nil {
@@ -0,0 +1,550 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package bmff implements reading and writing of XMP packets embedded in
+// ISO base media files (MP4, MOV, M4A, 3GP) as defined by XMP Specification
+// Part 3.
+//
+// MP4 files store XMP in a top-level `uuid` box with extended type
+// BE7ACFCB-97A9-42E8-9C71-999491E3AFAC. QuickTime files store XMP in a
+// `moov/udta/XMP_` box. Both locations are read, new packets are written to
+// the location that matches the file brand.
+//
+// Update modifies a file in place without touching media data. It reuses
+// the space of existing packets and adjacent `free` boxes and otherwise
+// moves the box that holds the packet to the end of the file, turning the
+// old location into a `free` box. Write produces a new file that keeps the
+// original box order and fixes up `stco` and `co64` chunk offsets when
+// media data moves.
+//
+// Native QuickTime udta, mdta and iTunes ilst atoms are decoded into the
+// qt, itunes and dji models by ReadMetadata. UpdateMetadata and
+// WriteMetadata merge edited models back into the moov box.
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// XMPUUID is the extended type of the MP4 XMP box.
+var XMPUUID = []byte{
+	0xbe, 0x7a, 0xcf, 0xcb, 0x97, 0xa9, 0x42, 0xe8,
+	0x9c, 0x71, 0x99, 0x94, 0x91, 0xe3, 0xaf, 0xac,
+}
+
+var ErrInvalidFile = errors.New("bmff: invalid file format")
+
+func isXMPBox(b Box) bool {
+	return b.Type == "uuid" && bytes.Equal(b.UUID, XMPUUID)
+}
+
+func isFree(typ string) bool {
+	return typ == "free" || typ == "skip"
+}
+
+// IsQuickTime returns true when the file brand in ftyp is QuickTime or
+// the file has no ftyp box (classic QuickTime movies).
+func IsQuickTime(r io.ReadSeeker) (bool, error) {
+	l, err := ReadBoxes(r, 0, -1)
+	if err != nil {
+		return false, err
+	}
+	return isQuickTime(r, l)
+}
+
+func isQuickTime(r io.ReadSeeker, l []Box) (bool, error) {
+	ftyp := FindBox(l, "ftyp")
+	if ftyp == nil {
+		return FindBox(l, "moov") != nil, nil
+	}
+	b, err := ftyp.ReadData(r)
+	if err != nil {
+		return false, err
+	}
+	return len(b) >= 4 && string(b[:4]) == "qt  ", nil
+}
+
+func checkFile(l []Box) error {
+	if len(l) == 0 {
+		return ErrInvalidFile
+	}
+	switch l[0].Type {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide", "pnot", "uuid":
+		return nil
+	default:
+		return ErrInvalidFile
+	}
+}
+
+// ReadPacket returns the XMP packet from the MP4 uuid box or the QuickTime
+// moov/udta/XMP_ box. It returns io.EOF when the file contains no XMP.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	l, err := ReadBoxes(r, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFile(l); err != nil {
+		return nil, err
+	}
+	for _, b := range l {
+		if isXMPBox(b) {
+			return b.ReadData(r)
+		}
+	}
+	box, err := FindPath(r, "moov", "udta", "XMP_")
+	if err != nil {
+		return nil, err
+	}
+	if box == nil {
+		return nil, io.EOF
+	}
+	return box.ReadData(r)
+}
+
+// Read decodes the XMP packet embedded in an ISO base media file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	b, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// freeBox returns the bytes of a `free` box of total size n (n >= 8).
+func freeBox(n int64) []byte {
+	b := make([]byte, n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	copy(b[4:], "free")
+	return b
+}
+
+// fit pads a serialized box into a slot of size space. The remaining space
+// is filled with a `free` box or, when too small to hold one, with XMP
+// padding before the packet trailer of leaf boxes. It returns nil if the
+// box does not fit.
+func fit(n *Node, space int64) []byte {
+	left := space - n.Size()
+	switch {
+	case left < 0, left < 8 && left > 0 && n.isContainer():
+		return nil
+	case left == 0:
+		return n.Bytes()
+	case left >= 8:
+		return append(n.Bytes(), freeBox(left)...)
+	}
+	// padding must stay inside the xpacket wrapper, bare packets can take
+	// trailing whitespace
+	i := bytes.LastIndex(n.Data, []byte("<?xpacket end"))
+	if i < 0 {
+		i = len(n.Data)
+	}
+	c := *n
+	c.Data = make([]byte, 0, len(n.Data)+int(left))
+	c.Data = append(c.Data, n.Data[:i]...)
+	c.Data = append(c.Data, bytes.Repeat([]byte{' '}, int(left))...)
+	c.Data = append(c.Data, n.Data[i:]...)
+	return c.Bytes()
+}
+
+// slot returns the contiguous space starting at box i including directly
+// following free boxes.
+func slot(l []Box, i int) int64 {
+	space := l[i].Size
+	for j := i + 1; j < len(l) && isFree(l[j].Type); j++ {
+		space += l[j].Size
+	}
+	return space
+}
+
+func writeAt(f io.WriteSeeker, b []byte, off int64) error {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write(b)
+	return err
+}
+
+// UpdatePacket stores packet in f without rewriting media data.
+func UpdatePacket(f io.ReadWriteSeeker, packet []byte) error {
+	l, err := ReadBoxes(f, 0, -1)
+	if err != nil {
+		return err
+	}
+	if err := checkFile(l); err != nil {
+		return err
+	}
+	qt, err := isQuickTime(f, l)
+	if err != nil {
+		return err
+	}
+	if qt {
+		return updateQuickTime(f, l, packet)
+	}
+	return updateMP4(f, l, packet)
+}
+
+// Update embeds the XMP document d into the file f in place.
+func Update(f io.ReadWriteSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return UpdatePacket(f, b)
+}
+
+func updateMP4(f io.ReadWriteSeeker, l []Box, packet []byte) error {
+	box := &Node{Type: "uuid", UUID: XMPUUID, Data: packet}
+
+	// reuse an existing XMP box or the first large enough free box
+	pos := -1
+	for i, b := range l {
+		if isXMPBox(b) {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		for i, b := range l {
+			if isFree(b.Type) && fit(box, slot(l, i)) != nil {
+				pos = i
+				break
+			}
+		}
+	}
+	if pos >= 0 {
+		if buf := fit(box, slot(l, pos)); buf != nil {
+			return writeAt(f, buf, l[pos].Offset)
+		}
+		if pos == len(l)-1 && isXMPBox(l[pos]) {
+			// the last box can grow
+			return writeAt(f, box.Bytes(), l[pos].Offset)
+		}
+		// mark the old box as free space
+		if err := writeAt(f, []byte("free"), l[pos].Offset+4); err != nil {
+			return err
+		}
+	}
+	return appendBox(f, l, box)
+}
+
+func updateQuickTime(f io.ReadWriteSeeker, l []Box, packet []byte) error {
+	moov := FindBox(l, "moov")
+	if moov == nil {
+		return fmt.Errorf("bmff: missing moov box")
+	}
+	box := &Node{Type: "XMP_", Data: packet}
+
+	// reuse space inside udta
+	children, err := ReadBoxes(f, moov.DataOffset(), moov.End())
+	if err != nil {
+		return err
+	}
+	if udta := FindBox(children, "udta"); udta != nil {
+		ul, err := ReadBoxes(f, udta.DataOffset(), udta.End())
+		if err != nil {
+			return err
+		}
+		pos := -1
+		for i, b := range ul {
+			if b.Type == "XMP_" {
+				pos = i
+				break
+			}
+		}
+		if pos < 0 {
+			for i, b := range ul {
+				if isFree(b.Type) && fit(box, slot(ul, i)) != nil {
+					pos = i
+					break
+				}
+			}
+		}
+		if pos >= 0 {
+			if buf := fit(box, slot(ul, pos)); buf != nil {
+				return writeAt(f, buf, ul[pos].Offset)
+			}
+		}
+	}
+
+	return rewriteMoov(f, l, func(moov *Node) error {
+		setQuickTimePacket(moov, packet)
+		return nil
+	})
+}
+
+// rewriteMoov edits moov in memory and writes it back, using the space of
+// free boxes following moov or relocating it to the end of the file.
+func rewriteMoov(f io.ReadWriteSeeker, l []Box, edit func(*Node) error) error {
+	moov := FindBox(l, "moov")
+	if moov == nil {
+		return fmt.Errorf("bmff: missing moov box")
+	}
+	buf, err := moov.ReadData(f)
+	if err != nil {
+		return err
+	}
+	node := &Node{Type: "moov", Prefix: []byte{}}
+	if node.Children, err = ParseNodes(buf); err != nil {
+		return err
+	}
+	if err := edit(node); err != nil {
+		return err
+	}
+	idx := 0
+	for i := range l {
+		if l[i].Offset == moov.Offset {
+			idx = i
+		}
+	}
+	if buf := fit(node, slot(l, idx)); buf != nil {
+		return writeAt(f, buf, moov.Offset)
+	}
+	if idx == len(l)-1 {
+		// moov is the last box and can grow
+		return writeAt(f, node.Bytes(), moov.Offset)
+	}
+	if err := writeAt(f, []byte("free"), moov.Offset+4); err != nil {
+		return err
+	}
+	return appendBox(f, l, node)
+}
+
+// setQuickTimePacket replaces or adds the XMP_ box in moov/udta and drops
+// free boxes inside udta.
+func setQuickTimePacket(moov *Node, packet []byte) {
+	udta := moov.Find("udta")
+	if udta == nil {
+		udta = NewContainer("udta")
+		moov.Children = append(moov.Children, udta)
+	}
+	children := make([]*Node, 0, len(udta.Children)+1)
+	var found bool
+	for _, c := range udta.Children {
+		switch {
+		case c.Type == "XMP_":
+			if !found {
+				children = append(children, &Node{Type: "XMP_", Data: packet})
+				found = true
+			}
+		case isFree(c.Type):
+		default:
+			children = append(children, c)
+		}
+	}
+	if !found {
+		children = append(children, &Node{Type: "XMP_", Data: packet})
+	}
+	udta.Children = children
+}
+
+// appendBox appends n at the end of the file. A box that extends to the
+// end of the file (size 0) is fixed up first.
+func appendBox(f io.ReadWriteSeeker, l []Box, n *Node) error {
+	if len(l) > 0 {
+		last := l[len(l)-1]
+		var hdr [4]byte
+		if _, err := f.Seek(last.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(hdr[:]) == 0 {
+			if last.Size > 0xffffffff {
+				return fmt.Errorf("bmff: cannot append to open-ended %s box", last.Type)
+			}
+			binary.BigEndian.PutUint32(hdr[:], uint32(last.Size))
+			if err := writeAt(f, hdr[:], last.Offset); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err := f.Write(n.Bytes())
+	return err
+}
+
+// WritePacket copies the file from r to w and stores packet in the
+// location that matches the file brand. The original box order is kept
+// and chunk offsets are fixed up when media data moves.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	return writeFile(w, r, packet, nil)
+}
+
+// writeFile copies the file from r to w. A non-nil packet replaces the XMP
+// packet and edit, when set, is applied to the moov box tree.
+func writeFile(w io.Writer, r io.ReadSeeker, packet []byte, edit func(*Node) error) error {
+	l, err := ReadBoxes(r, 0, -1)
+	if err != nil {
+		return err
+	}
+	if err := checkFile(l); err != nil {
+		return err
+	}
+	qt, err := isQuickTime(r, l)
+	if err != nil {
+		return err
+	}
+	xmpBox := packet != nil && !qt
+
+	// build the output box list; nil nodes are copied verbatim
+	type item struct {
+		box  Box
+		node *Node
+		pos  int64
+	}
+	items := make([]*item, 0, len(l)+1)
+	var moov *Node
+	var inserted bool
+	for _, b := range l {
+		switch {
+		case isXMPBox(b) && packet != nil:
+			if xmpBox && !inserted {
+				items = append(items, &item{box: b, node: &Node{Type: "uuid", UUID: XMPUUID, Data: packet}})
+				inserted = true
+			}
+		case b.Type == "moov" && moov == nil:
+			buf, err := b.ReadData(r)
+			if err != nil {
+				return err
+			}
+			moov = &Node{Type: "moov", Prefix: []byte{}}
+			if moov.Children, err = ParseNodes(buf); err != nil {
+				return err
+			}
+			if qt && packet != nil {
+				setQuickTimePacket(moov, packet)
+			}
+			if edit != nil {
+				if err := edit(moov); err != nil {
+					return err
+				}
+			}
+			items = append(items, &item{box: b, node: moov})
+		default:
+			items = append(items, &item{box: b})
+		}
+	}
+	if moov == nil {
+		return fmt.Errorf("bmff: missing moov box")
+	}
+	if xmpBox && !inserted {
+		// insert after moov
+		for i, v := range items {
+			if v.node == moov {
+				n := &item{node: &Node{Type: "uuid", UUID: XMPUUID, Data: packet}}
+				items = append(items[:i+1], append([]*item{n}, items[i+1:]...)...)
+				break
+			}
+		}
+	}
+
+	// compute the new layout
+	var pos int64
+	for _, v := range items {
+		v.pos = pos
+		if v.node != nil {
+			pos += v.node.Size()
+		} else {
+			pos += v.box.Size
+		}
+	}
+
+	// fix up chunk offsets that point into verbatim copied boxes
+	relocate := func(ofs int64) int64 {
+		for _, v := range items {
+			if v.node == nil && ofs >= v.box.Offset && ofs < v.box.End() {
+				return ofs + v.pos - v.box.Offset
+			}
+		}
+		return ofs
+	}
+	if err := fixChunkOffsets(moov, relocate); err != nil {
+		return err
+	}
+
+	for _, v := range items {
+		if v.node != nil {
+			if _, err := w.Write(v.node.Bytes()); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := r.Seek(v.box.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, v.box.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write copies the file from r to w and embeds the XMP document d.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, b)
+}
+
+// fixChunkOffsets rewrites all stco and co64 entries in moov using fn.
+func fixChunkOffsets(moov *Node, fn func(int64) int64) error {
+	return moov.Walk(func(n *Node) error {
+		switch n.Type {
+		case "stco":
+			if len(n.Data) < 8 {
+				return fmt.Errorf("bmff: short stco box")
+			}
+			cnt := int(binary.BigEndian.Uint32(n.Data[4:]))
+			if len(n.Data) < 8+cnt*4 {
+				return fmt.Errorf("bmff: short stco box")
+			}
+			for i := 0; i < cnt; i++ {
+				p := n.Data[8+i*4:]
+				v := fn(int64(binary.BigEndian.Uint32(p)))
+				if v > 0xffffffff {
+					return fmt.Errorf("bmff: chunk offset exceeds 32bit stco range")
+				}
+				binary.BigEndian.PutUint32(p, uint32(v))
+			}
+		case "co64":
+			if len(n.Data) < 8 {
+				return fmt.Errorf("bmff: short co64 box")
+			}
+			cnt := int(binary.BigEndian.Uint32(n.Data[4:]))
+			if len(n.Data) < 8+cnt*8 {
+				return fmt.Errorf("bmff: short co64 box")
+			}
+			for i := 0; i < cnt; i++ {
+				p := n.Data[8+i*8:]
+				binary.BigEndian.PutUint64(p, uint64(fn(int64(binary.BigEndian.Uint64(p)))))
+			}
+		}
+		return nil
+	})
+}
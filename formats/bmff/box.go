@@ -0,0 +1,355 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Box is the location of a box inside a file.
+type Box struct {
+	Type   string // four character code
+	UUID   []byte // extended type for `uuid` boxes
+	Offset int64  // file offset of the box header
+	Size   int64  // total size including header
+	Header int64  // header size
+}
+
+func (b Box) DataOffset() int64 {
+	return b.Offset + b.Header
+}
+
+func (b Box) DataSize() int64 {
+	return b.Size - b.Header
+}
+
+func (b Box) End() int64 {
+	return b.Offset + b.Size
+}
+
+// ReadData reads the box payload.
+func (b Box) ReadData(r io.ReadSeeker) ([]byte, error) {
+	if b.DataSize() > maxBoxSize {
+		return nil, fmt.Errorf("bmff: %s box too large (%d bytes)", b.Type, b.Size)
+	}
+	buf := make([]byte, b.DataSize())
+	if _, err := r.Seek(b.DataOffset(), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("bmff: reading %s box: %v", b.Type, err)
+	}
+	return buf, nil
+}
+
+// maximum size of box payloads we load into memory
+const maxBoxSize = 1 << 30
+
+// ReadBoxes lists all boxes between start and end. Set end to -1 to read
+// until the end of the file.
+func ReadBoxes(r io.ReadSeeker, start, end int64) ([]Box, error) {
+	if end < 0 {
+		var err error
+		if end, err = r.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	boxes := make([]Box, 0)
+	for ofs := start; ofs+8 <= end; {
+		b, err := readBox(r, ofs, end)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, b)
+		ofs = b.End()
+	}
+	return boxes, nil
+}
+
+func readBox(r io.ReadSeeker, ofs, end int64) (Box, error) {
+	if _, err := r.Seek(ofs, io.SeekStart); err != nil {
+		return Box{}, err
+	}
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+		return Box{}, fmt.Errorf("bmff: reading box at offset %d: %v", ofs, err)
+	}
+	b := Box{
+		Type:   string(hdr[4:8]),
+		Offset: ofs,
+		Size:   int64(binary.BigEndian.Uint32(hdr[:4])),
+		Header: 8,
+	}
+	switch b.Size {
+	case 0:
+		b.Size = end - ofs
+	case 1:
+		if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+			return Box{}, fmt.Errorf("bmff: reading box at offset %d: %v", ofs, err)
+		}
+		b.Size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		b.Header = 16
+	}
+	if b.Type == "uuid" {
+		b.UUID = make([]byte, 16)
+		if _, err := io.ReadFull(r, b.UUID); err != nil {
+			return Box{}, fmt.Errorf("bmff: reading uuid box at offset %d: %v", ofs, err)
+		}
+		b.Header += 16
+	}
+	if b.Size < b.Header || b.End() > end {
+		return Box{}, fmt.Errorf("bmff: invalid %s box size %d at offset %d", b.Type, b.Size, ofs)
+	}
+	return b, nil
+}
+
+// FindBox returns the first box of type typ in l.
+func FindBox(l []Box, typ string) *Box {
+	for i := range l {
+		if l[i].Type == typ {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// FindPath walks a path of box types starting at the top-level of the
+// file, e.g. `moov`, `udta`, `XMP_`. Full boxes like `meta` are not
+// supported as intermediate path elements.
+func FindPath(r io.ReadSeeker, path ...string) (*Box, error) {
+	start, end := int64(0), int64(-1)
+	var box *Box
+	for _, typ := range path {
+		l, err := ReadBoxes(r, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if box = FindBox(l, typ); box == nil {
+			return nil, nil
+		}
+		start, end = box.DataOffset(), box.End()
+	}
+	return box, nil
+}
+
+// HEIF and AVIF image brands. Files with one of these major brands store
+// metadata as items in a top-level `meta` box and are handled by package
+// heif.
+var ImageBrands = []string{"mif1", "msf1", "heic", "heix", "heim", "heis", "hevc", "hevx", "hevm", "hevs", "avif", "avis"}
+
+// Brands returns the major and compatible brands of the `ftyp` box at the
+// start of head.
+func Brands(head []byte) (string, []string) {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return "", nil
+	}
+	size := int(binary.BigEndian.Uint32(head))
+	if size > len(head) || size < 16 {
+		size = len(head)
+	}
+	compat := make([]string, 0)
+	for i := 16; i+4 <= size; i += 4 {
+		compat = append(compat, string(head[i:i+4]))
+	}
+	return string(head[8:12]), compat
+}
+
+// IsImageBrand returns true when brand is a HEIF or AVIF image brand.
+func IsImageBrand(brand string) bool {
+	for _, v := range ImageBrands {
+		if v == brand {
+			return true
+		}
+	}
+	return false
+}
+
+// Node is an in-memory box tree used to edit small boxes such as `moov`.
+// Leaf boxes keep their payload in Data, container boxes in Children.
+// Prefix holds payload bytes in front of the children (e.g. version and
+// flags of full boxes) and Tail holds trailing bytes too short to form
+// a box (e.g. QuickTime udta terminators).
+type Node struct {
+	Type     string
+	UUID     []byte
+	Data     []byte
+	Prefix   []byte
+	Children []*Node
+	Tail     []byte
+}
+
+// container boxes we descend into when parsing box trees and the size of
+// their payload prefix
+var containerBoxes = map[string]int{
+	"moov": 0,
+	"trak": 0,
+	"mdia": 0,
+	"minf": 0,
+	"stbl": 0,
+	"udta": 0,
+	"edts": 0,
+	"dinf": 0,
+	"mvex": 0,
+}
+
+// ParseNode parses a complete box including its header.
+func ParseNode(b []byte) (*Node, error) {
+	l, err := ParseNodes(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) != 1 {
+		return nil, fmt.Errorf("bmff: expected single box, found %d", len(l))
+	}
+	return l[0], nil
+}
+
+// ParseNodes parses a sequence of boxes such as the payload of a container
+// box. Trailing bytes too short to form a box are ignored.
+func ParseNodes(b []byte) ([]*Node, error) {
+	l := make([]*Node, 0)
+	for len(b) >= 8 {
+		size := int64(binary.BigEndian.Uint32(b))
+		hdr := int64(8)
+		switch size {
+		case 0:
+			size = int64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, fmt.Errorf("bmff: short box header")
+			}
+			size = int64(binary.BigEndian.Uint64(b[8:]))
+			hdr = 16
+		}
+		n := &Node{Type: string(b[4:8])}
+		if n.Type == "uuid" {
+			if int64(len(b)) < hdr+16 {
+				return nil, fmt.Errorf("bmff: short uuid box header")
+			}
+			n.UUID = append([]byte{}, b[hdr:hdr+16]...)
+			hdr += 16
+		}
+		if size < hdr || size > int64(len(b)) {
+			return nil, fmt.Errorf("bmff: invalid %s box size %d", n.Type, size)
+		}
+		data := b[hdr:size]
+		if pre, ok := containerBoxes[n.Type]; ok && len(data) >= pre {
+			n.Prefix = append([]byte{}, data[:pre]...)
+			children, err := ParseNodes(data[pre:])
+			if err != nil {
+				return nil, err
+			}
+			n.Children = children
+			// keep trailing bytes
+			var used int64
+			for _, c := range children {
+				used += c.Size()
+			}
+			n.Tail = append([]byte{}, data[int64(pre)+used:]...)
+		} else {
+			n.Data = append([]byte{}, data...)
+		}
+		l = append(l, n)
+		b = b[size:]
+	}
+	return l, nil
+}
+
+func (n *Node) isContainer() bool {
+	return n.Children != nil || n.Prefix != nil || n.Tail != nil
+}
+
+func (n *Node) payloadSize() int64 {
+	if !n.isContainer() {
+		return int64(len(n.Data))
+	}
+	s := int64(len(n.Prefix) + len(n.Tail))
+	for _, c := range n.Children {
+		s += c.Size()
+	}
+	return s
+}
+
+// Size returns the serialized size of the box including its header.
+func (n *Node) Size() int64 {
+	s := n.payloadSize() + 8 + int64(len(n.UUID))
+	if s > 0xffffffff {
+		s += 8
+	}
+	return s
+}
+
+// Bytes serializes the box tree.
+func (n *Node) Bytes() []byte {
+	var buf bytes.Buffer
+	n.writeTo(&buf)
+	return buf.Bytes()
+}
+
+func (n *Node) writeTo(buf *bytes.Buffer) {
+	size := n.Size()
+	var hdr [16]byte
+	if size > 0xffffffff {
+		binary.BigEndian.PutUint32(hdr[:], 1)
+		copy(hdr[4:], n.Type)
+		binary.BigEndian.PutUint64(hdr[8:], uint64(size))
+		buf.Write(hdr[:16])
+	} else {
+		binary.BigEndian.PutUint32(hdr[:], uint32(size))
+		copy(hdr[4:], n.Type)
+		buf.Write(hdr[:8])
+	}
+	buf.Write(n.UUID)
+	if !n.isContainer() {
+		buf.Write(n.Data)
+		return
+	}
+	buf.Write(n.Prefix)
+	for _, c := range n.Children {
+		c.writeTo(buf)
+	}
+	buf.Write(n.Tail)
+}
+
+// Find returns the first child of type typ.
+func (n *Node) Find(typ string) *Node {
+	for _, c := range n.Children {
+		if c.Type == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for n and all its descendants.
+func (n *Node) Walk(fn func(*Node) error) error {
+	if err := fn(n); err != nil {
+		return err
+	}
+	for _, c := range n.Children {
+		if err := c.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewContainer returns an empty container box.
+func NewContainer(typ string) *Node {
+	return &Node{Type: typ, Children: make([]*Node, 0)}
+}
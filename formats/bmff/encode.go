@@ -0,0 +1,685 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	qtmodel "github.com/trimmer-io/go-xmp/models/qt"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// iTunes freeform item namespace
+const itunesMean = "com.apple.iTunes"
+
+// packed language code for undetermined language (und)
+const langUndetermined = 0x55c4
+
+// sizes of well-known iTunes integer items, all others are written with
+// 32 bit or, when the value requires, 64 bit
+var intSizes = map[string]int{
+	"akID": 1,
+	"cpil": 1,
+	"hdvd": 1,
+	"pcst": 1,
+	"pgap": 1,
+	"rtng": 1,
+	"shwm": 1,
+	"stik": 1,
+	"tmpo": 2,
+	"plID": 8,
+}
+
+// UpdateMetadata stores the native metadata models of m in the moov box of
+// f without rewriting media data.
+func UpdateMetadata(f io.ReadWriteSeeker, m *Metadata) error {
+	l, err := ReadBoxes(f, 0, -1)
+	if err != nil {
+		return err
+	}
+	if err := checkFile(l); err != nil {
+		return err
+	}
+	return rewriteMoov(f, l, func(moov *Node) error {
+		return EncodeMetadata(moov, m)
+	})
+}
+
+// WriteMetadata copies the file from r to w and stores the native metadata
+// models of m in the moov box. Chunk offsets are fixed up when media data
+// moves.
+func WriteMetadata(w io.Writer, r io.ReadSeeker, m *Metadata) error {
+	return writeFile(w, r, nil, func(moov *Node) error {
+		return EncodeMetadata(moov, m)
+	})
+}
+
+// EncodeMetadata merges the models of m into the moov box tree. Userdata
+// and DJI are written as moov/udta atoms, Metadata as mdta items in
+// moov/meta and ITunes as ilst items in the iTunes meta box, which is
+// created in moov/udta when missing.
+//
+// Only values that differ from what is currently stored in moov are
+// written. Items of cleared fields are removed while all other atoms,
+// including those unknown to the models, are kept as they are. Callers
+// should therefore edit the models returned by ReadMetadata. Nil models
+// leave their atoms untouched and Metadata.Items is ignored.
+func EncodeMetadata(moov *Node, m *Metadata) error {
+	orig, err := DecodeMetadata(moov)
+	if err != nil {
+		return err
+	}
+	if m.Userdata != nil {
+		if err := encodeUserdata(moov, diffModel(m.Userdata, orig.Userdata, "qt")); err != nil {
+			return err
+		}
+	}
+	if m.DJI != nil {
+		if err := encodeUserdata(moov, diffModel(m.DJI, orig.DJI, "qt")); err != nil {
+			return err
+		}
+	}
+	if m.Metadata != nil {
+		if err := encodeMdta(moov, diffModel(m.Metadata, orig.Metadata, "qt")); err != nil {
+			return err
+		}
+	}
+	if m.ITunes != nil {
+		if err := encodeMdir(moov, diffModel(m.ITunes, orig.ITunes, "iTunes")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// change is a model value that differs from the decoded file contents.
+// An invalid value removes the item.
+type change struct {
+	key string
+	val reflect.Value
+}
+
+func (c change) remove() bool {
+	return !c.val.IsValid()
+}
+
+// diffModel compares the model v against the model orig decoded from the
+// file. Both are pointers to the same struct type, orig may be nil.
+func diffModel(v, orig interface{}, tag string) []change {
+	val := reflect.ValueOf(v).Elem()
+	ov := reflect.Zero(val.Type())
+	if o := reflect.ValueOf(orig); !o.IsNil() {
+		ov = o.Elem()
+	}
+	fields := getFields(val.Type(), tag)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k != ",any" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return fields[keys[i]] < fields[keys[j]] })
+	l := make([]change, 0)
+	for _, k := range keys {
+		f, of := val.Field(fields[k]), ov.Field(fields[k])
+		if reflect.DeepEqual(f.Interface(), of.Interface()) {
+			continue
+		}
+		if f.IsZero() {
+			l = append(l, change{key: k})
+		} else {
+			l = append(l, change{key: k, val: f})
+		}
+	}
+	i, ok := fields[",any"]
+	if !ok {
+		return l
+	}
+	ext := val.Field(i).Interface().(xmp.TagList)
+	oext := ov.Field(i).Interface().(xmp.TagList)
+	for _, t := range ext {
+		if _, ok := fields[t.Key]; ok || t.Key == "" {
+			continue
+		}
+		if ot := findTag(oext, t.Key); ot == nil || ot.Value != t.Value {
+			l = append(l, change{key: t.Key, val: reflect.ValueOf(t.Value)})
+		}
+	}
+	for _, t := range oext {
+		if findTag(ext, t.Key) == nil {
+			l = append(l, change{key: t.Key})
+		}
+	}
+	return l
+}
+
+func findTag(l xmp.TagList, key string) *xmp.Tag {
+	for i := range l {
+		if l[i].Key == key {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// atomType returns the four character code of key. Keys starting with
+// the UTF-8 copyright sign are converted to the Macintosh encoding. It
+// returns false for keys that need a freeform item.
+func atomType(key string) (string, bool) {
+	if strings.HasPrefix(key, "©") {
+		key = "\xa9" + key[len("©"):]
+	}
+	return key, len(key) == 4
+}
+
+// encodeUserdata applies changes to the atoms in moov/udta. Atoms starting
+// with © are written in international text format, other atoms hold the
+// raw value.
+func encodeUserdata(moov *Node, changes []change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	udta := moov.Find("udta")
+	if udta == nil {
+		udta = NewContainer("udta")
+		moov.Children = append(moov.Children, udta)
+	}
+	for _, c := range changes {
+		typ, ok := atomType(c.key)
+		if !ok {
+			xmp.Log.Debugf("bmff: skipping udta item with invalid key %q", c.key)
+			continue
+		}
+		if c.remove() {
+			udta.Children = removeNodes(udta.Children, func(n *Node) bool { return n.Type == typ })
+			continue
+		}
+		s, err := userdataText(c.val)
+		if err != nil {
+			xmp.Log.Debugf("bmff: skipping udta item %q: %v", c.key, err)
+			continue
+		}
+		data := []byte(s)
+		old := udta.Find(typ)
+		if strings.HasPrefix(typ, "\xa9") {
+			lang := uint16(langUndetermined)
+			if old != nil && len(old.Data) >= 4 {
+				lang = binary.BigEndian.Uint16(old.Data[2:])
+			}
+			data = make([]byte, 4+len(s))
+			binary.BigEndian.PutUint16(data, uint16(len(s)))
+			binary.BigEndian.PutUint16(data[2:], lang)
+			copy(data[4:], s)
+		}
+		udta.Children = setItemNode(udta.Children, &Node{Type: typ, Data: data}, func(n *Node) bool {
+			return n.Type == typ
+		})
+	}
+	return nil
+}
+
+// userdataText formats a model value as udta text.
+func userdataText(v reflect.Value) (string, error) {
+	switch x := v.Interface().(type) {
+	case *qtmodel.Location:
+		return iso6709(x), nil
+	case []byte:
+		return string(x), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		return userdataText(v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		// DJI and other vendors store signed decimals like +4.8
+		s := strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits())
+		if !strings.HasPrefix(s, "-") {
+			s = "+" + s
+		}
+		return s, nil
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+	if v.Kind() == reflect.String {
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("unsupported field type %s", v.Type())
+}
+
+// iso6709 formats a location like "+52.5200+013.4050+034.000/".
+func iso6709(x *qtmodel.Location) string {
+	var buf bytes.Buffer
+	for _, v := range []string{x.Latitude.Value(), x.Longitude.Value()} {
+		if !strings.HasPrefix(v, "+") && !strings.HasPrefix(v, "-") {
+			buf.WriteByte('+')
+		}
+		buf.WriteString(v)
+	}
+	if x.Altitude != 0 {
+		if x.Altitude > 0 {
+			buf.WriteByte('+')
+		}
+		buf.WriteString(strconv.FormatFloat(x.Altitude, 'f', 3, 64))
+	}
+	buf.WriteByte('/')
+	return buf.String()
+}
+
+func removeNodes(l []*Node, fn func(*Node) bool) []*Node {
+	res := l[:0]
+	for _, n := range l {
+		if !fn(n) {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// encodeData converts a model value into typed data items. Text is stored
+// as UTF-8, integers as big-endian signed values of the width iTunes
+// expects for key and cover art as JPEG, PNG or BMP image.
+func encodeData(key string, v reflect.Value) ([]Item, error) {
+	switch x := v.Interface().(type) {
+	case []byte:
+		return []Item{{Key: key, Type: TypeBinary, Data: x}}, nil
+	case xmp.StringList:
+		l := make([]Item, 0, len(x))
+		for _, s := range x {
+			l = append(l, Item{Key: key, Type: TypeUTF8, Data: []byte(s)})
+		}
+		return l, nil
+	case xmp.Rational:
+		if key == "disk" {
+			b := make([]byte, 6)
+			binary.BigEndian.PutUint16(b[2:], uint16(x.Num))
+			binary.BigEndian.PutUint16(b[4:], uint16(x.Den))
+			return []Item{{Key: key, Type: TypeBinary, Data: b}}, nil
+		}
+	}
+	switch key {
+	case "trkn":
+		if v.Kind() == reflect.Int {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint16(b[2:], uint16(v.Int()))
+			return []Item{{Key: key, Type: TypeBinary, Data: b}}, nil
+		}
+	case "gnre":
+		if v.Kind() == reflect.Uint8 {
+			b := make([]byte, 2)
+			binary.BigEndian.PutUint16(b, uint16(v.Uint()))
+			return []Item{{Key: key, Type: TypeBinary, Data: b}}, nil
+		}
+	case "covr", "com.apple.quicktime.artwork":
+		if v.Kind() == reflect.String {
+			return encodeImage(key, v.String())
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		return encodeData(key, v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		size, ok := intSizes[key]
+		switch {
+		case ok:
+		case isBool(v):
+			size = 1
+		case n < math.MinInt32 || n > math.MaxInt32:
+			size = 8
+		default:
+			size = 4
+		}
+		return []Item{{Key: key, Type: TypeSigned, Data: putInt(n, size)}}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := v.Uint()
+		size := 4
+		if n > math.MaxUint32 {
+			size = 8
+		}
+		return []Item{{Key: key, Type: TypeUnsigned, Data: putInt(int64(n), size)}}, nil
+	case reflect.Float32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(v.Float())))
+		return []Item{{Key: key, Type: TypeFloat32, Data: b}}, nil
+	case reflect.Float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(v.Float()))
+		return []Item{{Key: key, Type: TypeFloat64, Data: b}}, nil
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return []Item{{Key: key, Type: TypeUTF8, Data: b}}, nil
+	}
+	if v.Kind() == reflect.String {
+		return []Item{{Key: key, Type: TypeUTF8, Data: []byte(v.String())}}, nil
+	}
+	return nil, fmt.Errorf("unsupported field type %s", v.Type())
+}
+
+// isBool returns true for the 0/1 flag types of the iTunes and qt models.
+func isBool(v reflect.Value) bool {
+	_, ok := v.Interface().(interface{ Value() bool })
+	return ok
+}
+
+func putInt(n int64, size int) []byte {
+	b := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	return b
+}
+
+// encodeImage decodes base64 image data as produced by Item.String and
+// detects the image type.
+func encodeImage(key, s string) ([]Item, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 image data: %v", err)
+	}
+	it := Item{Key: key, Data: b}
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8}):
+		it.Type = TypeJPEG
+	case bytes.HasPrefix(b, []byte("\x89PNG")):
+		it.Type = TypePNG
+	case bytes.HasPrefix(b, []byte("BM")):
+		it.Type = TypeBMP
+	default:
+		return nil, fmt.Errorf("unsupported image format")
+	}
+	return []Item{it}, nil
+}
+
+// dataAtoms builds the children of an ilst item from typed items.
+func dataAtoms(items []Item) []*Node {
+	l := make([]*Node, 0, len(items))
+	for _, it := range items {
+		b := make([]byte, 8+len(it.Data))
+		binary.BigEndian.PutUint32(b, uint32(it.Type))
+		copy(b[8:], it.Data)
+		l = append(l, &Node{Type: "data", Data: b})
+	}
+	return l
+}
+
+// metaBox is an editable meta box. Full boxes keep their version and flags
+// in prefix.
+type metaBox struct {
+	node     *Node
+	prefix   []byte
+	children []*Node
+}
+
+func openMeta(n *Node) (*metaBox, error) {
+	m := &metaBox{node: n}
+	b := n.Data
+	if len(b) >= 12 && string(b[4:8]) != "hdlr" {
+		m.prefix, b = b[:4], b[4:]
+	}
+	var err error
+	if m.children, err = ParseNodes(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newMeta creates a meta box with a hdlr box for handler and an empty item
+// list.
+func newMeta(handler string, full bool) *metaBox {
+	hdlr := make([]byte, 25)
+	copy(hdlr[8:], handler)
+	if handler == handlerMdir {
+		copy(hdlr[12:], "appl")
+	}
+	m := &metaBox{
+		node:     &Node{Type: "meta"},
+		children: []*Node{{Type: "hdlr", Data: hdlr}},
+	}
+	if full {
+		m.prefix = make([]byte, 4)
+	}
+	if handler == handlerMdta {
+		m.children = append(m.children, &Node{Type: "keys", Data: make([]byte, 8)})
+	}
+	m.children = append(m.children, &Node{Type: "ilst"})
+	return m
+}
+
+func (m *metaBox) handler() string {
+	if h := FindNode(m.children, "hdlr"); h != nil && len(h.Data) >= 12 {
+		return string(h.Data[8:12])
+	}
+	return ""
+}
+
+// items returns the children of the ilst box, adding an empty ilst box
+// when missing.
+func (m *metaBox) items() ([]*Node, error) {
+	ilst := FindNode(m.children, "ilst")
+	if ilst == nil {
+		ilst = &Node{Type: "ilst"}
+		m.children = append(m.children, ilst)
+	}
+	return ParseNodes(ilst.Data)
+}
+
+// close serializes items into the ilst box and the meta box payload.
+func (m *metaBox) close(items []*Node) {
+	FindNode(m.children, "ilst").Data = nodeBytes(items)
+	m.node.Data = append(append([]byte{}, m.prefix...), nodeBytes(m.children)...)
+}
+
+// encodeMdta applies changes to the mdta items in moov/meta. New keys are
+// appended to the key table, items of removed keys are dropped while the
+// key table entries stay in place.
+func encodeMdta(moov *Node, changes []change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var meta *metaBox
+	if n := moov.Find("meta"); n != nil {
+		var err error
+		if meta, err = openMeta(n); err != nil {
+			return err
+		}
+		if h := meta.handler(); h != handlerMdta {
+			return fmt.Errorf("bmff: moov/meta has unsupported %q handler", h)
+		}
+	} else {
+		meta = newMeta(handlerMdta, false)
+		moov.Children = append(moov.Children, meta.node)
+	}
+	keysBox := FindNode(meta.children, "keys")
+	if keysBox == nil {
+		keysBox = &Node{Type: "keys", Data: make([]byte, 8)}
+		meta.children = append(meta.children, keysBox)
+	}
+	keys, err := decodeKeys(keysBox.Data)
+	if err != nil {
+		return err
+	}
+	items, err := meta.items()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		idx := -1
+		for i, k := range keys {
+			if k == c.key {
+				idx = i + 1
+				break
+			}
+		}
+		var typ [4]byte
+		binary.BigEndian.PutUint32(typ[:], uint32(idx))
+		if c.remove() {
+			if idx > 0 {
+				items = removeNodes(items, func(n *Node) bool { return n.Type == string(typ[:]) })
+			}
+			continue
+		}
+		data, err := encodeData(c.key, c.val)
+		if err != nil {
+			xmp.Log.Debugf("bmff: skipping mdta item %q: %v", c.key, err)
+			continue
+		}
+		if idx < 0 {
+			keys = append(keys, c.key)
+			idx = len(keys)
+			binary.BigEndian.PutUint32(typ[:], uint32(idx))
+			entry := make([]byte, 8+len(c.key))
+			binary.BigEndian.PutUint32(entry, uint32(len(entry)))
+			copy(entry[4:], handlerMdta)
+			copy(entry[8:], c.key)
+			keysBox.Data = append(keysBox.Data, entry...)
+			binary.BigEndian.PutUint32(keysBox.Data[4:], uint32(len(keys)))
+		}
+		items = setItemNode(items, &Node{Type: string(typ[:]), Data: nodeBytes(dataAtoms(data))}, func(n *Node) bool {
+			return n.Type == string(typ[:])
+		})
+	}
+	meta.close(items)
+	return nil
+}
+
+// encodeMdir applies changes to the iTunes items in the meta box with the
+// mdir handler in moov/udta or moov. Keys that are no four character code
+// are stored as freeform (----) items in the com.apple.iTunes namespace.
+func encodeMdir(moov *Node, changes []change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var meta *metaBox
+	udta := moov.Find("udta")
+	for _, n := range []*Node{udta, moov} {
+		if n == nil {
+			continue
+		}
+		if c := n.Find("meta"); c != nil {
+			m, err := openMeta(c)
+			if err != nil {
+				return err
+			}
+			if m.handler() == handlerMdir {
+				meta = m
+				break
+			}
+		}
+	}
+	if meta == nil {
+		if udta == nil {
+			udta = NewContainer("udta")
+			moov.Children = append(moov.Children, udta)
+		}
+		if udta.Find("meta") != nil {
+			return fmt.Errorf("bmff: moov/udta/meta has unsupported handler")
+		}
+		meta = newMeta(handlerMdir, true)
+		udta.Children = append(udta.Children, meta.node)
+	}
+	items, err := meta.items()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		typ, ok := atomType(c.key)
+		match := func(n *Node) bool {
+			if ok {
+				return n.Type == typ
+			}
+			return n.Type == "----" && freeformName(n) == c.key
+		}
+		if c.remove() {
+			items = removeNodes(items, match)
+			continue
+		}
+		data, err := encodeData(c.key, c.val)
+		if err != nil {
+			xmp.Log.Debugf("bmff: skipping iTunes item %q: %v", c.key, err)
+			continue
+		}
+		children := dataAtoms(data)
+		if !ok {
+			typ = "----"
+			children = append([]*Node{
+				{Type: "mean", Data: append(make([]byte, 4), itunesMean...)},
+				{Type: "name", Data: append(make([]byte, 4), c.key...)},
+			}, children...)
+		}
+		items = setItemNode(items, &Node{Type: typ, Data: nodeBytes(children)}, match)
+	}
+	meta.close(items)
+	return nil
+}
+
+// freeformName returns the name of an iTunes freeform item.
+func freeformName(n *Node) string {
+	l, err := ParseNodes(n.Data)
+	if err != nil {
+		return ""
+	}
+	if name := FindNode(l, "name"); name != nil && len(name.Data) >= 4 {
+		return string(name.Data[4:])
+	}
+	return ""
+}
+
+// setItemNode replaces the first item matching fn with n or appends n.
+// Further matching items are removed.
+func setItemNode(l []*Node, n *Node, fn func(*Node) bool) []*Node {
+	res := make([]*Node, 0, len(l)+1)
+	var found bool
+	for _, c := range l {
+		switch {
+		case !fn(c):
+			res = append(res, c)
+		case !found:
+			res = append(res, n)
+			found = true
+		}
+	}
+	if !found {
+		res = append(res, n)
+	}
+	return res
+}
+
+func nodeBytes(l []*Node) []byte {
+	var buf bytes.Buffer
+	for _, n := range l {
+		n.writeTo(&buf)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+import (
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// box types that may start an ISO base media or QuickTime file
+var topLevelBoxes = []string{"ftyp", "moov", "mdat", "free", "skip", "wide", "pnot"}
+
+type handler struct{}
+
+func (handler) CanHandle(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	if major, _ := Brands(head); IsImageBrand(major) {
+		return false
+	}
+	for _, v := range topLevelBoxes {
+		if string(head[4:8]) == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	return Read(r)
+}
+
+func (handler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	f, ok := w.(io.ReadWriteSeeker)
+	if !ok {
+		return xmp.ErrNotSeekable
+	}
+	return Update(f, d)
+}
+
+func (handler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite | xmp.CapInPlace
+}
+
+func init() {
+	magic := make([]xmp.Magic, len(topLevelBoxes))
+	for i, v := range topLevelBoxes {
+		magic[i] = xmp.Magic{Offset: 4, Value: []byte(v)}
+	}
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name:       "bmff",
+		Extensions: []string{".mp4", ".m4a", ".m4v", ".mov", ".qt", ".3gp", ".3g2"},
+		Magic:      magic,
+		Handler:    handler{},
+	})
+}
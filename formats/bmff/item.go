@@ -0,0 +1,247 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Well-known data types of QuickTime metadata and iTunes `data` atoms.
+const (
+	TypeBinary    = 0  // reserved for use where no type needs to be indicated
+	TypeUTF8      = 1  // UTF-8 without count or NUL terminator
+	TypeUTF16     = 2  // UTF-16BE without count or NUL terminator
+	TypeSJIS      = 3  // S/JIS without count or NUL terminator
+	TypeUTF8Sort  = 4  // UTF-8 variant storage of a string for sorting only
+	TypeUTF16Sort = 5  // UTF-16 variant storage of a string for sorting only
+	TypeJPEG      = 13 // JFIF image
+	TypePNG       = 14 // PNG image
+	TypeSigned    = 21 // big-endian signed integer of 1, 2, 3, 4 or 8 bytes
+	TypeUnsigned  = 22 // big-endian unsigned integer of 1, 2, 3, 4 or 8 bytes
+	TypeFloat32   = 23 // big-endian IEEE754 32 bit float
+	TypeFloat64   = 24 // big-endian IEEE754 64 bit float
+	TypeBMP       = 27 // Windows bitmap image
+	TypeInt8      = 65
+	TypeInt16     = 66
+	TypeInt32     = 67
+	TypeInt64     = 74
+	TypeUint8     = 75
+	TypeUint16    = 76
+	TypeUint32    = 77
+	TypeUint64    = 78
+)
+
+// Item is a single metadata value read from a udta atom or an ilst data
+// atom. Key is the four character code of the atom, the reverse DNS key of
+// mdta items or the name of iTunes freeform (----) items.
+type Item struct {
+	Key  string
+	Type int
+	Lang string
+	Data []byte
+}
+
+func (x Item) isText() bool {
+	switch x.Type {
+	case TypeUTF8, TypeUTF16, TypeSJIS, TypeUTF8Sort, TypeUTF16Sort:
+		return true
+	default:
+		return false
+	}
+}
+
+func (x Item) isInt() bool {
+	switch x.Type {
+	case TypeSigned, TypeUnsigned, TypeInt8, TypeInt16, TypeInt32, TypeInt64,
+		TypeUint8, TypeUint16, TypeUint32, TypeUint64:
+		return true
+	default:
+		return false
+	}
+}
+
+func (x Item) isImage() bool {
+	return x.Type == TypeJPEG || x.Type == TypePNG || x.Type == TypeBMP
+}
+
+// String returns the item value as text. Numbers are formatted in decimal
+// notation and images are base64 encoded. Binary items and items of
+// unknown type return their raw data.
+func (x Item) String() string {
+	switch {
+	case x.Type == TypeUTF16 || x.Type == TypeUTF16Sort:
+		return decodeUTF16(x.Data)
+	case x.isText():
+		return strings.TrimRight(string(x.Data), "\x00")
+	case x.isImage():
+		return base64.StdEncoding.EncodeToString(x.Data)
+	case x.Type == TypeFloat32 || x.Type == TypeFloat64:
+		f, _ := x.Float()
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	case x.isInt():
+		if n, ok := x.Int(); ok {
+			return strconv.FormatInt(n, 10)
+		}
+		return ""
+	default:
+		return strings.TrimRight(string(x.Data), "\x00")
+	}
+}
+
+// Int returns the value of integer items. Binary items of 1, 2, 4 or 8
+// bytes are read as big-endian integers and text items are parsed in
+// decimal notation up to an optional "/" separator.
+func (x Item) Int() (int64, bool) {
+	b := x.Data
+	switch x.Type {
+	case TypeSigned, TypeInt8, TypeInt16, TypeInt32, TypeInt64:
+		if len(b) == 0 || len(b) > 8 {
+			return 0, false
+		}
+		n := int64(int8(b[0]))
+		for _, v := range b[1:] {
+			n = n<<8 | int64(v)
+		}
+		return n, true
+	case TypeUnsigned, TypeUint8, TypeUint16, TypeUint32, TypeUint64:
+		if len(b) == 0 || len(b) > 8 {
+			return 0, false
+		}
+		return int64(readUint(b)), true
+	case TypeBinary:
+		// iTunes writes some integer items without type
+		switch len(b) {
+		case 1, 2, 4, 8:
+			return int64(readUint(b)), true
+		}
+	case TypeFloat32, TypeFloat64:
+		f, ok := x.Float()
+		return int64(f), ok
+	}
+	if !x.isText() {
+		return 0, false
+	}
+	s := x.String()
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(s), "+"), 10, 64)
+	return n, err == nil
+}
+
+// Float returns the value of float, integer and numeric text items.
+func (x Item) Float() (float64, bool) {
+	switch x.Type {
+	case TypeFloat32:
+		if len(x.Data) != 4 {
+			return 0, false
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(x.Data))), true
+	case TypeFloat64:
+		if len(x.Data) != 8 {
+			return 0, false
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(x.Data)), true
+	}
+	if !x.isText() && x.Type != TypeBinary {
+		n, ok := x.Int()
+		return float64(n), ok
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(x.String()), 64)
+	return f, err == nil
+}
+
+func readUint(b []byte) uint64 {
+	var n uint64
+	for _, v := range b {
+		n = n<<8 | uint64(v)
+	}
+	return n
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[i*2:])
+	}
+	if len(u) > 0 && u[0] == 0xfeff {
+		u = u[1:]
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+}
+
+// decodeLanguage returns the ISO 639-2/T code of a packed QuickTime
+// language code. Macintosh language codes other than English and
+// unspecified languages return an empty string.
+func decodeLanguage(code uint16) string {
+	switch {
+	case code == 0:
+		return "en"
+	case code < 0x400 || code == 0x7fff:
+		return ""
+	}
+	s := string([]byte{
+		byte(code>>10&0x1f) + 0x60,
+		byte(code>>5&0x1f) + 0x60,
+		byte(code&0x1f) + 0x60,
+	})
+	if s == "und" {
+		return ""
+	}
+	return s
+}
+
+// decodeIntlText decodes the international text list of udta atoms whose
+// name starts with ©. Each entry holds a 16 bit size, a 16 bit language
+// code and the text in Macintosh or UTF-8 encoding, or UTF-16 with BOM.
+func decodeIntlText(key string, b []byte) []Item {
+	l := make([]Item, 0, 1)
+	for len(b) >= 4 {
+		size := int(binary.BigEndian.Uint16(b))
+		if size > len(b)-4 {
+			break
+		}
+		it := Item{
+			Key:  key,
+			Type: TypeUTF8,
+			Lang: decodeLanguage(binary.BigEndian.Uint16(b[2:])),
+			Data: b[4 : 4+size],
+		}
+		switch {
+		case size >= 2 && b[4] == 0xfe && b[5] == 0xff:
+			it.Type = TypeUTF16
+		case !utf8.Valid(it.Data):
+			it.Data = []byte(decodeLatin1(it.Data))
+		}
+		l = append(l, it)
+		b = b[4+size:]
+	}
+	return l
+}
+
+// decodeLatin1 approximates Macintosh Roman text with ISO 8859-1.
+func decodeLatin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, v := range b {
+		r[i] = rune(v)
+	}
+	return string(r)
+}
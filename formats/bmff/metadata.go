@@ -0,0 +1,408 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/trimmer-io/go-xmp/models/dji"
+	"github.com/trimmer-io/go-xmp/models/itunes"
+	qtmodel "github.com/trimmer-io/go-xmp/models/qt"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// Metadata holds the native metadata of a QuickTime or MP4 movie.
+//
+// Userdata and DJI are filled from the four character code atoms in
+// moov/udta, Metadata from mdta items in moov/meta (keys and ilst) and
+// ITunes from ilst items in moov/udta/meta or moov/meta with the mdir
+// handler. Models without any matching atom are nil.
+type Metadata struct {
+	Userdata *qtmodel.QtUserdata
+	Metadata *qtmodel.QtMetadata
+	ITunes   *itunes.ITunesMetadata
+	DJI      *dji.DJI
+	Items    []Item // all decoded items in file order
+}
+
+// metadata handler types in meta/hdlr
+const (
+	handlerMdta = "mdta" // QuickTime metadata with reverse DNS keys
+	handlerMdir = "mdir" // iTunes metadata with four character codes
+)
+
+// ReadMetadata reads the moov box and decodes its metadata atoms. It
+// returns io.EOF when the file has no metadata atoms.
+func ReadMetadata(r io.ReadSeeker) (*Metadata, error) {
+	l, err := ReadBoxes(r, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFile(l); err != nil {
+		return nil, err
+	}
+	box := FindBox(l, "moov")
+	if box == nil {
+		return nil, io.EOF
+	}
+	buf, err := box.ReadData(r)
+	if err != nil {
+		return nil, err
+	}
+	moov := &Node{Type: "moov", Prefix: []byte{}}
+	if moov.Children, err = ParseNodes(buf); err != nil {
+		return nil, err
+	}
+	m, err := DecodeMetadata(moov)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Items) == 0 {
+		return nil, io.EOF
+	}
+	return m, nil
+}
+
+// DecodeMetadata decodes the metadata atoms of a moov box tree. Items that
+// cannot be stored in a model field are logged and skipped.
+func DecodeMetadata(moov *Node) (*Metadata, error) {
+	m := &Metadata{Items: make([]Item, 0)}
+	if udta := moov.Find("udta"); udta != nil {
+		for _, c := range udta.Children {
+			switch {
+			case c.Type == "meta":
+				items, handler, err := decodeMeta(c.Data)
+				if err != nil {
+					return nil, err
+				}
+				m.add(handler, items)
+			case c.Type == "XMP_":
+				// handled by ReadPacket
+			case strings.HasPrefix(c.Type, "\xa9"):
+				m.add("udta", decodeIntlText(macRomanKey(c.Type), c.Data))
+			default:
+				m.add("udta", []Item{{Key: c.Type, Type: TypeBinary, Data: c.Data}})
+			}
+		}
+	}
+	if meta := moov.Find("meta"); meta != nil {
+		items, handler, err := decodeMeta(meta.Data)
+		if err != nil {
+			return nil, err
+		}
+		m.add(handler, items)
+	}
+	return m, nil
+}
+
+// macRomanKey converts four character codes starting with the Macintosh
+// encoded copyright sign (0xA9) to the UTF-8 keys used in struct tags.
+func macRomanKey(typ string) string {
+	return "©" + typ[1:]
+}
+
+func (m *Metadata) add(handler string, items []Item) {
+	for _, it := range items {
+		m.Items = append(m.Items, it)
+		switch handler {
+		case "udta":
+			if m.Userdata == nil {
+				m.Userdata = &qtmodel.QtUserdata{}
+			}
+			setItem(m.Userdata, "qt", it)
+			if x := m.DJI; x != nil || hasField(reflect.TypeOf(dji.DJI{}), "qt", it.Key) {
+				if x == nil {
+					m.DJI = &dji.DJI{}
+				}
+				setItem(m.DJI, "qt", it)
+			}
+		case handlerMdta:
+			if m.Metadata == nil {
+				m.Metadata = &qtmodel.QtMetadata{}
+			}
+			setItem(m.Metadata, "qt", it)
+		case handlerMdir:
+			if m.ITunes == nil {
+				m.ITunes = &itunes.ITunesMetadata{}
+			}
+			setItem(m.ITunes, "iTunes", it)
+		}
+	}
+}
+
+// decodeMeta decodes the item list of a meta box payload. QuickTime stores
+// meta as plain container while ISO and iTunes files use a full box with
+// version and flags in front of the children.
+func decodeMeta(b []byte) ([]Item, string, error) {
+	if len(b) >= 12 && string(b[4:8]) != "hdlr" {
+		b = b[4:]
+	}
+	l, err := ParseNodes(b)
+	if err != nil {
+		return nil, "", err
+	}
+	var handler string
+	keys := make([]string, 0)
+	items := make([]Item, 0)
+	for _, n := range l {
+		switch n.Type {
+		case "hdlr":
+			if len(n.Data) >= 12 {
+				handler = string(n.Data[8:12])
+			}
+		case "keys":
+			if keys, err = decodeKeys(n.Data); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	ilst := FindNode(l, "ilst")
+	if ilst == nil {
+		return items, handler, nil
+	}
+	children, err := ParseNodes(ilst.Data)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, c := range children {
+		key := c.Type
+		switch {
+		case handler == handlerMdta:
+			idx := int(binary.BigEndian.Uint32([]byte(c.Type)))
+			if idx < 1 || idx > len(keys) {
+				xmp.Log.Debugf("bmff: skipping ilst item with invalid key index %d", idx)
+				continue
+			}
+			key = keys[idx-1]
+		case strings.HasPrefix(key, "\xa9"):
+			key = macRomanKey(key)
+		}
+		l, err := decodeItem(key, c.Data)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, l...)
+	}
+	return items, handler, nil
+}
+
+// decodeKeys decodes the key table of mdta metadata.
+func decodeKeys(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("bmff: short keys box")
+	}
+	n := int(binary.BigEndian.Uint32(b[4:]))
+	b = b[8:]
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("bmff: short keys box")
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			return nil, fmt.Errorf("bmff: invalid key size %d", size)
+		}
+		keys = append(keys, string(b[8:size]))
+		b = b[size:]
+	}
+	return keys, nil
+}
+
+// decodeItem decodes the data atoms of an ilst item. iTunes freeform items
+// (----) take their key from the name atom.
+func decodeItem(key string, b []byte) ([]Item, error) {
+	l, err := ParseNodes(b)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, 1)
+	for _, n := range l {
+		switch n.Type {
+		case "name":
+			if key == "----" && len(n.Data) >= 4 {
+				key = string(n.Data[4:])
+			}
+		case "data":
+			if len(n.Data) < 8 {
+				return nil, fmt.Errorf("bmff: short data atom in %q", key)
+			}
+			it := Item{
+				Key:  key,
+				Type: int(binary.BigEndian.Uint32(n.Data) & 0xffffff),
+				Lang: decodeLanguage(binary.BigEndian.Uint16(n.Data[6:])),
+				Data: n.Data[8:],
+			}
+			items = append(items, it)
+		}
+	}
+	for i := range items {
+		items[i].Key = key
+		// track and disc numbers are stored as number and total count
+		if (key == "trkn" || key == "disk") && items[i].Type == TypeBinary && len(items[i].Data) >= 6 {
+			b := items[i].Data
+			num, total := binary.BigEndian.Uint16(b[2:]), binary.BigEndian.Uint16(b[4:])
+			s := strconv.Itoa(int(num))
+			if total > 0 {
+				s += "/" + strconv.Itoa(int(total))
+			}
+			items[i] = Item{Key: key, Type: TypeUTF8, Lang: items[i].Lang, Data: []byte(s)}
+		}
+	}
+	return items, nil
+}
+
+// FindNode returns the first node of type typ in l.
+func FindNode(l []*Node, typ string) *Node {
+	for _, n := range l {
+		if n.Type == typ {
+			return n
+		}
+	}
+	return nil
+}
+
+// fieldMap maps struct tag keys to struct field indexes. The key ",any"
+// refers to the extension field that collects unknown items.
+type fieldMap map[string]int
+
+type fieldKey struct {
+	typ reflect.Type
+	tag string
+}
+
+var (
+	fieldCache     = make(map[fieldKey]fieldMap)
+	fieldCacheLock sync.RWMutex
+)
+
+// getFields parses the struct tags named tag of typ. Only the first tag
+// with this name is used, which for QtMetadata is the mdta key.
+func getFields(typ reflect.Type, tag string) fieldMap {
+	k := fieldKey{typ, tag}
+	fieldCacheLock.RLock()
+	m, ok := fieldCache[k]
+	fieldCacheLock.RUnlock()
+	if ok {
+		return m
+	}
+	m = make(fieldMap)
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get(tag)
+		switch name {
+		case "", "-":
+			continue
+		case ",any":
+			m[name] = i
+			continue
+		}
+		if _, ok := m[name]; !ok {
+			m[name] = i
+		}
+	}
+	fieldCacheLock.Lock()
+	fieldCache[k] = m
+	fieldCacheLock.Unlock()
+	return m
+}
+
+func hasField(typ reflect.Type, tag, key string) bool {
+	_, ok := getFields(typ, tag)[key]
+	return ok
+}
+
+// setItem stores it in the field of the struct pointed to by v whose tag
+// matches the item key. The first value wins for single value fields.
+// Unknown text items are appended to the extension field if the model has
+// one.
+func setItem(v interface{}, tag string, it Item) {
+	val := reflect.ValueOf(v).Elem()
+	fields := getFields(val.Type(), tag)
+	i, ok := fields[it.Key]
+	if !ok {
+		i, ok = fields[",any"]
+		if !ok || it.isImage() || it.Type == TypeBinary {
+			return
+		}
+		if s := it.String(); s != "" {
+			ext := val.Field(i).Addr().Interface().(*xmp.TagList)
+			*ext = append(*ext, xmp.Tag{Key: it.Key, Value: s, Lang: it.Lang})
+		}
+		return
+	}
+	if err := setValue(val.Field(i), it); err != nil {
+		xmp.Log.Debugf("bmff: skipping %s item %q: %v", tag, it.Key, err)
+	}
+}
+
+func setValue(f reflect.Value, it Item) error {
+	switch v := f.Addr().Interface().(type) {
+	case *[]byte:
+		if len(*v) == 0 {
+			*v = append([]byte{}, it.Data...)
+		}
+		return nil
+	case *xmp.StringList:
+		if s := it.String(); s != "" {
+			*v = append(*v, s)
+		}
+		return nil
+	}
+	if !f.IsZero() {
+		return nil
+	}
+	if f.Kind() == reflect.Ptr {
+		n := reflect.New(f.Type().Elem())
+		if err := setValue(n.Elem(), it); err != nil {
+			return err
+		}
+		f.Set(n)
+		return nil
+	}
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(it.String()))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(it.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := it.Int()
+		if !ok {
+			return fmt.Errorf("invalid integer value")
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := it.Int()
+		if !ok || n < 0 {
+			return fmt.Errorf("invalid integer value")
+		}
+		f.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		n, ok := it.Float()
+		if !ok {
+			return fmt.Errorf("invalid float value")
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
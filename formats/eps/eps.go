@@ -0,0 +1,290 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package eps implements reading and writing of XMP packets embedded in
+// PostScript, EPS and legacy Adobe Illustrator files as defined by XMP
+// Specification Part 3.
+//
+// The main XMP packet follows a `%begin_xml_code` or `%%BeginMetadata`
+// marker in the PostScript section. EPS files with a DOS binary header
+// wrap the PostScript section together with WMF or TIFF previews; packets
+// in previews are ignored. Packets are updated in place using their
+// padding and are never grown.
+package eps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var ErrInvalidFile = errors.New("eps: invalid file format")
+
+var (
+	dosMagic = []byte{0xc5, 0xd0, 0xd3, 0xc6}
+	psMagic  = []byte("%!PS-Adobe")
+)
+
+// size of the DOS EPS binary header
+const dosHeaderSize = 30
+
+// markers that enclose the main XMP packet
+var (
+	beginMarkers = [][]byte{[]byte("%begin_xml_code"), []byte("%%BeginMetadata")}
+	endMarkers   = [][]byte{[]byte("%end_xml_code"), []byte("%%EndMetadata")}
+	containsXMP  = []byte("%ADO_ContainsXMP:")
+)
+
+// bytes searched for a begin marker in front of a packet
+const markerWindow = 8192
+
+// bytes searched for DSC header comments
+const headerWindow = 64 << 10
+
+// DOSHeader is the binary header of EPS files with preview images.
+// Offsets and lengths are zero for missing sections.
+type DOSHeader struct {
+	PSOffset   uint32
+	PSLength   uint32
+	WMFOffset  uint32
+	WMFLength  uint32
+	TIFFOffset uint32
+	TIFFLength uint32
+	Checksum   uint16
+}
+
+// ReadDOSHeader reads the DOS EPS binary header. It returns nil for plain
+// PostScript files.
+func ReadDOSHeader(r io.ReadSeeker) (*DOSHeader, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var buf [dosHeaderSize]byte
+	n, err := io.ReadFull(r, buf[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, ErrInvalidFile
+	}
+	switch {
+	case n >= 4 && bytes.Equal(buf[:4], dosMagic):
+		if n < dosHeaderSize {
+			return nil, ErrInvalidFile
+		}
+		h := &DOSHeader{}
+		binary.Read(bytes.NewReader(buf[4:]), binary.LittleEndian, h)
+		return h, nil
+	case n >= len(psMagic) && bytes.HasPrefix(buf[:n], psMagic):
+		return nil, nil
+	default:
+		return nil, ErrInvalidFile
+	}
+}
+
+// psSection returns the location of the PostScript section.
+func psSection(r io.ReadSeeker) (int64, int64, error) {
+	h, err := ReadDOSHeader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	if h == nil {
+		return 0, size, nil
+	}
+	off, n := int64(h.PSOffset), int64(h.PSLength)
+	if off < dosHeaderSize || off+n > size {
+		return 0, 0, fmt.Errorf("eps: invalid PostScript section %d+%d", off, n)
+	}
+	return off, n, nil
+}
+
+func readAt(r io.ReadSeeker, off, n int64) ([]byte, error) {
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// lastIndex returns the position of the last match of any of seps in b.
+func lastIndex(b []byte, seps [][]byte) int {
+	pos := -1
+	for _, v := range seps {
+		if i := bytes.LastIndex(b, v); i > pos {
+			pos = i
+		}
+	}
+	return pos
+}
+
+// isMarked checks whether the text in front of a packet opens a metadata
+// block that has not been closed yet.
+func isMarked(b []byte) bool {
+	begin := lastIndex(b, beginMarkers)
+	return begin >= 0 && begin > lastIndex(b, endMarkers)
+}
+
+// mainMode returns the value of the %ADO_ContainsXMP header comment, e.g.
+// MainFirst, MainLast or NoMain.
+func mainMode(head []byte) string {
+	i := bytes.Index(head, containsXMP)
+	if i < 0 {
+		return ""
+	}
+	line := head[i+len(containsXMP):]
+	if j := bytes.IndexAny(line, "\r\n"); j >= 0 {
+		line = line[:j]
+	}
+	for _, v := range bytes.Fields(line) {
+		switch string(v) {
+		case "MainFirst", "MainLast", "NoMain":
+			return string(v)
+		}
+	}
+	return ""
+}
+
+// FindPacket returns the main XMP packet of the PostScript section. The
+// packet offset is relative to the start of the file. FindPacket returns
+// io.EOF when the file contains no marked packet.
+func FindPacket(r io.ReadSeeker) (*xmp.PacketInfo, error) {
+	off, size, err := psSection(r)
+	if err != nil {
+		return nil, err
+	}
+	n := size
+	if n > headerWindow {
+		n = headerWindow
+	}
+	head, err := readAt(r, off, n)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(head, psMagic) {
+		return nil, ErrInvalidFile
+	}
+	mode := mainMode(head)
+	if mode == "NoMain" {
+		return nil, io.EOF
+	}
+
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s := xmp.NewPacketScanner(io.LimitReader(r, size))
+	l := make([]*xmp.PacketInfo, 0)
+	for s.Next() {
+		l = append(l, s.Packet())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	var main *xmp.PacketInfo
+	for _, p := range l {
+		start := p.Offset - markerWindow
+		if start < 0 {
+			start = 0
+		}
+		b, err := readAt(r, off+start, p.Offset-start)
+		if err != nil {
+			return nil, err
+		}
+		if !isMarked(b) {
+			continue
+		}
+		main = p
+		if mode != "MainLast" {
+			break
+		}
+	}
+	if main == nil {
+		return nil, io.EOF
+	}
+	main.Offset += off
+	return main, nil
+}
+
+// ReadPacket returns the main XMP packet or io.EOF when the file contains
+// no XMP.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	p, err := FindPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	return p.Text(), nil
+}
+
+// Read decodes the main XMP packet embedded in a PostScript file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	b, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket overwrites the main XMP packet in f with packet. Shorter
+// packets are padded with whitespace in front of the trailer. It returns
+// xmp.ErrOverflow when packet is larger than the existing packet and
+// xmp.ErrReadOnlyPacket for read-only or non UTF-8 packets.
+func WritePacket(f io.ReadWriteSeeker, packet []byte) error {
+	p, err := FindPacket(f)
+	if err != nil {
+		return err
+	}
+	if !p.Writable || p.Encoding != xmp.EncodingUTF8 {
+		return xmp.ErrReadOnlyPacket
+	}
+	pad := p.Length - int64(len(packet))
+	if pad < 0 {
+		return xmp.ErrOverflow
+	}
+	end := bytes.LastIndex(packet, []byte("<?xpacket end="))
+	if end < 0 {
+		return xmp.ErrInvalidPacket
+	}
+	buf := make([]byte, 0, p.Length)
+	buf = append(buf, packet[:end]...)
+	buf = append(buf, bytes.Repeat([]byte{' '}, int(pad))...)
+	buf = append(buf, packet[end:]...)
+	if _, err := f.Seek(p.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	return err
+}
+
+// Write embeds the XMP document d into the space of the main packet in f
+// keeping the packet encoding. It returns xmp.ErrOverflow when d does not
+// fit.
+func Write(f io.ReadWriteSeeker, d *xmp.Document) error {
+	p, err := FindPacket(f)
+	if err != nil {
+		return err
+	}
+	return xmp.UpdatePacket(f, p.Offset, p.Length, d)
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/trimmer-io/go-xmp/formats/tiff"
+	exifmodel "github.com/trimmer-io/go-xmp/models/exif"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// fieldMap maps tag numbers to struct field indexes
+type fieldMap map[uint16]int
+
+var (
+	fieldCache     = make(map[reflect.Type]fieldMap)
+	fieldCacheLock sync.RWMutex
+)
+
+// getFields parses the `exif` struct tags of typ. Fields tagged "-" or
+// without tag are skipped.
+func getFields(typ reflect.Type) fieldMap {
+	fieldCacheLock.RLock()
+	m, ok := fieldCache[typ]
+	fieldCacheLock.RUnlock()
+	if ok {
+		return m
+	}
+	m = make(fieldMap)
+	for i := 0; i < typ.NumField(); i++ {
+		tag := typ.Field(i).Tag.Get("exif")
+		if !strings.HasPrefix(tag, "0x") {
+			continue
+		}
+		v, err := strconv.ParseUint(tag[2:], 16, 16)
+		if err != nil {
+			continue
+		}
+		if _, ok := m[uint16(v)]; !ok {
+			m[uint16(v)] = i
+		}
+	}
+	fieldCacheLock.Lock()
+	fieldCache[typ] = m
+	fieldCacheLock.Unlock()
+	return m
+}
+
+// DecodeIFD sets all fields of the struct pointed to by v whose `exif`
+// tag matches an entry in ifd and is accepted by filter. Values that
+// cannot be converted are skipped with a warning.
+func DecodeIFD(ifd *tiff.IFD, v interface{}, filter func(uint16) bool) {
+	val := reflect.ValueOf(v).Elem()
+	fields := getFields(val.Type())
+	for _, e := range ifd.Entries {
+		if filter != nil && !filter(e.Tag) {
+			continue
+		}
+		i, ok := fields[e.Tag]
+		if !ok {
+			continue
+		}
+		if err := setField(val.Field(i), e, ifd.Order); err != nil {
+			xmp.Log.Warnf("exif: tag 0x%04x: %v", e.Tag, err)
+		}
+	}
+}
+
+func setField(f reflect.Value, e tiff.Entry, o binary.ByteOrder) error {
+	if e.Count == 0 || len(e.Data) == 0 {
+		return nil
+	}
+	switch v := f.Addr().Interface().(type) {
+	case *exifmodel.Date:
+		s := e.String()
+		// cameras write blank dates when the clock is not set
+		if strings.Trim(s, " :0") == "" {
+			return nil
+		}
+		return v.UnmarshalText([]byte(s))
+	case *exifmodel.ByteArray:
+		*v = append(exifmodel.ByteArray{}, e.Data...)
+	case *exifmodel.ComponentArray:
+		a := make(exifmodel.ComponentArray, 0, e.Count)
+		for i := 0; i < int(e.Count); i++ {
+			a = append(a, exifmodel.Component(e.Uint(o, i)))
+		}
+		*v = a
+	case *exifmodel.GPSCoord:
+		for i := 0; i < 3 && i < int(e.Count); i++ {
+			(*v)[i] = e.Rational(o, i)
+		}
+	case *exifmodel.Flash:
+		return v.UnmarshalText([]byte(strconv.Itoa(e.Int(o, 0))))
+	case **exifmodel.OECF:
+		x, err := decodeOECF(e.Data, o)
+		if err != nil {
+			return err
+		}
+		*v = x
+	case **exifmodel.CFAPattern:
+		x, err := decodeCFAPattern(e.Data, o)
+		if err != nil {
+			return err
+		}
+		*v = x
+	case *exifmodel.DeviceSettings:
+		x, err := decodeDeviceSettings(e.Data, o)
+		if err != nil {
+			return err
+		}
+		*v = *x
+	case *xmp.Rational:
+		*v = e.Rational(o, 0)
+	case *xmp.RationalArray:
+		*v = e.Rationals(o)
+	case *xmp.StringArray:
+		if s := decodeString(e, o); s != "" {
+			*v = xmp.StringArray{s}
+		}
+	default:
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(decodeString(e, o))
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f.SetInt(int64(e.Int(o, 0)))
+		case reflect.Slice:
+			switch f.Type().Elem().Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				l := e.Ints(o)
+				s := reflect.MakeSlice(f.Type(), len(l), len(l))
+				for i, n := range l {
+					s.Index(i).SetInt(int64(n))
+				}
+				f.Set(s)
+			default:
+				return errUnsupported(f)
+			}
+		default:
+			return errUnsupported(f)
+		}
+	}
+	return nil
+}
+
+func errUnsupported(f reflect.Value) error {
+	return fmt.Errorf("unsupported field type %s", f.Type())
+}
+
+// character codes in front of UNDEFINED text values like UserComment
+var (
+	codeASCII     = []byte("ASCII\x00\x00\x00")
+	codeUnicode   = []byte("UNICODE\x00")
+	codeJIS       = []byte("JIS\x00\x00\x00\x00\x00")
+	codeUndefined = []byte("\x00\x00\x00\x00\x00\x00\x00\x00")
+)
+
+// decodeString converts ASCII, UNDEFINED and BYTE entries into text.
+// Multiple BYTE values are joined with dots as used by version tags.
+func decodeString(e tiff.Entry, o binary.ByteOrder) string {
+	switch e.Type {
+	case tiff.TypeASCII:
+		return e.String()
+	case tiff.TypeUndefined:
+		if len(e.Data) >= 8 {
+			switch code, text := e.Data[:8], e.Data[8:]; {
+			case bytes.Equal(code, codeUnicode):
+				return decodeUTF16(text, o)
+			case bytes.Equal(code, codeASCII),
+				bytes.Equal(code, codeJIS),
+				bytes.Equal(code, codeUndefined):
+				return trimText(text)
+			}
+		}
+		return trimText(e.Data)
+	case tiff.TypeByte:
+		if e.Count == 1 {
+			return strconv.Itoa(int(e.Data[0]))
+		}
+		s := make([]string, len(e.Data))
+		for i, v := range e.Data {
+			s[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(s, ".")
+	case tiff.TypeRational, tiff.TypeSRational:
+		return e.Rational(o, 0).String()
+	default:
+		return strconv.Itoa(e.Int(o, 0))
+	}
+}
+
+func trimText(b []byte) string {
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// decodeUTF16 decodes UCS-2 text in byte order o unless a byte order mark
+// says otherwise.
+func decodeUTF16(b []byte, o binary.ByteOrder) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		o, b = binary.BigEndian, b[2:]
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		o, b = binary.LittleEndian, b[2:]
+	}
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, o.Uint16(b[i:]))
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00 ")
+}
+
+// matrixSize reads the column and row count in front of OECF, SFR,
+// CFA pattern and device setting values.
+func matrixSize(b []byte, o binary.ByteOrder) (int, int, error) {
+	if len(b) < 4 {
+		return 0, 0, errShortValue
+	}
+	return int(o.Uint16(b)), int(o.Uint16(b[2:])), nil
+}
+
+var errShortValue = errors.New("short value")
+
+// decodeOECF decodes OECF and SpatialFrequencyResponse values: column
+// and row count, NUL terminated column names and signed rationals.
+func decodeOECF(b []byte, o binary.ByteOrder) (*exifmodel.OECF, error) {
+	cols, rows, err := matrixSize(b, o)
+	if err != nil {
+		return nil, err
+	}
+	x := &exifmodel.OECF{
+		Columns: cols,
+		Rows:    rows,
+		Names:   make(xmp.StringArray, 0, cols),
+		Values:  make(xmp.RationalArray, 0, cols*rows),
+	}
+	b = b[4:]
+	for i := 0; i < cols; i++ {
+		n := bytes.IndexByte(b, 0)
+		if n < 0 {
+			return nil, errShortValue
+		}
+		x.Names = append(x.Names, string(b[:n]))
+		b = b[n+1:]
+	}
+	for i := 0; i < cols*rows; i++ {
+		if len(b) < 8 {
+			return nil, errShortValue
+		}
+		x.Values = append(x.Values, xmp.Rational{
+			Num: int64(int32(o.Uint32(b))),
+			Den: int64(int32(o.Uint32(b[4:]))),
+		})
+		b = b[8:]
+	}
+	return x, nil
+}
+
+// decodeCFAPattern decodes column and row count followed by one byte per
+// color filter element.
+func decodeCFAPattern(b []byte, o binary.ByteOrder) (*exifmodel.CFAPattern, error) {
+	cols, rows, err := matrixSize(b, o)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4+cols*rows {
+		return nil, errShortValue
+	}
+	return &exifmodel.CFAPattern{
+		Columns: cols,
+		Rows:    rows,
+		Values:  append(exifmodel.ByteArray{}, b[4:4+cols*rows]...),
+	}, nil
+}
+
+// decodeDeviceSettings decodes column and row count followed by NUL
+// terminated UCS-2 strings.
+func decodeDeviceSettings(b []byte, o binary.ByteOrder) (*exifmodel.DeviceSettings, error) {
+	cols, rows, err := matrixSize(b, o)
+	if err != nil {
+		return nil, err
+	}
+	x := &exifmodel.DeviceSettings{
+		Columns: cols,
+		Rows:    rows,
+		Values:  make(xmp.StringArray, 0),
+	}
+	for b = b[4:]; len(b) >= 2; {
+		i := 0
+		for i+1 < len(b) && (b[i] != 0 || b[i+1] != 0) {
+			i += 2
+		}
+		if i > 0 {
+			x.Values = append(x.Values, decodeUTF16(b[:i], o))
+		}
+		if i+2 > len(b) {
+			break
+		}
+		b = b[i+2:]
+	}
+	return x, nil
+}
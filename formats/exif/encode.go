@@ -0,0 +1,713 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/trimmer-io/go-xmp/formats/tiff"
+	exifmodel "github.com/trimmer-io/go-xmp/models/exif"
+	tiffmodel "github.com/trimmer-io/go-xmp/models/tiff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+const tagMakerNote uint16 = 0x927c
+
+// tag ranges of the directories
+func isIFD0Tag(tag uint16) bool    { return tag >= 0x0100 && tag < 0x1000 || tag == tiff.TagCopyright }
+func isGPSTag(tag uint16) bool     { return tag < 0x0020 }
+func isRelatedTag(tag uint16) bool { return tag >= 0x1000 && tag <= 0x1002 }
+func isInteropTag(tag uint16) bool { return isGPSTag(tag) || isRelatedTag(tag) }
+func isExifTag(tag uint16) bool    { return !isGPSTag(tag) && !isIFD0Tag(tag) && !isRelatedTag(tag) }
+
+func isPointerTag(tag uint16) bool {
+	return tag == tiff.TagExifIFD || tag == tiff.TagGPSIFD || tag == tiff.TagInteropIFD
+}
+
+// TIFF types of tags that differ from the default type of their field
+var tagTypes = map[uint16]tiff.DataType{
+	0x0000: tiff.TypeByte,      // GPSVersionID
+	0x0002: tiff.TypeUndefined, // InteroperabilityVersion
+	0x0005: tiff.TypeByte,      // GPSAltitudeRef
+	0x001b: tiff.TypeUndefined, // GPSProcessingMethod
+	0x001c: tiff.TypeUndefined, // GPSAreaInformation
+	0x0100: tiff.TypeLong,      // ImageWidth
+	0x0101: tiff.TypeLong,      // ImageLength
+	0x1001: tiff.TypeLong,      // RelatedImageWidth
+	0x1002: tiff.TypeLong,      // RelatedImageLength
+	0x8831: tiff.TypeLong,      // StandardOutputSensitivity
+	0x8832: tiff.TypeLong,      // RecommendedExposureIndex
+	0x8833: tiff.TypeLong,      // ISOSpeed
+	0x8834: tiff.TypeLong,      // ISOSpeedLatitudeyyy
+	0x8835: tiff.TypeLong,      // ISOSpeedLatitudezzz
+	0x9000: tiff.TypeUndefined, // ExifVersion
+	0x9201: tiff.TypeSRational, // ShutterSpeedValue
+	0x9203: tiff.TypeSRational, // BrightnessValue
+	0x9204: tiff.TypeSRational, // ExposureBiasValue
+	0x9286: tiff.TypeUndefined, // UserComment
+	0xa000: tiff.TypeUndefined, // FlashpixVersion
+	0xa002: tiff.TypeLong,      // PixelXDimension
+	0xa003: tiff.TypeLong,      // PixelYDimension
+	0xa300: tiff.TypeUndefined, // FileSource
+	0xa301: tiff.TypeUndefined, // SceneType
+}
+
+// text tags prefixed with a character code
+var commentTags = map[uint16]bool{
+	0x001b: true,
+	0x001c: true,
+	0x9286: true,
+}
+
+// source is a model that provides values for tags accepted by filter
+type source struct {
+	val    reflect.Value
+	filter func(uint16) bool
+}
+
+func newSource(v interface{}, filter func(uint16) bool) source {
+	return source{reflect.ValueOf(v).Elem(), filter}
+}
+
+// Encode serializes the models into a TIFF structured EXIF blob without
+// APP1 header. Tags whose model values did not change since decoding are
+// copied verbatim, tags unknown to the models are preserved and the
+// thumbnail in IFD1 is carried over. The maker note stays at its original
+// offset because vendor maker notes often contain absolute offsets.
+//
+// When the tiff model differs from the decoded IFD0 its values take
+// precedence over the tiff fields of the exif model.
+func (x *Exif) Encode() ([]byte, error) {
+	o := x.Order
+	if o == nil {
+		o = binary.BigEndian
+	}
+	info, ex := x.Info, x.EX
+	if info == nil {
+		info = &exifmodel.ExifInfo{}
+	}
+	if ex == nil {
+		ex = &exifmodel.ExifEXInfo{}
+	}
+	ifd0Src := []source{newSource(info, isIFD0Tag)}
+	if x.Tiff != nil {
+		var orig *tiffmodel.TiffInfo
+		if x.IFD0 != nil {
+			orig = tiff.NewInfo(x.IFD0)
+		}
+		t, tags := tiffChanges(x.Tiff, orig)
+		ifd0Src = append([]source{newSource(t, func(tag uint16) bool { return tags[tag] })}, ifd0Src...)
+	}
+	ifds := [...][]tiff.Entry{
+		x.buildIFD(x.IFD0, o, ifd0Src...),
+		x.buildIFD(x.ExifIFD, o, newSource(info, isExifTag), newSource(ex, isExifTag)),
+		x.buildIFD(x.InteropIFD, o, newSource(info, isRelatedTag), newSource(ex, isInteropTag)),
+		x.buildIFD(x.GPSIFD, o, newSource(info, isGPSTag)),
+		nil,
+	}
+	if x.IFD1 != nil {
+		ifds[4] = append([]tiff.Entry{}, x.IFD1.Entries...)
+	}
+	const (
+		ifd0 = iota
+		exifIFD
+		interopIFD
+		gpsIFD
+		ifd1
+	)
+
+	// link sub-directories with placeholder pointers
+	pointer := func(tag uint16) tiff.Entry {
+		return tiff.Entry{Tag: tag, Type: tiff.TypeLong, Count: 1, Data: make([]byte, 4)}
+	}
+	if len(ifds[interopIFD]) > 0 {
+		ifds[exifIFD] = append(ifds[exifIFD], pointer(tiff.TagInteropIFD))
+	}
+	if len(ifds[exifIFD]) > 0 {
+		ifds[ifd0] = append(ifds[ifd0], pointer(tiff.TagExifIFD))
+	}
+	if len(ifds[gpsIFD]) > 0 {
+		ifds[ifd0] = append(ifds[ifd0], pointer(tiff.TagGPSIFD))
+	}
+	for _, l := range ifds {
+		sort.SliceStable(l, func(i, j int) bool { return l[i].Tag < l[j].Tag })
+	}
+
+	// keep an unchanged maker note at its original offset
+	l := &layout{buf: make([]byte, 8)}
+	var makerNote *tiff.Entry
+	if x.ExifIFD != nil {
+		if e := x.ExifIFD.Find(tagMakerNote); e != nil && e.Offset >= 8 {
+			for i, v := range ifds[exifIFD] {
+				if v.Tag == tagMakerNote && bytes.Equal(v.Data, e.Data) {
+					makerNote = &ifds[exifIFD][i]
+					l.start, l.end = int(e.Offset), int(e.Offset)+len(e.Data)
+				}
+			}
+		}
+	}
+
+	// allocate directories and values
+	dirs := make([]int, len(ifds))
+	for i, entries := range ifds {
+		// IFD0 is mandatory
+		if len(entries) == 0 && i != ifd0 {
+			continue
+		}
+		dirs[i] = l.alloc(2 + len(entries)*12 + 4)
+		for j := range entries {
+			e := &entries[j]
+			switch {
+			case len(e.Data) <= 4:
+				e.Offset = 0
+			case e == makerNote:
+				e.Offset = uint32(l.start)
+			default:
+				e.Offset = uint32(l.alloc(len(e.Data)))
+				copy(l.buf[e.Offset:], e.Data)
+			}
+		}
+		if i == ifd1 {
+			if err := x.copyThumbnail(l, entries, o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if makerNote != nil {
+		l.grow(l.end)
+		copy(l.buf[l.start:], makerNote.Data)
+	}
+	if len(l.buf) > 0xffffffff {
+		return nil, fmt.Errorf("exif: data exceeds 4GB")
+	}
+
+	// patch pointers and write directories
+	for _, e := range ifds[ifd0] {
+		switch e.Tag {
+		case tiff.TagExifIFD:
+			o.PutUint32(e.Data, uint32(dirs[exifIFD]))
+		case tiff.TagGPSIFD:
+			o.PutUint32(e.Data, uint32(dirs[gpsIFD]))
+		}
+	}
+	for _, e := range ifds[exifIFD] {
+		if e.Tag == tiff.TagInteropIFD {
+			o.PutUint32(e.Data, uint32(dirs[interopIFD]))
+		}
+	}
+	for i, entries := range ifds {
+		if len(entries) == 0 && i != ifd0 {
+			continue
+		}
+		var next uint32
+		if i == ifd0 && len(ifds[ifd1]) > 0 {
+			next = uint32(dirs[ifd1])
+		}
+		writeIFD(l.buf[dirs[i]:], entries, next, o)
+	}
+	if o == binary.LittleEndian {
+		copy(l.buf, "II")
+	} else {
+		copy(l.buf, "MM")
+	}
+	o.PutUint16(l.buf[2:], 42)
+	o.PutUint32(l.buf[4:], uint32(dirs[ifd0]))
+	return l.buf, nil
+}
+
+// layout allocates word aligned space in the output buffer around a
+// reserved region.
+type layout struct {
+	buf        []byte
+	start, end int
+}
+
+func (l *layout) alloc(n int) int {
+	ofs := len(l.buf) + len(l.buf)&1
+	if l.end > l.start && ofs < l.end && ofs+n > l.start {
+		ofs = l.end + l.end&1
+	}
+	l.grow(ofs + n)
+	return ofs
+}
+
+func (l *layout) grow(n int) {
+	if n > len(l.buf) {
+		l.buf = append(l.buf, make([]byte, n-len(l.buf))...)
+	}
+}
+
+func writeIFD(b []byte, entries []tiff.Entry, next uint32, o binary.ByteOrder) {
+	o.PutUint16(b, uint16(len(entries)))
+	b = b[2:]
+	for _, e := range entries {
+		o.PutUint16(b, e.Tag)
+		o.PutUint16(b[2:], uint16(e.Type))
+		o.PutUint32(b[4:], e.Count)
+		copy(b[8:12], []byte{0, 0, 0, 0})
+		if len(e.Data) > 4 {
+			o.PutUint32(b[8:], e.Offset)
+		} else {
+			copy(b[8:], e.Data)
+		}
+		b = b[12:]
+	}
+	o.PutUint32(b, next)
+}
+
+// copyThumbnail copies JPEG or strip thumbnail data referenced by IFD1
+// and updates the offsets.
+func (x *Exif) copyThumbnail(l *layout, entries []tiff.Entry, o binary.ByteOrder) error {
+	find := func(tag uint16) *tiff.Entry {
+		for i := range entries {
+			if entries[i].Tag == tag {
+				return &entries[i]
+			}
+		}
+		return nil
+	}
+	copyData := func(ofs, size uint32) (uint32, error) {
+		if int(ofs)+int(size) > len(x.raw) {
+			return 0, fmt.Errorf("exif: invalid thumbnail offset %d", ofs)
+		}
+		n := l.alloc(int(size))
+		copy(l.buf[n:], x.raw[ofs:ofs+size])
+		return uint32(n), nil
+	}
+	if e, n := find(tiff.TagJPEGInterchangeFormat), find(tiff.TagJPEGInterchangeFormatLen); e != nil && n != nil {
+		ofs, err := copyData(e.Uint(o, 0), n.Uint(o, 0))
+		if err != nil {
+			return err
+		}
+		*e = tiff.Entry{Tag: e.Tag, Type: tiff.TypeLong, Count: 1, Data: longs(o, ofs)}
+	}
+	if e, n := find(tiff.TagStripOffsets), find(tiff.TagStripByteCounts); e != nil && n != nil && e.Count == n.Count {
+		l2 := make([]uint32, e.Count)
+		for i := range l2 {
+			ofs, err := copyData(e.Uint(o, i), n.Uint(o, i))
+			if err != nil {
+				return err
+			}
+			l2[i] = ofs
+		}
+		*e = tiff.Entry{Tag: e.Tag, Type: tiff.TypeLong, Count: e.Count, Data: longs(o, l2...)}
+		if len(e.Data) > 4 {
+			e.Offset = uint32(l.alloc(len(e.Data)))
+			copy(l.buf[e.Offset:], e.Data)
+		}
+	}
+	return nil
+}
+
+func longs(o binary.ByteOrder, v ...uint32) []byte {
+	b := make([]byte, len(v)*4)
+	for i, n := range v {
+		o.PutUint32(b[i*4:], n)
+	}
+	return b
+}
+
+// buildIFD merges model values into the entries of orig. For every tag
+// the first source whose value differs from the original entry wins. A
+// zero value removes the tag, unchanged tags and tags unknown to all
+// sources are kept verbatim. Sub-IFD pointers are dropped.
+func (x *Exif) buildIFD(orig *tiff.IFD, o binary.ByteOrder, sources ...source) []tiff.Entry {
+	var entries []tiff.Entry
+	if orig != nil {
+		entries = orig.Entries
+	}
+	l := make([]tiff.Entry, 0, len(entries))
+	done := make(map[uint16]bool)
+	for _, e := range entries {
+		if isPointerTag(e.Tag) || done[e.Tag] {
+			continue
+		}
+		done[e.Tag] = true
+		e := e
+		if v, ok := x.merge(e.Tag, &e, o, sources); ok {
+			if v == nil {
+				continue
+			}
+			e = *v
+		}
+		l = append(l, e)
+	}
+	// add new tags in tag order of the first source
+	for _, src := range sources {
+		fields := getFields(src.val.Type())
+		tags := make([]int, 0, len(fields))
+		for tag := range fields {
+			tags = append(tags, int(tag))
+		}
+		sort.Ints(tags)
+		for _, t := range tags {
+			tag := uint16(t)
+			if done[tag] || !src.filter(tag) {
+				continue
+			}
+			done[tag] = true
+			if v, ok := x.merge(tag, nil, o, sources); ok && v != nil {
+				l = append(l, *v)
+			}
+		}
+	}
+	return l
+}
+
+// merge picks the model value for tag. It returns false when the entry
+// should be kept as is and a nil entry when the tag is removed.
+func (x *Exif) merge(tag uint16, orig *tiff.Entry, o binary.ByteOrder, sources []source) (*tiff.Entry, bool) {
+	for _, src := range sources {
+		if !src.filter(tag) {
+			continue
+		}
+		i, ok := getFields(src.val.Type())[tag]
+		if !ok {
+			continue
+		}
+		fv := src.val.Field(i)
+		if orig != nil {
+			v := reflect.New(fv.Type()).Elem()
+			err := setField(v, *orig, o)
+			if err != nil && fv.IsZero() || err == nil && reflect.DeepEqual(v.Interface(), fv.Interface()) {
+				continue
+			}
+		} else if fv.IsZero() {
+			continue
+		}
+		if fv.IsZero() {
+			return nil, true
+		}
+		var typ tiff.DataType
+		if orig != nil {
+			typ = orig.Type
+		}
+		e, err := encodeField(tag, fv, typ, o)
+		if err != nil {
+			xmp.Log.Warnf("exif: tag 0x%04x: %v", tag, err)
+			return nil, false
+		}
+		return e, true
+	}
+	return nil, false
+}
+
+// tiffChanges returns an exif model with the fields of m that differ from
+// orig and the set of their tags.
+func tiffChanges(m, orig *tiffmodel.TiffInfo) (*exifmodel.ExifInfo, map[uint16]bool) {
+	if orig == nil {
+		orig = &tiffmodel.TiffInfo{}
+	}
+	x := &exifmodel.ExifInfo{}
+	tags := make(map[uint16]bool)
+	changed := func(tag uint16, a, b interface{}) bool {
+		if reflect.DeepEqual(a, b) {
+			return false
+		}
+		tags[tag] = true
+		return true
+	}
+	if changed(tiff.TagArtist, m.Artist, orig.Artist) {
+		x.Artist = strings.Join(m.Artist, ";")
+	}
+	if changed(tiff.TagBitsPerSample, m.BitsPerSample, orig.BitsPerSample) {
+		x.BitsPerSample = m.BitsPerSample
+	}
+	if changed(tiff.TagCompression, m.Compression, orig.Compression) {
+		x.Compression = m.Compression
+	}
+	if changed(tiff.TagDateTime, m.DateTime, orig.DateTime) {
+		x.DateTime = exifmodel.Date(m.DateTime.Value())
+	}
+	if changed(tiff.TagImageLength, m.ImageLength, orig.ImageLength) {
+		x.ImageLength = m.ImageLength
+	}
+	if changed(tiff.TagImageWidth, m.ImageWidth, orig.ImageWidth) {
+		x.ImageWidth = m.ImageWidth
+	}
+	if changed(tiff.TagMake, m.Make, orig.Make) {
+		x.Make = m.Make
+	}
+	if changed(tiff.TagModel, m.Model, orig.Model) {
+		x.Model = m.Model
+	}
+	if changed(tiff.TagSoftware, m.Software, orig.Software) {
+		x.Software = m.Software
+	}
+	if changed(tiff.TagImageDescription, m.ImageDescription, orig.ImageDescription) {
+		x.ImageDescription = m.ImageDescription.Default()
+	}
+	if changed(tiff.TagCopyright, m.Copyright, orig.Copyright) {
+		x.Copyright = m.Copyright.Default()
+	}
+	if changed(tiff.TagOrientation, m.Orientation, orig.Orientation) {
+		x.Orientation = m.Orientation
+	}
+	if changed(tiff.TagPhotometricInterpretation, m.PhotometricInterpretation, orig.PhotometricInterpretation) {
+		x.PhotometricInterpretation = m.PhotometricInterpretation
+	}
+	if changed(tiff.TagPlanarConfiguration, m.PlanarConfiguration, orig.PlanarConfiguration) {
+		x.PlanarConfiguration = m.PlanarConfiguration
+	}
+	if changed(tiff.TagPrimaryChromaticities, m.PrimaryChromaticities, orig.PrimaryChromaticities) {
+		x.PrimaryChromaticities = m.PrimaryChromaticities
+	}
+	if changed(tiff.TagReferenceBlackWhite, m.ReferenceBlackWhite, orig.ReferenceBlackWhite) {
+		x.ReferenceBlackWhite = m.ReferenceBlackWhite
+	}
+	if changed(tiff.TagResolutionUnit, m.ResolutionUnit, orig.ResolutionUnit) {
+		x.ResolutionUnit = m.ResolutionUnit
+	}
+	if changed(tiff.TagSamplesPerPixel, m.SamplesPerPixel, orig.SamplesPerPixel) {
+		x.SamplesPerPixel = m.SamplesPerPixel
+	}
+	if changed(tiff.TagTransferFunction, m.TransferFunction, orig.TransferFunction) {
+		x.TransferFunction = m.TransferFunction
+	}
+	if changed(tiff.TagWhitePoint, m.WhitePoint, orig.WhitePoint) {
+		x.WhitePoint = m.WhitePoint
+	}
+	if changed(tiff.TagXResolution, m.XResolution, orig.XResolution) {
+		x.XResolution = m.XResolution
+	}
+	if changed(tiff.TagYCbCrCoefficients, m.YCbCrCoefficients, orig.YCbCrCoefficients) {
+		x.YCbCrCoefficients = m.YCbCrCoefficients
+	}
+	if changed(tiff.TagYCbCrPositioning, m.YCbCrPositioning, orig.YCbCrPositioning) {
+		x.YCbCrPositioning = m.YCbCrPositioning
+	}
+	if changed(tiff.TagYCbCrSubSampling, m.YCbCrSubSampling, orig.YCbCrSubSampling) {
+		x.YCbCrSubSampling = m.YCbCrSubSampling
+	}
+	if changed(tiff.TagYResolution, m.YResolution, orig.YResolution) {
+		x.YResolution = m.YResolution
+	}
+	return x, tags
+}
+
+// encodeField converts a model value into an entry of type typ or the
+// default type of tag when typ does not fit the value.
+func encodeField(tag uint16, fv reflect.Value, typ tiff.DataType, o binary.ByteOrder) (*tiff.Entry, error) {
+	e := &tiff.Entry{Tag: tag}
+	switch v := fv.Interface().(type) {
+	case exifmodel.Date:
+		layout := exifmodel.EXIF_DATE_FORMAT
+		if tag == 0x001d {
+			// GPSDateStamp
+			layout = "2006:01:02"
+		}
+		e.Type, e.Data = tiff.TypeASCII, append([]byte(time.Time(v).Format(layout)), 0)
+	case exifmodel.ByteArray:
+		e.Type, e.Data = tiff.TypeUndefined, []byte(v)
+		if typ == tiff.TypeByte {
+			e.Type = typ
+		}
+	case exifmodel.ComponentArray:
+		e.Type, e.Data = tiff.TypeUndefined, make([]byte, len(v))
+		for i, c := range v {
+			e.Data[i] = byte(c)
+		}
+	case exifmodel.GPSCoord:
+		e.Type, e.Data = tiff.TypeRational, putRationals(tiff.TypeRational, o, v[:]...)
+	case exifmodel.Flash:
+		n := int(v.Return&0x3)<<1 | int(v.Mode&0x3)<<3
+		if v.Fired {
+			n |= 0x01
+		}
+		if v.Function {
+			n |= 0x20
+		}
+		if v.RedEyeMode {
+			n |= 0x40
+		}
+		e.Type = intType(tag, typ, n)
+		e.Data = putInts(e.Type, o, n)
+	case *exifmodel.OECF:
+		e.Type, e.Data = tiff.TypeUndefined, encodeOECF(v, o)
+	case *exifmodel.CFAPattern:
+		b := make([]byte, 4, 4+len(v.Values))
+		o.PutUint16(b, uint16(v.Columns))
+		o.PutUint16(b[2:], uint16(v.Rows))
+		e.Type, e.Data = tiff.TypeUndefined, append(b, v.Values...)
+	case exifmodel.DeviceSettings:
+		b := make([]byte, 4)
+		o.PutUint16(b, uint16(v.Columns))
+		o.PutUint16(b[2:], uint16(v.Rows))
+		for _, s := range v.Values {
+			b = append(append(b, encodeUTF16(s, o)...), 0, 0)
+		}
+		e.Type, e.Data = tiff.TypeUndefined, b
+	case xmp.Rational:
+		e.Type = rationalType(tag, typ)
+		e.Data = putRationals(e.Type, o, v)
+	case xmp.RationalArray:
+		e.Type = rationalType(tag, typ)
+		e.Data = putRationals(e.Type, o, v...)
+	case xmp.StringArray:
+		e.Type = stringType(tag, typ)
+		e.Data = encodeString(tag, e.Type, strings.Join(v, " "), o)
+	default:
+		switch fv.Kind() {
+		case reflect.String:
+			e.Type = stringType(tag, typ)
+			e.Data = encodeString(tag, e.Type, fv.String(), o)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n := int(fv.Int())
+			e.Type = intType(tag, typ, n)
+			e.Data = putInts(e.Type, o, n)
+		case reflect.Slice:
+			l := make([]int, fv.Len())
+			max := 0
+			for i := range l {
+				switch fv.Index(i).Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					l[i] = int(fv.Index(i).Int())
+				default:
+					return nil, errUnsupported(fv)
+				}
+				if l[i] > max {
+					max = l[i]
+				}
+			}
+			e.Type = intType(tag, typ, max)
+			e.Data = putInts(e.Type, o, l...)
+		default:
+			return nil, errUnsupported(fv)
+		}
+	}
+	e.Count = uint32(len(e.Data) / e.Type.Size())
+	return e, nil
+}
+
+func defaultType(tag uint16, typ tiff.DataType) tiff.DataType {
+	if t, ok := tagTypes[tag]; ok {
+		return t
+	}
+	return typ
+}
+
+// intType keeps integer types of existing entries when n fits.
+func intType(tag uint16, typ tiff.DataType, n int) tiff.DataType {
+	switch typ {
+	case tiff.TypeByte, tiff.TypeUndefined:
+		if n >= 0 && n <= 0xff {
+			return typ
+		}
+	case tiff.TypeShort:
+		if n >= 0 && n <= 0xffff {
+			return typ
+		}
+	case tiff.TypeLong, tiff.TypeSLong, tiff.TypeSShort:
+		return typ
+	}
+	if t := defaultType(tag, tiff.TypeShort); t != tiff.TypeShort || n >= 0 && n <= 0xffff {
+		return t
+	}
+	return tiff.TypeLong
+}
+
+func rationalType(tag uint16, typ tiff.DataType) tiff.DataType {
+	switch typ {
+	case tiff.TypeRational, tiff.TypeSRational:
+		return typ
+	}
+	return defaultType(tag, tiff.TypeRational)
+}
+
+func stringType(tag uint16, typ tiff.DataType) tiff.DataType {
+	switch typ {
+	case tiff.TypeASCII, tiff.TypeUndefined, tiff.TypeByte:
+		return typ
+	}
+	return defaultType(tag, tiff.TypeASCII)
+}
+
+func putInts(typ tiff.DataType, o binary.ByteOrder, v ...int) []byte {
+	b := make([]byte, len(v)*typ.Size())
+	for i, n := range v {
+		switch typ.Size() {
+		case 1:
+			b[i] = byte(n)
+		case 2:
+			o.PutUint16(b[i*2:], uint16(n))
+		default:
+			o.PutUint32(b[i*4:], uint32(n))
+		}
+	}
+	return b
+}
+
+func putRationals(typ tiff.DataType, o binary.ByteOrder, v ...xmp.Rational) []byte {
+	b := make([]byte, len(v)*8)
+	for i, r := range v {
+		o.PutUint32(b[i*8:], uint32(r.Num))
+		o.PutUint32(b[i*8+4:], uint32(r.Den))
+	}
+	return b
+}
+
+// encodeString is the reverse of decodeString. Comment tags get a
+// character code prefix, non-ASCII comments are stored as UCS-2.
+func encodeString(tag uint16, typ tiff.DataType, s string, o binary.ByteOrder) []byte {
+	switch typ {
+	case tiff.TypeUndefined:
+		if !commentTags[tag] {
+			return []byte(s)
+		}
+		for _, r := range s {
+			if r > 0x7f {
+				return append(append([]byte{}, codeUnicode...), encodeUTF16(s, o)...)
+			}
+		}
+		return append(append([]byte{}, codeASCII...), s...)
+	case tiff.TypeByte:
+		f := strings.Split(s, ".")
+		b := make([]byte, 0, len(f))
+		for _, v := range f {
+			n, _ := strconv.ParseUint(strings.TrimSpace(v), 10, 8)
+			b = append(b, byte(n))
+		}
+		return b
+	default:
+		return append([]byte(s), 0)
+	}
+}
+
+func encodeUTF16(s string, o binary.ByteOrder) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, v := range u {
+		o.PutUint16(b[i*2:], v)
+	}
+	return b
+}
+
+func encodeOECF(x *exifmodel.OECF, o binary.ByteOrder) []byte {
+	b := make([]byte, 4)
+	o.PutUint16(b, uint16(x.Columns))
+	o.PutUint16(b[2:], uint16(x.Rows))
+	for _, v := range x.Names {
+		b = append(append(b, v...), 0)
+	}
+	return append(b, putRationals(tiff.TypeSRational, o, x.Values...)...)
+}
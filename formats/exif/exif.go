@@ -0,0 +1,150 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package exif implements decoding and encoding of binary EXIF metadata stored in TIFF
+// structured blobs such as the payload of JPEG APP1 `Exif` segments as
+// defined by CIPA DC-008.
+//
+// IFD0, the Exif IFD, the GPS IFD and the Interoperability IFD are decoded
+// into the exif and tiff models by matching entries against the `exif`
+// struct tags of model fields. Encoding merges changed model values back
+// into the decoded directories.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/trimmer-io/go-xmp/formats/tiff"
+	exifmodel "github.com/trimmer-io/go-xmp/models/exif"
+	tiffmodel "github.com/trimmer-io/go-xmp/models/tiff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var ErrInvalidFile = errors.New("exif: invalid file format")
+
+// Header is the identifier in front of EXIF data in JPEG APP1 segments.
+const Header = "Exif\x00\x00"
+
+// Exif is a decoded EXIF blob. The raw directories are kept so that
+// unknown tags and maker notes can be preserved when writing.
+type Exif struct {
+	Order      binary.ByteOrder
+	IFD0       *tiff.IFD
+	ExifIFD    *tiff.IFD // nil when missing
+	GPSIFD     *tiff.IFD // nil when missing
+	InteropIFD *tiff.IFD // nil when missing
+	IFD1       *tiff.IFD // thumbnail directory, nil when missing
+	Tiff       *tiffmodel.TiffInfo
+	Info       *exifmodel.ExifInfo
+	EX         *exifmodel.ExifEXInfo
+	raw        []byte // decoded blob
+}
+
+// New returns an empty Exif for encoding blobs from scratch.
+func New(order binary.ByteOrder) *Exif {
+	return &Exif{
+		Order: order,
+		Tiff:  &tiffmodel.TiffInfo{},
+		Info:  &exifmodel.ExifInfo{},
+		EX:    &exifmodel.ExifEXInfo{},
+	}
+}
+
+// Decode parses a TIFF structured EXIF blob. A leading APP1 Exif header
+// is skipped.
+func Decode(b []byte) (*Exif, error) {
+	b = bytes.TrimPrefix(b, []byte(Header))
+	r, err := tiff.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrInvalidFile
+	}
+	ifd0, err := r.ReadIFD(r.First)
+	if err != nil {
+		return nil, err
+	}
+	x := &Exif{
+		Order: r.Order,
+		IFD0:  ifd0,
+		Tiff:  tiff.NewInfo(ifd0),
+		Info:  &exifmodel.ExifInfo{},
+		EX:    &exifmodel.ExifEXInfo{},
+		raw:   b,
+	}
+	if ifd0.Next > 0 {
+		if x.IFD1, err = r.ReadIFD(ifd0.Next); err != nil {
+			xmp.Log.Warnf("exif: reading IFD1: %v", err)
+		}
+	}
+	x.ExifIFD = readSubIFD(r, ifd0, tiff.TagExifIFD)
+	x.GPSIFD = readSubIFD(r, ifd0, tiff.TagGPSIFD)
+	if x.ExifIFD != nil {
+		x.InteropIFD = readSubIFD(r, x.ExifIFD, tiff.TagInteropIFD)
+	}
+
+	// GPS tags share their numbers with Interoperability tags, so
+	// each directory only fills fields of its own tag range
+	isGPS := func(tag uint16) bool { return tag < 0x0020 }
+	notGPS := func(tag uint16) bool { return tag >= 0x0020 }
+	all := func(tag uint16) bool { return true }
+	DecodeIFD(ifd0, x.Info, notGPS)
+	if x.ExifIFD != nil {
+		DecodeIFD(x.ExifIFD, x.Info, notGPS)
+		DecodeIFD(x.ExifIFD, x.EX, notGPS)
+	}
+	if x.GPSIFD != nil {
+		DecodeIFD(x.GPSIFD, x.Info, isGPS)
+	}
+	if x.InteropIFD != nil {
+		DecodeIFD(x.InteropIFD, x.Info, notGPS)
+		DecodeIFD(x.InteropIFD, x.EX, all)
+	}
+	if x.Info.ExPhotographicSensitivity > 0 {
+		x.Info.ISOSpeedRatings = xmp.IntList{x.Info.ExPhotographicSensitivity}
+	}
+	return x, nil
+}
+
+func readSubIFD(r *tiff.Reader, ifd *tiff.IFD, tag uint16) *tiff.IFD {
+	e := ifd.Find(tag)
+	if e == nil {
+		return nil
+	}
+	ofs := e.Uint(ifd.Order, 0)
+	if ofs == 0 {
+		return nil
+	}
+	sub, err := r.ReadIFD(ofs)
+	if err != nil {
+		// be resilient to broken sub-IFD pointers
+		xmp.Log.Warnf("exif: reading sub-IFD 0x%04x: %v", tag, err)
+		return nil
+	}
+	return sub
+}
+
+// AddModels converts dates, text and GPS values into their XMP
+// representation and adds the tiff, exif and exifEX models to d.
+func (x *Exif) AddModels(d *xmp.Document) error {
+	if err := x.Info.SyncToXMP(d); err != nil {
+		return err
+	}
+	for _, m := range []xmp.Model{x.Tiff, x.Info, x.EX} {
+		if _, err := d.AddModel(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
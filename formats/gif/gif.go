@@ -0,0 +1,262 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package gif implements reading and writing of XMP packets embedded in
+// GIF application extensions as defined by XMP Specification Part 3.
+//
+// The packet is stored in an application extension with identifier "XMP
+// Data" and authentication code "XMP". Its bytes are not split into data
+// sub-blocks. Instead a 258 byte magic trailer follows the packet so that
+// GIF decoders which interpret the packet text as sub-block sizes always
+// find the block terminator.
+package gif
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+const (
+	blockExtension   byte = 0x21
+	blockImage       byte = 0x2C
+	blockTrailer     byte = 0x3B
+	labelApplication byte = 0xFF
+)
+
+var (
+	gif87a    = []byte("GIF87a")
+	gif89a    = []byte("GIF89a")
+	xmpAppID  = []byte("XMP DataXMP")
+	xmpHeader = append([]byte{blockExtension, labelApplication, byte(len(xmpAppID))}, xmpAppID...)
+)
+
+// magicTrailer is 0x01, 0xFF, 0xFE, ..., 0x01, 0x00 followed by the block
+// terminator.
+var magicTrailer = func() []byte {
+	b := make([]byte, 258)
+	b[0] = 0x01
+	for i := 0; i < 256; i++ {
+		b[i+1] = byte(0xFF - i)
+	}
+	return b
+}()
+
+var ErrInvalidFile = errors.New("gif: invalid file format")
+
+// block is a raw GIF block including introducer and label bytes.
+type block []byte
+
+func (b block) isXMP() bool {
+	return bytes.HasPrefix(b, xmpHeader)
+}
+
+func (b block) isTrailer() bool {
+	return len(b) == 1 && b[0] == blockTrailer
+}
+
+// packet returns the XMP packet of an XMP application extension.
+func (b block) packet() ([]byte, error) {
+	data := b[len(xmpHeader):]
+	if !bytes.HasSuffix(data, magicTrailer) {
+		return nil, fmt.Errorf("gif: missing XMP magic trailer")
+	}
+	return data[:len(data)-len(magicTrailer)], nil
+}
+
+func makeXMPBlock(packet []byte) (block, error) {
+	if bytes.IndexByte(packet, 0) >= 0 {
+		return nil, fmt.Errorf("gif: xmp packet must not contain NUL bytes")
+	}
+	b := make(block, 0, len(xmpHeader)+len(packet)+len(magicTrailer))
+	b = append(b, xmpHeader...)
+	b = append(b, packet...)
+	return append(b, magicTrailer...), nil
+}
+
+// readSubBlocks appends data sub-blocks up to and including the block
+// terminator to buf.
+func readSubBlocks(r *bufio.Reader, buf []byte) ([]byte, error) {
+	for {
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf = append(buf, n)
+		if n == 0 {
+			return buf, nil
+		}
+		start := len(buf)
+		buf = append(buf, make([]byte, n)...)
+		if _, err := io.ReadFull(r, buf[start:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func readBlock(r *bufio.Reader) (block, error) {
+	intro, err := r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch intro {
+	case blockTrailer:
+		return block{intro}, nil
+	case blockExtension:
+		label, err := r.ReadByte()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return readSubBlocks(r, []byte{intro, label})
+	case blockImage:
+		var desc [9]byte
+		if _, err := io.ReadFull(r, desc[:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf := append([]byte{intro}, desc[:]...)
+		if desc[8]&0x80 > 0 {
+			buf = append(buf, make([]byte, 3<<(desc[8]&0x07+1))...)
+			if _, err := io.ReadFull(r, buf[10:]); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+		}
+		// LZW minimum code size
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return readSubBlocks(r, append(buf, c))
+	default:
+		return nil, fmt.Errorf("gif: invalid block type 0x%02x", intro)
+	}
+}
+
+// readHeader reads the signature, logical screen descriptor and global
+// color table.
+func readHeader(r *bufio.Reader) ([]byte, error) {
+	hdr := make([]byte, 13)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, ErrInvalidFile
+	}
+	if !bytes.Equal(hdr[:6], gif87a) && !bytes.Equal(hdr[:6], gif89a) {
+		return nil, ErrInvalidFile
+	}
+	if hdr[10]&0x80 > 0 {
+		hdr = append(hdr, make([]byte, 3<<(hdr[10]&0x07+1))...)
+		if _, err := io.ReadFull(r, hdr[13:]); err != nil {
+			return nil, ErrInvalidFile
+		}
+	}
+	return hdr, nil
+}
+
+// ReadPacket returns the XMP packet stored in the XMP application extension
+// or io.EOF when the file contains no XMP.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	if _, err := readHeader(br); err != nil {
+		return nil, err
+	}
+	for {
+		b, err := readBlock(br)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case b.isXMP():
+			return b.packet()
+		case b.isTrailer():
+			return nil, io.EOF
+		}
+	}
+}
+
+// Read decodes the XMP packet embedded in a GIF file.
+func Read(r io.Reader) (*xmp.Document, error) {
+	b, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the GIF file from r to w and stores packet in an XMP
+// application extension. An existing extension is replaced in place,
+// otherwise a new one is inserted before the trailer. GIF87a files are
+// upgraded to GIF89a since they cannot carry extensions. All other blocks
+// are copied unchanged.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	x, err := makeXMPBlock(packet)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	hdr, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+	copy(hdr, gif89a)
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(hdr); err != nil {
+		return err
+	}
+	var written bool
+	for {
+		b, err := readBlock(br)
+		if err != nil {
+			return err
+		}
+		switch {
+		case b.isXMP():
+			if written {
+				// drop duplicate XMP extensions
+				continue
+			}
+			b = x
+			written = true
+		case b.isTrailer() && !written:
+			if _, err := bw.Write(x); err != nil {
+				return err
+			}
+		}
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+		if b.isTrailer() {
+			break
+		}
+	}
+	// keep any trailing data
+	if _, err := io.Copy(bw, br); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Write copies the GIF file from r to w and embeds the XMP document d.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, b)
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package heif
+
+import (
+	"io"
+
+	"github.com/trimmer-io/go-xmp/formats/bmff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+type handler struct{}
+
+func (handler) CanHandle(head []byte) bool {
+	major, _ := bmff.Brands(head)
+	return bmff.IsImageBrand(major)
+}
+
+func (handler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	return Read(r)
+}
+
+func (handler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	return Write(w, r, d)
+}
+
+func (handler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite | xmp.CapPacketUpdate
+}
+
+func init() {
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name:       "heif",
+		Extensions: []string{".heic", ".heif", ".hif", ".avif"},
+		Magic:      []xmp.Magic{{Offset: 4, Value: []byte("ftyp")}},
+		Handler:    handler{},
+	})
+}
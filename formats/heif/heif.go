@@ -0,0 +1,664 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package heif implements reading and writing of XMP packets embedded in
+// HEIF, HEIC and AVIF image files as defined by XMP Specification Part 3
+// and ISO/IEC 23008-12.
+//
+// HEIF files store XMP as a `mime` item with content type
+// application/rdf+xml. The item is declared in the `iinf` box of the
+// top-level `meta` box and its data location is stored in `iloc`. Write
+// stores the packet in a separate `mdat` box following `meta` and fixes up
+// all `iloc` extents that point into data that moves.
+package heif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/formats/bmff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var ErrInvalidFile = errors.New("heif: invalid file format")
+
+// XMPContentType is the content type of XMP items.
+const XMPContentType = "application/rdf+xml"
+
+// Item is an entry of the item information box.
+type Item struct {
+	ID              uint32
+	Type            string // four character code, `mime` for XMP
+	Name            string
+	ContentType     string
+	ContentEncoding string
+}
+
+func (i Item) IsXMP() bool {
+	return i.Type == "mime" && i.ContentType == XMPContentType
+}
+
+// cstring splits a null-terminated string from b.
+func cstring(b []byte) (string, []byte) {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i]), b[i+1:]
+	}
+	return string(b), nil
+}
+
+// parseItemInfo decodes the payload of an `infe` box.
+func parseItemInfo(b []byte) (Item, error) {
+	var item Item
+	if len(b) < 8 {
+		return item, fmt.Errorf("heif: short infe box")
+	}
+	version := b[0]
+	b = b[4:]
+	switch version {
+	case 0, 1:
+		item.ID = uint32(binary.BigEndian.Uint16(b))
+		item.Type = "mime"
+		item.Name, b = cstring(b[4:])
+		item.ContentType, b = cstring(b)
+		item.ContentEncoding, _ = cstring(b)
+	case 2, 3:
+		if version == 2 {
+			item.ID = uint32(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		} else {
+			if len(b) < 10 {
+				return item, fmt.Errorf("heif: short infe box")
+			}
+			item.ID = binary.BigEndian.Uint32(b)
+			b = b[4:]
+		}
+		if len(b) < 6 {
+			return item, fmt.Errorf("heif: short infe box")
+		}
+		item.Type = string(b[2:6])
+		item.Name, b = cstring(b[6:])
+		if item.Type == "mime" {
+			item.ContentType, b = cstring(b)
+			item.ContentEncoding, _ = cstring(b)
+		}
+	default:
+		return item, fmt.Errorf("heif: unsupported infe version %d", version)
+	}
+	return item, nil
+}
+
+// itemInfoBytes encodes an `infe` box payload in version 2 or 3.
+func itemInfoBytes(item Item) []byte {
+	var buf bytes.Buffer
+	var tmp [4]byte
+	if item.ID > 0xffff {
+		buf.Write([]byte{3, 0, 0, 0})
+		binary.BigEndian.PutUint32(tmp[:], item.ID)
+		buf.Write(tmp[:4])
+	} else {
+		buf.Write([]byte{2, 0, 0, 0})
+		binary.BigEndian.PutUint16(tmp[:], uint16(item.ID))
+		buf.Write(tmp[:2])
+	}
+	buf.Write([]byte{0, 0}) // protection index
+	buf.WriteString(item.Type)
+	buf.WriteString(item.Name)
+	buf.WriteByte(0)
+	if item.Type == "mime" {
+		buf.WriteString(item.ContentType)
+		buf.WriteByte(0)
+		if item.ContentEncoding != "" {
+			buf.WriteString(item.ContentEncoding)
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+// parseItemInfos decodes the payload of an `iinf` box.
+func parseItemInfos(b []byte) ([]Item, error) {
+	if len(b) < 6 {
+		return nil, fmt.Errorf("heif: short iinf box")
+	}
+	hdr := 6
+	if b[0] > 0 {
+		hdr = 8
+	}
+	if len(b) < hdr {
+		return nil, fmt.Errorf("heif: short iinf box")
+	}
+	nodes, err := bmff.ParseNodes(b[hdr:])
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Type != "infe" {
+			continue
+		}
+		item, err := parseItemInfo(n.Data)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// extent is a contiguous range of item data.
+type extent struct {
+	index  uint64
+	offset uint64
+	length uint64
+}
+
+// itemLocation is an entry of the item location box.
+type itemLocation struct {
+	id      uint32
+	method  uint16 // 0 = file offset, 1 = idat offset, 2 = item offset
+	ref     uint16 // data reference index, 0 = this file
+	base    uint64
+	extents []extent
+}
+
+// itemLocations is the decoded `iloc` box.
+type itemLocations struct {
+	version    byte
+	flags      [3]byte
+	offsetSize int
+	lengthSize int
+	baseSize   int
+	indexSize  int
+	items      []*itemLocation
+}
+
+func (l *itemLocations) find(id uint32) *itemLocation {
+	for _, v := range l.items {
+		if v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint(n int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < n {
+		r.err = fmt.Errorf("heif: short iloc box")
+		return 0
+	}
+	var v uint64
+	for _, c := range r.b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func putUint(buf *bytes.Buffer, v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		buf.WriteByte(byte(v >> (8 * uint(i))))
+	}
+}
+
+func validSize(n int) bool {
+	return n == 0 || n == 4 || n == 8
+}
+
+// parseItemLocations decodes the payload of an `iloc` box.
+func parseItemLocations(b []byte) (*itemLocations, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("heif: short iloc box")
+	}
+	l := &itemLocations{version: b[0]}
+	copy(l.flags[:], b[1:4])
+	if l.version > 2 {
+		return nil, fmt.Errorf("heif: unsupported iloc version %d", l.version)
+	}
+	r := &reader{b: b[4:]}
+	v := r.uint(2)
+	l.offsetSize, l.lengthSize = int(v>>12&0xf), int(v>>8&0xf)
+	l.baseSize = int(v >> 4 & 0xf)
+	if l.version > 0 {
+		l.indexSize = int(v & 0xf)
+	}
+	if !validSize(l.offsetSize) || !validSize(l.lengthSize) || !validSize(l.baseSize) || !validSize(l.indexSize) {
+		return nil, fmt.Errorf("heif: invalid iloc field size")
+	}
+	idSize := 2
+	if l.version == 2 {
+		idSize = 4
+	}
+	count := int(r.uint(idSize))
+	for i := 0; i < count && r.err == nil; i++ {
+		loc := &itemLocation{id: uint32(r.uint(idSize))}
+		if l.version > 0 {
+			loc.method = uint16(r.uint(2)) & 0xf
+		}
+		loc.ref = uint16(r.uint(2))
+		loc.base = r.uint(l.baseSize)
+		n := int(r.uint(2))
+		for j := 0; j < n && r.err == nil; j++ {
+			var e extent
+			if l.version > 0 {
+				e.index = r.uint(l.indexSize)
+			}
+			e.offset = r.uint(l.offsetSize)
+			e.length = r.uint(l.lengthSize)
+			loc.extents = append(loc.extents, e)
+		}
+		l.items = append(l.items, loc)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return l, nil
+}
+
+// fieldSize returns the smallest valid field size not below n that holds v.
+func fieldSize(n int, v uint64) int {
+	switch {
+	case v > 0xffffffff:
+		return 8
+	case v > 0 && n < 4:
+		return 4
+	default:
+		return n
+	}
+}
+
+// bytes encodes the iloc payload. Field sizes grow when values no longer
+// fit.
+func (l *itemLocations) bytes() []byte {
+	for _, loc := range l.items {
+		l.baseSize = fieldSize(l.baseSize, loc.base)
+		for _, e := range loc.extents {
+			l.offsetSize = fieldSize(l.offsetSize, e.offset)
+			l.lengthSize = fieldSize(l.lengthSize, e.length)
+			if l.version > 0 {
+				l.indexSize = fieldSize(l.indexSize, e.index)
+			}
+		}
+	}
+	idSize := 2
+	if l.version == 2 {
+		idSize = 4
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(l.version)
+	buf.Write(l.flags[:])
+	putUint(&buf, uint64(l.offsetSize<<12|l.lengthSize<<8|l.baseSize<<4|l.indexSize), 2)
+	putUint(&buf, uint64(len(l.items)), idSize)
+	for _, loc := range l.items {
+		putUint(&buf, uint64(loc.id), idSize)
+		if l.version > 0 {
+			putUint(&buf, uint64(loc.method), 2)
+		}
+		putUint(&buf, uint64(loc.ref), 2)
+		putUint(&buf, loc.base, l.baseSize)
+		putUint(&buf, uint64(len(loc.extents)), 2)
+		for _, e := range loc.extents {
+			if l.version > 0 {
+				putUint(&buf, e.index, l.indexSize)
+			}
+			putUint(&buf, e.offset, l.offsetSize)
+			putUint(&buf, e.length, l.lengthSize)
+		}
+	}
+	return buf.Bytes()
+}
+
+// file is the parsed box structure of a HEIF file.
+type file struct {
+	boxes []bmff.Box
+	meta  *bmff.Box
+	node  *bmff.Node // meta box tree
+	items []Item
+	iloc  *itemLocations
+}
+
+func readFile(r io.ReadSeeker) (*file, error) {
+	l, err := bmff.ReadBoxes(r, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) == 0 || l[0].Type != "ftyp" {
+		return nil, ErrInvalidFile
+	}
+	f := &file{boxes: l, meta: bmff.FindBox(l, "meta")}
+	if f.meta == nil {
+		return nil, fmt.Errorf("heif: missing meta box")
+	}
+	buf, err := f.meta.ReadData(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("heif: short meta box")
+	}
+	f.node = &bmff.Node{Type: "meta", Prefix: buf[:4]}
+	if f.node.Children, err = bmff.ParseNodes(buf[4:]); err != nil {
+		return nil, err
+	}
+	if n := f.node.Find("iinf"); n != nil {
+		if f.items, err = parseItemInfos(n.Data); err != nil {
+			return nil, err
+		}
+	}
+	if n := f.node.Find("iloc"); n != nil {
+		if f.iloc, err = parseItemLocations(n.Data); err != nil {
+			return nil, err
+		}
+	} else {
+		f.iloc = &itemLocations{version: 1}
+	}
+	return f, nil
+}
+
+func (f *file) xmpItem() *Item {
+	for i := range f.items {
+		if f.items[i].IsXMP() {
+			return &f.items[i]
+		}
+	}
+	return nil
+}
+
+// readItem reads and concatenates all extents of item id.
+func (f *file) readItem(r io.ReadSeeker, id uint32) ([]byte, error) {
+	loc := f.iloc.find(id)
+	if loc == nil {
+		return nil, fmt.Errorf("heif: missing location for item %d", id)
+	}
+	if loc.ref != 0 {
+		return nil, fmt.Errorf("heif: item %d is stored in an external file", id)
+	}
+	var src io.ReadSeeker
+	switch loc.method {
+	case 0:
+		src = r
+	case 1:
+		idat := f.node.Find("idat")
+		if idat == nil {
+			return nil, fmt.Errorf("heif: missing idat box")
+		}
+		src = bytes.NewReader(idat.Data)
+	default:
+		return nil, fmt.Errorf("heif: unsupported construction method %d for item %d", loc.method, id)
+	}
+	end, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, e := range loc.extents {
+		ofs, n := int64(loc.base+e.offset), int64(e.length)
+		if n == 0 {
+			n = end - ofs
+		}
+		if ofs < 0 || n < 0 || ofs+n > end {
+			return nil, fmt.Errorf("heif: invalid extent for item %d", id)
+		}
+		if _, err := src.Seek(ofs, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(&buf, src, n); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Items lists the items declared in the meta box of a HEIF file.
+func Items(r io.ReadSeeker) ([]Item, error) {
+	f, err := readFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.items, nil
+}
+
+// ReadItem returns the data of item id, e.g. the `Exif` item.
+func ReadItem(r io.ReadSeeker, id uint32) ([]byte, error) {
+	f, err := readFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.readItem(r, id)
+}
+
+// ReadPacket returns the XMP packet stored as item in the meta box. It
+// returns io.EOF when the file contains no XMP.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	f, err := readFile(r)
+	if err != nil {
+		return nil, err
+	}
+	item := f.xmpItem()
+	if item == nil {
+		return nil, io.EOF
+	}
+	return f.readItem(r, item.ID)
+}
+
+// Read decodes the XMP packet embedded in a HEIF file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	b, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// isBoxData checks whether the only extent of loc covers the payload of an
+// mdat box exactly, which is how Write stores packets.
+func isBoxData(loc *itemLocation, b bmff.Box) bool {
+	if loc.method != 0 || loc.ref != 0 || len(loc.extents) != 1 || b.Type != "mdat" {
+		return false
+	}
+	e := loc.extents[0]
+	return int64(loc.base+e.offset) == b.DataOffset() && int64(e.length) == b.DataSize()
+}
+
+// WritePacket copies the HEIF file from r to w and stores packet as XMP
+// item. An existing XMP item is replaced, otherwise a new item is added.
+// The packet is written into its own `mdat` box after `meta` and all item
+// locations in the file are adjusted to the new layout. Data of replaced
+// items that shares a box with other data is left in place.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	f, err := readFile(r)
+	if err != nil {
+		return err
+	}
+	if bmff.FindBox(f.boxes, "moov") != nil {
+		return fmt.Errorf("heif: writing image sequences is not supported")
+	}
+	iinf, iloc := f.node.Find("iinf"), f.node.Find("iloc")
+	if iinf == nil {
+		return fmt.Errorf("heif: missing iinf box")
+	}
+	if iloc == nil {
+		iloc = &bmff.Node{Type: "iloc"}
+		f.node.Children = append(f.node.Children, iloc)
+	}
+
+	// find or create the XMP item
+	var loc *itemLocation
+	drop := -1
+	if item := f.xmpItem(); item != nil {
+		if loc = f.iloc.find(item.ID); loc == nil {
+			loc = &itemLocation{id: item.ID}
+			f.iloc.items = append(f.iloc.items, loc)
+		}
+		for i, b := range f.boxes {
+			if isBoxData(loc, b) {
+				drop = i
+			}
+		}
+	} else {
+		var id uint32
+		for _, v := range f.items {
+			if v.ID > id {
+				id = v.ID
+			}
+		}
+		for _, v := range f.iloc.items {
+			if v.id > id {
+				id = v.id
+			}
+		}
+		id++
+		if id > 0xffff && f.iloc.version < 2 {
+			return fmt.Errorf("heif: item id %d exceeds iloc range", id)
+		}
+		item := Item{ID: id, Type: "mime", Name: "XMP", ContentType: XMPContentType}
+		if err := addItemInfo(iinf, item); err != nil {
+			return err
+		}
+		loc = &itemLocation{id: id}
+		f.iloc.items = append(f.iloc.items, loc)
+	}
+	loc.method, loc.ref, loc.base = 0, 0, 0
+	loc.extents = []extent{{length: uint64(len(packet))}}
+
+	// remember original file offsets of all other items
+	orig := make(map[*itemLocation][]int64)
+	for _, v := range f.iloc.items {
+		if v == loc || v.method != 0 || v.ref != 0 {
+			continue
+		}
+		l := make([]int64, len(v.extents))
+		for i, e := range v.extents {
+			l[i] = int64(v.base + e.offset)
+		}
+		orig[v] = l
+	}
+
+	// build the output box list; nil nodes are copied verbatim
+	type entry struct {
+		box  bmff.Box
+		node *bmff.Node
+		pos  int64
+	}
+	mdat := &bmff.Node{Type: "mdat", Data: packet}
+	entries := make([]*entry, 0, len(f.boxes)+1)
+	for i, b := range f.boxes {
+		switch {
+		case i == drop:
+		case b.Offset == f.meta.Offset:
+			entries = append(entries, &entry{box: b, node: f.node}, &entry{node: mdat})
+		default:
+			entries = append(entries, &entry{box: b})
+		}
+	}
+	relocate := func(ofs int64) int64 {
+		for _, v := range entries {
+			if v.node == nil && ofs >= v.box.Offset && ofs < v.box.End() {
+				return ofs + v.pos - v.box.Offset
+			}
+		}
+		return ofs
+	}
+
+	// the meta box size depends on the offsets stored in iloc, so iterate
+	// until the layout is stable
+	for size := int64(-1); size != f.node.Size(); {
+		size = f.node.Size()
+		var pos int64
+		for _, v := range entries {
+			v.pos = pos
+			if v.node != nil {
+				pos += v.node.Size()
+			} else {
+				pos += v.box.Size
+			}
+		}
+		for v, l := range orig {
+			base := int64(v.base)
+			if base > 0 {
+				base = relocate(base)
+			}
+			for i, ofs := range l {
+				n := relocate(ofs)
+				if n < base {
+					base = 0
+				}
+				v.extents[i].offset = uint64(n - base)
+			}
+			v.base = uint64(base)
+		}
+		for _, v := range entries {
+			if v.node == mdat {
+				loc.extents[0].offset = uint64(v.pos + 8)
+			}
+		}
+		iloc.Data = f.iloc.bytes()
+	}
+
+	for _, v := range entries {
+		if v.node != nil {
+			if _, err := w.Write(v.node.Bytes()); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := r.Seek(v.box.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, v.box.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addItemInfo appends an `infe` entry to the iinf box n.
+func addItemInfo(n *bmff.Node, item Item) error {
+	b := n.Data
+	infe := (&bmff.Node{Type: "infe", Data: itemInfoBytes(item)}).Bytes()
+	if b[0] == 0 {
+		count := binary.BigEndian.Uint16(b[4:])
+		if count == 0xffff {
+			return fmt.Errorf("heif: too many items")
+		}
+		binary.BigEndian.PutUint16(b[4:], count+1)
+	} else {
+		binary.BigEndian.PutUint32(b[4:], binary.BigEndian.Uint32(b[4:])+1)
+	}
+	n.Data = append(b, infe...)
+	return nil
+}
+
+// Write copies the HEIF file from r to w and embeds the XMP document d.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, b)
+}
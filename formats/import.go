@@ -0,0 +1,32 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package formats
+
+// register all file format handlers
+import (
+	_ "github.com/trimmer-io/go-xmp/formats/bmff"
+	_ "github.com/trimmer-io/go-xmp/formats/eps"
+	_ "github.com/trimmer-io/go-xmp/formats/gif"
+	_ "github.com/trimmer-io/go-xmp/formats/heif"
+	_ "github.com/trimmer-io/go-xmp/formats/jpeg"
+	_ "github.com/trimmer-io/go-xmp/formats/mp3"
+	_ "github.com/trimmer-io/go-xmp/formats/pdf"
+	_ "github.com/trimmer-io/go-xmp/formats/png"
+	_ "github.com/trimmer-io/go-xmp/formats/psd"
+	_ "github.com/trimmer-io/go-xmp/formats/riff"
+	_ "github.com/trimmer-io/go-xmp/formats/svg"
+	_ "github.com/trimmer-io/go-xmp/formats/tiff"
+	_ "github.com/trimmer-io/go-xmp/formats/webp"
+)
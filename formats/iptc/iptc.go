@@ -0,0 +1,287 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package iptc implements decoding and encoding of legacy IPTC-IIM
+// records as defined by the IPTC Information Interchange Model 4.2. IIM
+// datasets are mapped to the dc and photoshop models following the IPTC
+// Core mapping, and the MD5 digest stored in photoshop:LegacyIPTCDigest
+// is used to tell whether XMP or IIM is more recent.
+package iptc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidFile = errors.New("iptc: invalid IIM data")
+
+// tag marker in front of every dataset
+const tagMarker = 0x1c
+
+// escape sequence in dataset 1:90 for UTF-8 text
+var charsetUTF8 = []byte("\x1b%G")
+
+// well-known datasets
+const (
+	EnvelopeVersion   = 1<<8 | 0
+	CodedCharacterSet = 1<<8 | 90
+	RecordVersion     = 2<<8 | 0
+	ObjectName        = 2<<8 | 5
+	Urgency           = 2<<8 | 10
+	Category          = 2<<8 | 15
+	SupplementalCat   = 2<<8 | 20
+	Keywords          = 2<<8 | 25
+	Instructions      = 2<<8 | 40
+	DateCreated       = 2<<8 | 55
+	TimeCreated       = 2<<8 | 60
+	Byline            = 2<<8 | 80
+	BylineTitle       = 2<<8 | 85
+	City              = 2<<8 | 90
+	Sublocation       = 2<<8 | 92
+	ProvinceState     = 2<<8 | 95
+	CountryCode       = 2<<8 | 100
+	CountryName       = 2<<8 | 101
+	TransmissionRef   = 2<<8 | 103
+	Headline          = 2<<8 | 105
+	Credit            = 2<<8 | 110
+	Source            = 2<<8 | 115
+	CopyrightNotice   = 2<<8 | 116
+	Caption           = 2<<8 | 120
+	CaptionWriter     = 2<<8 | 122
+)
+
+// maximum length of text datasets in bytes
+var maxLength = map[int]int{
+	ObjectName:      64,
+	Urgency:         1,
+	Category:        3,
+	SupplementalCat: 32,
+	Keywords:        64,
+	Instructions:    256,
+	DateCreated:     8,
+	TimeCreated:     11,
+	Byline:          32,
+	BylineTitle:     32,
+	City:            32,
+	Sublocation:     32,
+	ProvinceState:   32,
+	CountryCode:     3,
+	CountryName:     64,
+	TransmissionRef: 32,
+	Headline:        256,
+	Credit:          32,
+	Source:          32,
+	CopyrightNotice: 128,
+	Caption:         2000,
+	CaptionWriter:   32,
+}
+
+// DataSet is a single IIM dataset.
+type DataSet struct {
+	Record byte
+	ID     byte
+	Data   []byte
+}
+
+// Tag returns the record and dataset number as single value, e.g.
+// 2<<8|25 for keywords.
+func (x DataSet) Tag() int {
+	return int(x.Record)<<8 | int(x.ID)
+}
+
+func (x DataSet) String() string {
+	return fmt.Sprintf("%d:%02d", x.Record, x.ID)
+}
+
+// DataSets is a list of IIM datasets in file order.
+type DataSets []DataSet
+
+// Decode parses IIM data such as the payload of Photoshop image resource
+// 0x0404. Trailing padding is ignored.
+func Decode(b []byte) (DataSets, error) {
+	l := make(DataSets, 0)
+	for len(b) >= 5 && b[0] == tagMarker {
+		ds := DataSet{Record: b[1], ID: b[2]}
+		size := int(binary.BigEndian.Uint16(b[3:]))
+		b = b[5:]
+		if size&0x8000 != 0 {
+			// extended dataset, size is stored in the next n bytes
+			n := size & 0x7fff
+			if n > 4 || n > len(b) {
+				return nil, ErrInvalidFile
+			}
+			size = 0
+			for _, v := range b[:n] {
+				size = size<<8 | int(v)
+			}
+			b = b[n:]
+		}
+		if size > len(b) {
+			return nil, ErrInvalidFile
+		}
+		ds.Data = append([]byte{}, b[:size]...)
+		l = append(l, ds)
+		b = b[size:]
+	}
+	if len(bytes.TrimRight(b, "\x00")) > 0 {
+		return nil, ErrInvalidFile
+	}
+	return l, nil
+}
+
+// Encode serializes all datasets in list order.
+func (l DataSets) Encode() []byte {
+	var buf bytes.Buffer
+	for _, v := range l {
+		buf.Write([]byte{tagMarker, v.Record, v.ID})
+		if n := len(v.Data); n < 0x8000 {
+			buf.Write([]byte{byte(n >> 8), byte(n)})
+		} else {
+			buf.Write([]byte{0x80, 4, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		}
+		buf.Write(v.Data)
+	}
+	return buf.Bytes()
+}
+
+// Find returns the first dataset with tag or nil.
+func (l DataSets) Find(tag int) *DataSet {
+	for i := range l {
+		if l[i].Tag() == tag {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// IsUTF8 returns true when dataset 1:90 declares UTF-8 text or, when 1:90
+// is missing, all text is valid UTF-8 and contains non-ASCII characters.
+func (l DataSets) IsUTF8() bool {
+	if ds := l.Find(CodedCharacterSet); ds != nil {
+		return bytes.Equal(ds.Data, charsetUTF8)
+	}
+	var nonASCII bool
+	for _, v := range l {
+		if v.Record != 2 {
+			continue
+		}
+		if !utf8.Valid(v.Data) {
+			return false
+		}
+		for _, c := range v.Data {
+			if c >= 0x80 {
+				nonASCII = true
+			}
+		}
+	}
+	return nonASCII
+}
+
+// Strings returns the text of all datasets with tag. Text in other than
+// UTF-8 encoding is decoded as ISO 8859-1.
+func (l DataSets) Strings(tag int) []string {
+	isUTF8 := l.IsUTF8()
+	s := make([]string, 0)
+	for _, v := range l {
+		if v.Tag() != tag {
+			continue
+		}
+		if str := decodeText(v.Data, isUTF8); str != "" {
+			s = append(s, str)
+		}
+	}
+	return s
+}
+
+// String returns the text of the first dataset with tag.
+func (l DataSets) String(tag int) string {
+	if s := l.Strings(tag); len(s) > 0 {
+		return s[0]
+	}
+	return ""
+}
+
+func decodeText(b []byte, isUTF8 bool) string {
+	b = bytes.TrimRight(b, "\x00")
+	if isUTF8 {
+		return strings.TrimSpace(string(b))
+	}
+	r := make([]rune, len(b))
+	for i, v := range b {
+		r[i] = rune(v)
+	}
+	return strings.TrimSpace(string(r))
+}
+
+// Set replaces all datasets with tag by one dataset per value. New
+// datasets are inserted in tag order. Text is truncated to the maximum
+// length defined by IIM at a character boundary.
+func (l DataSets) Set(tag int, values ...string) DataSets {
+	pos := -1
+	out := make(DataSets, 0, len(l)+len(values))
+	for _, v := range l {
+		if v.Tag() == tag {
+			if pos < 0 {
+				pos = len(out)
+			}
+			continue
+		}
+		out = append(out, v)
+	}
+	if pos < 0 {
+		pos = len(out)
+		for i, v := range out {
+			if v.Tag() > tag {
+				pos = i
+				break
+			}
+		}
+	}
+	add := make(DataSets, 0, len(values))
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		add = append(add, DataSet{
+			Record: byte(tag >> 8),
+			ID:     byte(tag),
+			Data:   []byte(truncate(v, maxLength[tag])),
+		})
+	}
+	return append(out[:pos], append(add, out[pos:]...)...)
+}
+
+// truncate shortens s to at most n bytes without splitting characters.
+func truncate(s string, n int) string {
+	if n == 0 || len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Digest returns the MD5 digest of raw IIM data in the format used by
+// photoshop:LegacyIPTCDigest.
+func Digest(b []byte) string {
+	sum := md5.Sum(b)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package iptc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trimmer-io/go-xmp/models/dc"
+	"github.com/trimmer-io/go-xmp/models/ps"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// record 2 datasets that carry binary data and are never transcoded
+var binaryDataSets = map[int]bool{
+	RecordVersion: true,
+	2<<8 | 125:    true, // rasterized caption
+	2<<8 | 200:    true, // ObjectData preview file format
+	2<<8 | 201:    true, // ObjectData preview file format version
+	2<<8 | 202:    true, // ObjectData preview data
+}
+
+// photoshop text properties and their IIM datasets
+func textFields(p *ps.PhotoshopInfo) []struct {
+	tag int
+	val *string
+} {
+	return []struct {
+		tag int
+		val *string
+	}{
+		{Category, &p.Category},
+		{Instructions, &p.Instructions},
+		{BylineTitle, &p.AuthorsPosition},
+		{City, &p.City},
+		{ProvinceState, &p.State},
+		{CountryName, &p.Country},
+		{TransmissionRef, &p.TransmissionReference},
+		{Headline, &p.Headline},
+		{Credit, &p.Credit},
+		{Source, &p.Source},
+		{CaptionWriter, &p.CaptionWriter},
+	}
+}
+
+// Merge decodes raw IIM data and maps its datasets to the dc and photoshop
+// models in d following the IPTC Core mapping. The stored
+// photoshop:LegacyIPTCDigest decides which side is more recent:
+//
+//   - digest matches: XMP is up to date and left unchanged
+//   - digest differs: IIM was edited by a legacy application and its
+//     values replace XMP properties
+//   - no digest: IIM values only fill missing XMP properties
+func Merge(d *xmp.Document, raw []byte) error {
+	l, err := Decode(raw)
+	if err != nil {
+		return err
+	}
+	var force bool
+	if p := ps.FindModel(d); p != nil && p.LegacyIPTCDigest != "" {
+		if strings.EqualFold(p.LegacyIPTCDigest, Digest(raw)) {
+			return nil
+		}
+		force = true
+	}
+	return l.AddModels(d, force)
+}
+
+// AddModels maps datasets to the dc and photoshop models in d. When force
+// is false only properties missing in d are set.
+func (l DataSets) AddModels(d *xmp.Document, force bool) error {
+	if len(l) == 0 {
+		return nil
+	}
+	c, err := dc.MakeModel(d)
+	if err != nil {
+		return err
+	}
+	p, err := ps.MakeModel(d)
+	if err != nil {
+		return err
+	}
+	setAltString(&c.Title, l.String(ObjectName), force)
+	setAltString(&c.Rights, l.String(CopyrightNotice), force)
+	setAltString(&c.Description, l.String(Caption), force)
+	if v := l.Strings(Byline); len(v) > 0 && (force || len(c.Creator) == 0) {
+		c.Creator = xmp.StringList(v)
+	}
+	if v := l.Strings(Keywords); len(v) > 0 && (force || len(c.Subject) == 0) {
+		c.Subject = xmp.StringArray(v)
+	}
+	for _, f := range textFields(p) {
+		if v := l.String(f.tag); v != "" && (force || *f.val == "") {
+			*f.val = v
+		}
+	}
+	if v := l.Strings(SupplementalCat); len(v) > 0 && (force || len(p.SupplementalCategories) == 0) {
+		p.SupplementalCategories = xmp.StringArray(v)
+	}
+	if v, err := strconv.Atoi(l.String(Urgency)); err == nil && v > 0 && (force || p.Urgency == 0) {
+		p.Urgency = v
+	}
+	if t, ok := l.DateCreated(); ok && (force || p.DateCreated.IsZero()) {
+		p.DateCreated = xmp.NewDate(t)
+	}
+	return nil
+}
+
+func setAltString(a *xmp.AltString, v string, force bool) {
+	if v == "" || (!force && a.Default() != "") {
+		return
+	}
+	for i := range *a {
+		if (*a)[i].IsDefault {
+			(*a)[i].Value = v
+			return
+		}
+	}
+	a.AddDefault("", v)
+}
+
+// DateCreated combines datasets 2:55 (CCYYMMDD) and 2:60 (HHMMSS±HHMM).
+// Datasets without time are returned as midnight UTC.
+func (l DataSets) DateCreated() (time.Time, bool) {
+	date := l.String(DateCreated)
+	t, err := time.Parse("20060102", date)
+	if err != nil {
+		return time.Time{}, false
+	}
+	tm := l.String(TimeCreated)
+	for _, layout := range []string{"150405-0700", "150405"} {
+		if v, err := time.Parse("20060102"+layout, date+tm); err == nil {
+			return v, true
+		}
+	}
+	return t, true
+}
+
+// Update encodes the dc and photoshop models of d into IIM data. Datasets
+// in raw that have no XMP equivalent are kept. Text is written as UTF-8
+// and dataset 1:90 is set accordingly. The digest of the result is stored
+// in photoshop:LegacyIPTCDigest so readers can detect later edits by
+// legacy applications.
+func Update(raw []byte, d *xmp.Document) ([]byte, error) {
+	l, err := Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !l.IsUTF8() {
+		for i, v := range l {
+			if v.Record == 2 && !binaryDataSets[v.Tag()] {
+				l[i].Data = []byte(decodeText(v.Data, false))
+			}
+		}
+	}
+	l = l.Set(CodedCharacterSet, string(charsetUTF8))
+	l = l.Set(RecordVersion, "\x00\x04")
+	if c := dc.FindModel(d); c != nil {
+		l = l.Set(ObjectName, c.Title.Default())
+		l = l.Set(CopyrightNotice, c.Rights.Default())
+		l = l.Set(Caption, c.Description.Default())
+		l = l.Set(Byline, c.Creator...)
+		l = l.Set(Keywords, c.Subject...)
+	}
+	p, err := ps.MakeModel(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range textFields(p) {
+		l = l.Set(f.tag, *f.val)
+	}
+	l = l.Set(SupplementalCat, p.SupplementalCategories...)
+	if p.Urgency > 0 && p.Urgency < 10 {
+		l = l.Set(Urgency, strconv.Itoa(p.Urgency))
+	} else {
+		l = l.Set(Urgency)
+	}
+	if t := p.DateCreated.Value(); !t.IsZero() {
+		l = l.Set(DateCreated, t.Format("20060102"))
+		if h, m, s := t.Clock(); h+m+s > 0 || t.Location() != time.UTC {
+			l = l.Set(TimeCreated, t.Format("150405-0700"))
+		} else {
+			l = l.Set(TimeCreated)
+		}
+	} else {
+		l = l.Set(DateCreated)
+		l = l.Set(TimeCreated)
+	}
+	b := l.Encode()
+	p.LegacyIPTCDigest = Digest(b)
+	return b, nil
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package irb implements decoding and encoding of Photoshop image resource
+// blocks (IRB) as defined by the Adobe Photoshop File Formats Specification.
+//
+// Image resources are stored in the image resources section of PSD and PSB
+// files, in JPEG APP13 segments following the "Photoshop 3.0" header and in
+// TIFF tag 34377. Each block starts with a signature (usually "8BIM"), a
+// 16 bit resource ID and a Pascal string name padded to even size,
+// followed by a 32 bit length and the payload padded to even size.
+package irb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidFile = errors.New("irb: invalid image resource block")
+
+// Image resource IDs
+const (
+	ResolutionInfo uint16 = 0x03ED // resolution info
+	IPTC           uint16 = 0x0404 // IPTC-NAA record
+	ThumbnailPS4   uint16 = 0x0409 // Photoshop 4.0 thumbnail (BGR)
+	CopyrightFlag  uint16 = 0x040A // copyrighted flag
+	URL            uint16 = 0x040B // URL
+	Thumbnail      uint16 = 0x040C // Photoshop 5.0 thumbnail
+	ICCProfile     uint16 = 0x040F // ICC color profile
+	Slices         uint16 = 0x041A // slices
+	XMP            uint16 = 0x0424 // XMP metadata
+	CaptionDigest  uint16 = 0x0425 // MD5 digest of the IPTC-NAA record
+	PrintScale     uint16 = 0x0426 // print scale
+	PixelAspect    uint16 = 0x0428 // pixel aspect ratio
+	PrintFlagsInfo uint16 = 0x2710 // print flags information
+)
+
+// maximum size of image resource lists we load into memory
+const maxResourceSize = 1 << 30
+
+// JPEG APP13 segments carrying image resources start with this header.
+const JPEGHeader = "Photoshop 3.0\x00"
+
+// image resource block signatures
+var signatures = []string{"8BIM", "MeSa", "PHUT", "AgHg", "DCSR"}
+
+// Resource is a single image resource block. Data holds the payload
+// without padding.
+type Resource struct {
+	Signature string
+	ID        uint16
+	Name      string
+	Data      []byte
+}
+
+// Resources is a list of image resource blocks in file order.
+type Resources []*Resource
+
+func isSignature(s string) bool {
+	for _, v := range signatures {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse decodes a list of image resource blocks.
+func Parse(b []byte) (Resources, error) {
+	l := make(Resources, 0)
+	for len(b) > 0 {
+		if len(b) < 12 || !isSignature(string(b[:4])) {
+			return nil, ErrInvalidFile
+		}
+		res := &Resource{
+			Signature: string(b[:4]),
+			ID:        binary.BigEndian.Uint16(b[4:]),
+		}
+		// Pascal string padded to even size including the length byte
+		n := int(b[6])
+		name := (n + 2) &^ 1
+		if len(b) < 6+name+4 {
+			return nil, fmt.Errorf("irb: short image resource block %#04x", res.ID)
+		}
+		res.Name = string(b[7 : 7+n])
+		b = b[6+name:]
+		size := int64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if size > int64(len(b)) {
+			return nil, fmt.Errorf("irb: short image resource block %#04x", res.ID)
+		}
+		res.Data = b[:size]
+		b = b[size:]
+		if size&1 == 1 && len(b) > 0 {
+			b = b[1:]
+		}
+		l = append(l, res)
+	}
+	return l, nil
+}
+
+// ParseJPEG decodes image resources from the payload of one or more JPEG
+// APP13 segments. Large resource lists are split across consecutive
+// segments, each starting with the "Photoshop 3.0" header.
+func ParseJPEG(segments ...[]byte) (Resources, error) {
+	var buf bytes.Buffer
+	for _, v := range segments {
+		if !bytes.HasPrefix(v, []byte(JPEGHeader)) {
+			return nil, ErrInvalidFile
+		}
+		buf.Write(v[len(JPEGHeader):])
+	}
+	return Parse(buf.Bytes())
+}
+
+// Read reads and decodes a list of image resource blocks of size bytes.
+func Read(r io.Reader, size int64) (Resources, error) {
+	if size > maxResourceSize {
+		return nil, fmt.Errorf("irb: image resources too large (%d bytes)", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("irb: reading image resources: %v", err)
+	}
+	return Parse(b)
+}
+
+func (r *Resource) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	sig := r.Signature
+	if sig == "" {
+		sig = "8BIM"
+	}
+	buf.WriteString(sig)
+	binary.Write(&buf, binary.BigEndian, r.ID)
+	name := r.Name
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	if len(name)&1 == 0 {
+		buf.WriteByte(0)
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(r.Data)))
+	buf.Write(r.Data)
+	if len(r.Data)&1 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.WriteTo(w)
+}
+
+// Bytes encodes all image resource blocks.
+func (l Resources) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, v := range l {
+		v.WriteTo(&buf)
+	}
+	return buf.Bytes()
+}
+
+// JPEG encodes all image resource blocks as payload of one or more APP13
+// segments. Segments are split at resource boundaries when possible so
+// each one stays below the maximum segment payload size of 65533 bytes.
+func (l Resources) JPEG() [][]byte {
+	const maxPayload = 65533 - len(JPEGHeader)
+	segments := make([][]byte, 0)
+	var buf bytes.Buffer
+	flush := func() {
+		if buf.Len() > 0 {
+			segments = append(segments, append([]byte(JPEGHeader), buf.Bytes()...))
+			buf.Reset()
+		}
+	}
+	for _, v := range l {
+		var res bytes.Buffer
+		v.WriteTo(&res)
+		if buf.Len()+res.Len() > maxPayload {
+			flush()
+		}
+		for b := res.Bytes(); len(b) > 0; {
+			n := maxPayload - buf.Len()
+			if n > len(b) {
+				n = len(b)
+			}
+			buf.Write(b[:n])
+			b = b[n:]
+			if len(b) > 0 {
+				flush()
+			}
+		}
+	}
+	flush()
+	return segments
+}
+
+// Find returns the first resource with id or nil.
+func (l Resources) Find(id uint16) *Resource {
+	for _, v := range l {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// Set replaces the payload of the first resource with id or appends a new
+// 8BIM resource when none exists. A nil payload removes the resource.
+func (l Resources) Set(id uint16, data []byte) Resources {
+	for i, v := range l {
+		if v.ID != id {
+			continue
+		}
+		if data == nil {
+			return append(l[:i], l[i+1:]...)
+		}
+		v.Data = data
+		return l
+	}
+	if data == nil {
+		return l
+	}
+	return append(l, &Resource{ID: id, Data: data})
+}
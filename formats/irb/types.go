@@ -0,0 +1,349 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package irb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/trimmer-io/go-xmp/formats/iptc"
+	"github.com/trimmer-io/go-xmp/models/ps"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// thumbnail formats
+const (
+	ThumbnailRawRGB  = 0
+	ThumbnailJpegRGB = 1
+)
+
+// ThumbnailImage is the payload of thumbnail resources 0x0409 and 0x040C.
+// Data holds JFIF data for the JPEG format. Thumbnails in resource 0x0409
+// written by Photoshop 4.0 store pixels in BGR order.
+type ThumbnailImage struct {
+	Format       int
+	Width        int
+	Height       int
+	WidthBytes   int // padded row bytes = (width * bits per pixel + 31) / 32 * 4
+	TotalSize    int // WidthBytes * height * planes
+	BitsPerPixel int
+	Planes       int
+	Data         []byte
+}
+
+// size of the thumbnail header
+const thumbnailHeaderSize = 28
+
+// NewThumbnail returns a thumbnail resource for JPEG data.
+func NewThumbnail(jpeg []byte, width, height int) *Resource {
+	t := &ThumbnailImage{
+		Format:       ThumbnailJpegRGB,
+		Width:        width,
+		Height:       height,
+		WidthBytes:   (width*24 + 31) / 32 * 4,
+		BitsPerPixel: 24,
+		Planes:       1,
+		Data:         jpeg,
+	}
+	t.TotalSize = t.WidthBytes * height
+	return &Resource{ID: Thumbnail, Data: t.Bytes()}
+}
+
+// Thumbnail decodes thumbnail resources 0x0409 and 0x040C.
+func (r *Resource) Thumbnail() (*ThumbnailImage, error) {
+	if r.ID != Thumbnail && r.ID != ThumbnailPS4 {
+		return nil, fmt.Errorf("irb: resource %#04x is not a thumbnail", r.ID)
+	}
+	b := r.Data
+	if len(b) < thumbnailHeaderSize {
+		return nil, ErrInvalidFile
+	}
+	be := binary.BigEndian
+	t := &ThumbnailImage{
+		Format:       int(be.Uint32(b)),
+		Width:        int(be.Uint32(b[4:])),
+		Height:       int(be.Uint32(b[8:])),
+		WidthBytes:   int(be.Uint32(b[12:])),
+		TotalSize:    int(be.Uint32(b[16:])),
+		BitsPerPixel: int(be.Uint16(b[24:])),
+		Planes:       int(be.Uint16(b[26:])),
+	}
+	// size after compression
+	size := int(be.Uint32(b[20:]))
+	if size > len(b)-thumbnailHeaderSize || size == 0 {
+		size = len(b) - thumbnailHeaderSize
+	}
+	t.Data = b[thumbnailHeaderSize : thumbnailHeaderSize+size]
+	return t, nil
+}
+
+// Bytes encodes the thumbnail as resource payload.
+func (t *ThumbnailImage) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, []uint32{
+		uint32(t.Format),
+		uint32(t.Width),
+		uint32(t.Height),
+		uint32(t.WidthBytes),
+		uint32(t.TotalSize),
+		uint32(len(t.Data)),
+	})
+	binary.Write(&buf, binary.BigEndian, []uint16{uint16(t.BitsPerPixel), uint16(t.Planes)})
+	buf.Write(t.Data)
+	return buf.Bytes()
+}
+
+// Slice is a single entry of the slices resource.
+type Slice struct {
+	ID        int
+	GroupID   int
+	Origin    int
+	LayerID   int // associated layer for layer based slices (origin 1)
+	Name      string
+	Type      int
+	Left      int
+	Top       int
+	Right     int
+	Bottom    int
+	URL       string
+	Target    string
+	Message   string
+	AltTag    string
+	IsHTML    bool
+	CellText  string
+	HorzAlign int
+	VertAlign int
+	Color     [4]byte // alpha, red, green, blue
+}
+
+// SliceInfo is the payload of slices resource 0x041A in version 6 format.
+type SliceInfo struct {
+	Top    int
+	Left   int
+	Bottom int
+	Right  int
+	Name   string // name of the group of slices
+	Slices []Slice
+}
+
+// sliceReader reads big endian values from resource data and remembers
+// the first error.
+type sliceReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sliceReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = ErrInvalidFile
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sliceReader) int() int {
+	return int(int32(binary.BigEndian.Uint32(r.next(4))))
+}
+
+// string reads a Unicode string with 32 bit length in UTF-16 code units.
+func (r *sliceReader) string() string {
+	n := r.int()
+	if n < 0 || n > len(r.b)/2 {
+		r.err = ErrInvalidFile
+		return ""
+	}
+	b := r.next(n * 2)
+	u := make([]uint16, n)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[i*2:])
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+}
+
+// Slices decodes the slices resource 0x041A. Only the version 6 format is
+// supported, later versions store slices in a descriptor structure.
+func (r *Resource) Slices() (*SliceInfo, error) {
+	if r.ID != Slices {
+		return nil, fmt.Errorf("irb: resource %#04x is not a slices resource", r.ID)
+	}
+	sr := &sliceReader{b: r.Data}
+	if v := sr.int(); v != 6 {
+		return nil, fmt.Errorf("irb: unsupported slices version %d", v)
+	}
+	x := &SliceInfo{
+		Top:    sr.int(),
+		Left:   sr.int(),
+		Bottom: sr.int(),
+		Right:  sr.int(),
+		Name:   sr.string(),
+	}
+	n := sr.int()
+	if n < 0 || n > len(sr.b) {
+		return nil, ErrInvalidFile
+	}
+	x.Slices = make([]Slice, 0, n)
+	for i := 0; i < n && sr.err == nil; i++ {
+		s := Slice{
+			ID:      sr.int(),
+			GroupID: sr.int(),
+			Origin:  sr.int(),
+		}
+		if s.Origin == 1 {
+			s.LayerID = sr.int()
+		}
+		s.Name = sr.string()
+		s.Type = sr.int()
+		s.Left = sr.int()
+		s.Top = sr.int()
+		s.Right = sr.int()
+		s.Bottom = sr.int()
+		s.URL = sr.string()
+		s.Target = sr.string()
+		s.Message = sr.string()
+		s.AltTag = sr.string()
+		s.IsHTML = sr.next(1)[0] != 0
+		s.CellText = sr.string()
+		s.HorzAlign = sr.int()
+		s.VertAlign = sr.int()
+		copy(s.Color[:], sr.next(4))
+		x.Slices = append(x.Slices, s)
+	}
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	return x, nil
+}
+
+// IPTC decodes the IPTC-NAA record in resource 0x0404.
+func (r *Resource) IPTC() (iptc.DataSets, error) {
+	if r.ID != IPTC {
+		return nil, fmt.Errorf("irb: resource %#04x is not an IPTC-NAA record", r.ID)
+	}
+	return iptc.Decode(r.Data)
+}
+
+// XMP decodes the XMP packet in resource 0x0424.
+func (r *Resource) XMP() (*xmp.Document, error) {
+	if r.ID != XMP {
+		return nil, fmt.Errorf("irb: resource %#04x is not an XMP packet", r.ID)
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(r.Data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ICCProfileName returns the profile description of the ICC profile in
+// resource 0x040F as used by photoshop:ICCProfile.
+func (r *Resource) ICCProfileName() string {
+	if r.ID != ICCProfile {
+		return ""
+	}
+	return profileDescription(r.Data)
+}
+
+// profileDescription reads the 'desc' tag of an ICC profile, which is a
+// textDescriptionType in version 2 profiles and a multiLocalizedUnicodeType
+// in version 4 profiles.
+func profileDescription(b []byte) string {
+	be := binary.BigEndian
+	if len(b) < 132 || string(b[36:40]) != "acsp" {
+		return ""
+	}
+	n := int(be.Uint32(b[128:]))
+	for i := 0; i < n && 132+i*12+12 <= len(b); i++ {
+		e := b[132+i*12:]
+		if string(e[:4]) != "desc" {
+			continue
+		}
+		ofs, size := int(be.Uint32(e[4:])), int(be.Uint32(e[8:]))
+		if ofs < 0 || size < 12 || ofs+size > len(b) || ofs+size < ofs {
+			return ""
+		}
+		tag := b[ofs : ofs+size]
+		switch string(tag[:4]) {
+		case "desc":
+			l := int(be.Uint32(tag[8:]))
+			if l > len(tag)-12 {
+				return ""
+			}
+			return strings.TrimRight(string(tag[12:12+l]), "\x00")
+		case "mluc":
+			if len(tag) < 28 {
+				return ""
+			}
+			// use the first record
+			l, o := int(be.Uint32(tag[20:])), int(be.Uint32(tag[24:]))
+			if o+l > len(tag) || o+l < o || l&1 == 1 {
+				return ""
+			}
+			u := make([]uint16, l/2)
+			for i := range u {
+				u[i] = be.Uint16(tag[o+i*2:])
+			}
+			return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+		}
+		return ""
+	}
+	return ""
+}
+
+// Value returns the typed value of well-known resources: iptc.DataSets for
+// the IPTC-NAA record, *xmp.Document for XMP, *ThumbnailImage for
+// thumbnails and *SliceInfo for slices. Other resources including the ICC
+// profile are returned as raw data.
+func (r *Resource) Value() (interface{}, error) {
+	switch r.ID {
+	case IPTC:
+		return r.IPTC()
+	case XMP:
+		return r.XMP()
+	case Thumbnail, ThumbnailPS4:
+		return r.Thumbnail()
+	case Slices:
+		return r.Slices()
+	default:
+		return r.Data, nil
+	}
+}
+
+// AddModels feeds the IPTC-NAA record and the ICC profile name into the
+// dc and photoshop models of d. IPTC values are reconciled with XMP using
+// photoshop:LegacyIPTCDigest. Broken IPTC records are skipped.
+func (l Resources) AddModels(d *xmp.Document) error {
+	if res := l.Find(IPTC); res != nil {
+		if err := iptc.Merge(d, res.Data); err != nil {
+			xmp.Log.Warnf("irb: skipping IPTC-NAA record: %v", err)
+		}
+	}
+	if res := l.Find(ICCProfile); res != nil {
+		if name := res.ICCProfileName(); name != "" {
+			p, err := ps.MakeModel(d)
+			if err != nil {
+				return err
+			}
+			if p.ICCProfile == "" {
+				p.ICCProfile = name
+			}
+		}
+	}
+	return nil
+}
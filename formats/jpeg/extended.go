@@ -0,0 +1,550 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Extended XMP
+//
+// XMP packets larger than a single APP1 segment are split into a StandardXMP
+// packet and an ExtendedXMP serialization which is stored in one or more
+// APP1 segments of its own. Both parts are linked by the MD5 digest of the
+// ExtendedXMP serialization which is stored as xmpNote:HasExtendedXMP in
+// the StandardXMP packet (see XMP Specification Part 3, section 1.1.3.1).
+//
+// Each ExtendedXMP segment contains
+//
+//   http://ns.adobe.com/xmp/extension/\0  35 bytes signature
+//   GUID                                  32 bytes ASCII hex MD5 digest
+//   full length                           4 bytes big endian
+//   offset                                4 bytes big endian
+//   data                                  up to 65458 bytes
+
+package jpeg
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	nsXmpNote    = "http://ns.adobe.com/xmp/note/"
+	nsRDF        = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	guidLen      = 32
+	extChunkSize = maxSegmentSize - 35 - guidLen - 8
+)
+
+var extHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+// properties that move to ExtendedXMP first in priority order
+var extPriority = []string{
+	"xmp:Thumbnails",
+	"crs:",
+	"photoshop:History",
+}
+
+func (s segment) isExtendedXMP() bool {
+	return s.Marker == markerAPP1 && bytes.HasPrefix(s.Data, extHeader) && len(s.Data) >= len(extHeader)+guidLen+8
+}
+
+// extendedChunk is the payload of a single ExtendedXMP segment
+type extendedChunk struct {
+	guid   string
+	length uint32
+	offset uint32
+	data   []byte
+}
+
+func parseExtendedChunk(s segment) extendedChunk {
+	b := s.Data[len(extHeader):]
+	return extendedChunk{
+		guid:   string(b[:guidLen]),
+		length: binary.BigEndian.Uint32(b[guidLen:]),
+		offset: binary.BigEndian.Uint32(b[guidLen+4:]),
+		data:   b[guidLen+8:],
+	}
+}
+
+// assembleExtended collects all ExtendedXMP chunks with matching guid
+// and returns the complete ExtendedXMP serialization.
+func assembleExtended(segs []segment, guid string) ([]byte, error) {
+	chunks := make([]extendedChunk, 0)
+	for _, s := range segs {
+		if !s.isExtendedXMP() {
+			continue
+		}
+		if c := parseExtendedChunk(s); c.guid == guid {
+			chunks = append(chunks, c)
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("jpeg: missing extended xmp for guid %s", guid)
+	}
+	// the declared length is untrusted, never allocate more than the
+	// chunks can actually fill
+	size := int64(chunks[0].length)
+	var total int64
+	for _, c := range chunks {
+		total += int64(len(c.data))
+	}
+	if size > total {
+		return nil, fmt.Errorf("jpeg: incomplete extended xmp, found %d of %d bytes", total, size)
+	}
+	buf := make([]byte, size)
+	var n int64
+	for _, c := range chunks {
+		if int64(c.length) != size || int64(c.offset)+int64(len(c.data)) > size {
+			return nil, fmt.Errorf("jpeg: invalid extended xmp chunk at offset %d", c.offset)
+		}
+		copy(buf[c.offset:], c.data)
+		n += int64(len(c.data))
+	}
+	if n != size {
+		return nil, fmt.Errorf("jpeg: incomplete extended xmp, found %d of %d bytes", n, size)
+	}
+	if sum := md5.Sum(buf); !strings.EqualFold(hex.EncodeToString(sum[:]), guid) {
+		return nil, fmt.Errorf("jpeg: extended xmp digest mismatch for guid %s", guid)
+	}
+	return buf, nil
+}
+
+// makeExtendedSegments splits an ExtendedXMP serialization into segments.
+func makeExtendedSegments(ext []byte, guid string) []segment {
+	segs := make([]segment, 0, len(ext)/extChunkSize+1)
+	for ofs := 0; ofs < len(ext); ofs += extChunkSize {
+		end := ofs + extChunkSize
+		if end > len(ext) {
+			end = len(ext)
+		}
+		buf := make([]byte, 0, len(extHeader)+guidLen+8+end-ofs)
+		buf = append(buf, extHeader...)
+		buf = append(buf, guid...)
+		var l [8]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(ext)))
+		binary.BigEndian.PutUint32(l[4:], uint32(ofs))
+		buf = append(buf, l[:]...)
+		buf = append(buf, ext[ofs:end]...)
+		segs = append(segs, segment{Marker: markerAPP1, Data: buf})
+	}
+	return segs
+}
+
+// rdfProperty is a top-level XMP property either serialized as attribute
+// of an rdf:Description (raw is the unescaped value) or as child element
+// (raw is the verbatim XML serialization).
+type rdfProperty struct {
+	name string
+	attr bool
+	raw  []byte
+}
+
+func (p rdfProperty) size() int {
+	if p.attr {
+		return len(p.name) + len(p.raw) + 4
+	}
+	return len(p.raw)
+}
+
+type rdfDescription struct {
+	about string
+	ns    []xml.Attr
+	props []rdfProperty
+}
+
+// rdfPacket is a flat representation of an XMP packet that keeps the
+// original serialization of top-level properties intact so they can be
+// redistributed across StandardXMP and ExtendedXMP without loss.
+type rdfPacket struct {
+	head  []byte // xpacket header (optional)
+	tail  []byte // xpacket trailer and padding (optional)
+	xmptk string
+	ns    []xml.Attr // namespaces declared on x:xmpmeta and rdf:RDF
+	desc  []*rdfDescription
+}
+
+func qname(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func isNsAttr(a xml.Attr) bool {
+	return a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns"
+}
+
+// findNs returns the index of the declaration for the same prefix as a
+// in l or -1.
+func findNs(l []xml.Attr, a xml.Attr) int {
+	for i, v := range l {
+		if v.Name == a.Name {
+			return i
+		}
+	}
+	return -1
+}
+
+// setNs adds namespace declaration a to l, an existing declaration for
+// the same prefix is replaced.
+func setNs(l []xml.Attr, a xml.Attr) []xml.Attr {
+	if i := findNs(l, a); i >= 0 {
+		l[i] = a
+		return l
+	}
+	return append(l, a)
+}
+
+func parseRdfPacket(b []byte) (*rdfPacket, error) {
+	p := &rdfPacket{}
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var (
+		depth int
+		desc  *rdfDescription
+		start int
+	)
+	for {
+		ofs := d.InputOffset()
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jpeg: parsing xmp failed: %v", err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+			switch name := qname(t.Name); {
+			case depth == 1 && name == "x:xmpmeta":
+				p.head = b[:ofs]
+				for _, a := range t.Attr {
+					if isNsAttr(a) {
+						if a.Value != "adobe:ns:meta/" {
+							p.ns = setNs(p.ns, a)
+						}
+					} else if qname(a.Name) == "x:xmptk" {
+						p.xmptk = a.Value
+					}
+				}
+			case name == "rdf:RDF":
+				if p.head == nil {
+					p.head = b[:ofs]
+				}
+				for _, a := range t.Attr {
+					if isNsAttr(a) && a.Value != nsRDF {
+						// rdf:RDF is the inner scope and wins over x:xmpmeta
+						p.ns = setNs(p.ns, a)
+					}
+				}
+			case name == "rdf:Description" && desc == nil:
+				desc = &rdfDescription{}
+				for _, a := range t.Attr {
+					switch {
+					case isNsAttr(a):
+						desc.ns = append(desc.ns, a)
+					case qname(a.Name) == "rdf:about":
+						desc.about = a.Value
+					default:
+						desc.props = append(desc.props, rdfProperty{
+							name: qname(a.Name),
+							attr: true,
+							raw:  []byte(a.Value),
+						})
+					}
+				}
+				p.desc = append(p.desc, desc)
+				start = depth
+			case desc != nil && depth == start+1:
+				// top-level property element, capture verbatim
+				level := 1
+				for level > 0 {
+					tt, err := d.RawToken()
+					if err != nil {
+						return nil, fmt.Errorf("jpeg: parsing xmp failed: %v", err)
+					}
+					switch tt.(type) {
+					case xml.StartElement:
+						level++
+					case xml.EndElement:
+						level--
+					}
+				}
+				depth--
+				desc.props = append(desc.props, rdfProperty{
+					name: qname(t.Name),
+					raw:  b[ofs:d.InputOffset()],
+				})
+			}
+		case xml.EndElement:
+			if desc != nil && depth == start {
+				desc = nil
+			}
+			depth--
+			if depth == 0 {
+				p.tail = b[d.InputOffset():]
+				return p, nil
+			}
+		}
+	}
+	if len(p.desc) == 0 {
+		return nil, fmt.Errorf("jpeg: parsing xmp failed: missing rdf:Description")
+	}
+	return p, nil
+}
+
+// remove deletes all properties matching name and returns them
+func (p *rdfPacket) remove(name string) []rdfProperty {
+	l := make([]rdfProperty, 0)
+	for _, d := range p.desc {
+		props := d.props[:0]
+		for _, v := range d.props {
+			if v.name == name || strings.HasSuffix(name, ":") && strings.HasPrefix(v.name, name) {
+				l = append(l, v)
+			} else {
+				props = append(props, v)
+			}
+		}
+		d.props = props
+	}
+	return l
+}
+
+// find returns the value of simple property name
+func (p *rdfPacket) find(name string) string {
+	for _, d := range p.desc {
+		for _, v := range d.props {
+			if v.name != name {
+				continue
+			}
+			if v.attr {
+				return string(v.raw)
+			}
+			var s string
+			if err := xml.Unmarshal(v.raw, &s); err == nil {
+				return strings.TrimSpace(s)
+			}
+		}
+	}
+	return ""
+}
+
+// bytes serializes the packet. Descriptions without properties are
+// skipped. The xpacket wrapper is only written when wrap is true.
+func (p *rdfPacket) bytes(wrap bool) []byte {
+	var buf bytes.Buffer
+	if wrap {
+		buf.Write(p.head)
+	}
+	buf.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"`)
+	if p.xmptk != "" {
+		buf.WriteString(` x:xmptk="`)
+		xml.EscapeText(&buf, []byte(p.xmptk))
+		buf.WriteByte('"')
+	}
+	buf.WriteString(`><rdf:RDF xmlns:rdf="`)
+	buf.WriteString(nsRDF)
+	buf.WriteByte('"')
+	writeAttrs(&buf, p.ns)
+	buf.WriteByte('>')
+	for _, d := range p.desc {
+		if len(d.props) == 0 {
+			continue
+		}
+		buf.WriteString(`<rdf:Description rdf:about="`)
+		xml.EscapeText(&buf, []byte(d.about))
+		buf.WriteByte('"')
+		writeAttrs(&buf, d.ns)
+		var elems int
+		for _, v := range d.props {
+			if v.attr {
+				buf.WriteByte(' ')
+				buf.WriteString(v.name)
+				buf.WriteString(`="`)
+				xml.EscapeText(&buf, v.raw)
+				buf.WriteByte('"')
+			} else {
+				elems++
+			}
+		}
+		if elems == 0 {
+			buf.WriteString("/>")
+			continue
+		}
+		buf.WriteByte('>')
+		for _, v := range d.props {
+			if !v.attr {
+				buf.Write(v.raw)
+			}
+		}
+		buf.WriteString("</rdf:Description>")
+	}
+	buf.WriteString("</rdf:RDF></x:xmpmeta>")
+	if wrap {
+		buf.Write(p.tail)
+	}
+	return buf.Bytes()
+}
+
+func writeAttrs(buf *bytes.Buffer, l []xml.Attr) {
+	for _, a := range l {
+		buf.WriteByte(' ')
+		buf.WriteString(qname(a.Name))
+		buf.WriteString(`="`)
+		xml.EscapeText(buf, []byte(a.Value))
+		buf.WriteByte('"')
+	}
+}
+
+// clone returns a copy of p with the same descriptions but no properties
+func (p *rdfPacket) clone() *rdfPacket {
+	c := *p
+	c.desc = make([]*rdfDescription, len(p.desc))
+	for i, d := range p.desc {
+		c.desc[i] = &rdfDescription{about: d.about, ns: d.ns}
+	}
+	return &c
+}
+
+// mergeExtended joins a StandardXMP packet and its ExtendedXMP
+// serialization into a single packet and removes xmpNote:HasExtendedXMP.
+func mergeExtended(std, ext []byte) ([]byte, error) {
+	sp, err := parseRdfPacket(std)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := parseRdfPacket(ext)
+	if err != nil {
+		return nil, err
+	}
+	sp.remove("xmpNote:HasExtendedXMP")
+	for _, a := range ep.ns {
+		i := findNs(sp.ns, a)
+		switch {
+		case i < 0:
+			sp.ns = append(sp.ns, a)
+		case sp.ns[i].Value != a.Value:
+			// prefix is bound to another namespace in StandardXMP, declare
+			// it on the extended descriptions instead
+			for _, d := range ep.desc {
+				if findNs(d.ns, a) < 0 {
+					d.ns = append(d.ns, a)
+				}
+			}
+		}
+	}
+	sp.desc = append(sp.desc, ep.desc...)
+	return sp.bytes(true), nil
+}
+
+// splitExtended splits packet into a StandardXMP packet that fits into
+// a single APP1 segment and an ExtendedXMP serialization following the
+// priority rules of XMP Specification Part 3. The returned ext is nil
+// when the packet fits without splitting.
+func splitExtended(packet []byte) (std, ext []byte, guid string, err error) {
+	maxStd := maxSegmentSize - len(xmpHeader)
+	if len(packet) <= maxStd {
+		return packet, nil, "", nil
+	}
+	sp, err := parseRdfPacket(packet)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	sp.remove("xmpNote:HasExtendedXMP")
+
+	// drop padding from the standard packet
+	if i := bytes.Index(sp.tail, []byte("<?xpacket end")); i >= 0 {
+		sp.tail = append([]byte("\n"), sp.tail[i:]...)
+	}
+
+	// reserve space for the xmpNote:HasExtendedXMP property
+	note := rdfDescription{
+		ns: []xml.Attr{{Name: xml.Name{Space: "xmlns", Local: "xmpNote"}, Value: nsXmpNote}},
+		props: []rdfProperty{{
+			name: "xmpNote:HasExtendedXMP",
+			attr: true,
+			raw:  bytes.Repeat([]byte("0"), guidLen),
+		}},
+	}
+	sp.desc = append(sp.desc, &note)
+
+	ep := sp.clone()
+	ep.desc = ep.desc[:len(ep.desc)-1]
+	// move properties by priority, then by size
+	fits := len(sp.bytes(true)) <= maxStd
+	for _, name := range extPriority {
+		if fits {
+			break
+		}
+		sp.moveTo(ep, name)
+		fits = len(sp.bytes(true)) <= maxStd
+	}
+	for !fits {
+		name := sp.largest("xmpNote:HasExtendedXMP")
+		if name == "" {
+			return nil, nil, "", ErrPacketTooLarge
+		}
+		sp.moveTo(ep, name)
+		fits = len(sp.bytes(true)) <= maxStd
+	}
+
+	ext = ep.bytes(false)
+	sum := md5.Sum(ext)
+	guid = strings.ToUpper(hex.EncodeToString(sum[:]))
+	note.props[0].raw = []byte(guid)
+	return sp.bytes(true), ext, guid, nil
+}
+
+// moveTo moves all properties matching name from p to the description at
+// the same position in x.
+func (p *rdfPacket) moveTo(x *rdfPacket, name string) {
+	for i, d := range p.desc {
+		if i >= len(x.desc) {
+			break
+		}
+		props := d.props[:0]
+		for _, v := range d.props {
+			if v.name == name || strings.HasSuffix(name, ":") && strings.HasPrefix(v.name, name) {
+				x.desc[i].props = append(x.desc[i].props, v)
+			} else {
+				props = append(props, v)
+			}
+		}
+		d.props = props
+	}
+}
+
+// largest returns the name of the largest top-level property
+func (p *rdfPacket) largest(except string) string {
+	type entry struct {
+		name string
+		size int
+	}
+	l := make([]entry, 0)
+	for _, d := range p.desc {
+		for _, v := range d.props {
+			if v.name != except {
+				l = append(l, entry{v.name, v.size()})
+			}
+		}
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	sort.SliceStable(l, func(i, j int) bool { return l[i].size > l[j].size })
+	return l[0].name
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package jpeg implements reading and writing of XMP packets embedded in
+// JPEG APP1 segments as defined by XMP Specification Part 3.
+package jpeg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/formats/irb"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// JPEG markers
+const (
+	markerTEM   byte = 0x01
+	markerRST0  byte = 0xD0
+	markerRST7  byte = 0xD7
+	markerSOI   byte = 0xD8
+	markerEOI   byte = 0xD9
+	markerSOS   byte = 0xDA
+	markerAPP0  byte = 0xE0
+	markerAPP1  byte = 0xE1
+	markerAPP13 byte = 0xED
+)
+
+// maximum payload size of a marker segment (excluding the 2 byte length)
+const maxSegmentSize = 0xFFFF - 2
+
+var (
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	exifHeader = []byte("Exif\x00\x00")
+	jfifHeader = []byte("JFIF\x00")
+	jfxxHeader = []byte("JFXX\x00")
+)
+
+var (
+	ErrInvalidFile    = errors.New("jpeg: invalid file format")
+	ErrPacketTooLarge = errors.New("jpeg: xmp packet exceeds segment size")
+)
+
+// segment is a single JPEG marker segment. Data holds the payload without
+// the marker and length fields.
+type segment struct {
+	Marker byte
+	Data   []byte
+}
+
+func (s segment) isXMP() bool {
+	return s.Marker == markerAPP1 && bytes.HasPrefix(s.Data, xmpHeader)
+}
+
+func (s segment) isExif() bool {
+	return s.Marker == markerAPP1 && bytes.HasPrefix(s.Data, exifHeader)
+}
+
+func (s segment) isIRB() bool {
+	return s.Marker == markerAPP13 && bytes.HasPrefix(s.Data, []byte(irb.JPEGHeader))
+}
+
+func (s segment) isJFIF() bool {
+	return s.Marker == markerAPP0 && (bytes.HasPrefix(s.Data, jfifHeader) || bytes.HasPrefix(s.Data, jfxxHeader))
+}
+
+func (s segment) WriteTo(w io.Writer) (int64, error) {
+	if len(s.Data) > maxSegmentSize {
+		return 0, ErrPacketTooLarge
+	}
+	var hdr [4]byte
+	hdr[0] = 0xFF
+	hdr[1] = s.Marker
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(s.Data)+2))
+	n, err := w.Write(hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(s.Data)
+	return int64(n + m), err
+}
+
+// hasLength returns true for markers followed by a length field
+func hasLength(m byte) bool {
+	switch {
+	case m == markerSOI, m == markerEOI, m == markerTEM:
+		return false
+	case m >= markerRST0 && m <= markerRST7:
+		return false
+	default:
+		return true
+	}
+}
+
+// readSegments reads all marker segments up to and including the SOS
+// marker segment. The reader is positioned at the start of entropy coded
+// image data afterwards.
+func readSegments(r *bufio.Reader) ([]segment, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return nil, ErrInvalidFile
+	}
+	if soi[0] != 0xFF || soi[1] != markerSOI {
+		return nil, ErrInvalidFile
+	}
+	segs := make([]segment, 0)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("jpeg: reading marker: %v", err)
+		}
+		if c != 0xFF {
+			return nil, fmt.Errorf("jpeg: invalid marker prefix 0x%02x", c)
+		}
+		// skip fill bytes
+		m := byte(0xFF)
+		for m == 0xFF {
+			if m, err = r.ReadByte(); err != nil {
+				return nil, fmt.Errorf("jpeg: reading marker: %v", err)
+			}
+		}
+		if !hasLength(m) {
+			if m == markerEOI {
+				return segs, io.ErrUnexpectedEOF
+			}
+			segs = append(segs, segment{Marker: m})
+			continue
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, fmt.Errorf("jpeg: reading segment length: %v", err)
+		}
+		size := int(binary.BigEndian.Uint16(l[:]))
+		if size < 2 {
+			return nil, fmt.Errorf("jpeg: invalid segment length %d for marker 0x%02x", size, m)
+		}
+		buf := make([]byte, size-2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("jpeg: reading segment 0x%02x: %v", m, err)
+		}
+		segs = append(segs, segment{Marker: m, Data: buf})
+		if m == markerSOS {
+			return segs, nil
+		}
+	}
+}
+
+// ReadPacket returns the XMP packet stored in the first XMP APP1 segment
+// or io.EOF when the file contains no XMP. When the packet refers to
+// ExtendedXMP via xmpNote:HasExtendedXMP, the extension segments are
+// reassembled and merged into the returned packet.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	segs, err := readSegments(bufio.NewReader(r))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return readPacket(segs)
+}
+
+func readPacket(segs []segment) ([]byte, error) {
+	for _, s := range segs {
+		if !s.isXMP() {
+			continue
+		}
+		b := s.Data[len(xmpHeader):]
+		p, err := parseRdfPacket(b)
+		if err != nil {
+			return b, nil
+		}
+		guid := p.find("xmpNote:HasExtendedXMP")
+		if guid == "" {
+			return b, nil
+		}
+		ext, err := assembleExtended(segs, guid)
+		if err != nil {
+			xmp.Log.Warnf("%v, using StandardXMP only", err)
+			return b, nil
+		}
+		return mergeExtended(b, ext)
+	}
+	return nil, io.EOF
+}
+
+// ReadResources returns the Photoshop image resources stored in APP13
+// segments or io.EOF when the file contains none.
+func ReadResources(r io.Reader) (irb.Resources, error) {
+	segs, err := readSegments(bufio.NewReader(r))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return readResources(segs)
+}
+
+func readResources(segs []segment) (irb.Resources, error) {
+	l := make([][]byte, 0)
+	for _, s := range segs {
+		if s.isIRB() {
+			l = append(l, s.Data)
+		}
+	}
+	if len(l) == 0 {
+		return nil, io.EOF
+	}
+	return irb.ParseJPEG(l...)
+}
+
+// Read decodes the XMP packet embedded in a JPEG file. IPTC-NAA and ICC
+// profile resources from APP13 segments are merged into the photoshop
+// and dc models.
+func Read(r io.Reader) (*xmp.Document, error) {
+	segs, err := readSegments(bufio.NewReader(r))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	b, err := readPacket(segs)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	switch l, err := readResources(segs); err {
+	case nil:
+		if err := l.AddModels(d); err != nil {
+			return nil, err
+		}
+	case io.EOF:
+	default:
+		xmp.Log.Warnf("jpeg: skipping image resources: %v", err)
+	}
+	return d, nil
+}
+
+// WritePacket copies the JPEG file from r to w and stores packet in an XMP
+// APP1 segment. An existing XMP segment is replaced in place, otherwise a
+// new segment is inserted after any leading JFIF and Exif segments. Packets
+// larger than a single segment are split into StandardXMP and ExtendedXMP
+// segments. All other segments and the image data are copied unchanged.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	std, ext, guid, err := splitExtended(packet)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	segs, err := readSegments(br)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("jpeg: missing image data")
+		}
+		return err
+	}
+
+	x := []segment{{
+		Marker: markerAPP1,
+		Data:   append(append(make([]byte, 0, len(xmpHeader)+len(std)), xmpHeader...), std...),
+	}}
+	if ext != nil {
+		x = append(x, makeExtendedSegments(ext, guid)...)
+	}
+
+	// find the insert position
+	pos := -1
+	for i, s := range segs {
+		if s.isXMP() {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		pos = 0
+		for pos < len(segs) && (segs[pos].isJFIF() || segs[pos].isExif()) {
+			pos++
+		}
+	}
+
+	// drop existing XMP and ExtendedXMP segments
+	out := make([]segment, 0, len(segs)+len(x))
+	for i, s := range segs {
+		if i == pos {
+			out = append(out, x...)
+		}
+		if !s.isXMP() && !s.isExtendedXMP() {
+			out = append(out, s)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write([]byte{0xFF, markerSOI}); err != nil {
+		return err
+	}
+	for _, s := range out {
+		if !hasLength(s.Marker) {
+			if _, err := bw.Write([]byte{0xFF, s.Marker}); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := s.WriteTo(bw); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(bw, br); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Write copies the JPEG file from r to w and embeds the XMP document d.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, b)
+}
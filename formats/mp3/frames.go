@@ -0,0 +1,937 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	id3model "github.com/trimmer-io/go-xmp/models/id3"
+	"github.com/trimmer-io/go-xmp/models/xmp_dm"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// XMP packets are stored in a PRIV frame with this owner identifier.
+const xmpOwner = "XMP"
+
+// UFID owner used when the model carries no owner information.
+const ufidOwner = "http://www.id3.org/dummy/ufid.html"
+
+// chapter times are stored in milliseconds
+var msRate = xmpdm.FrameRate{Rate: 1000, Base: 1}
+
+// textField describes a text or URL frame that maps to a model field.
+type textField struct {
+	ID       string
+	Index    int  // struct field index
+	Min, Max byte // supported tag versions
+	Date     bool
+}
+
+var (
+	dateType   = reflect.TypeOf(xmp.Date{})
+	textFields = listTextFields()
+)
+
+// listTextFields collects the text and URL frames of the ID3 model from
+// its struct tags.
+func listTextFields() []textField {
+	l := make([]textField, 0)
+	typ := reflect.TypeOf(id3model.ID3{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tokens := strings.Split(f.Tag.Get("id3"), ",")
+		id := tokens[0]
+		if !isTextFrame(id) && !isURLFrame(id) && id != "ITNU" && id != "PCST" {
+			continue
+		}
+		tf := textField{ID: id, Index: i, Min: 2, Max: 4, Date: f.Type == dateType}
+		for _, v := range tokens[1:] {
+			switch v {
+			case "v2.4+":
+				tf.Min = 4
+			case "v2.3-":
+				tf.Max = 3
+			}
+		}
+		l = append(l, tf)
+	}
+	return l
+}
+
+func findTextField(id string) *textField {
+	for i := range textFields {
+		if textFields[i].ID == id {
+			return &textFields[i]
+		}
+	}
+	return nil
+}
+
+func isTextFrame(id string) bool {
+	return len(id) == 4 && id[0] == 'T' && id != "TXXX"
+}
+
+func isURLFrame(id string) bool {
+	return len(id) == 4 && id[0] == 'W' && id != "WXXX"
+}
+
+// frames managed by Model and SetModel, all other frames are kept as is
+var managedFrames = map[string]bool{
+	"TXXX": true, "WXXX": true, "COMM": true, "USLT": true, "USER": true,
+	"UFID": true, "PCNT": true, "POPM": true, "APIC": true, "SYLT": true,
+	"GEOB": true, "CHAP": true, "CTOC": true, "MCDI": true, "MLLT": true,
+	"SYTC": true, "SEEK": true, "PRIV": true, "ITNU": true, "PCST": true,
+}
+
+func isManaged(f Frame) bool {
+	if f.ID == "PRIV" && isXMPFrame(f) {
+		return false
+	}
+	return managedFrames[f.ID] || isTextFrame(f.ID) || isURLFrame(f.ID)
+}
+
+func isXMPFrame(f Frame) bool {
+	return f.ID == "PRIV" && bytes.HasPrefix(f.Data, []byte(xmpOwner+"\x00"))
+}
+
+var timestampFormats = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02T15",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+	"2006-01-02 15:04:05",
+}
+
+// parseTimestamp parses ID3v2.4 timestamps which are a subset of ISO 8601
+// with variable precision.
+func parseTimestamp(s string) (xmp.Date, error) {
+	for _, f := range timestampFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			return xmp.Date(t), nil
+		}
+	}
+	return xmp.ParseDate(s)
+}
+
+func formatTimestamp(d xmp.Date) string {
+	return d.Value().Format(timestampFormats[0])
+}
+
+// normalizeGenre resolves v1 genre references like "(17)" or "(17)Rock"
+// used in TCON frames of v2.2 and v2.3 tags.
+func normalizeGenre(l []string) []string {
+	out := make([]string, 0, len(l))
+	for _, v := range l {
+		for strings.HasPrefix(v, "(") {
+			i := strings.IndexByte(v, ')')
+			if i < 0 {
+				break
+			}
+			ref := v[1:i]
+			v = v[i+1:]
+			if strings.HasPrefix(ref, "(") {
+				// escaped literal parenthesis
+				v = ref + ")" + v
+				break
+			}
+			switch n, err := strconv.Atoi(ref); {
+			case err == nil:
+				out = append(out, id3model.GenreV1(n).String())
+			case ref == "RX":
+				out = append(out, "Remix")
+			case ref == "CR":
+				out = append(out, "Cover")
+			default:
+				out = append(out, ref)
+			}
+		}
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func readUint(b []byte) int64 {
+	var v int64
+	for _, c := range b {
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+func putCounter(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	for len(b) > 4 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// Model decodes all known frames into an ID3 model. Frames that have no
+// model representation are ignored.
+func (t *Tag) Model() (*id3model.ID3, error) {
+	m := &id3model.ID3{}
+	for _, f := range t.Frames {
+		if err := t.decodeFrame(m, f); err != nil {
+			xmp.Log.Warnf("id3: skipping frame %s: %v", f.ID, err)
+		}
+	}
+	if i := t.comment(); i >= 0 {
+		b := t.Frames[i].Data
+		_, rest := splitString(b[0], b[4:])
+		m.Comments = decodeString(b[0], rest)
+	}
+	return m, nil
+}
+
+// comment returns the index of the COMM frame that holds the model comment
+// or -1. This is the first frame without description or, when there is
+// none, the first one that is not an iTunes private comment like iTunNORM.
+func (t *Tag) comment() int {
+	idx := -1
+	for i, f := range t.Frames {
+		if f.ID != "COMM" || len(f.Data) < 4 {
+			continue
+		}
+		switch desc, _ := splitString(f.Data[0], f.Data[4:]); {
+		case desc == "":
+			return i
+		case idx < 0 && !strings.HasPrefix(desc, "iTun"):
+			idx = i
+		}
+	}
+	return idx
+}
+
+// langFrame returns language and description of a COMM or USLT frame.
+func langFrame(f *Frame) (string, string) {
+	if f == nil || len(f.Data) < 4 {
+		return "", ""
+	}
+	desc, _ := splitString(f.Data[0], f.Data[4:])
+	return string(f.Data[1:4]), desc
+}
+
+func (t *Tag) decodeFrame(m *id3model.ID3, f Frame) error {
+	b := f.Data
+	if len(b) == 0 {
+		return nil
+	}
+	switch id := f.ID; {
+	case id == "TXXX":
+		desc, rest := splitString(b[0], b[1:])
+		val := decodeString(b[0], rest)
+		if desc == "" {
+			m.UserText = val
+		} else {
+			m.Extension = append(m.Extension, xmp.Tag{Key: desc, Value: val})
+		}
+	case id == "TCON":
+		m.ContentType = normalizeGenre(decodeText(b))
+	case isTextFrame(id) || id == "ITNU" || id == "PCST":
+		l := decodeText(b)
+		if len(l) == 0 || l[0] == "" {
+			return nil
+		}
+		tf := findTextField(id)
+		if tf == nil {
+			m.Extension = append(m.Extension, xmp.Tag{Key: id, Value: strings.Join(l, "/")})
+			return nil
+		}
+		if tf.Date {
+			d, err := parseTimestamp(l[0])
+			if err != nil {
+				return err
+			}
+			return xmp.SetNativeField(m, id, d.String())
+		}
+		return m.SetTag(id, strings.Join(l, "/"))
+	case id == "WXXX":
+		_, rest := splitString(b[0], b[1:])
+		m.UserURL = xmp.Url(decodeString(encLatin1, rest))
+	case id == "WFED":
+		// iTunes stores podcast URLs as text frame
+		if b[0] < 4 {
+			if l := decodeText(b); len(l) > 0 {
+				m.PodcastURL = l[0]
+			}
+		} else {
+			m.PodcastURL = decodeString(encLatin1, b)
+		}
+	case isURLFrame(id):
+		if findTextField(id) == nil {
+			m.Extension = append(m.Extension, xmp.Tag{Key: id, Value: decodeString(encLatin1, b)})
+			return nil
+		}
+		return m.SetTag(id, decodeString(encLatin1, b))
+	case id == "COMM" || id == "USLT":
+		if len(b) < 4 {
+			return ErrInvalidTag
+		}
+		// the comment is picked from all COMM frames in Model
+		if id == "USLT" {
+			_, rest := splitString(b[0], b[4:])
+			val := decodeString(b[0], rest)
+			m.UnsynchronizedLyrics = append(m.UnsynchronizedLyrics, strings.Split(val, "\n")...)
+		}
+	case id == "USER":
+		if len(b) < 4 {
+			return ErrInvalidTag
+		}
+		m.TermsOfUse = append(m.TermsOfUse, decodeString(b[0], b[4:]))
+	case id == "UFID":
+		if m.UniqueFileIdentifier == "" {
+			_, rest := splitString(encLatin1, b)
+			m.UniqueFileIdentifier = xmp.Uri(rest)
+		}
+	case id == "PCNT":
+		m.PlayCounter = readUint(b)
+	case id == "POPM":
+		email, rest := splitString(encLatin1, b)
+		p := id3model.Popularimeter{Email: email}
+		if len(rest) > 0 {
+			p.Rating = rest[0]
+			p.Counter = readUint(rest[1:])
+		}
+		m.Popularimeter = append(m.Popularimeter, p)
+	case id == "APIC":
+		p, err := t.decodePicture(b)
+		if err != nil {
+			return err
+		}
+		m.AttachedPicture = append(m.AttachedPicture, *p)
+	case id == "GEOB":
+		enc := b[0]
+		mime, rest := splitString(encLatin1, b[1:])
+		name, rest := splitString(enc, rest)
+		desc, rest := splitString(enc, rest)
+		m.GeneralEncapsulatedObject = append(m.GeneralEncapsulatedObject, id3model.EncapsulatedObject{
+			Mimetype:    mime,
+			Filename:    name,
+			Description: desc,
+			Data:        rest,
+		})
+	case id == "SYLT":
+		l, err := decodeLyrics(b)
+		if err != nil {
+			return err
+		}
+		m.SynchronizedLyrics = append(m.SynchronizedLyrics, *l)
+	case id == "CHAP":
+		c, err := t.decodeChapter(b)
+		if err != nil {
+			return err
+		}
+		m.Chapters = append(m.Chapters, *c)
+	case id == "CTOC":
+		e, err := t.decodeToc(b)
+		if err != nil {
+			return err
+		}
+		m.TableOfContents = append(m.TableOfContents, *e)
+	case id == "PRIV":
+		if isXMPFrame(f) {
+			return nil
+		}
+		owner, rest := splitString(encLatin1, b)
+		m.Private = append(m.Private, id3model.PrivateData{Owner: owner, Data: rest})
+	case id == "MCDI":
+		m.MusicCDIdentifier = b
+	case id == "MLLT":
+		m.MPEGLocationLookupTable = b
+	case id == "SYTC":
+		m.SynchronizedTempoCodes = b
+	case id == "SEEK":
+		m.Seek = readUint(b)
+	}
+	return nil
+}
+
+func (t *Tag) decodePicture(b []byte) (*id3model.AttachedPicture, error) {
+	enc := b[0]
+	var mime string
+	var rest []byte
+	if t.Version == 2 {
+		// v2.2 PIC frames use a three character image format
+		if len(b) < 5 {
+			return nil, ErrInvalidTag
+		}
+		switch format := strings.ToUpper(string(b[1:4])); format {
+		case "JPG":
+			mime = "image/jpeg"
+		case "-->":
+			mime = "-->"
+		default:
+			mime = "image/" + strings.ToLower(format)
+		}
+		rest = b[4:]
+	} else {
+		mime, rest = splitString(encLatin1, b[1:])
+	}
+	if len(rest) < 1 {
+		return nil, ErrInvalidTag
+	}
+	typ := rest[0]
+	desc, data := splitString(enc, rest[1:])
+	return &id3model.AttachedPicture{
+		Mimetype:    mime,
+		Type:        id3model.PictureType(typ),
+		Description: desc,
+		Data:        data,
+	}, nil
+}
+
+func decodeLyrics(b []byte) (*id3model.TimedLyrics, error) {
+	if len(b) < 6 {
+		return nil, ErrInvalidTag
+	}
+	enc := b[0]
+	l := &id3model.TimedLyrics{
+		Lang: string(b[1:4]),
+		Unit: id3model.PositionType(b[4]),
+		Type: id3model.LyricsType(b[5]),
+	}
+	_, b = splitString(enc, b[6:])
+	for len(b) > 0 {
+		var s string
+		s, b = splitString(enc, b)
+		if len(b) < 4 {
+			return nil, ErrInvalidTag
+		}
+		l.Lyrics = append(l.Lyrics, id3model.TimedText{
+			Text:      s,
+			Timestamp: int64(binary.BigEndian.Uint32(b)),
+		})
+		b = b[4:]
+	}
+	return l, nil
+}
+
+// subFrames parses frames embedded in CHAP and CTOC frames.
+func (t *Tag) subFrames(b []byte) *Tag {
+	sub := &Tag{Version: t.Version}
+	if err := sub.readFrames(b, false); err != nil {
+		xmp.Log.Warnf("%v", err)
+	}
+	return sub
+}
+
+func (t *Tag) subTitle(b []byte) string {
+	if f := t.subFrames(b).Find("TIT2"); f != nil {
+		if l := decodeText(f.Data); len(l) > 0 {
+			return l[0]
+		}
+	}
+	return ""
+}
+
+// splitChapter returns the element ID, the 16 bytes of start and end
+// times and offsets, and the embedded frames of a CHAP frame.
+func splitChapter(b []byte) (string, []byte, []byte, error) {
+	name, rest := splitString(encLatin1, b)
+	if len(rest) < 16 {
+		return "", nil, nil, ErrInvalidTag
+	}
+	return name, rest[:16], rest[16:], nil
+}
+
+// splitToc returns the element ID, flags, child element IDs and the
+// embedded frames of a CTOC frame.
+func splitToc(b []byte) (string, byte, []string, []byte, error) {
+	id, rest := splitString(encLatin1, b)
+	if len(rest) < 2 {
+		return "", 0, nil, nil, ErrInvalidTag
+	}
+	flags, n := rest[0], int(rest[1])
+	rest = rest[2:]
+	var ids []string
+	for i := 0; i < n && len(rest) > 0; i++ {
+		var s string
+		s, rest = splitString(encLatin1, rest)
+		ids = append(ids, s)
+	}
+	return id, flags, ids, rest, nil
+}
+
+func (t *Tag) decodeChapter(b []byte) (*id3model.Chapter, error) {
+	name, times, sub, err := splitChapter(b)
+	if err != nil {
+		return nil, err
+	}
+	start := int64(binary.BigEndian.Uint32(times))
+	end := int64(binary.BigEndian.Uint32(times[4:]))
+	return &id3model.Chapter{
+		Name:      name,
+		StartTime: xmpdm.FrameCount{Count: start, Rate: msRate},
+		Duration:  xmpdm.FrameCount{Count: end - start, Rate: msRate},
+		Comment:   t.subTitle(sub),
+	}, nil
+}
+
+func (t *Tag) decodeToc(b []byte) (*id3model.TocEntry, error) {
+	_, flags, ids, sub, err := splitToc(b)
+	if err != nil {
+		return nil, err
+	}
+	return &id3model.TocEntry{
+		Flags:  int(flags),
+		IDList: ids,
+		Info:   t.subTitle(sub),
+	}, nil
+}
+
+// SetModel updates the frames managed by the ID3 model from m. Only frames
+// whose model value changed are rewritten, all other frames including
+// those the model cannot represent and the XMP frame are kept as is.
+func (t *Tag) SetModel(m *id3model.ID3) error {
+	var prev []Frame
+	upgrade := t.Version == 2
+	if !upgrade {
+		orig, err := t.Model()
+		if err != nil {
+			return err
+		}
+		if prev, err = t.encodeModel(orig); err != nil {
+			return err
+		}
+	}
+	if t.Version != 3 {
+		t.Version = 4
+	}
+	next, err := t.encodeModel(m)
+	if err != nil {
+		return err
+	}
+	if upgrade {
+		// v2.2 payloads differ from later versions, rewrite all of them
+		t.Remove(isManaged)
+		t.Frames = append(next, t.Frames...)
+		return nil
+	}
+	frames := make([]Frame, 0)
+	for _, id := range changedFrames(prev, next) {
+		t.removeFrames(id)
+		for _, f := range next {
+			if f.ID == id {
+				frames = append(frames, f)
+			}
+		}
+	}
+	t.Frames = append(frames, t.Frames...)
+	return nil
+}
+
+// changedFrames returns the IDs of frames that differ between the
+// encodings of two models.
+func changedFrames(prev, next []Frame) []string {
+	group := func(l []Frame) map[string][][]byte {
+		g := make(map[string][][]byte)
+		for _, f := range l {
+			g[f.ID] = append(g[f.ID], f.Data)
+		}
+		return g
+	}
+	a, b := group(prev), group(next)
+	ids := make([]string, 0)
+	for id := range a {
+		if !equalData(a[id], b[id]) {
+			ids = append(ids, id)
+		}
+	}
+	for id := range b {
+		if _, ok := a[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func equalData(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeFrames deletes the frames holding the model value for id. COMM
+// and UFID values come from a single frame, so other frames with the same
+// ID are kept.
+func (t *Tag) removeFrames(id string) {
+	i := -1
+	switch id {
+	case "COMM":
+		i = t.comment()
+	case "UFID":
+		for j, f := range t.Frames {
+			if f.ID == id {
+				i = j
+				break
+			}
+		}
+	default:
+		t.Remove(func(f Frame) bool {
+			return f.ID == id && !isXMPFrame(f)
+		})
+		return
+	}
+	if i >= 0 {
+		t.Frames = append(t.Frames[:i], t.Frames[i+1:]...)
+	}
+}
+
+func (t *Tag) encodeModel(m *id3model.ID3) ([]Frame, error) {
+	l := make([]Frame, 0)
+	add := func(id string, b []byte) {
+		l = append(l, Frame{ID: id, Data: b})
+	}
+	has := func(id string) bool {
+		for _, f := range l {
+			if f.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	v := t.Version
+	val := reflect.ValueOf(m).Elem()
+	for _, tf := range textFields {
+		var s string
+		switch {
+		case tf.ID == "TCON":
+			s = encodeGenre(v, m.ContentType)
+		case tf.Date:
+			if d := val.Field(tf.Index).Interface().(xmp.Date); !d.IsZero() {
+				s = formatTimestamp(d)
+			}
+		default:
+			x, err := m.GetTag(tf.ID)
+			if err != nil {
+				return nil, err
+			}
+			s = x
+		}
+		// skip empty values and zero numbers
+		if s == "" || s == "0" || has(tf.ID) {
+			continue
+		}
+		switch {
+		case v < tf.Min || v > tf.Max:
+			convertFrame(tf.ID, s, add, has)
+		case isURLFrame(tf.ID) && tf.ID != "WFED":
+			add(tf.ID, encodeString(encLatin1, s, false))
+		default:
+			add(tf.ID, encodeText(v, s))
+		}
+	}
+	if m.UserText != "" {
+		add("TXXX", encodeDescribed(v, "", m.UserText))
+	}
+	for _, x := range m.Extension {
+		switch {
+		case isTextFrame(x.Key) && findTextField(x.Key) == nil:
+			add(x.Key, encodeText(v, x.Value))
+		case isURLFrame(x.Key) && findTextField(x.Key) == nil:
+			add(x.Key, encodeString(encLatin1, x.Value, false))
+		default:
+			add("TXXX", encodeDescribed(v, x.Key, x.Value))
+		}
+	}
+	if m.UserURL != "" {
+		enc := pickEncoding(v)
+		add("WXXX", append(append([]byte{enc}, encodeString(enc, "", true)...), m.UserURL...))
+	}
+	if m.Comments != "" {
+		var lang, desc string
+		if i := t.comment(); i >= 0 {
+			lang, desc = langFrame(&t.Frames[i])
+		}
+		add("COMM", encodeLang(v, lang, desc, m.Comments))
+	}
+	if len(m.UnsynchronizedLyrics) > 0 {
+		lang, desc := langFrame(t.Find("USLT"))
+		add("USLT", encodeLang(v, lang, desc, strings.Join(m.UnsynchronizedLyrics, "\n")))
+	}
+	for _, s := range m.TermsOfUse {
+		enc := pickEncoding(v, s)
+		add("USER", append([]byte{enc, 'x', 'x', 'x'}, encodeString(enc, s, false)...))
+	}
+	if m.UniqueFileIdentifier != "" {
+		owner := ufidOwner
+		if f := t.Find("UFID"); f != nil {
+			if s, _ := splitString(encLatin1, f.Data); s != "" {
+				owner = s
+			}
+		}
+		add("UFID", append(encodeString(encLatin1, owner, true), m.UniqueFileIdentifier...))
+	}
+	if m.PlayCounter > 0 {
+		add("PCNT", putCounter(m.PlayCounter))
+	}
+	for _, p := range m.Popularimeter {
+		b := append(encodeString(encLatin1, p.Email, true), p.Rating)
+		if p.Counter > 0 {
+			b = append(b, putCounter(p.Counter)...)
+		}
+		add("POPM", b)
+	}
+	for _, p := range m.AttachedPicture {
+		enc := pickEncoding(v, p.Description)
+		b := append([]byte{enc}, encodeString(encLatin1, p.Mimetype, true)...)
+		b = append(b, byte(p.Type))
+		b = append(b, encodeString(enc, p.Description, true)...)
+		add("APIC", append(b, p.Data...))
+	}
+	for _, o := range m.GeneralEncapsulatedObject {
+		enc := pickEncoding(v, o.Filename, o.Description)
+		b := append([]byte{enc}, encodeString(encLatin1, o.Mimetype, true)...)
+		b = append(b, encodeString(enc, o.Filename, true)...)
+		b = append(b, encodeString(enc, o.Description, true)...)
+		add("GEOB", append(b, o.Data...))
+	}
+	for _, s := range m.SynchronizedLyrics {
+		texts := make([]string, len(s.Lyrics))
+		for i, x := range s.Lyrics {
+			texts[i] = x.Text
+		}
+		enc := pickEncoding(v, texts...)
+		b := append([]byte{enc}, langCode(s.Lang)...)
+		b = append(b, byte(s.Unit), byte(s.Type))
+		b = append(b, encodeString(enc, "", true)...)
+		for _, x := range s.Lyrics {
+			b = append(b, encodeString(enc, x.Text, true)...)
+			var ts [4]byte
+			binary.BigEndian.PutUint32(ts[:], uint32(x.Timestamp))
+			b = append(b, ts[:]...)
+		}
+		add("SYLT", b)
+	}
+	for _, c := range m.Chapters {
+		b, err := t.encodeChapter(c)
+		if err != nil {
+			return nil, err
+		}
+		add("CHAP", b)
+	}
+	for i, e := range m.TableOfContents {
+		b, err := t.encodeToc(i, e)
+		if err != nil {
+			return nil, err
+		}
+		add("CTOC", b)
+	}
+	for _, p := range m.Private {
+		if p.Owner == xmpOwner {
+			continue
+		}
+		add("PRIV", append(encodeString(encLatin1, p.Owner, true), p.Data...))
+	}
+	if len(m.MusicCDIdentifier) > 0 {
+		add("MCDI", m.MusicCDIdentifier)
+	}
+	if len(m.MPEGLocationLookupTable) > 0 {
+		add("MLLT", m.MPEGLocationLookupTable)
+	}
+	if len(m.SynchronizedTempoCodes) > 0 {
+		add("SYTC", m.SynchronizedTempoCodes)
+	}
+	if m.Seek > 0 && v == 4 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(m.Seek))
+		add("SEEK", b[:])
+	}
+	return l, nil
+}
+
+// convertFrame translates frames between v2.3 and v2.4 when the model
+// contains a frame the target version does not support. Frames without
+// equivalent are dropped.
+func convertFrame(id, val string, add func(string, []byte), has func(string) bool) {
+	switch id {
+	case "TDRC":
+		d, err := parseTimestamp(val)
+		if err != nil {
+			return
+		}
+		tm := d.Value()
+		add("TYER", encodeText(3, strconv.Itoa(tm.Year())))
+		if len(val) >= 10 {
+			add("TDAT", encodeText(3, tm.Format("0201")))
+		}
+		if len(val) >= 16 {
+			add("TIME", encodeText(3, tm.Format("1504")))
+		}
+	case "TDOR":
+		if len(val) >= 4 {
+			add("TORY", encodeText(3, val[:4]))
+		}
+	case "TYER", "TORY", "IPLS":
+		to := map[string]string{"TYER": "TDRC", "TORY": "TDOR", "IPLS": "TIPL"}[id]
+		if !has(to) {
+			add(to, encodeText(4, val))
+		}
+	}
+}
+
+// encodeGenre writes multiple genres as NUL separated list in v2.4 and as
+// v1 genre references in v2.3.
+func encodeGenre(version byte, l id3model.Genre) string {
+	if version == 4 {
+		return strings.Join(l, "\x00")
+	}
+	var refs, names []string
+	for _, v := range l {
+		if g, err := id3model.ParseGenreV1(v); err == nil && g.String() == v {
+			refs = append(refs, "("+strconv.Itoa(int(g))+")")
+		} else {
+			names = append(names, v)
+		}
+	}
+	return strings.Join(refs, "") + strings.Join(names, "/")
+}
+
+func langCode(s string) []byte {
+	if len(s) != 3 {
+		return []byte("xxx")
+	}
+	return []byte(s)
+}
+
+// encodeDescribed encodes TXXX style frames with description and value.
+func encodeDescribed(version byte, desc, val string) []byte {
+	enc := pickEncoding(version, desc, val)
+	b := append([]byte{enc}, encodeString(enc, desc, true)...)
+	return append(b, encodeString(enc, val, false)...)
+}
+
+// encodeLang encodes COMM and USLT style frames.
+func encodeLang(version byte, lang, desc, val string) []byte {
+	enc := pickEncoding(version, desc, val)
+	b := append([]byte{enc}, langCode(lang)...)
+	b = append(b, encodeString(enc, desc, true)...)
+	return append(b, encodeString(enc, val, false)...)
+}
+
+// encodeSub replaces the title in the embedded frames b of a CHAP or
+// CTOC frame. Other embedded frames are kept.
+func (t *Tag) encodeSub(b []byte, title string) ([]byte, error) {
+	sub := t.subFrames(b)
+	sub.Remove(func(f Frame) bool {
+		return f.ID == "TIT2"
+	})
+	if title != "" {
+		sub.Frames = append([]Frame{{ID: "TIT2", Data: encodeText(t.Version, title)}}, sub.Frames...)
+	}
+	return sub.encodeFrames()
+}
+
+func toMs(c xmpdm.FrameCount) int64 {
+	if c.Rate.IsZero() || c.Rate == msRate {
+		return c.Count
+	}
+	return int64(float64(c.Count) * 1000 / c.Rate.Value())
+}
+
+// encodeChapter creates a CHAP frame for c. An existing chapter with the
+// same element ID is kept when unchanged, otherwise its byte offsets and
+// embedded frames other than the title are reused.
+func (t *Tag) encodeChapter(c id3model.Chapter) ([]byte, error) {
+	var times [16]byte
+	binary.BigEndian.PutUint32(times[8:], 0xffffffff)
+	binary.BigEndian.PutUint32(times[12:], 0xffffffff)
+	var sub []byte
+	for _, f := range t.FindAll("CHAP") {
+		name, x, rest, err := splitChapter(f.Data)
+		if err != nil || name != c.Name {
+			continue
+		}
+		if o, err := t.decodeChapter(f.Data); err == nil && reflect.DeepEqual(*o, c) {
+			return f.Data, nil
+		}
+		copy(times[8:], x[8:])
+		sub = rest
+		break
+	}
+	start, end := toMs(c.StartTime), toMs(c.StartTime)+toMs(c.Duration)
+	binary.BigEndian.PutUint32(times[0:], uint32(start))
+	binary.BigEndian.PutUint32(times[4:], uint32(end))
+	b := append(encodeString(encLatin1, c.Name, true), times[:]...)
+	frames, err := t.encodeSub(sub, c.Comment)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, frames...), nil
+}
+
+// encodeToc creates the i-th CTOC frame for e. The model carries no
+// element ID, so the ID and embedded frames other than the title of the
+// i-th existing CTOC frame are reused.
+func (t *Tag) encodeToc(i int, e id3model.TocEntry) ([]byte, error) {
+	if len(e.IDList) > 255 {
+		return nil, fmt.Errorf("id3: too many entries in table of contents")
+	}
+	id := "toc" + strconv.Itoa(i)
+	var sub []byte
+	if l := t.FindAll("CTOC"); i < len(l) {
+		if o, err := t.decodeToc(l[i].Data); err == nil && reflect.DeepEqual(*o, e) {
+			return l[i].Data, nil
+		}
+		if x, _, _, rest, err := splitToc(l[i].Data); err == nil {
+			id, sub = x, rest
+		}
+	}
+	b := encodeString(encLatin1, id, true)
+	b = append(b, byte(e.Flags), byte(len(e.IDList)))
+	for _, v := range e.IDList {
+		b = append(b, encodeString(encLatin1, v, true)...)
+	}
+	frames, err := t.encodeSub(sub, e.Info)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, frames...), nil
+}
+
+// Packet returns the XMP packet stored in a PRIV frame or nil.
+func (t *Tag) Packet() []byte {
+	for _, f := range t.Frames {
+		if isXMPFrame(f) && len(f.Data) > len(xmpOwner)+1 {
+			return f.Data[len(xmpOwner)+1:]
+		}
+	}
+	return nil
+}
+
+// SetPacket replaces the XMP PRIV frame with packet.
+func (t *Tag) SetPacket(packet []byte) {
+	t.Remove(isXMPFrame)
+	t.Add("PRIV", append([]byte(xmpOwner+"\x00"), packet...))
+}
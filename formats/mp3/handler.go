@@ -0,0 +1,54 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mp3
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+type handler struct{}
+
+// CanHandle accepts files starting with an ID3v2 tag or an MPEG audio
+// frame sync.
+func (handler) CanHandle(head []byte) bool {
+	if bytes.HasPrefix(head, []byte("ID3")) {
+		return true
+	}
+	return len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0
+}
+
+func (handler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	return Read(r)
+}
+
+func (handler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	return Write(w, r, d)
+}
+
+func (handler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite | xmp.CapNative
+}
+
+func init() {
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name:       "mp3",
+		Extensions: []string{".mp3"},
+		Magic:      []xmp.Magic{{Offset: 0, Value: []byte("ID3")}},
+		Handler:    handler{},
+	})
+}
@@ -0,0 +1,419 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mp3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	id3model "github.com/trimmer-io/go-xmp/models/id3"
+)
+
+// sizes of the ID3v1 tag and the extended TAG+ block in front of it
+const (
+	v1Size    = 128
+	v1ExtSize = 227
+)
+
+// GenreNone is the ID3v1 genre byte for files without genre.
+const GenreNone id3model.GenreV1 = 0xff
+
+// TagV1 is an ID3v1 or ID3v1.1 tag stored in the last 128 bytes of a file,
+// optionally preceded by a 227 byte extended TAG+ block. Text is ISO-8859-1
+// encoded. The TAG+ block continues title, artist and album with up to 60
+// more characters each.
+type TagV1 struct {
+	Title     string
+	Artist    string
+	Album     string
+	Year      string
+	Comment   string
+	Track     int              // ID3v1.1 track number, 0 for ID3v1.0 tags
+	Genre     id3model.GenreV1 // GenreNone when unset
+	Speed     byte             // TAG+ speed, 0 unset, 1 slow, 2 medium, 3 fast, 4 hardcore
+	GenreName string           // TAG+ free-text genre
+	StartTime string           // TAG+ start of music as mmm:ss
+	EndTime   string           // TAG+ end of music as mmm:ss
+	Size      int              // size in the file, 128 or 355 with TAG+ block
+}
+
+// NewTagV1 returns an empty tag without genre.
+func NewTagV1() *TagV1 {
+	return &TagV1{Genre: GenreNone}
+}
+
+// ReadTagV1 reads the ID3v1 tag and TAG+ block at the end of r. It returns
+// io.EOF when the file has no ID3v1 tag.
+func ReadTagV1(r io.ReadSeeker) (*TagV1, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if end < v1Size {
+		return nil, io.EOF
+	}
+	size := int64(v1Size + v1ExtSize)
+	if end < size {
+		size = v1Size
+	}
+	buf := make([]byte, size)
+	if _, err := r.Seek(end-size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("id3: reading v1 tag: %v", err)
+	}
+	return ParseTagV1(buf)
+}
+
+// ParseTagV1 decodes the ID3v1 tag at the end of b and a TAG+ block
+// directly in front of it. It returns io.EOF when b does not end with an
+// ID3v1 tag.
+func ParseTagV1(b []byte) (*TagV1, error) {
+	if len(b) < v1Size || string(b[len(b)-v1Size:len(b)-v1Size+3]) != "TAG" {
+		return nil, io.EOF
+	}
+	v1 := b[len(b)-v1Size:]
+	var ext []byte
+	if len(b) >= v1Size+v1ExtSize {
+		if x := b[len(b)-v1Size-v1ExtSize:]; string(x[:4]) == "TAG+" {
+			ext = x[:v1ExtSize]
+		}
+	}
+	t := &TagV1{
+		Title:   v1String(v1[3:33]),
+		Artist:  v1String(v1[33:63]),
+		Album:   v1String(v1[63:93]),
+		Year:    v1String(v1[93:97]),
+		Comment: v1String(v1[97:127]),
+		Genre:   id3model.GenreV1(v1[127]),
+		Size:    v1Size,
+	}
+	if v1[125] == 0 && v1[126] != 0 {
+		// ID3v1.1 track number
+		t.Comment = v1String(v1[97:125])
+		t.Track = int(v1[126])
+	}
+	if ext != nil {
+		t.Title = v1String(append(append([]byte{}, v1[3:33]...), ext[4:64]...))
+		t.Artist = v1String(append(append([]byte{}, v1[33:63]...), ext[64:124]...))
+		t.Album = v1String(append(append([]byte{}, v1[63:93]...), ext[124:184]...))
+		t.Speed = ext[184]
+		t.GenreName = v1String(ext[185:215])
+		t.StartTime = v1String(ext[215:221])
+		t.EndTime = v1String(ext[221:227])
+		t.Size += v1ExtSize
+	}
+	return t, nil
+}
+
+// v1String decodes a fixed width Latin-1 field up to the first NUL byte.
+// Trailing spaces used as padding by some writers are removed.
+func v1String(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimRight(decodeString(encLatin1, b), " ")
+}
+
+// putField writes the Latin-1 encoded text s into the fixed width field
+// b, truncating and padding with NUL bytes. It returns the remaining text
+// which did not fit.
+func putField(b []byte, s []byte) []byte {
+	n := copy(b, s)
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
+	return s[n:]
+}
+
+// hasExt returns true when the tag needs a TAG+ block.
+func (t *TagV1) hasExt() bool {
+	return t.Speed != 0 || t.GenreName != "" || t.StartTime != "" || t.EndTime != "" ||
+		len(encodeString(encLatin1, t.Title, false)) > 30 ||
+		len(encodeString(encLatin1, t.Artist, false)) > 30 ||
+		len(encodeString(encLatin1, t.Album, false)) > 30
+}
+
+// Bytes encodes the tag. Text is truncated to the field widths and a TAG+
+// block is written in front of the 128 byte tag when title, artist or
+// album exceed 30 characters or extended fields are set.
+func (t *TagV1) Bytes() []byte {
+	v1 := make([]byte, v1Size)
+	copy(v1, "TAG")
+	title := putField(v1[3:33], encodeString(encLatin1, t.Title, false))
+	artist := putField(v1[33:63], encodeString(encLatin1, t.Artist, false))
+	album := putField(v1[63:93], encodeString(encLatin1, t.Album, false))
+	putField(v1[93:97], encodeString(encLatin1, t.Year, false))
+	if t.Track > 0 && t.Track < 256 {
+		putField(v1[97:125], encodeString(encLatin1, t.Comment, false))
+		v1[125], v1[126] = 0, byte(t.Track)
+	} else {
+		putField(v1[97:127], encodeString(encLatin1, t.Comment, false))
+	}
+	v1[127] = byte(t.Genre)
+	if !t.hasExt() {
+		return v1
+	}
+	ext := make([]byte, v1ExtSize)
+	copy(ext, "TAG+")
+	putField(ext[4:64], title)
+	putField(ext[64:124], artist)
+	putField(ext[124:184], album)
+	ext[184] = t.Speed
+	putField(ext[185:215], encodeString(encLatin1, t.GenreName, false))
+	putField(ext[215:221], encodeString(encLatin1, t.StartTime, false))
+	putField(ext[221:227], encodeString(encLatin1, t.EndTime, false))
+	return append(ext, v1...)
+}
+
+// Model returns an id3 model with the tag values.
+func (t *TagV1) Model() *id3model.ID3 {
+	m := &id3model.ID3{}
+	t.Merge(m)
+	return m
+}
+
+// Merge copies tag values into fields of m which are empty. It is used to
+// complete ID3v2 models with values only present in the ID3v1 tag.
+func (t *TagV1) Merge(m *id3model.ID3) {
+	if m.TitleDescription == "" {
+		m.TitleDescription = t.Title
+	}
+	if m.LeadPerformer == "" {
+		m.LeadPerformer = t.Artist
+	}
+	if m.AlbumTitle == "" {
+		m.AlbumTitle = t.Album
+	}
+	if m.Comments == "" {
+		m.Comments = t.Comment
+	}
+	if y, err := strconv.Atoi(t.Year); err == nil && modelYear(m) == 0 {
+		m.Year_v23 = y
+	}
+	if m.TrackNumber.IsZero() && t.Track > 0 {
+		m.TrackNumber = id3model.TrackNum{Track: t.Track}
+	}
+	if len(m.ContentType) == 0 {
+		m.ContentType = t.genres()
+	}
+}
+
+// genres returns the names of the v1 genre and the TAG+ genre.
+func (t *TagV1) genres() id3model.Genre {
+	l := make(id3model.Genre, 0, 2)
+	if _, ok := id3model.GenreMap[t.Genre]; ok {
+		l = append(l, t.Genre.String())
+	}
+	if t.GenreName != "" && (len(l) == 0 || l[0] != t.GenreName) {
+		l = append(l, t.GenreName)
+	}
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// modelYear returns the v2.3 year or the year of the v2.4 recording time.
+func modelYear(m *id3model.ID3) int {
+	if m.Year_v23 > 0 {
+		return m.Year_v23
+	}
+	if !m.RecordingTime.IsZero() {
+		return m.RecordingTime.Value().Year()
+	}
+	return 0
+}
+
+// SetModel overwrites tag values with the non-empty fields of m. Genres
+// that are no ID3v1 genre are stored in the TAG+ genre field.
+func (t *TagV1) SetModel(m *id3model.ID3) {
+	if m.TitleDescription != "" {
+		t.Title = m.TitleDescription
+	}
+	if m.LeadPerformer != "" {
+		t.Artist = m.LeadPerformer
+	}
+	if m.AlbumTitle != "" {
+		t.Album = m.AlbumTitle
+	}
+	if m.Comments != "" {
+		t.Comment = m.Comments
+	}
+	if y := modelYear(m); y > 0 {
+		t.Year = strconv.Itoa(y)
+	}
+	if m.TrackNumber.Track > 0 {
+		t.Track = m.TrackNumber.Track
+	}
+	if len(m.ContentType) > 0 {
+		t.Genre, t.GenreName = GenreNone, ""
+		for _, v := range m.ContentType {
+			if g, err := id3model.ParseGenreV1(v); err == nil && g.String() == v {
+				t.Genre = g
+				break
+			}
+		}
+		if t.Genre == GenreNone {
+			t.GenreName = m.ContentType[0]
+		}
+	}
+}
+
+// Conflict is a value that differs between the ID3v1 and ID3v2 tag of a
+// file. Frame is the ID3v2 frame identifier.
+type Conflict struct {
+	Frame string
+	V1    string
+	V2    string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: v1 %q, v2 %q", c.Frame, c.V1, c.V2)
+}
+
+// Reconcile compares the tag against the ID3v2 model m and returns all
+// values which are present in both but disagree. Values of m are
+// truncated to the ID3v1 field widths before comparison, so that an ID3v1
+// tag holding the shortened ID3v2 value is no conflict.
+func (t *TagV1) Reconcile(m *id3model.ID3) []Conflict {
+	l := make([]Conflict, 0)
+	check := func(frame, v1, v2 string, width int) {
+		if v1 == "" || v2 == "" {
+			return
+		}
+		if fitV1(v1, width) != fitV1(v2, width) {
+			l = append(l, Conflict{Frame: frame, V1: v1, V2: v2})
+		}
+	}
+	width := 30
+	if t.Size > v1Size {
+		width += 60
+	}
+	check("TIT2", t.Title, m.TitleDescription, width)
+	check("TPE1", t.Artist, m.LeadPerformer, width)
+	check("TALB", t.Album, m.AlbumTitle, width)
+	if t.Track > 0 {
+		check("COMM", t.Comment, m.Comments, 28)
+	} else {
+		check("COMM", t.Comment, m.Comments, 30)
+	}
+	if y := modelYear(m); y > 0 {
+		frame := "TYER"
+		if m.Year_v23 == 0 {
+			frame = "TDRC"
+		}
+		check(frame, t.Year, strconv.Itoa(y), 4)
+	}
+	if t.Track > 0 && m.TrackNumber.Track > 0 {
+		check("TRCK", strconv.Itoa(t.Track), strconv.Itoa(m.TrackNumber.Track), 3)
+	}
+	if g := t.genres(); len(g) > 0 && len(m.ContentType) > 0 {
+		var found bool
+		for _, v := range m.ContentType {
+			if strings.EqualFold(v, g[0]) {
+				found = true
+			}
+		}
+		if !found {
+			l = append(l, Conflict{Frame: "TCON", V1: g.String(), V2: m.ContentType.String()})
+		}
+	}
+	return l
+}
+
+// fitV1 returns s as it would be stored in a field of width characters.
+func fitV1(s string, width int) string {
+	b := encodeString(encLatin1, s, false)
+	if len(b) > width {
+		b = b[:width]
+	}
+	return v1String(b)
+}
+
+// Reconcile reads the ID3v1 and ID3v2 tags of r and reports conflicting
+// values. It returns no conflicts when the file lacks one of the tags.
+func Reconcile(r io.ReadSeeker) ([]Conflict, error) {
+	v1, err := ReadTagV1(r)
+	switch err {
+	case nil:
+	case io.EOF:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	t, err := ReadTag(r)
+	switch err {
+	case nil:
+	case io.EOF:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	m, err := t.Model()
+	if err != nil {
+		return nil, err
+	}
+	return v1.Reconcile(m), nil
+}
+
+// splitV1 returns a reader for the contents of r in front of an ID3v1 tag
+// and the tag, which is nil when the file has none. The position of r is
+// kept.
+func splitV1(r io.ReadSeeker) (io.Reader, *TagV1, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := ReadTagV1(r)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	if t == nil {
+		return r, nil, nil
+	}
+	return io.LimitReader(r, end-int64(t.Size)-pos), t, nil
+}
+
+// WriteTagV1 copies the file from r to w and replaces the ID3v1 tag and
+// TAG+ block at its end with t. A nil tag removes them.
+func WriteTagV1(w io.Writer, r io.ReadSeeker, t *TagV1) error {
+	src, _, err := splitV1(r)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	_, err = w.Write(t.Bytes())
+	return err
+}
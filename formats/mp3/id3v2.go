@@ -0,0 +1,389 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mp3
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	id3model "github.com/trimmer-io/go-xmp/models/id3"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var (
+	ErrInvalidTag  = errors.New("id3: invalid tag")
+	ErrUnsupported = errors.New("id3: unsupported tag version")
+)
+
+// tag header flags
+const (
+	flagUnsync    = 0x80
+	flagExtHeader = 0x40
+	flagFooter    = 0x10
+)
+
+// frame format flags in v2.3 and v2.4 layout
+const (
+	v3Compressed = 0x0080
+	v3Encrypted  = 0x0040
+	v3Grouped    = 0x0020
+	v4Grouped    = 0x0040
+	v4Compressed = 0x0008
+	v4Encrypted  = 0x0004
+	v4Unsync     = 0x0002
+	v4DataLength = 0x0001
+)
+
+// size of the ID3v2 header and footer
+const headerSize = 10
+
+// maximum tag size (28 bit syncsafe integer)
+const maxTagSize = 1<<28 - 1
+
+// Frame is a single ID3v2 frame. IDs of v2.2 tags are converted to their
+// four character v2.4 equivalent when known. Data holds the frame payload
+// after removing unsynchronisation and compression.
+type Frame struct {
+	ID   string
+	Data []byte
+}
+
+// Tag is an ID3v2 tag.
+type Tag struct {
+	Version  byte // major version 2, 3 or 4
+	Revision byte
+	Size     int // total size including header, footer and padding
+	Frames   []Frame
+}
+
+// NewTag returns an empty v2.4 tag.
+func NewTag() *Tag {
+	return &Tag{
+		Version: 4,
+		Frames:  make([]Frame, 0),
+	}
+}
+
+// Find returns the first frame with id or nil.
+func (t *Tag) Find(id string) *Frame {
+	for i := range t.Frames {
+		if t.Frames[i].ID == id {
+			return &t.Frames[i]
+		}
+	}
+	return nil
+}
+
+// FindAll returns all frames with id.
+func (t *Tag) FindAll(id string) []Frame {
+	l := make([]Frame, 0)
+	for _, v := range t.Frames {
+		if v.ID == id {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// Remove deletes all frames for which fn returns true.
+func (t *Tag) Remove(fn func(Frame) bool) {
+	l := t.Frames[:0]
+	for _, v := range t.Frames {
+		if !fn(v) {
+			l = append(l, v)
+		}
+	}
+	t.Frames = l
+}
+
+// Add appends a frame.
+func (t *Tag) Add(id string, data []byte) {
+	t.Frames = append(t.Frames, Frame{ID: id, Data: data})
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func putSyncsafe(b []byte, v int) {
+	b[0] = byte(v>>21) & 0x7f
+	b[1] = byte(v>>14) & 0x7f
+	b[2] = byte(v>>7) & 0x7f
+	b[3] = byte(v) & 0x7f
+}
+
+// removeUnsync reverts the unsynchronisation scheme by dropping zero bytes
+// inserted after 0xff.
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xff && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// ReadTag reads an ID3v2 tag from the start of r. It returns io.EOF when
+// r does not start with a tag.
+func ReadTag(r io.Reader) (*Tag, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if string(hdr[:3]) != "ID3" {
+		return nil, io.EOF
+	}
+	size := syncsafe(hdr[6:])
+	// grow the buffer while reading, the size field may claim up to 256MB
+	// in a short file
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("id3: reading tag: %v", err)
+	}
+	buf := b.Bytes()
+	t := &Tag{
+		Version:  hdr[3],
+		Revision: hdr[4],
+		Size:     headerSize + size,
+		Frames:   make([]Frame, 0),
+	}
+	flags := hdr[5]
+	if flags&flagFooter > 0 && t.Version == 4 {
+		var footer [headerSize]byte
+		if _, err := io.ReadFull(r, footer[:]); err != nil {
+			return nil, fmt.Errorf("id3: reading footer: %v", err)
+		}
+		t.Size += headerSize
+	}
+	switch t.Version {
+	case 2:
+		if flags&0x40 > 0 {
+			// v2.2 compression was never defined
+			return nil, ErrUnsupported
+		}
+	case 3, 4:
+	default:
+		return nil, ErrUnsupported
+	}
+	if flags&flagUnsync > 0 && t.Version < 4 {
+		buf = removeUnsync(buf)
+	}
+	if flags&flagExtHeader > 0 && t.Version > 2 {
+		if len(buf) < 4 {
+			return nil, ErrInvalidTag
+		}
+		n := int(binary.BigEndian.Uint32(buf)) + 4
+		if t.Version == 4 {
+			n = syncsafe(buf)
+		}
+		if n > len(buf) {
+			return nil, ErrInvalidTag
+		}
+		buf = buf[n:]
+	}
+	if err := t.readFrames(buf, flags&flagUnsync > 0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tag) readFrames(buf []byte, unsync bool) error {
+	idLen, hdrLen := 4, 10
+	if t.Version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	for len(buf) >= hdrLen && buf[0] != 0 {
+		id := string(buf[:idLen])
+		var size int
+		var flags uint16
+		switch t.Version {
+		case 2:
+			size = int(buf[3])<<16 | int(buf[4])<<8 | int(buf[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(buf[4:]))
+			flags = binary.BigEndian.Uint16(buf[8:])
+		case 4:
+			size = syncsafe(buf[4:])
+			// some writers use plain integers in v2.4 tags
+			if plain := int(binary.BigEndian.Uint32(buf[4:])); plain != size && !isFrameStart(buf, hdrLen+size) && isFrameStart(buf, hdrLen+plain) {
+				size = plain
+			}
+			flags = binary.BigEndian.Uint16(buf[8:])
+		}
+		if hdrLen+size > len(buf) {
+			return fmt.Errorf("id3: frame %s size %d exceeds tag", id, size)
+		}
+		data := buf[hdrLen : hdrLen+size]
+		buf = buf[hdrLen+size:]
+		if t.Version == 2 {
+			if v, ok := id3model.V22_TO_V24_TAGS[id]; ok {
+				id = v
+			}
+		}
+		data, err := t.decodeFrameData(id, flags, data, unsync)
+		if err != nil {
+			xmp.Log.Warnf("%v", err)
+			continue
+		}
+		t.Frames = append(t.Frames, Frame{ID: id, Data: data})
+	}
+	return nil
+}
+
+func isFrameStart(buf []byte, ofs int) bool {
+	if ofs == len(buf) || ofs < len(buf) && buf[ofs] == 0 {
+		return true
+	}
+	if ofs+4 > len(buf) {
+		return false
+	}
+	for _, c := range buf[ofs : ofs+4] {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeFrameData removes frame level unsynchronisation, grouping and
+// compression. Encrypted frames cannot be decoded and are skipped.
+func (t *Tag) decodeFrameData(id string, flags uint16, data []byte, unsync bool) ([]byte, error) {
+	var compressed bool
+	switch t.Version {
+	case 3:
+		if flags&v3Encrypted > 0 {
+			return nil, fmt.Errorf("id3: skipping encrypted frame %s", id)
+		}
+		if flags&v3Compressed > 0 {
+			if len(data) < 4 {
+				return nil, fmt.Errorf("id3: short compressed frame %s", id)
+			}
+			data = data[4:]
+			compressed = true
+		}
+		if flags&v3Grouped > 0 && len(data) > 0 {
+			data = data[1:]
+		}
+	case 4:
+		if flags&v4Encrypted > 0 {
+			return nil, fmt.Errorf("id3: skipping encrypted frame %s", id)
+		}
+		if flags&v4Grouped > 0 && len(data) > 0 {
+			data = data[1:]
+		}
+		if flags&v4DataLength > 0 && len(data) >= 4 {
+			data = data[4:]
+		}
+		if flags&v4Unsync > 0 || unsync {
+			data = removeUnsync(data)
+		}
+		compressed = flags&v4Compressed > 0
+	}
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("id3: decompressing frame %s: %v", id, err)
+		}
+		defer zr.Close()
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("id3: decompressing frame %s: %v", id, err)
+		}
+	}
+	return data, nil
+}
+
+// encodeFrames serializes all frames with v2.3 or v2.4 frame headers.
+func (t *Tag) encodeFrames() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, f := range t.Frames {
+		if len(f.ID) == 3 {
+			f = upgradeFrame(f)
+		}
+		if len(f.ID) != 4 {
+			xmp.Log.Warnf("id3: skipping frame %s without v2.%d equivalent", f.ID, t.Version)
+			continue
+		}
+		var hdr [10]byte
+		copy(hdr[:], f.ID)
+		if t.Version == 4 {
+			if len(f.Data) > maxTagSize {
+				return nil, fmt.Errorf("id3: frame %s too large", f.ID)
+			}
+			putSyncsafe(hdr[4:], len(f.Data))
+		} else {
+			binary.BigEndian.PutUint32(hdr[4:], uint32(len(f.Data)))
+		}
+		buf.Write(hdr[:])
+		buf.Write(f.Data)
+	}
+	return buf.Bytes(), nil
+}
+
+// upgradeFrame keeps v2.2 frames without v2.4 equivalent. Text and URL
+// frames are stored as user defined frames described by their v2.2 ID,
+// all other frames as PRIV frame with owner "ID3v2.2:" and their ID.
+func upgradeFrame(f Frame) Frame {
+	switch {
+	case f.ID[0] == 'T' && len(f.Data) > 0:
+		enc := f.Data[0]
+		b := append([]byte{enc}, encodeString(enc, f.ID, true)...)
+		return Frame{ID: "TXXX", Data: append(b, f.Data[1:]...)}
+	case f.ID[0] == 'W':
+		b := append([]byte{encLatin1}, encodeString(encLatin1, f.ID, true)...)
+		return Frame{ID: "WXXX", Data: append(b, f.Data...)}
+	default:
+		b := encodeString(encLatin1, "ID3v2.2:"+f.ID, true)
+		return Frame{ID: "PRIV", Data: append(b, f.Data...)}
+	}
+}
+
+// Bytes serializes the tag as v2.3 or v2.4 without unsynchronisation.
+// Tags of other versions are written as v2.4. The tag is padded with
+// zeros to its original size when possible or by padding bytes otherwise.
+func (t *Tag) Bytes(padding int) ([]byte, error) {
+	if t.Version != 3 {
+		t.Version = 4
+	}
+	frames, err := t.encodeFrames()
+	if err != nil {
+		return nil, err
+	}
+	size := headerSize + len(frames)
+	if n := t.Size - size; n > 0 {
+		padding = n
+	}
+	if size+padding-headerSize > maxTagSize {
+		return nil, fmt.Errorf("id3: tag too large")
+	}
+	b := make([]byte, size+padding)
+	copy(b, "ID3")
+	b[3] = t.Version
+	putSyncsafe(b[6:], len(b)-headerSize)
+	copy(b[headerSize:], frames)
+	return b, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package mp3 implements reading and writing of ID3v2 tags in MP3 files.
+// XMP packets are stored in a PRIV frame with owner identifier "XMP" as
+// defined by XMP Specification Part 3.
+//
+// ID3v1 and ID3v1.1 tags including the extended TAG+ block at the end of
+// the file are read when the reader is seekable. Their values complete the
+// id3 model where the ID3v2 tag has none.
+package mp3
+
+import (
+	"bufio"
+	"io"
+
+	id3model "github.com/trimmer-io/go-xmp/models/id3"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// default padding added to new or grown tags
+const defaultPadding = 1024
+
+// readTag reads the tag at the start of br or returns a new empty tag when
+// the file has none.
+func readTag(br *bufio.Reader) (*Tag, error) {
+	b, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(b) != "ID3" {
+		return NewTag(), nil
+	}
+	return ReadTag(br)
+}
+
+// ReadPacket returns the XMP packet stored in the ID3v2 tag or io.EOF when
+// the file contains no XMP.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	t, err := ReadTag(r)
+	if err != nil {
+		return nil, err
+	}
+	if b := t.Packet(); b != nil {
+		return b, nil
+	}
+	return nil, io.EOF
+}
+
+// Read decodes the XMP packet and adds a model for the ID3v2 frames which
+// takes precedence over XMP properties in the id3 namespace. When r is
+// seekable, values of an ID3v1 tag are added for frames missing in the
+// ID3v2 tag. It returns io.EOF when the file has neither tag.
+func Read(r io.Reader) (*xmp.Document, error) {
+	var v1 *TagV1
+	if rs, ok := r.(io.ReadSeeker); ok {
+		var err error
+		if _, v1, err = splitV1(rs); err != nil {
+			return nil, err
+		}
+	}
+	t, err := ReadTag(r)
+	switch {
+	case err == io.EOF && v1 != nil:
+		t = NewTag()
+	case err != nil:
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if b := t.Packet(); b != nil {
+		d = &xmp.Document{}
+		if err := xmp.Unmarshal(b, d); err != nil {
+			return nil, err
+		}
+	}
+	m, err := t.Model()
+	if err != nil {
+		return nil, err
+	}
+	if v1 != nil {
+		for _, c := range v1.Reconcile(m) {
+			xmp.Log.Debugf("id3: v1 and v2 tags disagree in %s", c)
+		}
+		v1.Merge(m)
+	}
+	if _, err := d.AddModel(m); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func writeTag(w io.Writer, br *bufio.Reader, t *Tag, v1 *TagV1) error {
+	b, err := t.Bytes(defaultPadding)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(b); err != nil {
+		return err
+	}
+	if _, err := io.Copy(bw, br); err != nil {
+		return err
+	}
+	if v1 != nil {
+		if _, err := bw.Write(v1.Bytes()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// WritePacket copies the MP3 file from r to w and stores packet in the
+// ID3v2 tag. Existing frames are kept and a v2.4 tag is created when the
+// file has none.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	br := bufio.NewReader(r)
+	t, err := readTag(br)
+	if err != nil {
+		return err
+	}
+	t.SetPacket(packet)
+	return writeTag(w, br, t, nil)
+}
+
+// Write copies the MP3 file from r to w and embeds the XMP document d.
+// When d contains an id3 model its frames replace the corresponding frames
+// of the existing tag. An existing ID3v1 tag is updated from the model
+// when r is seekable.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	m := id3model.FindModel(d)
+	var v1 *TagV1
+	if rs, ok := r.(io.ReadSeeker); ok && m != nil {
+		var err error
+		if r, v1, err = splitV1(rs); err != nil {
+			return err
+		}
+	}
+	br := bufio.NewReader(r)
+	t, err := readTag(br)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if err := m.SyncFromXMP(d); err != nil {
+			return err
+		}
+		if err := t.SetModel(m); err != nil {
+			return err
+		}
+		if v1 != nil {
+			v1.SetModel(m)
+		}
+	}
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	t.SetPacket(b)
+	return writeTag(w, br, t, v1)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// text encodings
+const (
+	encLatin1  byte = 0
+	encUTF16   byte = 1 // with BOM
+	encUTF16BE byte = 2 // v2.4 only
+	encUTF8    byte = 3 // v2.4 only
+)
+
+func isWide(enc byte) bool {
+	return enc == encUTF16 || enc == encUTF16BE
+}
+
+// decodeString converts text in encoding enc to UTF-8 and strips trailing
+// NUL characters.
+func decodeString(enc byte, b []byte) string {
+	switch enc {
+	case encUTF16, encUTF16BE:
+		var order binary.ByteOrder = binary.BigEndian
+		if enc == encUTF16 {
+			// default to little endian for broken writers without BOM
+			order = binary.LittleEndian
+		}
+		if len(b) >= 2 {
+			switch {
+			case b[0] == 0xff && b[1] == 0xfe:
+				order, b = binary.LittleEndian, b[2:]
+			case b[0] == 0xfe && b[1] == 0xff:
+				order, b = binary.BigEndian, b[2:]
+			}
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u = append(u, order.Uint16(b[i:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	case encUTF8:
+		return strings.TrimRight(string(b), "\x00")
+	default:
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return strings.TrimRight(string(r), "\x00")
+	}
+}
+
+// encodeString converts s to encoding enc, optionally adding a terminator.
+func encodeString(enc byte, s string, term bool) []byte {
+	var buf bytes.Buffer
+	switch enc {
+	case encUTF16, encUTF16BE:
+		if enc == encUTF16 {
+			buf.Write([]byte{0xff, 0xfe})
+		}
+		for _, v := range utf16.Encode([]rune(s)) {
+			if enc == encUTF16 {
+				buf.Write([]byte{byte(v), byte(v >> 8)})
+			} else {
+				buf.Write([]byte{byte(v >> 8), byte(v)})
+			}
+		}
+		if term {
+			buf.Write([]byte{0, 0})
+		}
+	case encUTF8:
+		buf.WriteString(s)
+		if term {
+			buf.WriteByte(0)
+		}
+	default:
+		for _, r := range s {
+			if r > 0xff {
+				r = '?'
+			}
+			buf.WriteByte(byte(r))
+		}
+		if term {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+// splitString returns the terminated string at the start of b and the
+// remaining bytes.
+func splitString(enc byte, b []byte) (string, []byte) {
+	if isWide(enc) {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return decodeString(enc, b[:i]), b[i+2:]
+			}
+		}
+		return decodeString(enc, b), nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return decodeString(enc, b[:i]), b[i+1:]
+	}
+	return decodeString(enc, b), nil
+}
+
+// pickEncoding selects Latin-1 when possible and a Unicode encoding
+// supported by the tag version otherwise.
+func pickEncoding(version byte, s ...string) byte {
+	for _, v := range s {
+		for _, r := range v {
+			if r > 0xff || r == utf8.RuneError {
+				if version == 4 {
+					return encUTF8
+				}
+				return encUTF16
+			}
+		}
+	}
+	return encLatin1
+}
+
+// decodeText decodes the payload of a text frame. Version 2.4 allows
+// multiple NUL separated values.
+func decodeText(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	enc, b := b[0], b[1:]
+	l := make([]string, 0, 1)
+	for len(b) > 0 {
+		var s string
+		s, b = splitString(enc, b)
+		l = append(l, s)
+	}
+	// drop empty trailing values from terminated strings
+	for len(l) > 1 && l[len(l)-1] == "" {
+		l = l[:len(l)-1]
+	}
+	return l
+}
+
+// encodeText creates the payload of a text frame.
+func encodeText(version byte, s string) []byte {
+	enc := pickEncoding(version, s)
+	return append([]byte{enc}, encodeString(enc, s, false)...)
+}
@@ -0,0 +1,568 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// xref entry types
+const (
+	xrefFree       = 0
+	xrefInUse      = 1
+	xrefCompressed = 2
+)
+
+type xrefEntry struct {
+	Type   int
+	Offset int64 // file offset or object stream number
+	Gen    int   // generation or index in object stream
+}
+
+// file gives access to the objects of a PDF file through its cross
+// reference sections.
+type file struct {
+	r          io.ReadSeeker
+	size       int64
+	version    string
+	startxref  int64 // offset of the newest xref section
+	xrefStream bool  // newest xref section is a stream
+	trailer    dict  // newest trailer
+	xref       map[int]xrefEntry
+	objStms    map[int][]object
+	loading    map[int]bool // object streams currently being loaded
+}
+
+// maximum size of a single object or xref section buffer
+const maxObjectSize = 64 << 20
+
+func (f *file) readAt(off int64, n int) ([]byte, error) {
+	if off+int64(n) > f.size {
+		n = int(f.size - off)
+	}
+	if n <= 0 {
+		return nil, io.EOF
+	}
+	if _, err := f.r.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(f.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseAt runs fn on a lexer positioned at off and grows the buffer until
+// fn no longer fails with errShort.
+func (f *file) parseAt(off int64, fn func(l *lexer) error) error {
+	for n := 4096; ; n *= 4 {
+		b, err := f.readAt(off, n)
+		if err != nil {
+			return err
+		}
+		l := &lexer{b: b, final: off+int64(len(b)) >= f.size || n >= maxObjectSize}
+		if err := fn(l); err != errShort {
+			return err
+		}
+	}
+}
+
+// openFile reads the header and all cross reference sections.
+func openFile(r io.ReadSeeker) (*file, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	f := &file{
+		r:       r,
+		size:    size,
+		xref:    make(map[int]xrefEntry),
+		objStms: make(map[int][]object),
+		loading: make(map[int]bool),
+	}
+	hdr, err := f.readAt(0, 1024)
+	if err != nil {
+		return nil, ErrInvalidFile
+	}
+	i := bytes.Index(hdr, []byte("%PDF-"))
+	if i < 0 {
+		return nil, ErrInvalidFile
+	}
+	if j := bytes.IndexAny(hdr[i+5:], "\r\n "); j > 0 {
+		f.version = string(hdr[i+5 : i+5+j])
+	}
+	if f.startxref, err = f.findStartxref(); err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]bool)
+	for off := f.startxref; off >= 0; {
+		if seen[off] {
+			return nil, fmt.Errorf("pdf: xref loop at offset %d", off)
+		}
+		seen[off] = true
+		trailer, isStream, err := f.readXref(off)
+		if err != nil {
+			return nil, err
+		}
+		if f.trailer == nil {
+			f.trailer = trailer
+			f.xrefStream = isStream
+		}
+		// hybrid files reference an additional xref stream
+		if x, ok := trailer["XRefStm"].(int64); ok && !seen[x] {
+			seen[x] = true
+			if _, _, err := f.readXref(x); err != nil {
+				return nil, err
+			}
+		}
+		off = -1
+		if prev, ok := trailer["Prev"].(int64); ok {
+			off = prev
+		}
+	}
+	return f, nil
+}
+
+// findStartxref returns the offset stored after the last startxref
+// keyword.
+func (f *file) findStartxref() (int64, error) {
+	n := int64(1024)
+	if n > f.size {
+		n = f.size
+	}
+	b, err := f.readAt(f.size-n, int(n))
+	if err != nil {
+		return 0, err
+	}
+	i := bytes.LastIndex(b, []byte("startxref"))
+	if i < 0 {
+		return 0, fmt.Errorf("pdf: missing startxref")
+	}
+	l := &lexer{b: b[i+9:], final: true}
+	t, err := l.token()
+	if err != nil {
+		return 0, err
+	}
+	off, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || off < 0 || off >= f.size {
+		return 0, fmt.Errorf("pdf: invalid startxref %q", t)
+	}
+	return off, nil
+}
+
+// addEntry records an xref entry unless a newer section already defined
+// the object.
+func (f *file) addEntry(num int, e xrefEntry) {
+	if _, ok := f.xref[num]; !ok {
+		f.xref[num] = e
+	}
+}
+
+// readXref reads a classic xref table or an xref stream at off.
+func (f *file) readXref(off int64) (dict, bool, error) {
+	var trailer dict
+	var isTable bool
+	err := f.parseAt(off, func(l *lexer) error {
+		t, err := l.token()
+		if err != nil {
+			return err
+		}
+		if t != "xref" {
+			return nil
+		}
+		isTable = true
+		entries := make(map[int]xrefEntry)
+		for {
+			t, err := l.token()
+			if err != nil {
+				return err
+			}
+			if t == "trailer" {
+				break
+			}
+			start, err := strconv.Atoi(t)
+			if err != nil {
+				return fmt.Errorf("pdf: invalid xref subsection %q", t)
+			}
+			t, err = l.token()
+			if err != nil {
+				return err
+			}
+			count, err := strconv.Atoi(t)
+			if err != nil {
+				return fmt.Errorf("pdf: invalid xref subsection count %q", t)
+			}
+			for i := 0; i < count; i++ {
+				var v [3]string
+				for j := range v {
+					if v[j], err = l.token(); err != nil {
+						return err
+					}
+				}
+				ofs, _ := strconv.ParseInt(v[0], 10, 64)
+				gen, _ := strconv.Atoi(v[1])
+				e := xrefEntry{Type: xrefFree, Offset: ofs, Gen: gen}
+				if v[2] == "n" {
+					e.Type = xrefInUse
+				}
+				entries[start+i] = e
+			}
+		}
+		v, err := l.object()
+		if err != nil {
+			return err
+		}
+		d, ok := v.(dict)
+		if !ok {
+			return fmt.Errorf("pdf: invalid trailer")
+		}
+		for k, e := range entries {
+			f.addEntry(k, e)
+		}
+		trailer = d
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if isTable {
+		return trailer, false, nil
+	}
+	_, v, err := f.readObjectAt(off)
+	if err != nil {
+		return nil, false, err
+	}
+	s, ok := v.(*stream)
+	if !ok || s.Dict["Type"] != name("XRef") {
+		return nil, false, fmt.Errorf("pdf: invalid xref at offset %d", off)
+	}
+	if err := f.readXrefStream(s); err != nil {
+		return nil, false, err
+	}
+	return s.Dict, true, nil
+}
+
+func (f *file) readXrefStream(s *stream) error {
+	data, err := s.decode()
+	if err != nil {
+		return err
+	}
+	w, ok := s.Dict["W"].(array)
+	if !ok || len(w) != 3 {
+		return fmt.Errorf("pdf: invalid xref stream /W")
+	}
+	var widths [3]int
+	var rowLen int
+	for i, v := range w {
+		n, _ := v.(int64)
+		widths[i] = int(n)
+		rowLen += int(n)
+	}
+	if rowLen == 0 {
+		return fmt.Errorf("pdf: invalid xref stream /W")
+	}
+	index, ok := s.Dict["Index"].(array)
+	if !ok {
+		size, _ := s.Dict["Size"].(int64)
+		index = array{int64(0), size}
+	}
+	field := func(b []byte, n int, def int64) int64 {
+		if n == 0 {
+			return def
+		}
+		var v int64
+		for _, c := range b[:n] {
+			v = v<<8 | int64(c)
+		}
+		return v
+	}
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := index[i].(int64)
+		count, _ := index[i+1].(int64)
+		for j := int64(0); j < count; j++ {
+			if len(data) < rowLen {
+				return fmt.Errorf("pdf: short xref stream")
+			}
+			row := data[:rowLen]
+			data = data[rowLen:]
+			typ := field(row, widths[0], 1)
+			row = row[widths[0]:]
+			v1 := field(row, widths[1], 0)
+			row = row[widths[1]:]
+			v2 := field(row, widths[2], 0)
+			f.addEntry(int(start+j), xrefEntry{Type: int(typ), Offset: v1, Gen: int(v2)})
+		}
+	}
+	return nil
+}
+
+// readObjectAt parses the indirect object at off.
+func (f *file) readObjectAt(off int64) (ref, object, error) {
+	var r ref
+	var v object
+	var dataStart int64
+	var isStream bool
+	err := f.parseAt(off, func(l *lexer) error {
+		var err error
+		var t [3]string
+		for i := range t {
+			if t[i], err = l.token(); err != nil {
+				return err
+			}
+		}
+		num, err1 := strconv.Atoi(t[0])
+		gen, err2 := strconv.Atoi(t[1])
+		if err1 != nil || err2 != nil || t[2] != "obj" {
+			return fmt.Errorf("pdf: no object at offset %d", off)
+		}
+		r = ref{num, gen}
+		if v, err = l.object(); err != nil {
+			return err
+		}
+		if _, ok := v.(dict); ok {
+			if isStream, err = l.streamStart(); err != nil {
+				return err
+			}
+			dataStart = off + int64(l.pos)
+		}
+		return nil
+	})
+	if err != nil || !isStream {
+		return r, v, err
+	}
+	d := v.(dict)
+	length, err := f.resolve(d["Length"])
+	if err != nil {
+		return r, nil, err
+	}
+	n, ok := length.(int64)
+	if !ok || n < 0 || dataStart+n > f.size {
+		return r, nil, fmt.Errorf("pdf: invalid stream length in object %d", r.Num)
+	}
+	data := []byte{}
+	if n > 0 {
+		if data, err = f.readAt(dataStart, int(n)); err != nil {
+			return r, nil, err
+		}
+	}
+	return r, &stream{Dict: d, Data: data}, nil
+}
+
+// resolve loads the object v refers to or returns v when it is a direct
+// object.
+func (f *file) resolve(v object) (object, error) {
+	r, ok := v.(ref)
+	if !ok {
+		return v, nil
+	}
+	e, ok := f.xref[r.Num]
+	if !ok {
+		return nil, nil
+	}
+	switch e.Type {
+	case xrefInUse:
+		x, v, err := f.readObjectAt(e.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if x.Num != r.Num {
+			return nil, fmt.Errorf("pdf: object %d not found at offset %d", r.Num, e.Offset)
+		}
+		return v, nil
+	case xrefCompressed:
+		l, err := f.objectStream(int(e.Offset))
+		if err != nil {
+			return nil, err
+		}
+		if e.Gen >= len(l) {
+			return nil, fmt.Errorf("pdf: object %d not found in object stream", r.Num)
+		}
+		return l[e.Gen], nil
+	}
+	return nil, nil
+}
+
+// objectStream loads all objects stored in object stream num.
+func (f *file) objectStream(num int) ([]object, error) {
+	if l, ok := f.objStms[num]; ok {
+		return l, nil
+	}
+	// an object stream stored inside itself or in a stream that refers
+	// back to it would recurse forever
+	if f.loading[num] {
+		return nil, fmt.Errorf("pdf: circular reference to object stream %d", num)
+	}
+	f.loading[num] = true
+	defer delete(f.loading, num)
+	v, err := f.resolve(ref{Num: num})
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(*stream)
+	if !ok {
+		return nil, fmt.Errorf("pdf: invalid object stream %d", num)
+	}
+	data, err := s.decode()
+	if err != nil {
+		return nil, err
+	}
+	n, _ := s.Dict["N"].(int64)
+	first, _ := s.Dict["First"].(int64)
+	if first < 0 || first > int64(len(data)) {
+		return nil, fmt.Errorf("pdf: invalid object stream %d", num)
+	}
+	// each object takes at least two numbers in the header
+	if n < 0 || n > first/2 {
+		return nil, fmt.Errorf("pdf: invalid object count %d in object stream %d", n, num)
+	}
+	hdr := &lexer{b: data[:first], final: true}
+	l := make([]object, 0, n)
+	for i := int64(0); i < n; i++ {
+		if _, err := hdr.object(); err != nil {
+			return nil, err
+		}
+		ofs, err := hdr.object()
+		if err != nil {
+			return nil, err
+		}
+		pos, _ := ofs.(int64)
+		if first+pos > int64(len(data)) {
+			return nil, fmt.Errorf("pdf: invalid object stream %d", num)
+		}
+		v, err := (&lexer{b: data[first+pos:], final: true}).object()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+	f.objStms[num] = l
+	return l, nil
+}
+
+// decode returns the stream data after applying its filters. Only Flate
+// with optional PNG predictors is supported.
+func (s *stream) decode() ([]byte, error) {
+	filters := make([]object, 0)
+	params := make([]object, 0)
+	switch x := s.Dict["Filter"].(type) {
+	case name:
+		filters = append(filters, x)
+		params = append(params, s.Dict["DecodeParms"])
+	case array:
+		filters = x
+		if p, ok := s.Dict["DecodeParms"].(array); ok {
+			params = p
+		}
+	}
+	data := s.Data
+	for i, v := range filters {
+		if v != name("FlateDecode") {
+			return nil, fmt.Errorf("pdf: unsupported filter %v", v)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("pdf: flate: %v", err)
+		}
+		data, err = ioutil.ReadAll(zr)
+		zr.Close()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("pdf: flate: %v", err)
+		}
+		if i < len(params) {
+			if p, ok := params[i].(dict); ok {
+				if data, err = unpredict(data, p); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return data, nil
+}
+
+// unpredict reverts PNG predictors used by xref and object streams.
+func unpredict(data []byte, p dict) ([]byte, error) {
+	pred, _ := p["Predictor"].(int64)
+	if pred < 10 {
+		if pred > 1 {
+			return nil, fmt.Errorf("pdf: unsupported predictor %d", pred)
+		}
+		return data, nil
+	}
+	cols, ok := p["Columns"].(int64)
+	if !ok || cols <= 0 {
+		cols = 1
+	}
+	colors, ok := p["Colors"].(int64)
+	if !ok || colors <= 0 {
+		colors = 1
+	}
+	bpc, ok := p["BitsPerComponent"].(int64)
+	if !ok || bpc <= 0 {
+		bpc = 8
+	}
+	bpp := int((colors*bpc + 7) / 8)
+	rowLen := int((cols*colors*bpc + 7) / 8)
+	out := make([]byte, 0, len(data))
+	prev := make([]byte, rowLen)
+	for len(data) >= rowLen+1 {
+		typ, row := data[0], append([]byte{}, data[1:rowLen+1]...)
+		data = data[rowLen+1:]
+		for i := range row {
+			var a, c byte
+			if i >= bpp {
+				a, c = row[i-bpp], prev[i-bpp]
+			}
+			b := prev[i]
+			switch typ {
+			case 1:
+				row[i] += a
+			case 2:
+				row[i] += b
+			case 3:
+				row[i] += byte((int(a) + int(b)) / 2)
+			case 4:
+				row[i] += paeth(a, b, c)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
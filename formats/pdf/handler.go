@@ -0,0 +1,68 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pdf
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// handler is the PDF file format handler. The registered handler only
+// updates the metadata stream, handlers created with syncInfo set also
+// update the document information dictionary.
+type handler struct {
+	syncInfo bool
+}
+
+// NewHandler returns a PDF file format handler. With syncInfo set writes
+// also update the document information dictionary from the dc, xmp and
+// pdf properties like WriteWithInfo does.
+func NewHandler(syncInfo bool) xmp.FileHandler {
+	return handler{syncInfo: syncInfo}
+}
+
+func (handler) CanHandle(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("%PDF-"))
+}
+
+func (handler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	return Read(r)
+}
+
+func (h handler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	f, ok := w.(io.ReadWriteSeeker)
+	if !ok {
+		return xmp.ErrNotSeekable
+	}
+	if h.syncInfo {
+		return WriteWithInfo(f, d)
+	}
+	return Write(f, d)
+}
+
+func (handler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite | xmp.CapInPlace | xmp.CapNative
+}
+
+func init() {
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name:       "pdf",
+		Extensions: []string{".pdf"},
+		Magic:      []xmp.Magic{{Offset: 0, Value: []byte("%PDF-")}},
+		Handler:    handler{},
+	})
+}
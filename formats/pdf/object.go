@@ -0,0 +1,434 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// PDF object types. Strings are kept as raw bytes, integers as int64 and
+// real numbers as float64. Booleans map to bool and null to nil.
+type (
+	object interface{}
+	name   string
+	array  []object
+	dict   map[name]object
+	ref    struct{ Num, Gen int }
+)
+
+// stream is a stream object with its still encoded data.
+type stream struct {
+	Dict dict
+	Data []byte
+}
+
+// keyword is a bare token like obj, endobj, stream or R.
+type keyword string
+
+// errShort signals that the lexer ran out of input before the object was
+// complete. Callers retry with a larger buffer.
+var errShort = errors.New("pdf: short buffer")
+
+func isSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isDelim(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// lexer tokenizes PDF syntax. When final is false the buffer may end in
+// the middle of an object and lexing fails with errShort.
+type lexer struct {
+	b     []byte
+	pos   int
+	final bool
+}
+
+func (l *lexer) short() error {
+	if l.final {
+		return fmt.Errorf("pdf: unexpected end of file")
+	}
+	return errShort
+}
+
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		switch {
+		case isSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.b) && l.b[l.pos] != '\r' && l.b[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token returns the next regular token without interpreting it.
+func (l *lexer) token() (string, error) {
+	l.skipSpace()
+	start := l.pos
+	for l.pos < len(l.b) && !isSpace(l.b[l.pos]) && !isDelim(l.b[l.pos]) {
+		l.pos++
+	}
+	if l.pos == len(l.b) && !l.final {
+		return "", errShort
+	}
+	if start == l.pos {
+		return "", fmt.Errorf("pdf: unexpected character at offset %d", l.pos)
+	}
+	return string(l.b[start:l.pos]), nil
+}
+
+// expect consumes keyword kw.
+func (l *lexer) expect(kw string) error {
+	t, err := l.token()
+	if err != nil {
+		return err
+	}
+	if t != kw {
+		return fmt.Errorf("pdf: expected %s, got %s", kw, t)
+	}
+	return nil
+}
+
+func (l *lexer) object() (object, error) {
+	l.skipSpace()
+	if l.pos >= len(l.b) {
+		return nil, l.short()
+	}
+	switch c := l.b[l.pos]; c {
+	case '/':
+		l.pos++
+		return l.name()
+	case '(':
+		l.pos++
+		return l.literal()
+	case '<':
+		if l.pos+1 >= len(l.b) {
+			return nil, l.short()
+		}
+		if l.b[l.pos+1] == '<' {
+			l.pos += 2
+			return l.dict()
+		}
+		l.pos++
+		return l.hex()
+	case '[':
+		l.pos++
+		var a array
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.b) {
+				return nil, l.short()
+			}
+			if l.b[l.pos] == ']' {
+				l.pos++
+				return a, nil
+			}
+			v, err := l.object()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+	case ')', '>', ']', '{', '}':
+		return nil, fmt.Errorf("pdf: unexpected %c at offset %d", c, l.pos)
+	}
+	t, err := l.token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+		// look ahead for an indirect reference "num gen R"
+		save := l.pos
+		if g, err := l.token(); err == nil {
+			if gen, err := strconv.Atoi(g); err == nil {
+				if r, err := l.token(); err == nil && r == "R" {
+					return ref{Num: int(i), Gen: gen}, nil
+				} else if err == errShort {
+					return nil, err
+				}
+			}
+		} else if err == errShort {
+			return nil, err
+		}
+		l.pos = save
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(t, 64); err == nil {
+		return f, nil
+	}
+	return keyword(t), nil
+}
+
+func unhex(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
+
+func (l *lexer) name() (object, error) {
+	var buf bytes.Buffer
+	for ; l.pos < len(l.b); l.pos++ {
+		c := l.b[l.pos]
+		if isSpace(c) || isDelim(c) {
+			return name(buf.String()), nil
+		}
+		if c == '#' && l.pos+2 < len(l.b) && unhex(l.b[l.pos+1]) >= 0 && unhex(l.b[l.pos+2]) >= 0 {
+			buf.WriteByte(byte(unhex(l.b[l.pos+1])<<4 | unhex(l.b[l.pos+2])))
+			l.pos += 2
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	if !l.final {
+		return nil, errShort
+	}
+	return name(buf.String()), nil
+}
+
+func (l *lexer) literal() (object, error) {
+	var buf bytes.Buffer
+	depth := 1
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return buf.Bytes(), nil
+			}
+		case '\\':
+			if l.pos >= len(l.b) {
+				return nil, l.short()
+			}
+			c = l.b[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// line continuation
+				if l.pos < len(l.b) && l.b[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for i := 0; i < 2 && l.pos < len(l.b) && l.b[l.pos] >= '0' && l.b[l.pos] <= '7'; i++ {
+						v = v<<3 | int(l.b[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				}
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return nil, l.short()
+}
+
+func (l *lexer) hex() (object, error) {
+	var buf bytes.Buffer
+	hi := -1
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		l.pos++
+		if c == '>' {
+			if hi >= 0 {
+				buf.WriteByte(byte(hi << 4))
+			}
+			return buf.Bytes(), nil
+		}
+		v := unhex(c)
+		if v < 0 {
+			continue
+		}
+		if hi < 0 {
+			hi = v
+		} else {
+			buf.WriteByte(byte(hi<<4 | v))
+			hi = -1
+		}
+	}
+	return nil, l.short()
+}
+
+func (l *lexer) dict() (object, error) {
+	d := make(dict)
+	for {
+		l.skipSpace()
+		if l.pos+1 >= len(l.b) {
+			return nil, l.short()
+		}
+		if l.b[l.pos] == '>' && l.b[l.pos+1] == '>' {
+			l.pos += 2
+			return d, nil
+		}
+		k, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(name)
+		if !ok {
+			return nil, fmt.Errorf("pdf: invalid dictionary key %v", k)
+		}
+		v, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		d[key] = v
+	}
+}
+
+// streamStart consumes the stream keyword and the following end of line
+// marker. It returns false when no stream follows.
+func (l *lexer) streamStart() (bool, error) {
+	l.skipSpace()
+	if len(l.b)-l.pos < 8 && !l.final {
+		return false, errShort
+	}
+	if !bytes.HasPrefix(l.b[l.pos:], []byte("stream")) {
+		return false, nil
+	}
+	l.pos += 6
+	if l.pos < len(l.b) && l.b[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos < len(l.b) && l.b[l.pos] == '\n' {
+		l.pos++
+	}
+	return true, nil
+}
+
+// writeObject serializes v in PDF syntax.
+func writeObject(buf *bytes.Buffer, v object) {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(x))
+	case int:
+		buf.WriteString(strconv.Itoa(x))
+	case int64:
+		buf.WriteString(strconv.FormatInt(x, 10))
+	case float64:
+		buf.WriteString(strconv.FormatFloat(x, 'f', -1, 64))
+	case name:
+		buf.WriteByte('/')
+		for i := 0; i < len(x); i++ {
+			c := x[i]
+			if c < '!' || c > '~' || c == '#' || isDelim(c) {
+				fmt.Fprintf(buf, "#%02X", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	case []byte:
+		writeString(buf, x)
+	case keyword:
+		buf.WriteString(string(x))
+	case ref:
+		fmt.Fprintf(buf, "%d %d R", x.Num, x.Gen)
+	case array:
+		buf.WriteByte('[')
+		for i, e := range x {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			writeObject(buf, e)
+		}
+		buf.WriteByte(']')
+	case dict:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		buf.WriteString("<<")
+		for _, k := range keys {
+			buf.WriteByte(' ')
+			writeObject(buf, name(k))
+			buf.WriteByte(' ')
+			writeObject(buf, x[name(k)])
+		}
+		buf.WriteString(" >>")
+	default:
+		panic(fmt.Errorf("pdf: cannot serialize %T", v))
+	}
+}
+
+// writeString writes printable strings as literal and all others as hex
+// string.
+func writeString(buf *bytes.Buffer, b []byte) {
+	for _, c := range b {
+		if c < ' ' || c > '~' {
+			fmt.Fprintf(buf, "<%X>", b)
+			return
+		}
+	}
+	buf.WriteByte('(')
+	for _, c := range b {
+		if c == '(' || c == ')' || c == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	}
+	buf.WriteByte(')')
+}
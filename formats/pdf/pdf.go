@@ -0,0 +1,538 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package pdf implements reading and writing of the document level XMP
+// metadata stream in PDF files as defined by XMP Specification Part 3.
+//
+// Files are never rewritten. Changes are appended as incremental update
+// which keeps existing digital signatures valid.
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	pdfmodel "github.com/trimmer-io/go-xmp/models/pdf"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var (
+	ErrInvalidFile = errors.New("pdf: invalid file format")
+	ErrEncrypted   = errors.New("pdf: encrypted files are not supported")
+)
+
+func (f *file) catalog() (dict, error) {
+	v, err := f.resolve(f.trailer["Root"])
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(dict)
+	if !ok {
+		return nil, fmt.Errorf("pdf: missing document catalog")
+	}
+	return d, nil
+}
+
+// checkEncrypt fails for encrypted files unless the metadata stream is
+// stored in plain text and write is false.
+func (f *file) checkEncrypt(write bool) error {
+	v, ok := f.trailer["Encrypt"]
+	if !ok {
+		return nil
+	}
+	if write {
+		return ErrEncrypted
+	}
+	e, err := f.resolve(v)
+	if err != nil {
+		return err
+	}
+	if d, ok := e.(dict); ok && d["EncryptMetadata"] == false {
+		return nil
+	}
+	return ErrEncrypted
+}
+
+// ReadPacket returns the XMP packet from the metadata stream referenced by
+// the document catalog or io.EOF when the file contains no XMP.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	f, err := openFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.readPacket()
+}
+
+func (f *file) readPacket() ([]byte, error) {
+	if err := f.checkEncrypt(false); err != nil {
+		return nil, err
+	}
+	cat, err := f.catalog()
+	if err != nil {
+		return nil, err
+	}
+	v, err := f.resolve(cat["Metadata"])
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(*stream)
+	if !ok {
+		return nil, io.EOF
+	}
+	return s.decode()
+}
+
+// ReadInfo decodes the document information dictionary or returns io.EOF
+// when the file has none.
+func ReadInfo(r io.ReadSeeker) (*pdfmodel.PDFInfo, error) {
+	f, err := openFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.readInfo()
+}
+
+func (f *file) readInfo() (*pdfmodel.PDFInfo, error) {
+	v, err := f.resolve(f.trailer["Info"])
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(dict)
+	if !ok {
+		return nil, io.EOF
+	}
+	m := &pdfmodel.PDFInfo{PDFVersion: f.version}
+	if cat, err := f.catalog(); err == nil {
+		if v, ok := cat["Version"].(name); ok && string(v) > f.version {
+			m.PDFVersion = string(v)
+		}
+	}
+	text := func(key name) string {
+		if v, err := f.resolve(d[key]); err == nil {
+			if b, ok := v.([]byte); ok {
+				return decodeText(b)
+			}
+		}
+		return ""
+	}
+	date := func(key name) xmp.Date {
+		t, _ := parseDate(text(key))
+		return t
+	}
+	if s := text("Title"); s != "" {
+		m.Title = xmp.NewAltString(s)
+	}
+	if s := text("Author"); s != "" {
+		for _, v := range strings.Split(s, ";") {
+			if v = strings.TrimSpace(v); v != "" {
+				m.Author = append(m.Author, v)
+			}
+		}
+	}
+	if s := text("Subject"); s != "" {
+		m.Subject = xmp.NewAltString(s)
+	}
+	m.Keywords = text("Keywords")
+	m.Creator = xmp.AgentName(text("Creator"))
+	m.Producer = xmp.AgentName(text("Producer"))
+	m.CreationDate = date("CreationDate")
+	m.ModifyDate = date("ModDate")
+	m.Trapped = xmp.Bool(d["Trapped"] == name("True"))
+	return m, nil
+}
+
+// Read decodes the XMP packet and fills properties missing from XMP with
+// values from the document information dictionary. It returns io.EOF when
+// the file contains neither.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	f, err := openFile(r)
+	if err != nil {
+		return nil, err
+	}
+	var d *xmp.Document
+	b, err := f.readPacket()
+	switch err {
+	case nil:
+		d = &xmp.Document{}
+		if err := xmp.Unmarshal(b, d); err != nil {
+			return nil, err
+		}
+	case io.EOF:
+		d = xmp.NewDocument()
+	default:
+		return nil, err
+	}
+	info, err := f.readInfo()
+	switch err {
+	case nil:
+	case io.EOF:
+		if b == nil {
+			return nil, io.EOF
+		}
+		return d, nil
+	default:
+		return nil, err
+	}
+	if err := info.SyncToXMP(d); err != nil {
+		return nil, err
+	}
+	m, err := pdfmodel.MakeModel(d)
+	if err != nil {
+		return nil, err
+	}
+	if m.Keywords == "" {
+		m.Keywords = info.Keywords
+	}
+	if m.Producer == "" {
+		m.Producer = info.Producer
+	}
+	if m.PDFVersion == "" {
+		m.PDFVersion = info.PDFVersion
+	}
+	if !m.Trapped {
+		m.Trapped = info.Trapped
+	}
+	return d, nil
+}
+
+// update collects the objects of an incremental update.
+type update struct {
+	f       *file
+	size    int // next free object number
+	objects map[ref]object
+}
+
+func (u *update) add(r ref, v object) {
+	u.objects[r] = v
+}
+
+// newRef returns v when it is a reference or allocates a new object
+// number otherwise.
+func (u *update) newRef(v object) ref {
+	if r, ok := v.(ref); ok {
+		return r
+	}
+	r := ref{Num: u.size}
+	u.size++
+	return r
+}
+
+// Update appends an incremental update to f that stores packet in the
+// document metadata stream and, when info is not nil, merges info into
+// the document information dictionary.
+func Update(f io.ReadWriteSeeker, packet []byte, info *pdfmodel.PDFInfo) error {
+	x, err := openFile(f)
+	if err != nil {
+		return err
+	}
+	if err := x.checkEncrypt(true); err != nil {
+		return err
+	}
+	size, _ := x.trailer["Size"].(int64)
+	u := &update{f: x, size: int(size), objects: make(map[ref]object)}
+	root, ok := x.trailer["Root"].(ref)
+	if !ok {
+		return fmt.Errorf("pdf: missing document catalog")
+	}
+	cat, err := x.catalog()
+	if err != nil {
+		return err
+	}
+	meta := u.newRef(cat["Metadata"])
+	if _, ok := cat["Metadata"].(ref); !ok {
+		c := make(dict, len(cat)+1)
+		for k, v := range cat {
+			c[k] = v
+		}
+		c["Metadata"] = meta
+		u.add(root, c)
+	}
+	u.add(meta, &stream{
+		Dict: dict{"Type": name("Metadata"), "Subtype": name("XML")},
+		Data: packet,
+	})
+	trailer := dict{"Root": root}
+	for _, k := range []name{"Info", "ID"} {
+		if v, ok := x.trailer[k]; ok {
+			trailer[k] = v
+		}
+	}
+	if info != nil {
+		old, err := x.resolve(x.trailer["Info"])
+		if err != nil {
+			return err
+		}
+		d, _ := old.(dict)
+		r := u.newRef(x.trailer["Info"])
+		u.add(r, encodeInfo(d, info))
+		trailer["Info"] = r
+	}
+	return u.write(f, trailer)
+}
+
+// write appends all objects, a cross reference section of the same kind
+// as the previous one and the trailer.
+func (u *update) write(f io.ReadWriteSeeker, trailer dict) error {
+	var buf bytes.Buffer
+	if b, err := u.f.readAt(u.f.size-1, 1); err == nil && b[0] != '\n' && b[0] != '\r' {
+		buf.WriteByte('\n')
+	}
+	refs := make([]ref, 0, len(u.objects))
+	for r := range u.objects {
+		refs = append(refs, r)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Num < refs[j].Num })
+	offsets := make(map[ref]int64)
+	for _, r := range refs {
+		offsets[r] = u.f.size + int64(buf.Len())
+		writeIndirect(&buf, r, u.objects[r])
+	}
+	trailer["Prev"] = u.f.startxref
+	xrefOffset := u.f.size + int64(buf.Len())
+	if u.f.xrefStream {
+		r := ref{Num: u.size}
+		u.size++
+		refs = append(refs, r)
+		offsets[r] = xrefOffset
+		trailer["Type"] = name("XRef")
+		trailer["Size"] = int64(u.size)
+		trailer["W"] = array{int64(1), int64(4), int64(2)}
+		if xrefOffset > 0xffffffff {
+			trailer["W"] = array{int64(1), int64(8), int64(2)}
+		}
+		var index array
+		var data bytes.Buffer
+		for _, run := range runs(refs) {
+			index = append(index, int64(run[0].Num), int64(len(run)))
+			for _, r := range run {
+				data.WriteByte(xrefInUse)
+				ofs := offsets[r]
+				if xrefOffset > 0xffffffff {
+					data.Write([]byte{byte(ofs >> 56), byte(ofs >> 48), byte(ofs >> 40), byte(ofs >> 32)})
+				}
+				data.Write([]byte{byte(ofs >> 24), byte(ofs >> 16), byte(ofs >> 8), byte(ofs)})
+				data.Write([]byte{byte(r.Gen >> 8), byte(r.Gen)})
+			}
+		}
+		trailer["Index"] = index
+		writeIndirect(&buf, r, &stream{Dict: trailer, Data: data.Bytes()})
+	} else {
+		trailer["Size"] = int64(u.size)
+		buf.WriteString("xref\n")
+		for _, run := range runs(refs) {
+			fmt.Fprintf(&buf, "%d %d\n", run[0].Num, len(run))
+			for _, r := range run {
+				fmt.Fprintf(&buf, "%010d %05d n\r\n", offsets[r], r.Gen)
+			}
+		}
+		buf.WriteString("trailer\n")
+		writeObject(&buf, trailer)
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&buf, "startxref\n%d\n%%%%EOF\n", xrefOffset)
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err := f.Write(buf.Bytes())
+	return err
+}
+
+// runs splits sorted references into runs of consecutive object numbers.
+func runs(refs []ref) [][]ref {
+	var l [][]ref
+	for i, r := range refs {
+		if i == 0 || r.Num != refs[i-1].Num+1 {
+			l = append(l, nil)
+		}
+		l[len(l)-1] = append(l[len(l)-1], r)
+	}
+	return l
+}
+
+func writeIndirect(buf *bytes.Buffer, r ref, v object) {
+	fmt.Fprintf(buf, "%d %d obj\n", r.Num, r.Gen)
+	if s, ok := v.(*stream); ok {
+		s.Dict["Length"] = int64(len(s.Data))
+		writeObject(buf, s.Dict)
+		buf.WriteString("\nstream\n")
+		buf.Write(s.Data)
+		buf.WriteString("\nendstream")
+	} else {
+		writeObject(buf, v)
+	}
+	buf.WriteString("\nendobj\n")
+}
+
+// encodeInfo merges non-empty fields of m into a copy of the information
+// dictionary d.
+func encodeInfo(d dict, m *pdfmodel.PDFInfo) dict {
+	out := make(dict, len(d))
+	for k, v := range d {
+		out[k] = v
+	}
+	set := func(key name, s string) {
+		if s != "" {
+			out[key] = encodeText(s)
+		}
+	}
+	set("Title", m.Title.Default())
+	set("Author", strings.Join(m.Author, "; "))
+	set("Subject", m.Subject.Default())
+	set("Keywords", m.Keywords)
+	set("Creator", string(m.Creator))
+	set("Producer", string(m.Producer))
+	if !m.CreationDate.IsZero() {
+		set("CreationDate", formatDate(m.CreationDate))
+	}
+	if !m.ModifyDate.IsZero() {
+		set("ModDate", formatDate(m.ModifyDate))
+	}
+	if m.Trapped {
+		out["Trapped"] = name("True")
+	}
+	return out
+}
+
+// WritePacket stores packet in the metadata stream of f.
+func WritePacket(f io.ReadWriteSeeker, packet []byte) error {
+	return Update(f, packet, nil)
+}
+
+// Write embeds the XMP document d into f.
+func Write(f io.ReadWriteSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return Update(f, b, nil)
+}
+
+// WriteWithInfo embeds the XMP document d into f and updates the document
+// information dictionary from the dc, xmp and pdf properties of d.
+func WriteWithInfo(f io.ReadWriteSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	info := &pdfmodel.PDFInfo{}
+	if m := pdfmodel.FindModel(d); m != nil {
+		*info = *m
+	}
+	if err := info.SyncFromXMP(d); err != nil {
+		return err
+	}
+	return Update(f, b, info)
+}
+
+// decodeText converts a PDF text string to UTF-8. Strings without byte
+// order mark use PDFDocEncoding which is treated as Latin-1.
+func decodeText(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(u))
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// encodeText converts s to a PDF text string, using UTF-16BE for strings
+// that are not plain ASCII.
+func encodeText(s string) []byte {
+	for _, r := range s {
+		if r >= 0x80 {
+			b := []byte{0xfe, 0xff}
+			for _, v := range utf16.Encode([]rune(s)) {
+				b = append(b, byte(v>>8), byte(v))
+			}
+			return b
+		}
+	}
+	return []byte(s)
+}
+
+// parseDate parses PDF dates of the form D:YYYYMMDDHHmmSSOHH'mm' where
+// all fields after the year are optional.
+func parseDate(s string) (xmp.Date, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "D:")
+	var v [6]int
+	v[1], v[2] = 1, 1
+	digits := []int{4, 2, 2, 2, 2, 2}
+	i := 0
+	for k, n := range digits {
+		if len(s)-i < n || !isDigits(s[i:i+n]) {
+			if k == 0 {
+				return xmp.Date{}, fmt.Errorf("pdf: invalid date %q", s)
+			}
+			break
+		}
+		for _, c := range s[i : i+n] {
+			v[k] = v[k]*10 + int(c-'0')
+		}
+		i += n
+	}
+	loc := time.UTC
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		tz := strings.Replace(s[i+1:], "'", "", -1)
+		var h, m int
+		if len(tz) >= 2 && isDigits(tz[:2]) {
+			h = int(tz[0]-'0')*10 + int(tz[1]-'0')
+		}
+		if len(tz) >= 4 && isDigits(tz[2:4]) {
+			m = int(tz[2]-'0')*10 + int(tz[3]-'0')
+		}
+		ofs := h*3600 + m*60
+		if s[i] == '-' {
+			ofs = -ofs
+		}
+		loc = time.FixedZone("", ofs)
+	}
+	return xmp.Date(time.Date(v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], 0, loc)), nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func formatDate(d xmp.Date) string {
+	t := d.Value()
+	_, ofs := t.Zone()
+	if ofs == 0 {
+		return t.Format("D:20060102150405Z")
+	}
+	sign := '+'
+	if ofs < 0 {
+		sign, ofs = '-', -ofs
+	}
+	return fmt.Sprintf("%s%c%02d'%02d'", t.Format("D:20060102150405"), sign, ofs/3600, ofs/60%60)
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package png implements reading and writing of XMP packets embedded in
+// PNG iTXt chunks as defined by XMP Specification Part 3.
+package png
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	xmpKeyword   = []byte("XML:com.adobe.xmp\x00")
+)
+
+const (
+	chunkIDAT = "IDAT"
+	chunkIEND = "IEND"
+	chunkITXT = "iTXt"
+)
+
+var ErrInvalidFile = errors.New("png: invalid file format")
+
+// chunk is a single PNG chunk. Data holds the payload without length,
+// type and CRC fields.
+type chunk struct {
+	Type string
+	Data []byte
+}
+
+func (c chunk) isXMP() bool {
+	return c.Type == chunkITXT && bytes.HasPrefix(c.Data, xmpKeyword)
+}
+
+func (c chunk) WriteTo(w io.Writer) (int64, error) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(c.Data)))
+	copy(hdr[4:], c.Type)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(c.Data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	var n int64
+	for _, b := range [][]byte{hdr[:], c.Data, sum[:]} {
+		m, err := w.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func readChunk(r io.Reader) (chunk, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return chunk{}, io.ErrUnexpectedEOF
+		}
+		return chunk{}, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:4])
+	if size > 0x7fffffff {
+		return chunk{}, fmt.Errorf("png: invalid chunk length %d", size)
+	}
+	// grow the buffer while reading so a bogus length in a truncated
+	// file cannot trigger a huge allocation
+	c := chunk{Type: string(hdr[4:])}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return chunk{}, fmt.Errorf("png: reading %s chunk: %v", c.Type, err)
+	}
+	c.Data = buf.Bytes()
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return chunk{}, fmt.Errorf("png: reading %s chunk: %v", c.Type, err)
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(c.Data)
+	if crc.Sum32() != binary.BigEndian.Uint32(sum[:]) {
+		return chunk{}, fmt.Errorf("png: invalid crc in %s chunk", c.Type)
+	}
+	return c, nil
+}
+
+func readSignature(r io.Reader) error {
+	var sig [8]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil || !bytes.Equal(sig[:], pngSignature) {
+		return ErrInvalidFile
+	}
+	return nil
+}
+
+// decodeITXt returns the text of an XMP iTXt chunk and whether the text
+// was compressed.
+func decodeITXt(data []byte) ([]byte, bool, error) {
+	b := data[len(xmpKeyword):]
+	if len(b) < 2 {
+		return nil, false, fmt.Errorf("png: short iTXt chunk")
+	}
+	compressed := b[0] == 1
+	if compressed && b[1] != 0 {
+		return nil, false, fmt.Errorf("png: unsupported iTXt compression method %d", b[1])
+	}
+	b = b[2:]
+	// skip language tag and translated keyword
+	for i := 0; i < 2; i++ {
+		n := bytes.IndexByte(b, 0)
+		if n < 0 {
+			return nil, false, fmt.Errorf("png: malformed iTXt chunk")
+		}
+		b = b[n+1:]
+	}
+	if !compressed {
+		return b, false, nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, true, fmt.Errorf("png: decompressing iTXt chunk: %v", err)
+	}
+	defer zr.Close()
+	text, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, true, fmt.Errorf("png: decompressing iTXt chunk: %v", err)
+	}
+	return text, true, nil
+}
+
+func encodeITXt(packet []byte, compress bool) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(xmpKeyword)
+	if compress {
+		buf.Write([]byte{1, 0, 0, 0})
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(packet); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	} else {
+		buf.Write([]byte{0, 0, 0, 0})
+		buf.Write(packet)
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadPacket returns the XMP packet stored in the XML:com.adobe.xmp iTXt
+// chunk or io.EOF when the file contains no XMP.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	if err := readSignature(br); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := readChunk(br)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c.isXMP():
+			b, _, err := decodeITXt(c.Data)
+			return b, err
+		case c.Type == chunkIEND:
+			return nil, io.EOF
+		}
+	}
+}
+
+// Read decodes the XMP packet embedded in a PNG file.
+func Read(r io.Reader) (*xmp.Document, error) {
+	b, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the PNG file from r to w and stores packet in an
+// XML:com.adobe.xmp iTXt chunk. An existing chunk in front of the image
+// data is replaced in place keeping its compression mode, otherwise a new
+// uncompressed chunk is inserted before the first IDAT chunk and any XMP
+// chunk after the image data is dropped. All other chunks are copied
+// unchanged.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	br := bufio.NewReader(r)
+	if err := readSignature(br); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(pngSignature); err != nil {
+		return err
+	}
+	var written bool
+	for {
+		c, err := readChunk(br)
+		if err != nil {
+			return err
+		}
+		switch {
+		case c.isXMP():
+			if written {
+				// drop duplicate XMP chunks
+				continue
+			}
+			_, compress, _ := decodeITXt(c.Data)
+			if c.Data, err = encodeITXt(packet, compress); err != nil {
+				return err
+			}
+			written = true
+		case !written && (c.Type == chunkIDAT || c.Type == chunkIEND):
+			x := chunk{Type: chunkITXT}
+			if x.Data, err = encodeITXt(packet, false); err != nil {
+				return err
+			}
+			if _, err := x.WriteTo(bw); err != nil {
+				return err
+			}
+			written = true
+		}
+		if _, err := c.WriteTo(bw); err != nil {
+			return err
+		}
+		if c.Type == chunkIEND {
+			break
+		}
+	}
+	// keep any trailing data
+	if _, err := io.Copy(bw, br); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Write copies the PNG file from r to w and embeds the XMP document d.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, b)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package psd implements reading and writing of XMP packets embedded in
+// Photoshop PSD and PSB files as defined by XMP Specification Part 3.
+//
+// XMP is stored in image resource 0x0424 (1060). The IPTC-NAA record
+// (0x0404) and the ICC profile (0x040F) are available as raw data and are
+// reconciled with photoshop:LegacyIPTCDigest and photoshop:ICCProfile when
+// reading XMP. Image resources are decoded by package irb.
+package psd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/formats/irb"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var ErrInvalidFile = errors.New("psd: invalid file format")
+
+var magic = []byte("8BPS")
+
+// size of the file header
+const headerSize = 26
+
+// maximum size of the color mode and image resources sections
+const maxSectionSize = 256 << 20
+
+// file holds the sections in front of the layer and image data.
+type file struct {
+	header    []byte
+	colorMode []byte
+	resources []*Resource
+}
+
+func readSection(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("psd: reading section length: %v", err)
+	}
+	if n > maxSectionSize {
+		return nil, fmt.Errorf("psd: section too large (%d bytes)", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("psd: reading section: %v", err)
+	}
+	return b, nil
+}
+
+// readFile reads the file up to the end of the image resources section.
+func readFile(r io.Reader) (*file, error) {
+	f := &file{header: make([]byte, headerSize)}
+	if _, err := io.ReadFull(r, f.header); err != nil {
+		return nil, ErrInvalidFile
+	}
+	if !bytes.HasPrefix(f.header, magic) {
+		return nil, ErrInvalidFile
+	}
+	switch binary.BigEndian.Uint16(f.header[4:]) {
+	case 1, 2:
+	default:
+		return nil, ErrInvalidFile
+	}
+	var err error
+	if f.colorMode, err = readSection(r); err != nil {
+		return nil, err
+	}
+	b, err := readSection(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.resources, err = ParseResources(b); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ReadResources returns all image resources of a PSD or PSB file.
+func ReadResources(r io.Reader) ([]*Resource, error) {
+	f, err := readFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.resources, nil
+}
+
+// ReadResource returns the data of the first image resource with id. It
+// returns io.EOF when the resource does not exist.
+func ReadResource(r io.Reader, id uint16) ([]byte, error) {
+	l, err := ReadResources(r)
+	if err != nil {
+		return nil, err
+	}
+	if res := FindResource(l, id); res != nil {
+		return res.Data, nil
+	}
+	return nil, io.EOF
+}
+
+// ReadIPTC returns the raw IPTC-NAA record from resource 0x0404.
+func ReadIPTC(r io.Reader) ([]byte, error) {
+	return ReadResource(r, ResourceIPTC)
+}
+
+// ReadICCProfile returns the raw ICC profile from resource 0x040F.
+func ReadICCProfile(r io.Reader) ([]byte, error) {
+	return ReadResource(r, ResourceICCProfile)
+}
+
+// ReadPacket returns the XMP packet from resource 0x0424 or io.EOF when the
+// file contains no XMP.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	return ReadResource(r, ResourceXMP)
+}
+
+// Read decodes the XMP packet embedded in a PSD or PSB file and merges
+// IPTC-NAA and ICC profile resources into the photoshop and dc models.
+func Read(r io.Reader) (*xmp.Document, error) {
+	l, err := ReadResources(r)
+	if err != nil {
+		return nil, err
+	}
+	res := FindResource(l, ResourceXMP)
+	if res == nil {
+		return nil, io.EOF
+	}
+	d, err := res.XMP()
+	if err != nil {
+		return nil, err
+	}
+	if err := irb.Resources(l).AddModels(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WriteResources copies the file from r to w replacing the image resources
+// section with l. Layer and image data are copied unchanged.
+func WriteResources(w io.Writer, r io.Reader, l []*Resource) error {
+	f, err := readFile(r)
+	if err != nil {
+		return err
+	}
+	f.resources = l
+	return f.write(w, r)
+}
+
+func (f *file) write(w io.Writer, r io.Reader) error {
+	res := EncodeResources(f.resources)
+	if int64(len(res)) > 0xffffffff {
+		return fmt.Errorf("psd: image resources section too large")
+	}
+	var buf bytes.Buffer
+	buf.Write(f.header)
+	binary.Write(&buf, binary.BigEndian, uint32(len(f.colorMode)))
+	buf.Write(f.colorMode)
+	binary.Write(&buf, binary.BigEndian, uint32(len(res)))
+	buf.Write(res)
+	if _, err := buf.WriteTo(w); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// WritePacket copies the file from r to w and stores packet in resource
+// 0x0424. An existing XMP resource keeps its position, otherwise the
+// resource is appended.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	f, err := readFile(r)
+	if err != nil {
+		return err
+	}
+	if res := FindResource(f.resources, ResourceXMP); res != nil {
+		res.Data = packet
+	} else {
+		f.resources = append(f.resources, &Resource{ID: ResourceXMP, Data: packet})
+	}
+	return f.write(w, r)
+}
+
+// Write copies the file from r to w and embeds the XMP document d.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, b)
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package psd
+
+import (
+	"github.com/trimmer-io/go-xmp/formats/irb"
+)
+
+// Image resource IDs
+const (
+	ResourceIPTC       = irb.IPTC       // IPTC-NAA record
+	ResourceICCProfile = irb.ICCProfile // ICC color profile
+	ResourceXMP        = irb.XMP        // XMP metadata
+)
+
+// Resource is a single image resource block as implemented by package irb.
+type Resource = irb.Resource
+
+// ParseResources decodes the image resources section.
+func ParseResources(b []byte) ([]*Resource, error) {
+	return irb.Parse(b)
+}
+
+// EncodeResources encodes the image resources section.
+func EncodeResources(l []*Resource) []byte {
+	return irb.Resources(l).Bytes()
+}
+
+// FindResource returns the first resource with id or nil.
+func FindResource(l []*Resource, id uint16) *Resource {
+	return irb.Resources(l).Find(id)
+}
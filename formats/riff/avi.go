@@ -0,0 +1,316 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package riff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	riffmodel "github.com/trimmer-io/go-xmp/models/riff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// AVI is the form layout of an AVI file. The first form has type `AVI `,
+// OpenDML files larger than 1GB continue in `AVIX` forms.
+//
+// Metadata chunks are updated in place when they fit into their existing
+// space, otherwise they are appended to the last form at the end of the
+// file. The `movi` list, the `idx1` index and OpenDML super indexes never
+// move.
+type AVI struct {
+	Forms []*File
+}
+
+// StreamData is the payload of a `strd` chunk in the stream header list
+// of an AVI file. Cameras store vendor specific data here, often in an
+// EXIF-like IFD structure.
+type StreamData struct {
+	Stream  int    // stream number
+	Type    string // stream type from strh, e.g. vids or auds
+	Handler string // codec four character code from strh
+	Data    []byte
+}
+
+// formats of the IDIT chunk seen in the wild
+var iditFormats = []string{
+	"Mon Jan _2 15:04:05 2006",
+	"Mon Jan _2 15:04:05 MST 2006",
+	"2006:01:02 15:04:05",
+	"2006/01/02 15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006:01:02 15:04",
+}
+
+// ParseDateTimeOriginal parses the value of an IDIT chunk.
+func ParseDateTimeOriginal(s string) (time.Time, error) {
+	s = strings.TrimSpace(strings.TrimRight(s, "\x00"))
+	for _, f := range iditFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("riff: invalid IDIT date '%s'", s)
+}
+
+// ReadAVIFile reads the layout of all forms in an AVI file.
+func ReadAVIFile(r io.ReadSeeker) (*AVI, error) {
+	l, err := ReadForms(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) == 0 || l[0].Form != "AVI " {
+		return nil, ErrInvalidFile
+	}
+	return &AVI{Forms: l}, nil
+}
+
+// Find returns the first top-level chunk selected by match in any form.
+func (x *AVI) Find(match func(Chunk) bool) *Chunk {
+	for _, v := range x.Forms {
+		for i := range v.Chunks {
+			if match(v.Chunks[i]) {
+				return &v.Chunks[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (x *AVI) readChunk(r io.ReadSeeker, match func(Chunk) bool) ([]byte, error) {
+	c := x.Find(match)
+	if c == nil {
+		return nil, io.EOF
+	}
+	return c.ReadData(r)
+}
+
+// ReadPacket returns the XMP packet stored in the _PMX chunk or io.EOF
+// when the file contains no XMP.
+func (x *AVI) ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	b, err := x.readChunk(r, isXMPChunk)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b, "\x00"), nil
+}
+
+// ReadInfo decodes the top-level LIST/INFO chunk or returns io.EOF when
+// missing.
+func (x *AVI) ReadInfo(r io.ReadSeeker) (*riffmodel.RiffInfo, error) {
+	b, err := x.readChunk(r, isInfoChunk)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeInfo(b)
+}
+
+// ReadDateTimeOriginal returns the raw value of the IDIT chunk in the
+// hdrl list or at the top-level of the file and io.EOF when missing.
+func (x *AVI) ReadDateTimeOriginal(r io.ReadSeeker) (string, error) {
+	c := x.Find(func(c Chunk) bool { return c.ID == "IDIT" })
+	if c == nil {
+		if hdrl := x.Forms[0].FindList("hdrl"); hdrl != nil {
+			l, err := ReadList(r, *hdrl)
+			if err != nil {
+				return "", err
+			}
+			for i := range l {
+				if l[i].ID == "IDIT" {
+					c = &l[i]
+					break
+				}
+			}
+		}
+	}
+	if c == nil {
+		return "", io.EOF
+	}
+	b, err := c.ReadData(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00")), nil
+}
+
+// ReadIDIT returns the parsed IDIT date or io.EOF when missing.
+func (x *AVI) ReadIDIT(r io.ReadSeeker) (time.Time, error) {
+	s, err := x.ReadDateTimeOriginal(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ParseDateTimeOriginal(s)
+}
+
+// ReadStreamData returns the strd chunks of all streams in the order of
+// their stream headers.
+func (x *AVI) ReadStreamData(r io.ReadSeeker) ([]StreamData, error) {
+	l := make([]StreamData, 0)
+	hdrl := x.Forms[0].FindList("hdrl")
+	if hdrl == nil {
+		return l, nil
+	}
+	hl, err := ReadList(r, *hdrl)
+	if err != nil {
+		return nil, err
+	}
+	var stream int
+	for _, c := range hl {
+		if c.ID != "LIST" || c.List != "strl" {
+			continue
+		}
+		sl, err := ReadList(r, c)
+		if err != nil {
+			return nil, err
+		}
+		var typ, handler string
+		for _, v := range sl {
+			switch v.ID {
+			case "strh":
+				b, err := v.ReadData(r)
+				if err != nil {
+					return nil, err
+				}
+				if len(b) >= 8 {
+					typ, handler = string(b[:4]), strings.TrimRight(string(b[4:8]), "\x00")
+				}
+			case "strd":
+				b, err := v.ReadData(r)
+				if err != nil {
+					return nil, err
+				}
+				l = append(l, StreamData{
+					Stream:  stream,
+					Type:    typ,
+					Handler: handler,
+					Data:    b,
+				})
+			}
+		}
+		stream++
+	}
+	return l, nil
+}
+
+// ReplaceChunk stores a chunk with payload data in f. The first chunk
+// selected by match is overwritten when the new chunk fits, otherwise it
+// is turned into JUNK and the new chunk is appended to the last form.
+func (x *AVI) ReplaceChunk(f io.ReadWriteSeeker, id string, data []byte, match func(Chunk) bool, pad bool) error {
+	for _, v := range x.Forms {
+		if ok, err := v.replaceChunk(f, id, data, match, pad); ok || err != nil {
+			return err
+		}
+	}
+	last := x.Forms[len(x.Forms)-1]
+	return last.appendChunk(f, last.End(), makeChunk(id, data))
+}
+
+func writeAVIChunk(f io.ReadWriteSeeker, id string, data []byte, match func(Chunk) bool, pad bool) error {
+	x, err := ReadAVIFile(f)
+	if err != nil {
+		return err
+	}
+	return x.ReplaceChunk(f, id, data, match, pad)
+}
+
+// WriteAVIPacket stores packet in the _PMX chunk of AVI file f.
+func WriteAVIPacket(f io.ReadWriteSeeker, packet []byte) error {
+	return writeAVIChunk(f, "_PMX", packet, isXMPChunk, true)
+}
+
+// WriteAVIInfo stores m in the top-level LIST/INFO chunk of AVI file f.
+func WriteAVIInfo(f io.ReadWriteSeeker, m *riffmodel.RiffInfo) error {
+	b, err := EncodeInfo(m)
+	if err != nil {
+		return err
+	}
+	return writeAVIChunk(f, "LIST", b, isInfoChunk, false)
+}
+
+// ReadAVI decodes the XMP packet of an AVI file and adds a model for the
+// native INFO list and IDIT chunk. It returns io.EOF when the file
+// contains neither.
+func ReadAVI(r io.ReadSeeker) (*xmp.Document, error) {
+	x, err := ReadAVIFile(r)
+	if err != nil {
+		return nil, err
+	}
+	var d *xmp.Document
+	b, err := x.ReadPacket(r)
+	switch err {
+	case nil:
+		d = &xmp.Document{}
+		if err := xmp.Unmarshal(b, d); err != nil {
+			return nil, err
+		}
+	case io.EOF:
+		d = xmp.NewDocument()
+	default:
+		return nil, err
+	}
+	m, err := x.ReadInfo(r)
+	switch err {
+	case nil:
+	case io.EOF:
+		m = nil
+	default:
+		xmp.Log.Warnf("riff: %v", err)
+		m = nil
+	}
+	if s, err := x.ReadDateTimeOriginal(r); err == nil && s != "" {
+		if m == nil {
+			m = &riffmodel.RiffInfo{}
+		}
+		m.DateTimeOriginal2 = s
+	} else if err != nil && err != io.EOF {
+		xmp.Log.Warnf("riff: %v", err)
+	}
+	if m != nil {
+		if _, err := d.AddModel(m); err != nil {
+			return nil, err
+		}
+	}
+	if b == nil && m == nil {
+		return nil, io.EOF
+	}
+	return d, nil
+}
+
+// WriteAVI embeds the XMP document d into AVI file f and updates the INFO
+// list when d contains a riff model.
+func WriteAVI(f io.ReadWriteSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := WriteAVIPacket(f, b); err != nil {
+		return err
+	}
+	if m := riffmodel.FindModel(d); m != nil {
+		if err := m.SyncFromXMP(d); err != nil {
+			return err
+		}
+		// IDIT lives in the hdrl list of AVI files
+		info := *m
+		info.DateTimeOriginal2 = ""
+		if err := WriteAVIInfo(f, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
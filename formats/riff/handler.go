@@ -0,0 +1,91 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package riff
+
+import (
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+type handler struct{}
+
+func (handler) CanHandle(head []byte) bool {
+	if len(head) < 12 {
+		return false
+	}
+	switch string(head[:4]) {
+	case "RIFF", "RF64", "BW64":
+		return string(head[8:12]) == "WAVE"
+	}
+	return false
+}
+
+func (handler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	return Read(r)
+}
+
+func (handler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	f, ok := w.(io.ReadWriteSeeker)
+	if !ok {
+		return xmp.ErrNotSeekable
+	}
+	return Write(f, d)
+}
+
+func (handler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite | xmp.CapInPlace | xmp.CapNative
+}
+
+type aviHandler struct{}
+
+func (aviHandler) CanHandle(head []byte) bool {
+	return len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI "
+}
+
+func (aviHandler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	return ReadAVI(r)
+}
+
+func (aviHandler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	f, ok := w.(io.ReadWriteSeeker)
+	if !ok {
+		return xmp.ErrNotSeekable
+	}
+	return WriteAVI(f, d)
+}
+
+func (aviHandler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite | xmp.CapInPlace | xmp.CapNative
+}
+
+func init() {
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name:       "wav",
+		Extensions: []string{".wav", ".bwf", ".rf64"},
+		Magic: []xmp.Magic{
+			{Offset: 0, Value: []byte("RIFF")},
+			{Offset: 0, Value: []byte("RF64")},
+			{Offset: 0, Value: []byte("BW64")},
+		},
+		Handler: handler{},
+	})
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name:       "avi",
+		Extensions: []string{".avi"},
+		Magic:      []xmp.Magic{{Offset: 0, Value: []byte("RIFF")}},
+		Handler:    aviHandler{},
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package riff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/trimmer-io/go-xmp/models/ixml"
+	riffmodel "github.com/trimmer-io/go-xmp/models/riff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// DecodeInfo decodes the payload of a LIST/INFO chunk including the list
+// type. Unknown and empty tags are skipped.
+func DecodeInfo(b []byte) (*riffmodel.RiffInfo, error) {
+	if len(b) < 4 || string(b[:4]) != "INFO" {
+		return nil, fmt.Errorf("riff: invalid INFO list")
+	}
+	m := &riffmodel.RiffInfo{}
+	for b = b[4:]; len(b) >= 8; {
+		id := string(b[:4])
+		size := int(binary.LittleEndian.Uint32(b[4:]))
+		if 8+size > len(b) {
+			return nil, fmt.Errorf("riff: invalid INFO tag %s size %d", id, size)
+		}
+		val := strings.TrimRight(string(b[8:8+size]), "\x00 ")
+		if val != "" {
+			if err := m.SetTag(id, val); err != nil {
+				xmp.Log.Warnf("riff: skipping INFO tag %s: %v", id, err)
+			}
+		}
+		// the final pad byte may be missing
+		skip := 8 + size + size&1
+		if skip > len(b) {
+			skip = len(b)
+		}
+		b = b[skip:]
+	}
+	return m, nil
+}
+
+// EncodeInfo encodes all non-empty tags of m as LIST/INFO payload.
+func EncodeInfo(m *riffmodel.RiffInfo) ([]byte, error) {
+	tags, err := m.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("INFO")
+	seen := make(map[string]bool)
+	for _, v := range tags {
+		if seen[v.Key] || len(v.Key) != 4 {
+			continue
+		}
+		seen[v.Key] = true
+		// values are NUL terminated
+		buf.Write(makeChunk(v.Key, append([]byte(v.Value), 0)))
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeIXML decodes the payload of an iXML chunk.
+func DecodeIXML(b []byte) (*ixml.IXML, error) {
+	m := &ixml.IXML{}
+	if err := m.ParseXML(bytes.TrimRight(b, "\x00 \r\n\t")); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EncodeIXML encodes m as iXML chunk payload.
+func EncodeIXML(m *ixml.IXML) ([]byte, error) {
+	// must strip type funcs to avoid text marshalling
+	type _t ixml.IXML
+	b, err := xml.MarshalIndent((*_t)(m), "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("riff: encoding iXML: %v", err)
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// Bext is the broadcast audio extension chunk defined by EBU Tech 3285.
+type Bext struct {
+	Description          string
+	Originator           string
+	OriginatorReference  string
+	OriginationDate      string // yyyy-mm-dd
+	OriginationTime      string // hh-mm-ss
+	TimeReference        uint64 // first sample count since midnight
+	Version              uint16
+	UMID                 []byte // SMPTE 330M UMID, 64 bytes
+	LoudnessValue        int16  // 0.01 LUFS, version 2+
+	LoudnessRange        int16  // 0.01 LU
+	MaxTruePeakLevel     int16  // 0.01 dBTP
+	MaxMomentaryLoudness int16  // 0.01 LUFS
+	MaxShortTermLoudness int16  // 0.01 LUFS
+	CodingHistory        string
+}
+
+// size of the fixed part of a bext chunk
+const bextSize = 602
+
+// DecodeBext decodes the payload of a bext chunk.
+func DecodeBext(b []byte) (*Bext, error) {
+	if len(b) < bextSize {
+		return nil, fmt.Errorf("riff: short bext chunk")
+	}
+	str := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimSpace(string(b))
+	}
+	le := binary.LittleEndian
+	return &Bext{
+		Description:          str(b[0:256]),
+		Originator:           str(b[256:288]),
+		OriginatorReference:  str(b[288:320]),
+		OriginationDate:      str(b[320:330]),
+		OriginationTime:      str(b[330:338]),
+		TimeReference:        le.Uint64(b[338:]),
+		Version:              le.Uint16(b[346:]),
+		UMID:                 append([]byte{}, b[348:412]...),
+		LoudnessValue:        int16(le.Uint16(b[412:])),
+		LoudnessRange:        int16(le.Uint16(b[414:])),
+		MaxTruePeakLevel:     int16(le.Uint16(b[416:])),
+		MaxMomentaryLoudness: int16(le.Uint16(b[418:])),
+		MaxShortTermLoudness: int16(le.Uint16(b[420:])),
+		CodingHistory:        str(b[bextSize:]),
+	}, nil
+}
+
+// EncodeBext encodes m as bext chunk payload.
+func EncodeBext(m *Bext) []byte {
+	b := make([]byte, bextSize, bextSize+len(m.CodingHistory))
+	copy(b[0:256], m.Description)
+	copy(b[256:288], m.Originator)
+	copy(b[288:320], m.OriginatorReference)
+	copy(b[320:330], m.OriginationDate)
+	copy(b[330:338], m.OriginationTime)
+	le := binary.LittleEndian
+	le.PutUint64(b[338:], m.TimeReference)
+	le.PutUint16(b[346:], m.Version)
+	copy(b[348:412], m.UMID)
+	le.PutUint16(b[412:], uint16(m.LoudnessValue))
+	le.PutUint16(b[414:], uint16(m.LoudnessRange))
+	le.PutUint16(b[416:], uint16(m.MaxTruePeakLevel))
+	le.PutUint16(b[418:], uint16(m.MaxMomentaryLoudness))
+	le.PutUint16(b[420:], uint16(m.MaxShortTermLoudness))
+	return append(b, m.CodingHistory...)
+}
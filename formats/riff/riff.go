@@ -0,0 +1,446 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package riff implements reading and writing of metadata chunks in RIFF
+// based files as defined by XMP Specification Part 3. XMP is stored in
+// the `_PMX` chunk, legacy metadata in `LIST/INFO`, and broadcast wave
+// files may carry `bext` and `iXML` chunks. RF64 and BW64 files with
+// 64-bit sizes are supported. AVI files including OpenDML `AVIX` forms
+// carry `_PMX`, `LIST/INFO` and camera specific `strd` and `IDIT` chunks.
+//
+// Chunks are updated in place. When a new chunk fits into the space of the
+// existing one (including directly following `JUNK` chunks) it is
+// overwritten and remaining space is filled with `JUNK`, otherwise the old
+// chunk is turned into `JUNK` and the new chunk is appended to the file.
+package riff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrInvalidFile = errors.New("riff: invalid file format")
+	ErrTooLarge    = errors.New("riff: file exceeds 4GB and has no space for a ds64 chunk")
+)
+
+// size value used by RF64 files for chunks whose size is stored in ds64
+const sizeRF64 = 0xffffffff
+
+// Chunk is the location of a chunk inside a file.
+type Chunk struct {
+	ID     string // four character code
+	List   string // list type of LIST chunks
+	Offset int64  // file offset of the chunk header
+	Size   int64  // payload size without pad byte
+}
+
+func (c Chunk) DataOffset() int64 {
+	return c.Offset + 8
+}
+
+// End returns the offset after the chunk including the pad byte.
+func (c Chunk) End() int64 {
+	return c.Offset + 8 + c.Size + c.Size&1
+}
+
+// ReadData reads the chunk payload.
+func (c Chunk) ReadData(r io.ReadSeeker) ([]byte, error) {
+	if c.Size > maxChunkSize {
+		return nil, fmt.Errorf("riff: %s chunk too large (%d bytes)", c.ID, c.Size)
+	}
+	buf := make([]byte, c.Size)
+	if _, err := r.Seek(c.DataOffset(), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("riff: reading %s chunk: %v", c.ID, err)
+	}
+	return buf, nil
+}
+
+// maximum size of chunk payloads we load into memory
+const maxChunkSize = 1 << 30
+
+// File is the chunk layout of a RIFF form.
+type File struct {
+	ID     string // RIFF, RF64 or BW64
+	Form   string // form type, e.g. WAVE
+	Offset int64  // file offset of the form header
+	Size   int64  // form size from the header or ds64
+	Chunks []Chunk
+	ds64   *Chunk
+	table  map[string]int64 // ds64 sizes of chunks other than data
+}
+
+func (x *File) IsRF64() bool {
+	return x.ID == "RF64" || x.ID == "BW64"
+}
+
+// End returns the offset after the form.
+func (x *File) End() int64 {
+	return x.Offset + 8 + x.Size + x.Size&1
+}
+
+// Find returns the first chunk with id or nil.
+func (x *File) Find(id string) *Chunk {
+	for i := range x.Chunks {
+		if x.Chunks[i].ID == id {
+			return &x.Chunks[i]
+		}
+	}
+	return nil
+}
+
+// FindList returns the first LIST chunk of type typ or nil.
+func (x *File) FindList(typ string) *Chunk {
+	for i := range x.Chunks {
+		if x.Chunks[i].ID == "LIST" && x.Chunks[i].List == typ {
+			return &x.Chunks[i]
+		}
+	}
+	return nil
+}
+
+// ReadFile reads the chunk layout of the first RIFF form in r.
+func ReadFile(r io.ReadSeeker) (*File, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return readForm(r, 0, size)
+}
+
+// ReadForms reads the chunk layout of all consecutive RIFF forms in r.
+// AVI files larger than 1GB (OpenDML) continue in `AVIX` forms following
+// the first form.
+func ReadForms(r io.ReadSeeker) ([]*File, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]*File, 0, 1)
+	for ofs := int64(0); ofs+12 <= size; {
+		x, err := readForm(r, ofs, size)
+		if err != nil {
+			if len(l) > 0 && err == ErrInvalidFile {
+				// ignore trailing garbage
+				break
+			}
+			return nil, err
+		}
+		l = append(l, x)
+		if x.End() > size {
+			break
+		}
+		ofs = x.End()
+	}
+	return l, nil
+}
+
+func readForm(r io.ReadSeeker, ofs, size int64) (*File, error) {
+	if _, err := r.Seek(ofs, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, ErrInvalidFile
+	}
+	x := &File{
+		ID:     string(hdr[:4]),
+		Form:   string(hdr[8:12]),
+		Offset: ofs,
+		Size:   int64(binary.LittleEndian.Uint32(hdr[4:])),
+		Chunks: make([]Chunk, 0),
+	}
+	switch x.ID {
+	case "RIFF", "RF64", "BW64":
+	default:
+		return nil, ErrInvalidFile
+	}
+	end := x.End()
+	if x.IsRF64() || end > size {
+		// the real size is known after reading ds64
+		end = size
+	}
+	for ofs := ofs + 12; ofs+8 <= end; {
+		c, err := x.readChunk(r, ofs, size)
+		if err != nil {
+			return nil, err
+		}
+		x.Chunks = append(x.Chunks, c)
+		if c.ID == "ds64" && x.ds64 == nil {
+			if err := x.readDS64(r, c); err != nil {
+				return nil, err
+			}
+			x.ds64 = &x.Chunks[len(x.Chunks)-1]
+			if e := x.End(); e < end {
+				end = e
+			}
+		}
+		ofs = c.End()
+	}
+	return x, nil
+}
+
+// ReadList reads the layout of the chunks nested inside LIST chunk c.
+func ReadList(r io.ReadSeeker, c Chunk) ([]Chunk, error) {
+	if c.ID != "LIST" || c.Size < 4 {
+		return nil, fmt.Errorf("riff: %s chunk at offset %d is not a list", c.ID, c.Offset)
+	}
+	x := &File{}
+	l := make([]Chunk, 0)
+	end := c.DataOffset() + c.Size
+	for ofs := c.DataOffset() + 4; ofs+8 <= end; {
+		sub, err := x.readChunk(r, ofs, end)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, sub)
+		ofs = sub.End()
+	}
+	return l, nil
+}
+
+func (x *File) readChunk(r io.ReadSeeker, ofs, size int64) (Chunk, error) {
+	if _, err := r.Seek(ofs, io.SeekStart); err != nil {
+		return Chunk{}, err
+	}
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+		return Chunk{}, fmt.Errorf("riff: reading chunk at offset %d: %v", ofs, err)
+	}
+	c := Chunk{
+		ID:     string(hdr[:4]),
+		Offset: ofs,
+		Size:   int64(binary.LittleEndian.Uint32(hdr[4:])),
+	}
+	if c.Size == sizeRF64 && x.IsRF64() {
+		c.Size = x.chunkSize(c.ID)
+	}
+	if c.ID == "LIST" && c.Size >= 4 {
+		if _, err := io.ReadFull(r, hdr[8:12]); err != nil {
+			return Chunk{}, fmt.Errorf("riff: reading list at offset %d: %v", ofs, err)
+		}
+		c.List = string(hdr[8:12])
+	}
+	if c.DataOffset()+c.Size > size {
+		return Chunk{}, fmt.Errorf("riff: invalid %s chunk size %d at offset %d", c.ID, c.Size, ofs)
+	}
+	return c, nil
+}
+
+// ds64 layout: riff size, data size, sample count (64 bit each), table
+// length and table entries of chunk id and 64 bit size
+func (x *File) readDS64(r io.ReadSeeker, c Chunk) error {
+	b, err := c.ReadData(r)
+	if err != nil {
+		return err
+	}
+	if len(b) < 28 {
+		return fmt.Errorf("riff: short ds64 chunk")
+	}
+	x.table = make(map[string]int64)
+	if x.IsRF64() {
+		x.Size = int64(binary.LittleEndian.Uint64(b))
+	}
+	x.table["data"] = int64(binary.LittleEndian.Uint64(b[8:]))
+	n := int(binary.LittleEndian.Uint32(b[24:]))
+	for i := 0; i < n && 28+i*12+12 <= len(b); i++ {
+		e := b[28+i*12:]
+		x.table[string(e[:4])] = int64(binary.LittleEndian.Uint64(e[4:]))
+	}
+	return nil
+}
+
+func (x *File) chunkSize(id string) int64 {
+	if v, ok := x.table[id]; ok {
+		return v
+	}
+	return sizeRF64
+}
+
+func writeAt(f io.WriteSeeker, b []byte, off int64) error {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write(b)
+	return err
+}
+
+// makeChunk serializes a chunk including its pad byte.
+func makeChunk(id string, data []byte) []byte {
+	buf := make([]byte, 8, 8+len(data)+1)
+	copy(buf, id)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(data)))
+	buf = append(buf, data...)
+	if len(data)&1 == 1 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func isJunk(id string) bool {
+	return id == "JUNK" || id == "junk" || id == "PAD "
+}
+
+// ReplaceChunk stores a chunk with payload data in f. match selects the
+// existing chunk to replace. When pad is true the payload may be extended
+// with trailing whitespace to fill small gaps, which is only safe for text
+// payloads such as XML.
+func (x *File) ReplaceChunk(f io.ReadWriteSeeker, id string, data []byte, match func(Chunk) bool, pad bool) error {
+	if ok, err := x.replaceChunk(f, id, data, match, pad); ok || err != nil {
+		return err
+	}
+	return x.appendChunk(f, x.End(), makeChunk(id, data))
+}
+
+// replaceChunk overwrites the first chunk selected by match when the new
+// chunk fits into its space or when it is the last chunk of a form at the
+// end of the file. Otherwise the old chunk is turned into JUNK. It returns
+// true when the chunk was written.
+func (x *File) replaceChunk(f io.ReadWriteSeeker, id string, data []byte, match func(Chunk) bool, pad bool) (bool, error) {
+	pos := -1
+	for i, c := range x.Chunks {
+		if match(c) {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return false, nil
+	}
+	c := x.Chunks[pos]
+	space := c.End() - c.Offset
+	for j := pos + 1; j < len(x.Chunks) && isJunk(x.Chunks[j].ID); j++ {
+		space += x.Chunks[j].End() - x.Chunks[j].Offset
+	}
+	buf := makeChunk(id, data)
+	left := space - int64(len(buf))
+	if left > 0 && left < 8 && pad {
+		// use whitespace instead of a JUNK chunk
+		data = append(append([]byte{}, data...), bytes.Repeat([]byte{' '}, int(left))...)
+		buf = makeChunk(id, data)
+		left = space - int64(len(buf))
+	}
+	switch {
+	case left == 0:
+		return true, writeAt(f, buf, c.Offset)
+	case left >= 8:
+		return true, writeAt(f, append(buf, makeChunk("JUNK", make([]byte, left-8))...), c.Offset)
+	case pos == len(x.Chunks)-1 && c.End() == x.End():
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := f.(truncater); x.End() >= size && (left < 0 || ok) {
+			// the last chunk can grow, it can only shrink when the stale
+			// tail of the file is cut off
+			x.Chunks = x.Chunks[:pos]
+			return true, x.appendChunk(f, c.Offset, buf)
+		}
+	}
+	// turn the old chunk into junk
+	if err := writeAt(f, []byte("JUNK"), c.Offset); err != nil {
+		return false, err
+	}
+	x.Chunks[pos].ID = "JUNK"
+	return false, nil
+}
+
+// RemoveChunk turns all chunks selected by match into JUNK.
+func (x *File) RemoveChunk(f io.ReadWriteSeeker, match func(Chunk) bool) error {
+	for i, c := range x.Chunks {
+		if !match(c) {
+			continue
+		}
+		if err := writeAt(f, []byte("JUNK"), c.Offset); err != nil {
+			return err
+		}
+		x.Chunks[i].ID = "JUNK"
+	}
+	return nil
+}
+
+// truncater is implemented by *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// appendChunk writes buf at offset ofs which must be the end of the form
+// and updates the form size. When buf ends before the end of the file the
+// file is truncated.
+func (x *File) appendChunk(f io.ReadWriteSeeker, ofs int64, buf []byte) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if x.End() < size {
+		return fmt.Errorf("riff: cannot append to file with trailing data")
+	}
+	if err := writeAt(f, buf, ofs); err != nil {
+		return err
+	}
+	if end := ofs + int64(len(buf)); end < size {
+		t, ok := f.(truncater)
+		if !ok {
+			return fmt.Errorf("riff: cannot truncate file")
+		}
+		if err := t.Truncate(end); err != nil {
+			return err
+		}
+	}
+	x.Chunks = append(x.Chunks, Chunk{ID: string(buf[:4]), Offset: ofs, Size: int64(binary.LittleEndian.Uint32(buf[4:]))})
+	x.Size = ofs + int64(len(buf)) - x.Offset - 8
+	return x.writeSize(f)
+}
+
+// writeSize updates the form size in the header or in ds64. Files growing
+// beyond 4GB are converted to RF64 when a leading JUNK chunk reserves the
+// space for a ds64 chunk as recommended by EBU Tech 3306.
+func (x *File) writeSize(f io.ReadWriteSeeker) error {
+	var b [8]byte
+	if x.IsRF64() {
+		if x.ds64 == nil {
+			return fmt.Errorf("riff: missing ds64 chunk")
+		}
+		binary.LittleEndian.PutUint64(b[:], uint64(x.Size))
+		return writeAt(f, b[:], x.ds64.DataOffset())
+	}
+	if x.Size <= 0xffffffff {
+		binary.LittleEndian.PutUint32(b[:], uint32(x.Size))
+		return writeAt(f, b[:4], x.Offset+4)
+	}
+	if x.Offset > 0 || len(x.Chunks) == 0 || x.Chunks[0].ID != "JUNK" || x.Chunks[0].Size < 28 {
+		return ErrTooLarge
+	}
+	junk := x.Chunks[0]
+	ds := make([]byte, junk.Size)
+	binary.LittleEndian.PutUint64(ds, uint64(x.Size))
+	if data := x.Find("data"); data != nil {
+		binary.LittleEndian.PutUint64(ds[8:], uint64(data.Size))
+	}
+	if err := writeAt(f, makeChunk("ds64", ds), junk.Offset); err != nil {
+		return err
+	}
+	x.Chunks[0].ID = "ds64"
+	x.ds64 = &x.Chunks[0]
+	x.ID = "RF64"
+	copy(b[:], x.ID)
+	binary.LittleEndian.PutUint32(b[4:], sizeRF64)
+	return writeAt(f, b[:], 0)
+}
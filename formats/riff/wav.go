@@ -0,0 +1,180 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package riff
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/trimmer-io/go-xmp/models/ixml"
+	riffmodel "github.com/trimmer-io/go-xmp/models/riff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func isXMPChunk(c Chunk) bool  { return c.ID == "_PMX" }
+func isInfoChunk(c Chunk) bool { return c.ID == "LIST" && c.List == "INFO" }
+func isIXMLChunk(c Chunk) bool { return c.ID == "iXML" }
+
+func readChunk(r io.ReadSeeker, match func(Chunk) bool) ([]byte, error) {
+	x, err := ReadFile(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range x.Chunks {
+		if match(c) {
+			return c.ReadData(r)
+		}
+	}
+	return nil, io.EOF
+}
+
+// ReadPacket returns the XMP packet stored in the _PMX chunk or io.EOF
+// when the file contains no XMP.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	b, err := readChunk(r, isXMPChunk)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b, "\x00"), nil
+}
+
+// ReadInfo decodes the LIST/INFO chunk or returns io.EOF when missing.
+func ReadInfo(r io.ReadSeeker) (*riffmodel.RiffInfo, error) {
+	b, err := readChunk(r, isInfoChunk)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeInfo(b)
+}
+
+// ReadIXML decodes the iXML chunk or returns io.EOF when missing.
+func ReadIXML(r io.ReadSeeker) (*ixml.IXML, error) {
+	b, err := readChunk(r, isIXMLChunk)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeIXML(b)
+}
+
+// ReadBext decodes the bext chunk or returns io.EOF when missing.
+func ReadBext(r io.ReadSeeker) (*Bext, error) {
+	b, err := readChunk(r, func(c Chunk) bool { return c.ID == "bext" })
+	if err != nil {
+		return nil, err
+	}
+	return DecodeBext(b)
+}
+
+// Read decodes the XMP packet and adds models for the native INFO and
+// iXML chunks. Native chunks take precedence over XMP properties of the
+// same namespace. It returns io.EOF when the file contains neither.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	var d *xmp.Document
+	b, err := ReadPacket(r)
+	switch err {
+	case nil:
+		d = &xmp.Document{}
+		if err := xmp.Unmarshal(b, d); err != nil {
+			return nil, err
+		}
+	case io.EOF:
+		d = xmp.NewDocument()
+	default:
+		return nil, err
+	}
+	var found bool
+	if m, err := ReadInfo(r); err == nil {
+		if _, err := d.AddModel(m); err != nil {
+			return nil, err
+		}
+		found = true
+	} else if err != io.EOF {
+		xmp.Log.Warnf("riff: %v", err)
+	}
+	if m, err := ReadIXML(r); err == nil {
+		if _, err := d.AddModel(m); err != nil {
+			return nil, err
+		}
+		found = true
+	} else if err != io.EOF {
+		xmp.Log.Warnf("riff: %v", err)
+	}
+	if b == nil && !found {
+		return nil, io.EOF
+	}
+	return d, nil
+}
+
+func writeChunk(f io.ReadWriteSeeker, id string, data []byte, match func(Chunk) bool, pad bool) error {
+	x, err := ReadFile(f)
+	if err != nil {
+		return err
+	}
+	return x.ReplaceChunk(f, id, data, match, pad)
+}
+
+// WritePacket stores packet in the _PMX chunk of f.
+func WritePacket(f io.ReadWriteSeeker, packet []byte) error {
+	return writeChunk(f, "_PMX", packet, isXMPChunk, true)
+}
+
+// WriteInfo stores m in the LIST/INFO chunk of f.
+func WriteInfo(f io.ReadWriteSeeker, m *riffmodel.RiffInfo) error {
+	b, err := EncodeInfo(m)
+	if err != nil {
+		return err
+	}
+	return writeChunk(f, "LIST", b, isInfoChunk, false)
+}
+
+// WriteIXML stores m in the iXML chunk of f.
+func WriteIXML(f io.ReadWriteSeeker, m *ixml.IXML) error {
+	b, err := EncodeIXML(m)
+	if err != nil {
+		return err
+	}
+	return writeChunk(f, "iXML", b, isIXMLChunk, true)
+}
+
+// WriteBext stores m in the bext chunk of f.
+func WriteBext(f io.ReadWriteSeeker, m *Bext) error {
+	return writeChunk(f, "bext", EncodeBext(m), func(c Chunk) bool { return c.ID == "bext" }, false)
+}
+
+// Write embeds the XMP document d into f and updates the INFO and iXML
+// chunks when d contains the corresponding models.
+func Write(f io.ReadWriteSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := WritePacket(f, b); err != nil {
+		return err
+	}
+	if m := riffmodel.FindModel(d); m != nil {
+		if err := m.SyncFromXMP(d); err != nil {
+			return err
+		}
+		if err := WriteInfo(f, m); err != nil {
+			return err
+		}
+	}
+	if m := ixml.FindModel(d); m != nil {
+		if err := WriteIXML(f, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
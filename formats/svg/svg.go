@@ -0,0 +1,289 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package svg implements reading and writing of XMP packets embedded in
+// the metadata element of SVG files as defined by XMP Specification Part 3.
+//
+// The XMP tree may be stored with or without the x:xmpmeta wrapper. On
+// write the existing style is kept and all bytes outside the XMP element
+// are preserved, including whitespace, comments and processing
+// instructions.
+package svg
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var ErrInvalidFile = errors.New("svg: invalid file format")
+
+// location holds byte offsets of the elements relevant for XMP.
+type location struct {
+	root      int        // offset after the root start tag
+	prefix    string     // namespace prefix of the root element
+	rootEmpty bool       // root is an empty-element tag
+	metaStart int        // offset of the metadata start tag or -1
+	metaBody  int        // offset after the metadata start tag
+	metaEnd   int        // offset after the metadata end tag
+	metaEmpty bool       // metadata is an empty-element tag
+	metaName  string     // qualified name of the metadata element
+	start     int        // offset of the XMP element or -1
+	end       int        // offset after the XMP element
+	rdfOnly   bool       // XMP is stored without x:xmpmeta wrapper
+	ns        []xml.Attr // namespace declarations in scope of the XMP element
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func isXMPRoot(n xml.Name) bool {
+	return n.Space == "x" && n.Local == "xmpmeta" || n.Space == "rdf" && n.Local == "RDF"
+}
+
+// locate finds the metadata element and the XMP tree inside it.
+func locate(b []byte) (*location, error) {
+	loc := &location{root: -1, metaStart: -1, start: -1}
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = false
+	var (
+		stack     [][]xml.Attr
+		metaDepth = -1
+		xmpDepth  = -1
+	)
+	for {
+		off := int(dec.InputOffset())
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("svg: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth := len(stack)
+			if depth == 0 {
+				if t.Name.Local != "svg" {
+					return nil, ErrInvalidFile
+				}
+				loc.root = int(dec.InputOffset())
+				loc.prefix = t.Name.Space
+			}
+			if t.Name.Local == "metadata" && metaDepth < 0 && loc.start < 0 {
+				metaDepth = depth
+				loc.metaStart = off
+				loc.metaBody = int(dec.InputOffset())
+				loc.metaName = qualifiedName(t.Name)
+			}
+			if metaDepth >= 0 && xmpDepth < 0 && loc.start < 0 && isXMPRoot(t.Name) {
+				xmpDepth = depth
+				loc.start = off
+				loc.rdfOnly = t.Name.Space == "rdf"
+				// collect declarations of all ancestors, innermost first
+				for i := len(stack) - 1; i >= 0; i-- {
+					loc.ns = append(loc.ns, stack[i]...)
+				}
+			}
+			var decl []xml.Attr
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					decl = append(decl, a)
+				}
+			}
+			stack = append(stack, decl)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, ErrInvalidFile
+			}
+			stack = stack[:len(stack)-1]
+			depth := len(stack)
+			if depth == 0 && int(dec.InputOffset()) == loc.root {
+				loc.rootEmpty = true
+			}
+			if depth == xmpDepth {
+				loc.end = int(dec.InputOffset())
+				xmpDepth = -1
+			}
+			if depth == metaDepth {
+				loc.metaEnd = int(dec.InputOffset())
+				loc.metaEmpty = loc.metaEnd == loc.metaBody
+				metaDepth = -1
+			}
+		}
+	}
+	if loc.root < 0 {
+		return nil, ErrInvalidFile
+	}
+	return loc, nil
+}
+
+// fragment returns the XMP element with namespace declarations from its
+// ancestors copied into the start tag so it can be decoded on its own.
+func (loc *location) fragment(b []byte) []byte {
+	frag := b[loc.start:loc.end]
+	tag := len("<x:xmpmeta")
+	if loc.rdfOnly {
+		tag = len("<rdf:RDF")
+	}
+	var decl bytes.Buffer
+	seen := make(map[string]bool)
+	for _, a := range loc.ns {
+		prefix := []byte("xmlns:" + a.Name.Local + "=")
+		if seen[a.Name.Local] || bytes.Contains(frag, prefix) {
+			continue
+		}
+		seen[a.Name.Local] = true
+		fmt.Fprintf(&decl, " xmlns:%s=\"", a.Name.Local)
+		xml.EscapeText(&decl, []byte(a.Value))
+		decl.WriteByte('"')
+	}
+	if decl.Len() == 0 {
+		return frag
+	}
+	buf := make([]byte, 0, len(frag)+decl.Len())
+	buf = append(buf, frag[:tag]...)
+	buf = append(buf, decl.Bytes()...)
+	return append(buf, frag[tag:]...)
+}
+
+// ReadPacket returns the XMP element stored in the metadata element or
+// io.EOF when the file contains no XMP. Namespace declarations inherited
+// from enclosing SVG elements are added to the returned element.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := locate(b)
+	if err != nil {
+		return nil, err
+	}
+	if loc.start < 0 {
+		return nil, io.EOF
+	}
+	return loc.fragment(b), nil
+}
+
+// Read decodes the XMP tree embedded in an SVG file.
+func Read(r io.Reader) (*xmp.Document, error) {
+	b, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.NewDecoder(bytes.NewReader(b)).Decode(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// splice stores packet in b at the location of the existing XMP element,
+// inside an existing metadata element or in a new metadata element that
+// becomes the first child of the root element.
+func splice(b []byte, loc *location, packet []byte) ([]byte, error) {
+	var head, tail []byte
+	switch {
+	case loc.start >= 0:
+		head, tail = b[:loc.start], b[loc.end:]
+	case loc.metaStart >= 0 && !loc.metaEmpty:
+		head, tail = b[:loc.metaBody], b[loc.metaBody:]
+	case loc.metaStart >= 0:
+		head, tail = b[:loc.metaStart], b[loc.metaEnd:]
+		packet = wrapMetadata(loc.metaName, packet)
+	case loc.rootEmpty:
+		return nil, ErrInvalidFile
+	default:
+		head, tail = b[:loc.root], b[loc.root:]
+		name := "metadata"
+		if loc.prefix != "" {
+			name = loc.prefix + ":" + name
+		}
+		packet = append([]byte("\n"), wrapMetadata(name, packet)...)
+	}
+	buf := make([]byte, 0, len(head)+len(packet)+len(tail))
+	buf = append(buf, head...)
+	buf = append(buf, packet...)
+	return append(buf, tail...), nil
+}
+
+func wrapMetadata(name string, packet []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%s>", name)
+	buf.Write(packet)
+	fmt.Fprintf(&buf, "</%s>", name)
+	return buf.Bytes()
+}
+
+// WritePacket copies the SVG file from r to w and stores packet, which must
+// be an x:xmpmeta or rdf:RDF element, in the metadata element.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	loc, err := locate(b)
+	if err != nil {
+		return err
+	}
+	return write(w, b, loc, packet)
+}
+
+// Write copies the SVG file from r to w and embeds the XMP document d. An
+// existing XMP tree stored without x:xmpmeta wrapper is replaced by a bare
+// rdf:RDF element.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	loc, err := locate(b)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := xmp.NewEncoder(&buf)
+	enc.SetFlags(0)
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+	packet := buf.Bytes()
+	if loc.rdfOnly {
+		start := bytes.Index(packet, []byte("<rdf:RDF"))
+		end := bytes.LastIndex(packet, []byte("</rdf:RDF>"))
+		if start < 0 || end < 0 {
+			return fmt.Errorf("svg: missing rdf:RDF element")
+		}
+		packet = packet[start : end+len("</rdf:RDF>")]
+	}
+	return write(w, b, loc, packet)
+}
+
+func write(w io.Writer, b []byte, loc *location, packet []byte) error {
+	buf, err := splice(b, loc, packet)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tiff
+
+import (
+	"io"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var tiffMagic = []xmp.Magic{
+	{Offset: 0, Value: []byte("II*\x00")},
+	{Offset: 0, Value: []byte("MM\x00*")},
+	{Offset: 0, Value: []byte("IIRO")},    // Olympus ORF
+	{Offset: 0, Value: []byte("IIRS")},    // Olympus ORF
+	{Offset: 0, Value: []byte("IIU\x00")}, // Panasonic RW2
+}
+
+type handler struct{}
+
+func (handler) CanHandle(head []byte) bool {
+	for _, v := range tiffMagic {
+		if v.Match(head) {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	return Read(r)
+}
+
+func (handler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	f, ok := w.(io.ReadWriteSeeker)
+	if !ok {
+		return xmp.ErrNotSeekable
+	}
+	return Write(f, d)
+}
+
+func (handler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite | xmp.CapInPlace
+}
+
+func init() {
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name: "tiff",
+		Extensions: []string{
+			".tif", ".tiff", ".dng", ".cr2", ".nef", ".nrw", ".arw", ".sr2",
+			".srf", ".pef", ".orf", ".rw2", ".3fr", ".erf", ".kdc", ".mos",
+		},
+		Magic:   tiffMagic,
+		Handler: handler{},
+	})
+}
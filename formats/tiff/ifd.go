@@ -0,0 +1,319 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// TIFF field types
+type DataType uint16
+
+const (
+	TypeByte      DataType = 1
+	TypeASCII     DataType = 2
+	TypeShort     DataType = 3
+	TypeLong      DataType = 4
+	TypeRational  DataType = 5
+	TypeSByte     DataType = 6
+	TypeUndefined DataType = 7
+	TypeSShort    DataType = 8
+	TypeSLong     DataType = 9
+	TypeSRational DataType = 10
+	TypeFloat     DataType = 11
+	TypeDouble    DataType = 12
+	TypeIFD       DataType = 13
+)
+
+// Size returns the size in bytes of a single value of type t.
+func (t DataType) Size() int {
+	switch t {
+	case TypeByte, TypeASCII, TypeSByte, TypeUndefined:
+		return 1
+	case TypeShort, TypeSShort:
+		return 2
+	case TypeLong, TypeSLong, TypeFloat, TypeIFD:
+		return 4
+	case TypeRational, TypeSRational, TypeDouble:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// well-known TIFF tags
+const (
+	TagImageWidth                uint16 = 0x0100
+	TagImageLength               uint16 = 0x0101
+	TagBitsPerSample             uint16 = 0x0102
+	TagCompression               uint16 = 0x0103
+	TagPhotometricInterpretation uint16 = 0x0106
+	TagImageDescription          uint16 = 0x010e
+	TagMake                      uint16 = 0x010f
+	TagModel                     uint16 = 0x0110
+	TagStripOffsets              uint16 = 0x0111
+	TagOrientation               uint16 = 0x0112
+	TagSamplesPerPixel           uint16 = 0x0115
+	TagStripByteCounts           uint16 = 0x0117
+	TagXResolution               uint16 = 0x011a
+	TagYResolution               uint16 = 0x011b
+	TagPlanarConfiguration       uint16 = 0x011c
+	TagResolutionUnit            uint16 = 0x0128
+	TagTransferFunction          uint16 = 0x012d
+	TagSoftware                  uint16 = 0x0131
+	TagDateTime                  uint16 = 0x0132
+	TagArtist                    uint16 = 0x013b
+	TagWhitePoint                uint16 = 0x013e
+	TagPrimaryChromaticities     uint16 = 0x013f
+	TagJPEGInterchangeFormat     uint16 = 0x0201
+	TagJPEGInterchangeFormatLen  uint16 = 0x0202
+	TagYCbCrCoefficients         uint16 = 0x0211
+	TagYCbCrSubSampling          uint16 = 0x0212
+	TagYCbCrPositioning          uint16 = 0x0213
+	TagReferenceBlackWhite       uint16 = 0x0214
+	TagXMLPacket                 uint16 = 0x02bc
+	TagCopyright                 uint16 = 0x8298
+	TagPhotoshop                 uint16 = 0x8649
+	TagExifIFD                   uint16 = 0x8769
+	TagGPSIFD                    uint16 = 0x8825
+	TagInteropIFD                uint16 = 0xa005
+)
+
+var (
+	ErrInvalidFile = errors.New("tiff: invalid file format")
+	ErrBigTIFF     = errors.New("tiff: BigTIFF is not supported")
+)
+
+// maximum size of a single IFD entry value we are willing to load
+const maxValueSize = 1 << 28
+
+// Entry is a single IFD entry. Data holds the raw value bytes in file
+// byte order. Offset is the position of values larger than 4 bytes or
+// zero for values stored inline.
+type Entry struct {
+	Tag    uint16
+	Type   DataType
+	Count  uint32
+	Offset uint32
+	Data   []byte
+	pos    int64 // file position of the 12 byte entry
+}
+
+// IFD is a TIFF image file directory.
+type IFD struct {
+	Order   binary.ByteOrder
+	Offset  uint32
+	Entries []Entry
+	Next    uint32
+}
+
+func (x *IFD) Find(tag uint16) *Entry {
+	for i := range x.Entries {
+		if x.Entries[i].Tag == tag {
+			return &x.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Reader provides random access to a TIFF structured file or blob.
+type Reader struct {
+	r     io.ReadSeeker
+	size  int64
+	Order binary.ByteOrder
+	First uint32 // offset of IFD0
+}
+
+func NewReader(r io.ReadSeeker) (*Reader, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	x := &Reader{r: r, size: size}
+	var hdr [8]byte
+	if err := x.readAt(hdr[:], 0); err != nil {
+		return nil, ErrInvalidFile
+	}
+	switch string(hdr[:2]) {
+	case "II":
+		x.Order = binary.LittleEndian
+	case "MM":
+		x.Order = binary.BigEndian
+	default:
+		return nil, ErrInvalidFile
+	}
+	switch x.Order.Uint16(hdr[2:]) {
+	case 42:
+	case 43:
+		return nil, ErrBigTIFF
+	case 0x4f52, 0x5352, 0x55:
+		// Olympus ORF and Panasonic RW2 raw files
+	default:
+		return nil, ErrInvalidFile
+	}
+	x.First = x.Order.Uint32(hdr[4:])
+	return x, nil
+}
+
+func (x *Reader) Size() int64 {
+	return x.size
+}
+
+func (x *Reader) readAt(buf []byte, off int64) error {
+	if off < 0 || off+int64(len(buf)) > x.size && x.size > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if _, err := x.r.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(x.r, buf)
+	return err
+}
+
+// ReadIFD reads the directory at offset including all entry values.
+func (x *Reader) ReadIFD(offset uint32) (*IFD, error) {
+	var cnt [2]byte
+	if err := x.readAt(cnt[:], int64(offset)); err != nil {
+		return nil, fmt.Errorf("tiff: reading IFD at offset %d: %v", offset, err)
+	}
+	n := int(x.Order.Uint16(cnt[:]))
+	buf := make([]byte, n*12+4)
+	if err := x.readAt(buf, int64(offset)+2); err != nil {
+		return nil, fmt.Errorf("tiff: reading IFD at offset %d: %v", offset, err)
+	}
+	ifd := &IFD{
+		Order:   x.Order,
+		Offset:  offset,
+		Entries: make([]Entry, 0, n),
+		Next:    x.Order.Uint32(buf[n*12:]),
+	}
+	for i := 0; i < n; i++ {
+		b := buf[i*12 : i*12+12]
+		e := Entry{
+			Tag:   x.Order.Uint16(b),
+			Type:  DataType(x.Order.Uint16(b[2:])),
+			Count: x.Order.Uint32(b[4:]),
+			pos:   int64(offset) + 2 + int64(i*12),
+		}
+		sz := int64(e.Type.Size()) * int64(e.Count)
+		switch {
+		case e.Type.Size() == 0:
+			// skip unknown types
+			continue
+		case sz > maxValueSize:
+			return nil, fmt.Errorf("tiff: tag 0x%04x value too large (%d bytes)", e.Tag, sz)
+		case sz <= 4:
+			e.Data = make([]byte, sz)
+			copy(e.Data, b[8:])
+		default:
+			e.Offset = x.Order.Uint32(b[8:])
+			e.Data = make([]byte, sz)
+			if err := x.readAt(e.Data, int64(e.Offset)); err != nil {
+				// be resilient to broken offsets in vendor tags
+				xmp.Log.Warnf("tiff: reading tag 0x%04x at offset %d: %v", e.Tag, e.Offset, err)
+				continue
+			}
+		}
+		ifd.Entries = append(ifd.Entries, e)
+	}
+	return ifd, nil
+}
+
+// Uint returns the i-th integer value of BYTE, SHORT, LONG and IFD entries.
+func (e Entry) Uint(order binary.ByteOrder, i int) uint32 {
+	if i < 0 || uint32(i) >= e.Count {
+		return 0
+	}
+	switch e.Type {
+	case TypeByte, TypeUndefined, TypeSByte:
+		return uint32(e.Data[i])
+	case TypeShort, TypeSShort:
+		return uint32(order.Uint16(e.Data[i*2:]))
+	case TypeLong, TypeSLong, TypeIFD:
+		return order.Uint32(e.Data[i*4:])
+	default:
+		return 0
+	}
+}
+
+// Int returns the i-th value as signed integer.
+func (e Entry) Int(order binary.ByteOrder, i int) int {
+	switch e.Type {
+	case TypeSByte:
+		return int(int8(e.Uint(order, i)))
+	case TypeSShort:
+		return int(int16(e.Uint(order, i)))
+	case TypeSLong:
+		return int(int32(e.Uint(order, i)))
+	default:
+		return int(e.Uint(order, i))
+	}
+}
+
+// Ints returns all integer values.
+func (e Entry) Ints(order binary.ByteOrder) []int {
+	l := make([]int, 0, e.Count)
+	for i := 0; i < int(e.Count); i++ {
+		l = append(l, e.Int(order, i))
+	}
+	return l
+}
+
+// Rational returns the i-th value of RATIONAL and SRATIONAL entries.
+func (e Entry) Rational(order binary.ByteOrder, i int) xmp.Rational {
+	if i < 0 || uint32(i) >= e.Count {
+		return xmp.Rational{}
+	}
+	switch e.Type {
+	case TypeRational:
+		return xmp.Rational{
+			Num: int64(order.Uint32(e.Data[i*8:])),
+			Den: int64(order.Uint32(e.Data[i*8+4:])),
+		}
+	case TypeSRational:
+		return xmp.Rational{
+			Num: int64(int32(order.Uint32(e.Data[i*8:]))),
+			Den: int64(int32(order.Uint32(e.Data[i*8+4:]))),
+		}
+	case TypeFloat:
+		return xmp.FloatToRational(math.Float32frombits(order.Uint32(e.Data[i*4:])))
+	case TypeDouble:
+		return xmp.FloatToRational(float32(math.Float64frombits(order.Uint64(e.Data[i*8:]))))
+	default:
+		return xmp.Rational{Num: int64(e.Int(order, i)), Den: 1}
+	}
+}
+
+// Rationals returns all rational values.
+func (e Entry) Rationals(order binary.ByteOrder) xmp.RationalArray {
+	l := make(xmp.RationalArray, 0, e.Count)
+	for i := 0; i < int(e.Count); i++ {
+		l = append(l, e.Rational(order, i))
+	}
+	return l
+}
+
+// String returns the value of ASCII entries without trailing NUL bytes
+// and whitespace.
+func (e Entry) String() string {
+	return strings.TrimRight(string(e.Data), "\x00 ")
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package tiff implements reading and writing of XMP packets embedded in
+// TIFF tag 700 (XMLPacket) as defined by XMP Specification Part 3. This
+// also covers DNG and TIFF-based camera raw formats.
+//
+// Packets are updated without rewriting the file. When a new packet fits
+// into the space of the existing one it is overwritten in place, otherwise
+// it is appended to the end of the file and the IFD entry is patched.
+package tiff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/trimmer-io/go-xmp/formats/irb"
+	tiffmodel "github.com/trimmer-io/go-xmp/models/tiff"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// ReadPacket returns the XMP packet stored in tag 700 of IFD0 or io.EOF
+// when the file contains no XMP.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	ifd, err := readIFD0(r)
+	if err != nil {
+		return nil, err
+	}
+	return packetFromIFD(ifd)
+}
+
+// ReadResources returns the Photoshop image resources stored in tag 34377
+// of IFD0 or io.EOF when the file contains none.
+func ReadResources(r io.ReadSeeker) (irb.Resources, error) {
+	ifd, err := readIFD0(r)
+	if err != nil {
+		return nil, err
+	}
+	return resourcesFromIFD(ifd)
+}
+
+// Read decodes the XMP packet embedded in a TIFF file and adds a tiff
+// model built from the baseline tags in IFD0. IPTC-NAA and ICC profile
+// resources from tag 34377 are merged into the photoshop and dc models.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	ifd, err := readIFD0(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := packetFromIFD(ifd)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	if _, err := d.AddModel(NewInfo(ifd)); err != nil {
+		return nil, err
+	}
+	switch l, err := resourcesFromIFD(ifd); err {
+	case nil:
+		if err := l.AddModels(d); err != nil {
+			return nil, err
+		}
+	case io.EOF:
+	default:
+		xmp.Log.Warnf("tiff: skipping image resources: %v", err)
+	}
+	return d, nil
+}
+
+// ReadInfo fills a tiff model from the baseline tags in IFD0.
+func ReadInfo(r io.ReadSeeker) (*tiffmodel.TiffInfo, error) {
+	ifd, err := readIFD0(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewInfo(ifd), nil
+}
+
+func readIFD0(r io.ReadSeeker) (*IFD, error) {
+	x, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return x.ReadIFD(x.First)
+}
+
+func packetFromIFD(ifd *IFD) ([]byte, error) {
+	e := ifd.Find(TagXMLPacket)
+	if e == nil || len(e.Data) == 0 {
+		return nil, io.EOF
+	}
+	return e.Data, nil
+}
+
+func resourcesFromIFD(ifd *IFD) (irb.Resources, error) {
+	e := ifd.Find(TagPhotoshop)
+	if e == nil || len(e.Data) == 0 {
+		return nil, io.EOF
+	}
+	return irb.Parse(e.Data)
+}
+
+// NewInfo creates a tiff model from the baseline tags of ifd.
+func NewInfo(ifd *IFD) *tiffmodel.TiffInfo {
+	o := ifd.Order
+	m := &tiffmodel.TiffInfo{}
+	for _, e := range ifd.Entries {
+		switch e.Tag {
+		case TagImageWidth:
+			m.ImageWidth = int(e.Uint(o, 0))
+		case TagImageLength:
+			m.ImageLength = int(e.Uint(o, 0))
+		case TagBitsPerSample:
+			m.BitsPerSample = xmp.IntList(e.Ints(o))
+		case TagCompression:
+			m.Compression = tiffmodel.CompressionType(e.Uint(o, 0))
+		case TagPhotometricInterpretation:
+			m.PhotometricInterpretation = tiffmodel.ColorModel(e.Uint(o, 0))
+		case TagOrientation:
+			m.Orientation = tiffmodel.OrientationType(e.Uint(o, 0))
+		case TagSamplesPerPixel:
+			m.SamplesPerPixel = int(e.Uint(o, 0))
+		case TagPlanarConfiguration:
+			m.PlanarConfiguration = tiffmodel.PlanarType(e.Uint(o, 0))
+		case TagResolutionUnit:
+			m.ResolutionUnit = tiffmodel.ResolutionUnit(e.Uint(o, 0))
+		case TagXResolution:
+			m.XResolution = e.Rational(o, 0)
+		case TagYResolution:
+			m.YResolution = e.Rational(o, 0)
+		case TagTransferFunction:
+			m.TransferFunction = xmp.IntList(e.Ints(o))
+		case TagWhitePoint:
+			m.WhitePoint = e.Rationals(o)
+		case TagPrimaryChromaticities:
+			m.PrimaryChromaticities = e.Rationals(o)
+		case TagYCbCrCoefficients:
+			m.YCbCrCoefficients = e.Rationals(o)
+		case TagYCbCrSubSampling:
+			m.YCbCrSubSampling = tiffmodel.YCbCrSubSampling(e.Ints(o))
+		case TagYCbCrPositioning:
+			m.YCbCrPositioning = tiffmodel.YCbCrPosition(e.Uint(o, 0))
+		case TagReferenceBlackWhite:
+			m.ReferenceBlackWhite = e.Rationals(o)
+		case TagMake:
+			m.Make = e.String()
+		case TagModel:
+			m.Model = e.String()
+		case TagSoftware:
+			m.Software = e.String()
+		case TagArtist:
+			if s := e.String(); s != "" {
+				m.Artist = xmp.StringList(strings.Split(s, ";"))
+			}
+		case TagImageDescription:
+			if s := e.String(); s != "" {
+				m.ImageDescription = xmp.NewAltString(s)
+			}
+		case TagCopyright:
+			if s := e.String(); s != "" {
+				m.Copyright = xmp.NewAltString(s)
+			}
+		case TagDateTime:
+			if t, err := time.Parse("2006:01:02 15:04:05", e.String()); err == nil {
+				m.DateTime = xmp.NewDate(t)
+			}
+		}
+	}
+	return m
+}
+
+// WritePacket stores packet in tag 700 of IFD0. The file is never
+// rewritten. Existing packet space is reused when possible, otherwise the
+// packet is appended to the file. When IFD0 has no XMLPacket entry, a copy
+// of IFD0 with the new entry is appended and the header is patched.
+func WritePacket(f io.ReadWriteSeeker, packet []byte) error {
+	x, err := NewReader(f)
+	if err != nil {
+		return err
+	}
+	ifd, err := x.ReadIFD(x.First)
+	if err != nil {
+		return err
+	}
+	o := x.Order
+	if e := ifd.Find(TagXMLPacket); e != nil {
+		ofs := int64(e.Offset)
+		if e.Offset == 0 || len(packet) > len(e.Data) {
+			if ofs, err = appendData(f, packet); err != nil {
+				return err
+			}
+		} else if err := writeAt(f, packet, ofs); err != nil {
+			return err
+		}
+		var b [8]byte
+		o.PutUint32(b[:], uint32(len(packet)))
+		o.PutUint32(b[4:], uint32(ofs))
+		return writeAt(f, b[:], e.pos+4)
+	}
+
+	// append the packet and a copy of IFD0 with an additional entry
+	ofs, err := appendData(f, packet)
+	if err != nil {
+		return err
+	}
+	var cnt [2]byte
+	if err := x.readAt(cnt[:], int64(x.First)); err != nil {
+		return err
+	}
+	n := int(o.Uint16(cnt[:]))
+	buf := make([]byte, n*12+4)
+	if err := x.readAt(buf, int64(x.First)+2); err != nil {
+		return err
+	}
+	entries := make([][]byte, 0, n+1)
+	for i := 0; i < n; i++ {
+		entries = append(entries, buf[i*12:i*12+12])
+	}
+	e := make([]byte, 12)
+	o.PutUint16(e, TagXMLPacket)
+	o.PutUint16(e[2:], uint16(TypeByte))
+	o.PutUint32(e[4:], uint32(len(packet)))
+	o.PutUint32(e[8:], uint32(ofs))
+	entries = append(entries, e)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return o.Uint16(entries[i]) < o.Uint16(entries[j])
+	})
+	ifdBuf := make([]byte, 0, 2+len(entries)*12+4)
+	ifdBuf = append(ifdBuf, cnt[:]...)
+	o.PutUint16(ifdBuf, uint16(len(entries)))
+	for _, v := range entries {
+		ifdBuf = append(ifdBuf, v...)
+	}
+	ifdBuf = append(ifdBuf, buf[n*12:]...) // next IFD offset
+	pos, err := appendData(f, ifdBuf)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	o.PutUint32(hdr[:], uint32(pos))
+	return writeAt(f, hdr[:], 4)
+}
+
+// Write embeds the XMP document d into the TIFF file f.
+func Write(f io.ReadWriteSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(f, b)
+}
+
+func writeAt(f io.WriteSeeker, b []byte, off int64) error {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write(b)
+	return err
+}
+
+// appendData writes b word-aligned at the end of f and returns its offset.
+func appendData(f io.WriteSeeker, b []byte) (int64, error) {
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if end&1 == 1 {
+		if _, err := f.Write([]byte{0}); err != nil {
+			return 0, err
+		}
+		end++
+	}
+	if end+int64(len(b)) > 0xffffffff {
+		return 0, fmt.Errorf("tiff: file exceeds 4GB limit")
+	}
+	_, err = f.Write(b)
+	return end, err
+}
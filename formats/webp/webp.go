@@ -0,0 +1,284 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package webp implements reading and writing of XMP packets embedded in
+// the XMP chunk of extended format WebP files.
+package webp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var ErrInvalidFile = errors.New("webp: invalid file format")
+
+const (
+	chunkVP8X = "VP8X"
+	chunkVP8  = "VP8 "
+	chunkVP8L = "VP8L"
+	chunkXMP  = "XMP "
+)
+
+// VP8X feature flags
+const (
+	flagAlpha = 0x10
+	flagXMP   = 0x04
+)
+
+// size of the VP8X chunk payload
+const vp8xSize = 10
+
+// chunk is a single RIFF chunk. Data holds the payload without padding.
+type chunk struct {
+	ID   string
+	Data []byte
+}
+
+func (c chunk) size() int64 {
+	return 8 + int64(len(c.Data)) + int64(len(c.Data)&1)
+}
+
+func (c chunk) WriteTo(w io.Writer) (int64, error) {
+	var hdr [8]byte
+	copy(hdr[:], c.ID)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(c.Data)))
+	b := [][]byte{hdr[:], c.Data}
+	if len(c.Data)&1 == 1 {
+		b = append(b, []byte{0})
+	}
+	var n int64
+	for _, v := range b {
+		m, err := w.Write(v)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readHeader checks the RIFF/WEBP signature and returns the form size.
+func readHeader(r io.Reader) (int64, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, ErrInvalidFile
+	}
+	if string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WEBP" {
+		return 0, ErrInvalidFile
+	}
+	return int64(binary.LittleEndian.Uint32(hdr[4:])), nil
+}
+
+// readData reads n bytes of chunk data. The buffer grows while reading so
+// sizes from a forged header cannot trigger a huge allocation, short
+// files fail with ErrInvalidFile.
+func readData(r io.Reader, n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, n); err != nil {
+		if err == io.EOF {
+			return nil, ErrInvalidFile
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readChunks reads all chunks of the RIFF form.
+func readChunks(r io.Reader) ([]chunk, error) {
+	size, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]chunk, 0)
+	lr := &io.LimitedReader{R: r, N: size - 4}
+	for lr.N >= 8 {
+		var hdr [8]byte
+		if _, err := io.ReadFull(lr, hdr[:]); err != nil {
+			return nil, ErrInvalidFile
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		if n > lr.N {
+			return nil, fmt.Errorf("webp: chunk %s size %d exceeds file", string(hdr[:4]), n)
+		}
+		data, err := readData(lr, n)
+		if err != nil {
+			return nil, err
+		}
+		c := chunk{ID: string(hdr[:4]), Data: data}
+		if n&1 == 1 && lr.N > 0 {
+			if _, err := io.CopyN(ioutil.Discard, lr, 1); err != nil {
+				return nil, err
+			}
+		}
+		l = append(l, c)
+	}
+	if len(l) == 0 {
+		return nil, ErrInvalidFile
+	}
+	return l, nil
+}
+
+// ReadPacket returns the XMP packet stored in the XMP chunk or io.EOF
+// when the file contains no XMP.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	size, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	for lr := (&io.LimitedReader{R: br, N: size - 4}); lr.N >= 8; {
+		var hdr [8]byte
+		if _, err := io.ReadFull(lr, hdr[:]); err != nil {
+			return nil, ErrInvalidFile
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		if n > lr.N {
+			return nil, ErrInvalidFile
+		}
+		if string(hdr[:4]) == chunkXMP {
+			b, err := readData(lr, n)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.TrimRight(b, "\x00"), nil
+		}
+		if _, err := io.CopyN(ioutil.Discard, lr, n+n&1); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	return nil, io.EOF
+}
+
+// Read decodes the XMP packet embedded in a WebP file.
+func Read(r io.Reader) (*xmp.Document, error) {
+	b, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// makeVP8X creates the extended format header for a simple format file
+// from the dimensions stored in the VP8 or VP8L bitstream.
+func makeVP8X(c chunk) (chunk, error) {
+	var w, h int
+	var flags byte
+	b := c.Data
+	switch c.ID {
+	case chunkVP8:
+		// 3 byte frame tag, start code, 14 bit width and height
+		if len(b) < 10 || !bytes.Equal(b[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return chunk{}, fmt.Errorf("webp: invalid VP8 bitstream")
+		}
+		w = int(binary.LittleEndian.Uint16(b[6:]) & 0x3fff)
+		h = int(binary.LittleEndian.Uint16(b[8:]) & 0x3fff)
+	case chunkVP8L:
+		// signature byte followed by 14 bit width-1, height-1 and alpha bit
+		if len(b) < 5 || b[0] != 0x2f {
+			return chunk{}, fmt.Errorf("webp: invalid VP8L bitstream")
+		}
+		v := binary.LittleEndian.Uint32(b[1:])
+		w = int(v&0x3fff) + 1
+		h = int(v>>14&0x3fff) + 1
+		if v>>28&1 == 1 {
+			flags |= flagAlpha
+		}
+	default:
+		return chunk{}, ErrInvalidFile
+	}
+	x := chunk{ID: chunkVP8X, Data: make([]byte, vp8xSize)}
+	x.Data[0] = flags
+	putUint24(x.Data[4:], w-1)
+	putUint24(x.Data[7:], h-1)
+	return x, nil
+}
+
+// WritePacket copies the WebP file from r to w and stores packet in the
+// XMP chunk. Simple format files are converted to extended format, the
+// XMP flag in the VP8X header and the RIFF size are updated. All other
+// chunks are copied unchanged.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	l, err := readChunks(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	if l[0].ID != chunkVP8X {
+		x, err := makeVP8X(l[0])
+		if err != nil {
+			return err
+		}
+		l = append([]chunk{x}, l...)
+	}
+	if len(l[0].Data) < vp8xSize {
+		return fmt.Errorf("webp: short VP8X chunk")
+	}
+	l[0].Data[0] |= flagXMP
+
+	// XMP is the last chunk in extended format files
+	out := make([]chunk, 0, len(l)+1)
+	for _, c := range l {
+		if c.ID != chunkXMP {
+			out = append(out, c)
+		}
+	}
+	out = append(out, chunk{ID: chunkXMP, Data: packet})
+
+	var size int64 = 4
+	for _, c := range out {
+		size += c.size()
+	}
+	if size > 0xffffffff {
+		return fmt.Errorf("webp: file too large")
+	}
+	bw := bufio.NewWriter(w)
+	var hdr [12]byte
+	copy(hdr[:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(size))
+	copy(hdr[8:], "WEBP")
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	for _, c := range out {
+		if _, err := c.WriteTo(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Write copies the WebP file from r to w and embeds the XMP document d.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, b)
+}
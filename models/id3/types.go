@@ -145,21 +145,26 @@ type Genre []string
 
 func (x *Genre) UnmarshalText(data []byte) error {
 	value := string(data)
+	l := make(Genre, 0)
 	for _, v := range strings.Split(value, ",") {
 		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
 		if g, err := ParseGenreV1(v); err == nil {
-			*x = append(*x, g.String())
+			l = append(l, g.String())
 			continue
 		}
-		switch value {
+		switch v {
 		case "RX":
-			*x = append(*x, "Remix")
+			l = append(l, "Remix")
 		case "CR":
-			*x = append(*x, "Cover")
+			l = append(l, "Cover")
 		default:
-			*x = append(*x, value)
+			l = append(l, v)
 		}
 	}
+	*x = l
 	return nil
 }
 
@@ -0,0 +1,96 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package illustrator implements the Adobe Illustrator namespace used in
+// AI and EPS files.
+package illustrator
+
+import (
+	"fmt"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var (
+	NsIllustrator = xmp.NewNamespace("illustrator", "http://ns.adobe.com/illustrator/1.0/", NewModel)
+)
+
+func init() {
+	xmp.Register(NsIllustrator, xmp.XmpMetadata)
+}
+
+func NewModel(name string) xmp.Model {
+	return &Illustrator{}
+}
+
+func MakeModel(d *xmp.Document) (*Illustrator, error) {
+	m, err := d.MakeModel(NsIllustrator)
+	if err != nil {
+		return nil, err
+	}
+	x, _ := m.(*Illustrator)
+	return x, nil
+}
+
+func FindModel(d *xmp.Document) *Illustrator {
+	if m := d.FindModel(NsIllustrator); m != nil {
+		return m.(*Illustrator)
+	}
+	return nil
+}
+
+type Illustrator struct {
+	Type           string `xmp:"illustrator:Type"`           // "Document"
+	StartupProfile string `xmp:"illustrator:StartupProfile"` // "Print", "Web", "Mobile", ...
+	CreatorSubTool string `xmp:"illustrator:CreatorSubTool"`
+}
+
+func (x Illustrator) Can(nsName string) bool {
+	return NsIllustrator.GetName() == nsName
+}
+
+func (x Illustrator) Namespaces() xmp.NamespaceList {
+	return xmp.NamespaceList{NsIllustrator}
+}
+
+func (x *Illustrator) SyncModel(d *xmp.Document) error {
+	return nil
+}
+
+func (x *Illustrator) SyncFromXMP(d *xmp.Document) error {
+	return nil
+}
+
+func (x Illustrator) SyncToXMP(d *xmp.Document) error {
+	return nil
+}
+
+func (x *Illustrator) CanTag(tag string) bool {
+	_, err := xmp.GetNativeField(x, tag)
+	return err == nil
+}
+
+func (x *Illustrator) GetTag(tag string) (string, error) {
+	if v, err := xmp.GetNativeField(x, tag); err != nil {
+		return "", fmt.Errorf("%s: %v", NsIllustrator.GetName(), err)
+	} else {
+		return v, nil
+	}
+}
+
+func (x *Illustrator) SetTag(tag, value string) error {
+	if err := xmp.SetNativeField(x, tag, value); err != nil {
+		return fmt.Errorf("%s: %v", NsIllustrator.GetName(), err)
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	_ "github.com/trimmer-io/go-xmp/models/dji"
 	_ "github.com/trimmer-io/go-xmp/models/exif"
 	_ "github.com/trimmer-io/go-xmp/models/id3"
+	_ "github.com/trimmer-io/go-xmp/models/illustrator"
 	_ "github.com/trimmer-io/go-xmp/models/itunes"
 	_ "github.com/trimmer-io/go-xmp/models/ixml"
 	_ "github.com/trimmer-io/go-xmp/models/mp4"
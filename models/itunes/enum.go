@@ -19,7 +19,9 @@ package itunes
 
 import (
 	"bytes"
+	"fmt"
 	"strconv"
+	"strings"
 )
 
 type MediaType int
@@ -259,6 +261,33 @@ const (
 	AppleStoreZWE AppleStoreCountry = 143605 // Zimbabwe
 )
 
+// MarshalText keeps the numeric storefront id used by iTunes.
+func (x AppleStoreCountry) MarshalText() ([]byte, error) {
+	if x == 0 {
+		return nil, nil
+	}
+	return []byte(strconv.FormatInt(int64(x), 10)), nil
+}
+
+// UnmarshalText accepts plain storefront ids as well as the full iTunes
+// storefront string "143441-1,29" where only the country part is kept.
+func (x *AppleStoreCountry) UnmarshalText(data []byte) error {
+	v := strings.TrimSpace(string(data))
+	if i := strings.IndexAny(v, "-,"); i >= 0 {
+		v = v[:i]
+	}
+	if v == "" {
+		*x = 0
+		return nil
+	}
+	i, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return fmt.Errorf("iTunes: invalid store front id '%s'", string(data))
+	}
+	*x = AppleStoreCountry(i)
+	return nil
+}
+
 // iTunes Genre category, genre and subgenre
 // https://affiliate.itunes.apple.com/resources/documentation/genre-mapping/
 // https://itunes.apple.com/WebObjects/MZStoreServices.woa/ws/genres
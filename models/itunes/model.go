@@ -177,7 +177,7 @@ type ITunesMetadata struct {
 	SortName          string                `iTunes:"sonm" xmp:"iTunes:SortName"`
 	SortShow          string                `iTunes:"sosn" xmp:"iTunes:SortShow"`
 	SoundEngineer     string                `iTunes:"©sne" xmp:"iTunes:SoundEngineer"`
-	StoreFrontID      string                `iTunes:"sfID" xmp:"iTunes:StoreFrontID"` // apple store country
+	StoreFrontID      AppleStoreCountry     `iTunes:"sfID" xmp:"iTunes:StoreFrontID"` // apple store country
 	Synopsis          string                `iTunes:"ldes" xmp:"iTunes:Synopsis"`
 	Thanks            string                `iTunes:"©thx" xmp:"iTunes:Thanks"`
 	Title             string                `iTunes:"©nam" xmp:"iTunes:Title"`
@@ -109,7 +109,7 @@ func (x PDFInfo) SyncToXMP(d *xmp.Document) error {
 	if len(m.Description) == 0 {
 		m.Description = x.Subject
 	}
-	if len(m.Rights) == 0 {
+	if len(m.Rights) == 0 && x.Copyright != "" {
 		m.Rights.AddDefault("", x.Copyright)
 	}
 
@@ -57,8 +57,36 @@ type Location struct {
 	Role      LocationRole `xmp:"qt:Role,attr"`
 }
 
+// UnmarshalText parses ISO 6709 locations as stored in ©xyz atoms, e.g.
+// "+52.5200+013.4050+034.000/". Latitude and longitude keep their signed
+// decimal representation.
 func (x *Location) UnmarshalText(data []byte) error {
-	// todo: need sample data
+	v := strings.TrimSuffix(strings.TrimSpace(string(data)), "/")
+	l := make([]string, 0, 3)
+	for i := 0; i < len(v); {
+		j := strings.IndexAny(v[i+1:], "+-")
+		if j < 0 {
+			l = append(l, v[i:])
+			break
+		}
+		l = append(l, v[i:i+1+j])
+		i += 1 + j
+	}
+	if len(l) < 2 || len(l) > 3 {
+		return fmt.Errorf("qt: invalid ISO 6709 location '%s'", string(data))
+	}
+	loc := Location{
+		Latitude:  xmp.GPSCoord(l[0]),
+		Longitude: xmp.GPSCoord(l[1]),
+	}
+	if len(l) == 3 {
+		alt, err := strconv.ParseFloat(l[2], 64)
+		if err != nil {
+			return fmt.Errorf("qt: invalid ISO 6709 altitude '%s': %v", l[2], err)
+		}
+		loc.Altitude = alt
+	}
+	x.Latitude, x.Longitude, x.Altitude = loc.Latitude, loc.Longitude, loc.Altitude
 	return nil
 }
 
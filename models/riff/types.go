@@ -30,6 +30,10 @@ func (x *StringArray) UnmarshalText(data []byte) error {
 	return nil
 }
 
+func (x StringArray) MarshalText() ([]byte, error) {
+	return []byte(strings.Join(x, "; ")), nil
+}
+
 func (x StringArray) MarshalXMP(e *xmp.Encoder, node *xmp.Node, m xmp.Model) error {
 	return xmp.MarshalArray(e, node, x.Typ(), x)
 }
@@ -49,6 +53,14 @@ func (x *AltString) UnmarshalText(data []byte) error {
 	return nil
 }
 
+func (x AltString) MarshalText() ([]byte, error) {
+	l := make([]string, 0, len(x))
+	for _, v := range x {
+		l = append(l, v.Value)
+	}
+	return []byte(strings.Join(l, "; ")), nil
+}
+
 func (x AltString) Typ() xmp.ArrayType {
 	return xmp.ArrayTypeAlternative
 }
@@ -0,0 +1,345 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/trimmer-io/go-xmp/formats/bmff"
+	"github.com/trimmer-io/go-xmp/models/itunes"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// intlText encodes a QuickTime international text entry with a packed
+// ISO 639-2/T language code.
+func intlText(lang, s string) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	binary.BigEndian.PutUint16(b[2:], uint16(lang[0]-0x60)<<10|uint16(lang[1]-0x60)<<5|uint16(lang[2]-0x60))
+	return append(b, s...)
+}
+
+// dataAtom encodes an ilst data atom of type typ.
+func dataAtom(typ uint32, value []byte) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, typ)
+	return makeBox("data", b, value)
+}
+
+func hdlrBox(handler string) []byte {
+	return makeBox("hdlr", make([]byte, 8), []byte(handler), make([]byte, 13))
+}
+
+func u32(v ...uint32) []byte {
+	b := make([]byte, len(v)*4)
+	for i, n := range v {
+		binary.BigEndian.PutUint32(b[i*4:], n)
+	}
+	return b
+}
+
+// makeMovie builds a QuickTime movie with udta text atoms, an iTunes item
+// list in udta/meta and mdta items in moov/meta.
+func makeMovie() []byte {
+	keys := [][]byte{
+		[]byte("com.apple.quicktime.title"),
+		[]byte("com.apple.quicktime.creationdate"),
+		[]byte("com.apple.quicktime.direction.facing"),
+		[]byte("com.example.custom"),
+	}
+	var kbuf bytes.Buffer
+	kbuf.Write(u32(0, uint32(len(keys))))
+	for _, k := range keys {
+		kbuf.Write(u32(uint32(len(k) + 8)))
+		kbuf.WriteString("mdta")
+		kbuf.Write(k)
+	}
+	facing := make([]byte, 4)
+	binary.BigEndian.PutUint32(facing, math.Float32bits(271.5))
+	meta := makeBox("meta",
+		hdlrBox("mdta"),
+		makeBox("keys", kbuf.Bytes()),
+		makeBox("ilst",
+			makeBox("\x00\x00\x00\x01", dataAtom(1, []byte("Clip 1"))),
+			makeBox("\x00\x00\x00\x02", dataAtom(1, []byte("2017-08-06T14:25:00+0200"))),
+			makeBox("\x00\x00\x00\x03", dataAtom(23, facing)),
+			makeBox("\x00\x00\x00\x04", dataAtom(1, []byte("custom value"))),
+		),
+	)
+	ilst := makeBox("ilst",
+		makeBox("\xa9nam", dataAtom(1, []byte("Song"))),
+		makeBox("trkn", dataAtom(0, []byte{0, 0, 0, 3, 0, 12, 0, 0})),
+		makeBox("disk", dataAtom(0, []byte{0, 0, 0, 1, 0, 2})),
+		makeBox("tmpo", dataAtom(21, []byte{0, 120})),
+		makeBox("stik", dataAtom(21, []byte{9})),
+		makeBox("geID", dataAtom(21, u32(4401))),
+		makeBox("covr", dataAtom(13, testThumbnail)),
+		makeBox("----",
+			makeBox("mean", u32(0), []byte("com.apple.iTunes")),
+			makeBox("name", u32(0), []byte("iTunSMPB")),
+			dataAtom(1, []byte(" 00000000 00000840 000001CA 00000000003F31F6")),
+		),
+	)
+	udta := makeBox("udta",
+		makeBox("\xa9nam", intlText("eng", "Movie"), intlText("deu", "Film")),
+		makeBox("\xa9xyz", intlText("eng", "+52.5200+013.4050+034.000/")),
+		makeBox("\xa9fpt", intlText("eng", "+4.80")),
+		makeBox("\xa9gyw", intlText("eng", "-2.00")),
+		makeBox("CNMN", []byte("Canon EOS 5D Mark II\x00")),
+		makeBox("meta", u32(0), hdlrBox("mdir"), ilst),
+		makeBox("XMP_", []byte("<x:xmpmeta/>")),
+	)
+	moov := makeBox("moov", makeBox("mvhd", make([]byte, 100)), udta, meta)
+	ftyp := makeBox("ftyp", []byte("qt  "), []byte{0, 0, 0, 0}, []byte("qt  "))
+	return append(append(ftyp, moov...), makeBox("mdat", mdatPayload)...)
+}
+
+func TestAtomsDecode(T *testing.T) {
+	m, err := bmff.ReadMetadata(bytes.NewReader(makeMovie()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+
+	u := m.Userdata
+	if u == nil {
+		T.Fatalf("missing userdata model")
+	}
+	if u.Title != "Movie" || u.CanonModel != "Canon EOS 5D Mark II" || u.FlightPitch != 4.8 {
+		T.Errorf("invalid userdata %+v", u)
+	}
+	if u.LocationGPS == nil || u.LocationGPS.Latitude != "+52.5200" || u.LocationGPS.Altitude != 34 {
+		T.Errorf("invalid location %+v", u.LocationGPS)
+	}
+	var langs []string
+	for _, it := range m.Items {
+		if it.Key == "©nam" && it.Type == bmff.TypeUTF8 {
+			langs = append(langs, it.Lang)
+		}
+	}
+	if len(langs) != 3 || langs[0] != "eng" || langs[1] != "deu" {
+		T.Errorf("invalid languages %v", langs)
+	}
+
+	if m.DJI == nil || m.DJI.FlightPitchDegree != 4.8 || m.DJI.GimbalYawDegree != -2 {
+		T.Errorf("invalid DJI model %+v", m.DJI)
+	}
+
+	q := m.Metadata
+	if q == nil {
+		T.Fatalf("missing mdta model")
+	}
+	if q.Title != "Clip 1" || q.DirectionFacing != 271.5 {
+		T.Errorf("invalid mdta model %+v", q)
+	}
+	if want := time.Date(2017, 8, 6, 12, 25, 0, 0, time.UTC); !q.CreationDate.Value().Equal(want) {
+		T.Errorf("invalid creation date %v", q.CreationDate)
+	}
+	if len(q.Extension) != 1 || q.Extension[0].Key != "com.example.custom" || q.Extension[0].Value != "custom value" {
+		T.Errorf("invalid mdta extension %v", q.Extension)
+	}
+
+	x := m.ITunes
+	if x == nil {
+		T.Fatalf("missing iTunes model")
+	}
+	if x.Title != "Song" || x.TrackNumber != 3 || x.DiscNumber.Num != 1 || x.DiscNumber.Den != 2 {
+		T.Errorf("invalid iTunes model %+v", x)
+	}
+	if x.BeatsPerMin != 120 || x.MediaType != itunes.MediaTypeMovie || x.GenreID != 4401 {
+		T.Errorf("invalid iTunes integers %+v", x)
+	}
+	if x.CoverArt == "" || x.SMPB == nil || x.SMPB.EncoderDelay != 0x840 {
+		T.Errorf("invalid iTunes binary items %+v", x)
+	}
+
+	if _, err := bmff.ReadMetadata(bytes.NewReader(makeMP4("isom"))); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+// findItem returns the first decoded item with key.
+func findItem(m *bmff.Metadata, key string) *bmff.Item {
+	for i := range m.Items {
+		if m.Items[i].Key == key {
+			return &m.Items[i]
+		}
+	}
+	return nil
+}
+
+func TestAtomsItemTypes(T *testing.T) {
+	// unknown types like GIF (12) and UUID (28) have no text or number
+	// representation
+	for _, typ := range []int{12, 28} {
+		it := bmff.Item{Key: "test", Type: typ, Data: []byte("GIF89a")}
+		if s := it.String(); s != "GIF89a" {
+			T.Errorf("type %d: expected raw data, got %q", typ, s)
+		}
+		if _, ok := it.Int(); ok {
+			T.Errorf("type %d: unexpected integer value", typ)
+		}
+		if _, ok := it.Float(); ok {
+			T.Errorf("type %d: unexpected float value", typ)
+		}
+	}
+	if n, ok := (bmff.Item{Type: bmff.TypeUTF8, Data: []byte("3/12")}).Int(); !ok || n != 3 {
+		T.Errorf("invalid text integer %d", n)
+	}
+	if n, ok := (bmff.Item{Type: bmff.TypeUint16, Data: []byte{1, 2}}).Int(); !ok || n != 258 {
+		T.Errorf("invalid integer %d", n)
+	}
+}
+
+func TestAtomsWrite(T *testing.T) {
+	src := makeMovie()
+	m, err := bmff.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	m.Userdata.Title = "New Movie"
+	m.Userdata.CanonModel = ""
+	m.DJI.GimbalYawDegree = 1.5
+	m.Metadata.Title = "Clip 2"
+	m.Metadata.Make = "Apple"
+	m.Metadata.Extension = nil
+	m.ITunes.Title = "New Song"
+	m.ITunes.MediaType = itunes.MediaTypeMusicVideo
+	m.ITunes.GenreID = 1625
+	m.ITunes.StoreFrontID = itunes.AppleStoreDEU
+	m.ITunes.CDDBToc = "1+150+3000"
+
+	var buf bytes.Buffer
+	if err := bmff.WriteMetadata(&buf, bytes.NewReader(src), m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	x, err := bmff.ReadMetadata(r)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+
+	if x.Userdata.Title != "New Movie" || x.Userdata.CanonModel != "" || findItem(x, "CNMN") != nil {
+		T.Errorf("invalid userdata %+v", x.Userdata)
+	}
+	if it := findItem(x, "©nam"); it == nil || it.Lang != "eng" {
+		T.Errorf("language of replaced text not kept: %+v", it)
+	}
+	if x.DJI.GimbalYawDegree != 1.5 || x.DJI.FlightPitchDegree != 4.8 {
+		T.Errorf("invalid DJI model %+v", x.DJI)
+	}
+	if x.Userdata.LocationGPS == nil || x.Userdata.LocationGPS.Longitude != "+013.4050" {
+		T.Errorf("unchanged location lost %+v", x.Userdata.LocationGPS)
+	}
+
+	q := x.Metadata
+	if q.Title != "Clip 2" || q.Make != "Apple" || q.DirectionFacing != 271.5 || len(q.Extension) != 0 {
+		T.Errorf("invalid mdta model %+v", q)
+	}
+
+	t := x.ITunes
+	if t.Title != "New Song" || t.MediaType != itunes.MediaTypeMusicVideo || t.GenreID != 1625 || t.StoreFrontID != itunes.AppleStoreDEU {
+		T.Errorf("invalid iTunes model %+v", t)
+	}
+	if t.CDDBToc != "1+150+3000" || t.SMPB == nil || t.CoverArt != m.ITunes.CoverArt {
+		T.Errorf("invalid iTunes freeform items %+v", t)
+	}
+	for _, v := range []struct {
+		key  string
+		typ  int
+		size int
+	}{
+		{"stik", bmff.TypeSigned, 1},
+		{"geID", bmff.TypeSigned, 4},
+		{"sfID", bmff.TypeSigned, 4},
+		{"tmpo", bmff.TypeSigned, 2},
+		{"covr", bmff.TypeJPEG, len(testThumbnail)},
+	} {
+		if it := findItem(x, v.key); it == nil || it.Type != v.typ || len(it.Data) != v.size {
+			T.Errorf("%s: invalid data atom %+v", v.key, it)
+		}
+	}
+	if it := findItem(x, "trkn"); it == nil || it.String() != "3/12" {
+		T.Errorf("unchanged track number not kept: %+v", it)
+	}
+	if b, err := bmff.ReadPacket(r); err != nil || string(b) != "<x:xmpmeta/>" {
+		T.Errorf("XMP packet not kept: %q %v", b, err)
+	}
+}
+
+func TestAtomsUpdate(T *testing.T) {
+	f := makeTempFile(T, makeMP4("isom"))
+	defer removeTempFile(f)
+
+	m := &bmff.Metadata{
+		ITunes: &itunes.ITunesMetadata{
+			Title:        "Video",
+			MediaType:    itunes.MediaTypeMusicVideo,
+			StoreFrontID: itunes.AppleStoreUSA,
+		},
+	}
+	if err := bmff.UpdateMetadata(f, m); err != nil {
+		T.Fatalf("update failed: %v", err)
+	}
+	checkChunk(T, f)
+	x, err := bmff.ReadMetadata(f)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if t := x.ITunes; t == nil || t.Title != "Video" || t.MediaType != itunes.MediaTypeMusicVideo || t.StoreFrontID != itunes.AppleStoreUSA {
+		T.Errorf("invalid iTunes model %+v", t)
+	}
+	if x.Userdata != nil || x.Metadata != nil {
+		T.Errorf("unexpected models %+v", x)
+	}
+}
+
+func TestAtomsStoreFrontIDText(T *testing.T) {
+	for _, v := range []struct {
+		Value string
+		ID    itunes.AppleStoreCountry
+		Text  string
+	}{
+		{"143441", itunes.AppleStoreUSA, "143441"},
+		{"143443-4,29", itunes.AppleStoreDEU, "143443"},
+	} {
+		packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+			`<rdf:Description rdf:about="" xmlns:iTunes="http://ns.apple.com/itunes/1.0/" iTunes:StoreFrontID="` + v.Value + `"/>` +
+			`</rdf:RDF></x:xmpmeta>`
+		d := &xmp.Document{}
+		if err := xmp.Unmarshal([]byte(packet), d); err != nil {
+			T.Fatalf("%s: unmarshal failed: %v", v.Value, err)
+		}
+		m := itunes.FindModel(d)
+		if m == nil || m.StoreFrontID != v.ID {
+			T.Errorf("%s: invalid model %+v", v.Value, m)
+			continue
+		}
+		b, err := xmp.Marshal(d)
+		if err != nil {
+			T.Fatalf("%s: marshal failed: %v", v.Value, err)
+		}
+		if !bytes.Contains(b, []byte(`iTunes:StoreFrontID="`+v.Text+`"`)) && !bytes.Contains(b, []byte(`<iTunes:StoreFrontID>`+v.Text+`<`)) {
+			T.Errorf("%s: missing StoreFrontID in %s", v.Value, string(b))
+		}
+		if s, err := d.GetPath("iTunes:StoreFrontID"); err != nil || s != v.Text {
+			T.Errorf("%s: invalid path value %q %v", v.Value, s, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	xmpriff "github.com/trimmer-io/go-xmp/formats/riff"
+	_ "github.com/trimmer-io/go-xmp/models"
+	"github.com/trimmer-io/go-xmp/models/riff"
+)
+
+var (
+	aviFrame1 = []byte("\xff\xd8frame one\xff\xd9")
+	aviFrame2 = []byte("\xff\xd8frame two\xff\xd9")
+	aviStrd   = []byte("AVIF\x08\x00\x00\x00vendor data")
+)
+
+func makeList(typ string, chunks ...[]byte) []byte {
+	return makeChunk("LIST", append([]byte(typ), bytes.Join(chunks, nil)...))
+}
+
+// makeAVI builds a single frame MJPEG AVI file with a camera strd chunk,
+// an IDIT date and an INFO list. OpenDML files get a second frame in an
+// AVIX form.
+func makeAVI(opendml bool) []byte {
+	strh := append([]byte("vidsMJPG"), make([]byte, 48)...)
+	hdrl := makeList("hdrl",
+		makeChunk("avih", make([]byte, 56)),
+		makeList("strl",
+			makeChunk("strh", strh),
+			makeChunk("strf", make([]byte, 40)),
+			makeChunk("strd", aviStrd),
+		),
+		makeChunk("IDIT", []byte("THU OCT 26 16:46:04 2006\n\x00")),
+	)
+	info := makeList("INFO", makeChunk("ISFT", []byte("Camera 1.0\x00")))
+	movi := makeList("movi", makeChunk("00dc", aviFrame1))
+	idx := append([]byte("00dc\x10\x00\x00\x00\x04\x00\x00\x00"), byte(len(aviFrame1)), 0, 0, 0)
+	out := makeChunk("RIFF", append([]byte("AVI "), bytes.Join([][]byte{hdrl, info, movi, makeChunk("idx1", idx)}, nil)...))
+	if opendml {
+		out = append(out, makeChunk("RIFF", append([]byte("AVIX"), makeList("movi", makeChunk("00dc", aviFrame2))...))...)
+	}
+	return out
+}
+
+// checkFrames makes sure the movie data did not move.
+func checkFrames(T *testing.T, r io.ReadSeeker, opendml bool) {
+	x, err := xmpriff.ReadAVIFile(r)
+	if err != nil {
+		T.Fatalf("reading file failed: %v", err)
+	}
+	orig, _ := xmpriff.ReadAVIFile(bytes.NewReader(makeAVI(opendml)))
+	frames := [][]byte{aviFrame1, aviFrame2}
+	if !opendml {
+		frames = frames[:1]
+	}
+	if len(x.Forms) != len(frames) {
+		T.Fatalf("expected %d forms, got %d", len(frames), len(x.Forms))
+	}
+	for i, v := range x.Forms {
+		movi := v.FindList("movi")
+		if movi == nil {
+			T.Fatalf("form %d: missing movi list", i)
+		}
+		if got, want := movi.Offset, orig.Forms[i].FindList("movi").Offset; got != want {
+			T.Errorf("form %d: movi list moved from offset %d to %d", i, want, got)
+		}
+		l, err := xmpriff.ReadList(r, *movi)
+		if err != nil || len(l) != 1 {
+			T.Fatalf("form %d: invalid movi list: %v", i, err)
+		}
+		b, err := l[0].ReadData(r)
+		if err != nil || !bytes.Equal(b, frames[i]) {
+			T.Errorf("form %d: frame data changed", i)
+		}
+	}
+	if x.Forms[0].Find("idx1") == nil {
+		T.Errorf("missing idx1 index")
+	}
+}
+
+func TestAviRead(T *testing.T) {
+	for _, opendml := range []bool{false, true} {
+		r := bytes.NewReader(makeAVI(opendml))
+		x, err := xmpriff.ReadAVIFile(r)
+		if err != nil {
+			T.Fatalf("reading file failed: %v", err)
+		}
+		if _, err := x.ReadPacket(r); err != io.EOF {
+			T.Errorf("expected io.EOF, got %v", err)
+		}
+		l, err := x.ReadStreamData(r)
+		if err != nil {
+			T.Fatalf("reading strd failed: %v", err)
+		}
+		if len(l) != 1 || l[0].Stream != 0 || l[0].Type != "vids" || l[0].Handler != "MJPG" || !bytes.Equal(l[0].Data, aviStrd) {
+			T.Errorf("invalid stream data %+v", l)
+		}
+		t, err := x.ReadIDIT(r)
+		if err != nil {
+			T.Fatalf("reading IDIT failed: %v", err)
+		}
+		if want := time.Date(2006, 10, 26, 16, 46, 4, 0, time.UTC); !t.Equal(want) {
+			T.Errorf("invalid IDIT date: got=%v want=%v", t, want)
+		}
+		d, err := xmpriff.ReadAVI(r)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		m := riff.FindModel(d)
+		if m == nil || m.Software != "Camera 1.0" || m.DateTimeOriginal2 != "THU OCT 26 16:46:04 2006" {
+			T.Errorf("invalid riff model %+v", m)
+		}
+	}
+}
+
+func TestAviWrite(T *testing.T) {
+	for _, opendml := range []bool{false, true} {
+		f := makeTempFile(T, makeAVI(opendml))
+		defer removeTempFile(f)
+		d := makeDocument("Blue Square Test File - .avi")
+		if err := xmpriff.WriteAVI(f, d); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		x, err := xmpriff.ReadAVIFile(f)
+		if err != nil {
+			T.Fatalf("reading file failed: %v", err)
+		}
+		last := x.Forms[len(x.Forms)-1]
+		if last.Find("_PMX") == nil {
+			T.Errorf("packet not appended to the last form")
+		}
+		d2, err := xmpriff.ReadAVI(f)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d2, "Blue Square Test File - .avi")
+		checkFrames(T, f, opendml)
+
+		// update in place
+		size, _ := f.Seek(0, io.SeekEnd)
+		if err := xmpriff.WriteAVI(f, makeDocument("Short")); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		if s, _ := f.Seek(0, io.SeekEnd); s != size {
+			T.Errorf("in-place update changed file size from %d to %d", size, s)
+		}
+		d3, err := xmpriff.ReadAVI(f)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d3, "Short")
+		checkFrames(T, f, opendml)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/trimmer-io/go-xmp/formats/bmff"
+	_ "github.com/trimmer-io/go-xmp/models"
+)
+
+var mdatPayload = []byte("0123456789abcdef")
+
+func makeBox(typ string, data ...[]byte) []byte {
+	var buf bytes.Buffer
+	size := 8
+	for _, v := range data {
+		size += len(v)
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(size))
+	buf.WriteString(typ)
+	for _, v := range data {
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
+
+// makeMP4 builds a minimal file with moov in front of mdat and a single
+// chunk offset pointing to the mdat payload.
+func makeMP4(brand string) []byte {
+	ftyp := makeBox("ftyp", []byte(brand), []byte{0, 0, 0, 0}, []byte(brand))
+	mkMoov := func(ofs uint32) []byte {
+		stco := make([]byte, 12)
+		binary.BigEndian.PutUint32(stco[4:], 1)
+		binary.BigEndian.PutUint32(stco[8:], ofs)
+		return makeBox("moov",
+			makeBox("mvhd", make([]byte, 100)),
+			makeBox("trak",
+				makeBox("mdia",
+					makeBox("minf",
+						makeBox("stbl", makeBox("stco", stco))))))
+	}
+	moov := mkMoov(0)
+	moov = mkMoov(uint32(len(ftyp) + len(moov) + 8))
+	out := append(ftyp, moov...)
+	return append(out, makeBox("mdat", mdatPayload)...)
+}
+
+// checkChunk verifies the chunk offset still points to the media payload
+func checkChunk(T *testing.T, r io.ReadSeeker) {
+	box, err := bmff.FindPath(r, "moov", "trak", "mdia", "minf", "stbl", "stco")
+	if err != nil || box == nil {
+		T.Fatalf("missing stco box: %v", err)
+	}
+	b, err := box.ReadData(r)
+	if err != nil {
+		T.Fatalf("reading stco failed: %v", err)
+	}
+	buf := make([]byte, len(mdatPayload))
+	r.Seek(int64(binary.BigEndian.Uint32(b[8:])), io.SeekStart)
+	io.ReadFull(r, buf)
+	if !bytes.Equal(buf, mdatPayload) {
+		T.Errorf("chunk offset points to %q", buf)
+	}
+}
+
+func TestBmffNoXMP(T *testing.T) {
+	if _, err := bmff.Read(bytes.NewReader(makeMP4("isom"))); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestBmffRewrite(T *testing.T) {
+	for _, brand := range []string{"isom", "qt  "} {
+		var buf bytes.Buffer
+		if err := bmff.Write(&buf, bytes.NewReader(makeMP4(brand)), makeDocument("rewrite")); err != nil {
+			T.Fatalf("%s: write failed: %v", brand, err)
+		}
+		r := bytes.NewReader(buf.Bytes())
+		d, err := bmff.Read(r)
+		if err != nil {
+			T.Fatalf("%s: read failed: %v", brand, err)
+		}
+		checkTitle(T, d, "rewrite")
+		checkChunk(T, r)
+		udta, _ := bmff.FindPath(r, "moov", "udta", "XMP_")
+		if (brand == "qt  ") != (udta != nil) {
+			T.Errorf("%s: packet stored in wrong location", brand)
+		}
+	}
+}
+
+func TestBmffUpdate(T *testing.T) {
+	for _, brand := range []string{"isom", "qt  "} {
+		f := makeTempFile(T, makeMP4(brand))
+		defer removeTempFile(f)
+
+		// insert, grow, shrink
+		for _, title := range []string{"first", "a much longer second title", "third"} {
+			size, _ := f.Seek(0, io.SeekEnd)
+			if err := bmff.Update(f, makeDocument(title)); err != nil {
+				T.Fatalf("%s: update failed: %v", brand, err)
+			}
+			d, err := bmff.Read(f)
+			if err != nil {
+				T.Fatalf("%s: read failed: %v", brand, err)
+			}
+			checkTitle(T, d, title)
+			checkChunk(T, f)
+			if s, _ := f.Seek(0, io.SeekEnd); title == "third" && s != size {
+				T.Errorf("%s: in-place update changed file size from %d to %d", brand, size, s)
+			}
+		}
+	}
+}
+
+func TestBmffUpdatePadding(T *testing.T) {
+	const (
+		head  = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?><x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="`
+		trail = `"/><?xpacket end="w"?>`
+	)
+	for _, brand := range []string{"isom", "qt  "} {
+		f := makeTempFile(T, makeMP4(brand))
+		defer removeTempFile(f)
+
+		// shrink by less than the size of a free box
+		if err := bmff.UpdatePacket(f, []byte(head+"0123456789"+trail)); err != nil {
+			T.Fatalf("%s: update failed: %v", brand, err)
+		}
+		size, _ := f.Seek(0, io.SeekEnd)
+		if err := bmff.UpdatePacket(f, []byte(head+"0123"+trail)); err != nil {
+			T.Fatalf("%s: update failed: %v", brand, err)
+		}
+		if s, _ := f.Seek(0, io.SeekEnd); s != size {
+			T.Errorf("%s: in-place update changed file size from %d to %d", brand, size, s)
+		}
+		b, err := bmff.ReadPacket(f)
+		if err != nil {
+			T.Fatalf("%s: read failed: %v", brand, err)
+		}
+		if !bytes.HasPrefix(b, []byte(head+"0123"+`"/>`)) || !bytes.HasSuffix(b, []byte(`<?xpacket end="w"?>`)) {
+			T.Errorf("%s: padding outside the packet wrapper: %q", brand, b)
+		}
+		checkChunk(T, f)
+	}
+}
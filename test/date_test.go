@@ -0,0 +1,49 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func TestParseDateTimezone(T *testing.T) {
+	for _, v := range []struct {
+		Value string
+		UTC   string
+	}{
+		{"2017-09-15T20:17:41+02", "2017-09-15T18:17:41Z"},
+		{"2017-09-15T20:17:41+0200", "2017-09-15T18:17:41Z"},
+		{"2017-09-15T20:17:41+02:00", "2017-09-15T18:17:41Z"},
+		{"2017-09-15T20:17:41-05:30", "2017-09-16T01:47:41Z"},
+		{"2017-09-15T20:17:41+2:00", "2017-09-15T18:17:41Z"},
+		{"2017-09-15T20:17:41+2", "2017-09-15T18:17:41Z"},
+		{"2017-09-15T20:17:41+00200", "2017-09-15T18:17:41Z"},
+		{"2017-09-15T20:17:41Z", "2017-09-15T20:17:41Z"},
+		{"2017-09-15T20:17:41", "2017-09-15T20:17:41Z"},
+		{"2017-09-15T20:17:41.250+02:00", "2017-09-15T18:17:41.25Z"},
+	} {
+		d, err := xmp.ParseDate(v.Value)
+		if err != nil {
+			T.Errorf("%s: %v", v.Value, err)
+			continue
+		}
+		if got := time.Time(d).UTC().Format(time.RFC3339Nano); got != v.UTC {
+			T.Errorf("%s: expected=%s got=%s", v.Value, v.UTC, got)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/trimmer-io/go-xmp/formats/eps"
+	"github.com/trimmer-io/go-xmp/models/illustrator"
+	"github.com/trimmer-io/go-xmp/models/xmp_tpg"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// makePS builds a PostScript file with a placed image packet followed by
+// the main packet in a %begin_xml_code block.
+func makePS(T *testing.T, mode string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%!PS-Adobe-3.0 EPSF-3.0\n%%Creator: Adobe Illustrator(R) 12.0\n")
+	if mode != "" {
+		buf.WriteString("%ADO_ContainsXMP: " + mode + "\n")
+	}
+	buf.WriteString("%%EndComments\n%%BeginProlog\n")
+	buf.WriteString("%%BeginDocument: placed.eps\n")
+	buf.Write(makePaddedPacket(T, "placed", 1024))
+	buf.WriteString("\n%%EndDocument\n")
+	buf.WriteString("%begin_xml_code\n/pdfmark where {pop true} {false} ifelse\n%begin_xml_packet: 2048\n")
+	buf.Write(makePaddedPacket(T, "main", 2048))
+	buf.WriteString("\n%end_xml_packet\n%end_xml_code\n%%EndProlog\nshowpage\n%%EOF\n")
+	return buf.Bytes()
+}
+
+// makeDOSEPS wraps PostScript into a DOS EPS file with a TIFF preview that
+// carries its own packet.
+func makeDOSEPS(T *testing.T, ps []byte) []byte {
+	tiff := append([]byte("II*\x00"), makePaddedPacket(T, "preview", 1024)...)
+	h := eps.DOSHeader{
+		PSOffset:   30,
+		PSLength:   uint32(len(ps)),
+		TIFFOffset: uint32(30 + len(ps)),
+		TIFFLength: uint32(len(tiff)),
+		Checksum:   0xffff,
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{0xc5, 0xd0, 0xd3, 0xc6})
+	binary.Write(&buf, binary.LittleEndian, h)
+	buf.Write(ps)
+	buf.Write(tiff)
+	return buf.Bytes()
+}
+
+func TestEpsRead(T *testing.T) {
+	for _, src := range [][]byte{makePS(T, ""), makePS(T, "MainFirst"), makeDOSEPS(T, makePS(T, ""))} {
+		d, err := eps.Read(bytes.NewReader(src))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d, "main")
+	}
+	if _, err := eps.Read(bytes.NewReader(makePS(T, "NoMain"))); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	ps := []byte("%!PS-Adobe-3.0\n%%BeginDocument: x\n" + string(makePaddedPacket(T, "x", 1024)) + "%%EndDocument\n")
+	if _, err := eps.Read(bytes.NewReader(ps)); err != io.EOF {
+		T.Errorf("expected io.EOF for unmarked packets, got %v", err)
+	}
+	if _, err := eps.Read(bytes.NewReader(makeJPEG(T))); err != eps.ErrInvalidFile {
+		T.Errorf("expected invalid file error, got %v", err)
+	}
+}
+
+func TestEpsUpdate(T *testing.T) {
+	src := makeDOSEPS(T, makePS(T, ""))
+	f := makeTempFile(T, src)
+	defer removeTempFile(f)
+	if err := eps.Write(f, makeDocument("updated")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	f.Seek(0, io.SeekStart)
+	b, _ := ioutil.ReadAll(f)
+	if len(b) != len(src) {
+		T.Fatalf("file size changed")
+	}
+	d, err := eps.Read(bytes.NewReader(b))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "updated")
+	if !bytes.Contains(b, []byte("placed")) || !bytes.Contains(b, []byte("preview")) {
+		T.Errorf("other packets changed")
+	}
+
+	// packets never grow
+	if err := eps.Write(f, makeDocument(strings.Repeat("x", 4096))); err != xmp.ErrOverflow {
+		T.Errorf("expected overflow error, got %v", err)
+	}
+	packet, _ := xmp.Marshal(makeDocument("raw"))
+	if err := eps.WritePacket(f, packet); err != nil {
+		T.Fatalf("write packet failed: %v", err)
+	}
+	f.Seek(0, io.SeekStart)
+	if d, err = eps.Read(f); err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "raw")
+}
+
+func TestIllustratorModel(T *testing.T) {
+	const packet = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:illustrator="http://ns.adobe.com/illustrator/1.0/" xmlns:xmpTPg="http://ns.adobe.com/xap/1.0/t/pg/">
+<illustrator:Type>Document</illustrator:Type>
+<illustrator:StartupProfile>Print</illustrator:StartupProfile>
+<xmpTPg:NPages>1</xmpTPg:NPages>
+</rdf:Description></rdf:RDF></x:xmpmeta>`
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal([]byte(packet), d); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	m := illustrator.FindModel(d)
+	if m == nil {
+		T.Fatalf("missing illustrator model")
+	}
+	if m.Type != "Document" || m.StartupProfile != "Print" {
+		T.Errorf("unexpected model values %#v", m)
+	}
+	if tpg := xmptpg.FindModel(d); tpg == nil || tpg.NPages != 1 {
+		T.Errorf("missing or invalid xmpTPg model")
+	}
+}
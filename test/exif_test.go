@@ -0,0 +1,364 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	xmpexif "github.com/trimmer-io/go-xmp/formats/exif"
+	_ "github.com/trimmer-io/go-xmp/models"
+	"github.com/trimmer-io/go-xmp/models/exif"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var (
+	testMakerNote = []byte("Nikon\x00\x02\x10\x00\x00MM\x00*\x00\x00\x00\x08")
+	testThumbnail = []byte("\xff\xd8\xff\xdbthumbnail\xff\xd9")
+)
+
+// ifdSize returns the size of a directory including its external values.
+func ifdSize(entries []tiffEntry) uint32 {
+	n := uint32(2 + len(entries)*12 + 4)
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			n += uint32(len(e.value) + len(e.value)&1)
+		}
+	}
+	return n
+}
+
+// makeIFD serializes a directory at file offset base followed by its
+// external values.
+func makeIFD(order binary.ByteOrder, base uint32, entries []tiffEntry) []byte {
+	var buf, ext bytes.Buffer
+	b := make([]byte, 12)
+	order.PutUint16(b, uint16(len(entries)))
+	buf.Write(b[:2])
+	extra := base + uint32(2+len(entries)*12+4)
+	for _, e := range entries {
+		order.PutUint16(b, e.tag)
+		order.PutUint16(b[2:], e.typ)
+		order.PutUint32(b[4:], e.count)
+		copy(b[8:], []byte{0, 0, 0, 0})
+		if len(e.value) > 4 {
+			order.PutUint32(b[8:], extra+uint32(ext.Len()))
+			ext.Write(e.value)
+			if len(e.value)&1 == 1 {
+				ext.WriteByte(0)
+			}
+		} else {
+			copy(b[8:], e.value)
+		}
+		buf.Write(b)
+	}
+	buf.Write([]byte{0, 0, 0, 0})
+	buf.Write(ext.Bytes())
+	return buf.Bytes()
+}
+
+func rationals(order binary.ByteOrder, v ...uint32) []byte {
+	b := make([]byte, len(v)*4)
+	for i, n := range v {
+		order.PutUint32(b[i*4:], n)
+	}
+	return b
+}
+
+// makeExif builds a TIFF structured EXIF blob with Exif, GPS and
+// Interoperability IFDs.
+func makeExif(order binary.ByteOrder) []byte {
+	short := func(v uint16) []byte {
+		b := make([]byte, 2)
+		order.PutUint16(b, v)
+		return b
+	}
+	long := func(v uint32) []byte {
+		return rationals(order, v)
+	}
+	ascii := func(s string) []byte {
+		return append([]byte(s), 0)
+	}
+	interop := []tiffEntry{
+		{0x0001, 2, 4, ascii("R98")},
+		{0x0002, 7, 4, []byte("0100")},
+	}
+	gps := []tiffEntry{
+		{0x0000, 1, 4, []byte{2, 3, 0, 0}},
+		{0x0001, 2, 2, ascii("N")},
+		{0x0002, 5, 3, rationals(order, 48, 1, 8, 1, 30, 1)},
+		{0x0003, 2, 2, ascii("E")},
+		{0x0004, 5, 3, rationals(order, 11, 1, 34, 1, 0, 1)},
+		{0x0005, 1, 1, []byte{0}},
+		{0x0006, 5, 1, rationals(order, 520, 1)},
+	}
+	comment := append([]byte("ASCII\x00\x00\x00"), "Hello"...)
+	cfa := append(append(short(2), short(2)...), 0, 1, 1, 2)
+	lens := ascii("24-70mm f/2.8")
+	ex := []tiffEntry{
+		{0x829a, 5, 1, rationals(order, 1, 250)},
+		{0x829d, 5, 1, rationals(order, 28, 10)},
+		{0x8827, 3, 1, short(400)},
+		{0x9000, 7, 4, []byte("0230")},
+		{0x9003, 2, 20, ascii("2017:05:01 12:30:45")},
+		{0x9101, 7, 4, []byte{1, 2, 3, 0}},
+		{0x9209, 3, 1, short(0x19)},
+		{0x927c, 7, uint32(len(testMakerNote)), testMakerNote},
+		{0x9286, 7, uint32(len(comment)), comment},
+		{0xa005, 4, 1, nil}, // interop pointer, patched below
+		{0xa302, 7, uint32(len(cfa)), cfa},
+		{0xa434, 2, uint32(len(lens)), lens},
+	}
+	camera := ascii("Trimmer Test Camera")
+	ifd0 := []tiffEntry{
+		{0x010f, 2, uint32(len(camera)), camera},
+		{0x0112, 3, 1, short(6)},
+		{0x0132, 2, 20, ascii("2017:05:02 08:00:00")},
+		{0x8769, 4, 1, nil}, // exif pointer
+		{0x8825, 4, 1, nil}, // gps pointer
+		{0xc4a5, 7, 8, []byte("PrintIM\x00")},
+	}
+	ifd1 := []tiffEntry{
+		{0x0103, 3, 1, short(6)},
+		{0x0201, 4, 1, nil}, // thumbnail offset
+		{0x0202, 4, 1, long(uint32(len(testThumbnail)))},
+	}
+	exifOfs := 8 + ifdSize(ifd0)
+	gpsOfs := exifOfs + ifdSize(ex)
+	interopOfs := gpsOfs + ifdSize(gps)
+	ifd1Ofs := interopOfs + ifdSize(interop)
+	ifd0[3].value = long(exifOfs)
+	ifd0[4].value = long(gpsOfs)
+	ex[9].value = long(interopOfs)
+	ifd1[1].value = long(ifd1Ofs + ifdSize(ifd1))
+
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	buf.Write(short(42))
+	buf.Write(long(8))
+	buf.Write(makeIFD(order, 8, ifd0))
+	buf.Write(makeIFD(order, exifOfs, ex))
+	buf.Write(makeIFD(order, gpsOfs, gps))
+	buf.Write(makeIFD(order, interopOfs, interop))
+	buf.Write(makeIFD(order, ifd1Ofs, ifd1))
+	buf.Write(testThumbnail)
+	b := buf.Bytes()
+	// link IFD1
+	order.PutUint32(b[8+2+len(ifd0)*12:], ifd1Ofs)
+	return b
+}
+
+func checkExif(T *testing.T, x *xmpexif.Exif) {
+	if got, want := x.Tiff.Make, "Trimmer Test Camera"; got != want {
+		T.Errorf("invalid tiff make: got=%q want=%q", got, want)
+	}
+	m := x.Info
+	if got, want := m.Make, "Trimmer Test Camera"; got != want {
+		T.Errorf("invalid make: got=%q want=%q", got, want)
+	}
+	if got, want := int(m.Orientation), 6; got != want {
+		T.Errorf("invalid orientation: got=%d want=%d", got, want)
+	}
+	if got, want := m.ExposureTime, (xmp.Rational{Num: 1, Den: 250}); got != want {
+		T.Errorf("invalid exposure time: got=%v want=%v", got, want)
+	}
+	if got, want := m.FNumber, (xmp.Rational{Num: 28, Den: 10}); got != want {
+		T.Errorf("invalid f-number: got=%v want=%v", got, want)
+	}
+	if len(m.ISOSpeedRatings) != 1 || m.ISOSpeedRatings[0] != 400 {
+		T.Errorf("invalid ISO speed: %v", m.ISOSpeedRatings)
+	}
+	if got, want := m.ExifVersion, "0230"; got != want {
+		T.Errorf("invalid exif version: got=%q want=%q", got, want)
+	}
+	want := time.Date(2017, 5, 1, 12, 30, 45, 0, time.UTC)
+	if got := m.DateTimeOriginal.Value(); !got.Equal(want) {
+		T.Errorf("invalid original date: got=%v want=%v", got, want)
+	}
+	if !m.Flash.Fired.Value() || m.Flash.Mode != 3 {
+		T.Errorf("invalid flash: %+v", m.Flash)
+	}
+	if len(m.UserComment) != 1 || m.UserComment[0] != "Hello" {
+		T.Errorf("invalid user comment: %v", m.UserComment)
+	}
+	if got, want := m.ComponentsConfiguration.String(), "1 2 3 0"; got != want {
+		T.Errorf("invalid components: got=%q want=%q", got, want)
+	}
+	if !bytes.Equal(m.MakerNote, testMakerNote) {
+		T.Errorf("invalid maker note: %x", []byte(m.MakerNote))
+	}
+	if m.CFAPattern == nil || m.CFAPattern.Columns != 2 || m.CFAPattern.Values.String() != "0 1 1 2" {
+		T.Errorf("invalid CFA pattern: %+v", m.CFAPattern)
+	}
+	if got, want := m.GPSVersionID, "2.3.0.0"; got != want {
+		T.Errorf("invalid GPS version: got=%q want=%q", got, want)
+	}
+	if m.GPSLatitudeRef != "N" || m.GPSLongitudeRef != "E" || m.GPSAltitudeRef != "0" {
+		T.Errorf("invalid GPS refs: %q %q %q", m.GPSLatitudeRef, m.GPSLongitudeRef, m.GPSAltitudeRef)
+	}
+	if got, want := m.GPSAltitude, (xmp.Rational{Num: 520, Den: 1}); got != want {
+		T.Errorf("invalid GPS altitude: got=%v want=%v", got, want)
+	}
+	if got, want := x.EX.InteroperabilityIndex, exif.InteropMode("R98"); got != want {
+		T.Errorf("invalid interop index: got=%q want=%q", got, want)
+	}
+	if got, want := x.EX.LensModel, "24-70mm f/2.8"; got != want {
+		T.Errorf("invalid lens model: got=%q want=%q", got, want)
+	}
+}
+
+func TestExifDecode(T *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		x, err := xmpexif.Decode(append([]byte(xmpexif.Header), makeExif(order)...))
+		if err != nil {
+			T.Fatalf("%v: decode failed: %v", order, err)
+		}
+		checkExif(T, x)
+		if x.ExifIFD == nil || x.GPSIFD == nil || x.InteropIFD == nil || x.IFD1 == nil {
+			T.Errorf("%v: missing sub-IFDs", order)
+		}
+	}
+}
+
+func TestExifToXMP(T *testing.T) {
+	x, err := xmpexif.Decode(makeExif(binary.BigEndian))
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	d := xmp.NewDocument()
+	if err := x.AddModels(d); err != nil {
+		T.Fatalf("adding models failed: %v", err)
+	}
+	m := exif.FindModel(d)
+	if m == nil {
+		T.Fatalf("missing exif model")
+	}
+	if got, want := string(m.GPSLatitudeCoord), "48,8.5000000N"; got != want {
+		T.Errorf("invalid XMP latitude: got=%q want=%q", got, want)
+	}
+	if m.DateTimeOriginalXMP.IsZero() {
+		T.Errorf("missing XMP original date")
+	}
+	if _, err := xmp.Marshal(d); err != nil {
+		T.Errorf("marshal failed: %v", err)
+	}
+}
+
+func TestExifEncode(T *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		src := makeExif(order)
+		x, err := xmpexif.Decode(src)
+		if err != nil {
+			T.Fatalf("%v: decode failed: %v", order, err)
+		}
+		// unchanged models produce an equivalent blob
+		b, err := x.Encode()
+		if err != nil {
+			T.Fatalf("%v: encode failed: %v", order, err)
+		}
+		x2, err := xmpexif.Decode(b)
+		if err != nil {
+			T.Fatalf("%v: decode failed: %v", order, err)
+		}
+		checkExif(T, x2)
+
+		// update date, GPS and model
+		date := time.Date(2018, 2, 3, 4, 5, 6, 0, time.UTC)
+		x.Info.DateTimeOriginal = exif.Date(date)
+		x.Info.GPSLatitude = exif.GPSCoord{{Num: 52, Den: 1}, {Num: 31, Den: 1}, {Num: 0, Den: 1}}
+		x.Info.GPSDestBearing = xmp.Rational{Num: 90, Den: 1}
+		x.Tiff.Model = "A much longer camera model name than before"
+		x.EX.LensModel = ""
+		if b, err = x.Encode(); err != nil {
+			T.Fatalf("%v: encode failed: %v", order, err)
+		}
+		x2, err = xmpexif.Decode(b)
+		if err != nil {
+			T.Fatalf("%v: decode failed: %v", order, err)
+		}
+		m := x2.Info
+		if got := m.DateTimeOriginal.Value(); !got.Equal(date) {
+			T.Errorf("%v: invalid original date: got=%v want=%v", order, got, date)
+		}
+		if m.GPSLatitude[0].Num != 52 || m.GPSLatitudeRef != "N" || m.GPSLongitude[1].Num != 34 {
+			T.Errorf("%v: invalid GPS coordinates %v %v", order, m.GPSLatitude, m.GPSLongitude)
+		}
+		if m.GPSDestBearing.Num != 90 {
+			T.Errorf("%v: missing new GPS tag", order)
+		}
+		if got, want := x2.Tiff.Model, x.Tiff.Model; got != want {
+			T.Errorf("%v: invalid model: got=%q want=%q", order, got, want)
+		}
+		if x2.EX.LensModel != "" || m.ExLensModel != "" {
+			T.Errorf("%v: lens model not removed", order)
+		}
+		if m.Make != "Trimmer Test Camera" || m.UserComment[0] != "Hello" || x2.EX.InteroperabilityIndex != "R98" {
+			T.Errorf("%v: unchanged tags lost", order)
+		}
+		if e := x2.IFD0.Find(0xc4a5); e == nil || string(e.Data) != "PrintIM\x00" {
+			T.Errorf("%v: unknown tag lost", order)
+		}
+		mn, orig := x2.ExifIFD.Find(0x927c), x.ExifIFD.Find(0x927c)
+		if mn == nil || !bytes.Equal(mn.Data, testMakerNote) || mn.Offset != orig.Offset {
+			T.Errorf("%v: maker note moved or changed", order)
+		}
+		if x2.IFD1 == nil {
+			T.Fatalf("%v: missing thumbnail IFD", order)
+		}
+		ofs, size := x2.IFD1.Find(0x0201).Uint(order, 0), x2.IFD1.Find(0x0202).Uint(order, 0)
+		if int(ofs+size) > len(b) || !bytes.Equal(b[ofs:ofs+size], testThumbnail) {
+			T.Errorf("%v: thumbnail lost", order)
+		}
+	}
+}
+
+func TestExifEncodeNew(T *testing.T) {
+	x := xmpexif.New(binary.LittleEndian)
+	x.Tiff.Make = "Trimmer"
+	x.Info.ExifVersion = "0231"
+	x.Info.ExposureTime = xmp.Rational{Num: 1, Den: 60}
+	x.Info.ExposureBiasValue = xmp.Rational{Num: -1, Den: 3}
+	x.Info.UserComment = xmp.StringArray{"Grüße"}
+	x.Info.GPSVersionID = "2.3.0.0"
+	x.Info.GPSAltitudeRef = "1"
+	x.EX.InteroperabilityIndex = "R98"
+	b, err := x.Encode()
+	if err != nil {
+		T.Fatalf("encode failed: %v", err)
+	}
+	x2, err := xmpexif.Decode(b)
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	m := x2.Info
+	if x2.Tiff.Make != "Trimmer" || m.ExifVersion != "0231" || m.ExposureTime != x.Info.ExposureTime || m.ExposureBiasValue != x.Info.ExposureBiasValue {
+		T.Errorf("invalid values %+v", m)
+	}
+	if len(m.UserComment) != 1 || m.UserComment[0] != "Grüße" {
+		T.Errorf("invalid user comment %v", m.UserComment)
+	}
+	if m.GPSVersionID != "2.3.0.0" || m.GPSAltitudeRef != "1" || x2.EX.InteroperabilityIndex != "R98" {
+		T.Errorf("invalid GPS or interop values")
+	}
+	if e := x2.ExifIFD.Find(0x9204); e == nil || e.Type != 10 {
+		T.Errorf("exposure bias must be SRATIONAL")
+	}
+}
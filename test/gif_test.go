@@ -0,0 +1,115 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"testing"
+
+	xmpgif "github.com/trimmer-io/go-xmp/formats/gif"
+	"github.com/trimmer-io/go-xmp/models/dc"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func makeGIF(T *testing.T, frames int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9)
+		img.Pix[i] = 1
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		T.Fatalf("encoding gif failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func checkGIF(T *testing.T, b []byte, frames int) {
+	g, err := gif.DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		T.Fatalf("decoding gif failed: %v", err)
+	}
+	if len(g.Image) != frames {
+		T.Errorf("expected %d frames, got %d", frames, len(g.Image))
+	}
+}
+
+func TestGifNoXMP(T *testing.T) {
+	if _, err := xmpgif.ReadPacket(bytes.NewReader(makeGIF(T, 1))); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	if _, err := xmpgif.ReadPacket(bytes.NewReader(makePNG(T))); err != xmpgif.ErrInvalidFile {
+		T.Errorf("expected invalid file error, got %v", err)
+	}
+}
+
+func TestGifRoundtrip(T *testing.T) {
+	src := makeGIF(T, 3)
+	d := makeDocument("Animated")
+	dc.FindModel(d).Rights = xmp.NewAltString("(c) Agency")
+
+	var buf bytes.Buffer
+	if err := xmpgif.Write(&buf, bytes.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	checkGIF(T, buf.Bytes(), 3)
+	d2, err := xmpgif.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d2, "Animated")
+	if m := dc.FindModel(d2); m == nil || m.Rights.Default() != "(c) Agency" {
+		T.Errorf("dc:rights lost")
+	}
+
+	// replace keeps a single extension
+	var buf2 bytes.Buffer
+	if err := xmpgif.Write(&buf2, bytes.NewReader(buf.Bytes()), makeDocument("Neu")); err != nil {
+		T.Fatalf("rewrite failed: %v", err)
+	}
+	checkGIF(T, buf2.Bytes(), 3)
+	if n := bytes.Count(buf2.Bytes(), []byte("XMP DataXMP")); n != 1 {
+		T.Errorf("expected 1 XMP extension, got %d", n)
+	}
+	d2, err = xmpgif.Read(bytes.NewReader(buf2.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d2, "Neu")
+}
+
+func TestGif87a(T *testing.T) {
+	src := makeGIF(T, 1)
+	copy(src, "GIF87a")
+	var buf bytes.Buffer
+	if err := xmpgif.Write(&buf, bytes.NewReader(src), makeDocument("Old")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("GIF89a")) {
+		T.Errorf("header not upgraded")
+	}
+	checkGIF(T, buf.Bytes(), 1)
+	d, err := xmpgif.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "Old")
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/trimmer-io/go-xmp/formats"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// testHandler stores a marshaled document after a fixed header.
+type testHandler struct{}
+
+var testMagic = []byte("TEST")
+
+func (testHandler) CanHandle(head []byte) bool {
+	return bytes.HasPrefix(head, testMagic)
+}
+
+func (testHandler) ReadXMP(r io.ReadSeeker) (*xmp.Document, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == len(testMagic) {
+		return nil, io.EOF
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(b[len(testMagic):], d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (testHandler) WriteXMP(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(testMagic, b...))
+	return err
+}
+
+func (testHandler) Capabilities() xmp.Capabilities {
+	return xmp.CapRead | xmp.CapWrite
+}
+
+func TestHandlerLookup(T *testing.T) {
+	for _, v := range []struct {
+		head []byte
+		name string
+		want string
+	}{
+		{makeJPEG(T), "image", "jpeg"},
+		{makePNG(T), "image.bin", "png"},
+		{makePSD(2), "image", "psd"},
+		{makeGIF(T, 1), "image.png", "gif"},
+		{makeTIFF(binary.BigEndian), "image", "tiff"},
+		{makeWAV(false), "audio.wav", "wav"},
+		{makeAVI(false), "movie.wav", "avi"},
+		{makeWebP("VP8 ", webpVP8), "image.wav", "webp"},
+		{makeMP3v23(), "audio", "mp3"},
+		{[]byte{0xff, 0xfb, 0x90, 0x00}, "audio.MP3", "mp3"},
+		{[]byte{0xff, 0xfb, 0x90, 0x00}, "audio", ""},
+		{makePDF(false, nil), "doc", "pdf"},
+		{[]byte("%!PS-Adobe-3.0 EPSF-3.0\n"), "logo", "eps"},
+		{[]byte{0xc5, 0xd0, 0xd3, 0xc6}, "logo.bin", "eps"},
+		{[]byte("\x00\x00\x00\x14ftypisom\x00\x00\x00\x00isom"), "movie", "bmff"},
+		{makeHEIF(false), "IMG_0001", "heif"},
+		{[]byte("\x00\x00\x00\x14ftypavif\x00\x00\x00\x00mif1"), "image.mp4", "heif"},
+		{[]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"/>"), "icon", "svg"},
+		{[]byte("<?xml version=\"1.0\"?>\n<svg/>"), "icon.SVG", "svg"},
+		{[]byte("<?xpacket begin=\"\"?>"), "IMG_1234.xmp", "xmp"},
+		{[]byte("unknown"), "file.txt", ""},
+	} {
+		f := xmp.LookupFormat(v.head, v.name)
+		switch {
+		case f == nil && v.want != "":
+			T.Errorf("%s: no format found, expected %s", v.name, v.want)
+		case f != nil && f.Name != v.want:
+			T.Errorf("%s: expected format %q, got %q", v.name, v.want, f.Name)
+		}
+	}
+}
+
+func TestHandlerFile(T *testing.T) {
+	xmp.RegisterFormat(xmp.FileFormat{
+		Name:       "test",
+		Extensions: []string{".test"},
+		Magic:      []xmp.Magic{{Offset: 0, Value: testMagic}},
+		Handler:    testHandler{},
+	})
+	dir, err := ioutil.TempDir("", "go-xmp-test")
+	if err != nil {
+		T.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, v := range []struct {
+		name string
+		data []byte
+	}{
+		{"file.test", testMagic},
+		{"image.jpg", makeJPEG(T)},
+		{"image.tif", makeTIFF(binary.LittleEndian)},
+		{"IMG_1234.xmp", nil},
+	} {
+		name := filepath.Join(dir, v.name)
+		if err := ioutil.WriteFile(name, v.data, 0600); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		if _, err := xmp.ReadFile(name); err != io.EOF {
+			T.Errorf("%s: expected io.EOF, got %v", v.name, err)
+		}
+		if err := xmp.WriteFile(name, makeDocument(v.name)); err != nil {
+			T.Fatalf("%s: write failed: %v", v.name, err)
+		}
+		d, err := xmp.ReadFile(name)
+		if err != nil {
+			T.Fatalf("%s: read failed: %v", v.name, err)
+		}
+		checkTitle(T, d, v.name)
+		if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+			T.Errorf("%s: file mode changed", v.name)
+		}
+	}
+
+	// unknown formats are scanned for packets
+	name := filepath.Join(dir, "file.bin")
+	b := append([]byte("\x00\x01"), makeWAV(false)[36:]...)
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if _, err := xmp.ReadFile(name); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	if err := xmp.WriteFile(name, makeDocument("x")); err != xmp.ErrUnsupportedFormat {
+		T.Errorf("expected unsupported format error, got %v", err)
+	}
+}
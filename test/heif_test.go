@@ -0,0 +1,128 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/trimmer-io/go-xmp/formats/heif"
+)
+
+var (
+	heifImage = []byte("hevc-image-data")
+	heifExif  = []byte("\x00\x00\x00\x06Exif\x00\x00MM")
+)
+
+func makeInfe(id uint16, typ string) []byte {
+	b := []byte{2, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(b[4:], id)
+	return makeBox("infe", b, []byte(typ), []byte("\x00"))
+}
+
+// makeHEIF builds a minimal HEIF file with an image item in mdat and an
+// Exif item in idat. The iloc box uses version 0 with base offsets only
+// when baseOnly is set.
+func makeHEIF(baseOnly bool) []byte {
+	ftyp := makeBox("ftyp", []byte("heic"), []byte{0, 0, 0, 0}, []byte("mif1heic"))
+	mkMeta := func(ofs uint32) []byte {
+		iinf := makeBox("iinf", []byte{0, 0, 0, 0, 0, 2}, makeInfe(1, "hvc1"), makeInfe(2, "Exif"))
+		var iloc bytes.Buffer
+		if baseOnly {
+			// version 0, base offset size 4, no idat construction
+			iloc.Write([]byte{0, 0, 0, 0, 0x04, 0x40, 0, 1})
+			binary.Write(&iloc, binary.BigEndian, []uint16{1, 0})
+			binary.Write(&iloc, binary.BigEndian, ofs)
+			binary.Write(&iloc, binary.BigEndian, []uint16{1})
+			binary.Write(&iloc, binary.BigEndian, uint32(len(heifImage)))
+		} else {
+			iloc.Write([]byte{1, 0, 0, 0, 0x44, 0x00, 0, 2})
+			binary.Write(&iloc, binary.BigEndian, []uint16{1, 0, 0, 1})
+			binary.Write(&iloc, binary.BigEndian, []uint32{ofs, uint32(len(heifImage))})
+			binary.Write(&iloc, binary.BigEndian, []uint16{2, 1, 0, 1})
+			binary.Write(&iloc, binary.BigEndian, []uint32{0, uint32(len(heifExif))})
+		}
+		return makeBox("meta", []byte{0, 0, 0, 0},
+			makeBox("hdlr", make([]byte, 8), []byte("pict"), make([]byte, 13)),
+			makeBox("pitm", []byte{0, 0, 0, 0, 0, 1}),
+			iinf,
+			makeBox("iloc", iloc.Bytes()),
+			makeBox("idat", heifExif))
+	}
+	meta := mkMeta(0)
+	meta = mkMeta(uint32(len(ftyp) + len(meta) + 8))
+	out := append(ftyp, meta...)
+	return append(out, makeBox("mdat", heifImage)...)
+}
+
+func checkHEIF(T *testing.T, r io.ReadSeeker, baseOnly bool) {
+	if b, err := heif.ReadItem(r, 1); err != nil || !bytes.Equal(b, heifImage) {
+		T.Errorf("image item data %q: %v", b, err)
+	}
+	if baseOnly {
+		return
+	}
+	if b, err := heif.ReadItem(r, 2); err != nil || !bytes.Equal(b, heifExif) {
+		T.Errorf("exif item data %q: %v", b, err)
+	}
+}
+
+func TestHeifNoXMP(T *testing.T) {
+	r := bytes.NewReader(makeHEIF(false))
+	checkHEIF(T, r, false)
+	if _, err := heif.Read(r); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	if _, err := heif.Read(bytes.NewReader(makeMP4("isom"))); err != heif.ErrInvalidFile && err == nil {
+		T.Errorf("expected error for files without meta box")
+	}
+}
+
+func TestHeifRoundtrip(T *testing.T) {
+	for _, baseOnly := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := heif.Write(&buf, bytes.NewReader(makeHEIF(baseOnly)), makeDocument("first")); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		r := bytes.NewReader(buf.Bytes())
+		d, err := heif.Read(r)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d, "first")
+		checkHEIF(T, r, baseOnly)
+		items, err := heif.Items(r)
+		if err != nil || len(items) != 3 || !items[2].IsXMP() || items[2].ID != 3 {
+			T.Errorf("unexpected items %v: %v", items, err)
+		}
+
+		// replacing the packet drops the old XMP box
+		var buf2 bytes.Buffer
+		if err := heif.Write(&buf2, r, makeDocument("again")); err != nil {
+			T.Fatalf("rewrite failed: %v", err)
+		}
+		r = bytes.NewReader(buf2.Bytes())
+		if d, err = heif.Read(r); err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d, "again")
+		checkHEIF(T, r, baseOnly)
+		if buf2.Len() != buf.Len() {
+			T.Errorf("file size changed from %d to %d", buf.Len(), buf2.Len())
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trimmer-io/go-xmp/formats/iptc"
+	"github.com/trimmer-io/go-xmp/models/dc"
+	"github.com/trimmer-io/go-xmp/models/ps"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// makeIIM serializes datasets in list order.
+func makeIIM(sets ...iptc.DataSet) []byte {
+	return iptc.DataSets(sets).Encode()
+}
+
+func iim(tag int, value string) iptc.DataSet {
+	return iptc.DataSet{Record: byte(tag >> 8), ID: byte(tag), Data: []byte(value)}
+}
+
+func TestIptcDecode(T *testing.T) {
+	// Latin-1 text without 1:90
+	b := makeIIM(
+		iim(iptc.RecordVersion, "\x00\x04"),
+		iim(iptc.ObjectName, "Caf\xe9"),
+		iim(iptc.Keywords, "one"),
+		iim(iptc.Keywords, "two"),
+		iim(2<<8|202, strings.Repeat("x", 0x9000)),
+	)
+	l, err := iptc.Decode(append(b, 0))
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	if len(l) != 5 || len(l[4].Data) != 0x9000 {
+		T.Fatalf("invalid datasets %v", l)
+	}
+	if l.IsUTF8() {
+		T.Errorf("expected Latin-1 text")
+	}
+	if v := l.String(iptc.ObjectName); v != "Café" {
+		T.Errorf("invalid object name %q", v)
+	}
+	if v := l.Strings(iptc.Keywords); len(v) != 2 || v[1] != "two" {
+		T.Errorf("invalid keywords %v", v)
+	}
+	if !bytes.Equal(l.Encode(), b) {
+		T.Errorf("encoding does not round-trip")
+	}
+
+	// UTF-8 via 1:90
+	l, err = iptc.Decode(makeIIM(
+		iim(iptc.CodedCharacterSet, "\x1b%G"),
+		iim(iptc.ObjectName, "Caf\xc3\xa9"),
+	))
+	if err != nil || !l.IsUTF8() || l.String(iptc.ObjectName) != "Café" {
+		T.Errorf("invalid UTF-8 decoding: %v", err)
+	}
+
+	if _, err := iptc.Decode([]byte{0x1c, 2, 5, 0, 10, 'x'}); err != iptc.ErrInvalidFile {
+		T.Errorf("expected invalid data error, got %v", err)
+	}
+}
+
+func TestIptcMerge(T *testing.T) {
+	raw := makeIIM(
+		iim(iptc.ObjectName, "Legacy"),
+		iim(iptc.Byline, "Photographer"),
+		iim(iptc.City, "Berlin"),
+		iim(iptc.Urgency, "2"),
+		iim(iptc.DateCreated, "20170806"),
+		iim(iptc.TimeCreated, "142500+0200"),
+	)
+	for _, v := range []struct {
+		digest string
+		title  string
+	}{
+		{"", "XMP"},
+		{iptc.Digest(raw), "XMP"},
+		{strings.ToLower(iptc.Digest(raw)), "XMP"},
+		{"00000000000000000000000000000000", "Legacy"},
+	} {
+		d := makeDocument("XMP")
+		d.AddModel(&ps.PhotoshopInfo{LegacyIPTCDigest: v.digest})
+		if err := iptc.Merge(d, raw); err != nil {
+			T.Fatalf("merge failed: %v", err)
+		}
+		checkTitle(T, d, v.title)
+		p := ps.FindModel(d)
+		if v.digest != "" && v.title == "XMP" {
+			if p.City != "" {
+				T.Errorf("unexpected city %q with matching digest", p.City)
+			}
+			continue
+		}
+		if p.City != "Berlin" || p.Urgency != 2 {
+			T.Errorf("invalid photoshop model %+v", p)
+		}
+		if want := time.Date(2017, 8, 6, 12, 25, 0, 0, time.UTC); !p.DateCreated.Value().Equal(want) {
+			T.Errorf("invalid date %v", p.DateCreated)
+		}
+	}
+}
+
+func TestIptcUpdate(T *testing.T) {
+	raw := makeIIM(
+		iim(iptc.RecordVersion, "\x00\x02"),
+		iim(iptc.ObjectName, "Old"),
+		iim(2<<8|12, "Caf\xe9"), // subject reference, kept
+		iim(iptc.Keywords, "old"),
+	)
+	d := xmp.NewDocument()
+	d.AddModel(&dc.DublinCore{
+		Title:   xmp.NewAltString("Über"),
+		Subject: xmp.NewStringArray("a", "b"),
+		Creator: xmp.NewStringList(strings.Repeat("ü", 20)),
+	})
+	d.AddModel(&ps.PhotoshopInfo{
+		Headline:    "News",
+		DateCreated: xmp.NewDate(time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)),
+	})
+	b, err := iptc.Update(raw, d)
+	if err != nil {
+		T.Fatalf("update failed: %v", err)
+	}
+	if v := ps.FindModel(d).LegacyIPTCDigest; v != iptc.Digest(b) {
+		T.Errorf("invalid digest %s", v)
+	}
+	l, err := iptc.Decode(b)
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	if l[0].Tag() != iptc.CodedCharacterSet || !l.IsUTF8() {
+		T.Errorf("missing UTF-8 character set")
+	}
+	if v := l.Find(iptc.RecordVersion); v == nil || string(v.Data) != "\x00\x04" {
+		T.Errorf("invalid record version")
+	}
+	if v := l.String(iptc.ObjectName); v != "Über" {
+		T.Errorf("invalid object name %q", v)
+	}
+	if v := l.String(2<<8 | 12); v != "Café" {
+		T.Errorf("unknown dataset not transcoded: %q", v)
+	}
+	if v := l.Strings(iptc.Keywords); len(v) != 2 || v[0] != "a" {
+		T.Errorf("invalid keywords %v", v)
+	}
+	if v := l.String(iptc.Byline); v != strings.Repeat("ü", 16) {
+		T.Errorf("by-line not truncated to 32 bytes: %q", v)
+	}
+	if l.String(iptc.DateCreated) != "20180102" || l.Find(iptc.TimeCreated) != nil {
+		T.Errorf("invalid date created")
+	}
+	if l.String(iptc.Headline) != "News" {
+		T.Errorf("invalid headline")
+	}
+
+	// a second update is stable and keeps the digest
+	c, err := iptc.Update(b, d)
+	if err != nil || !bytes.Equal(b, c) {
+		T.Errorf("update not stable: %v", err)
+	}
+}
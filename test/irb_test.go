@@ -0,0 +1,178 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/trimmer-io/go-xmp/formats/iptc"
+	"github.com/trimmer-io/go-xmp/formats/irb"
+	xmpjpeg "github.com/trimmer-io/go-xmp/formats/jpeg"
+	"github.com/trimmer-io/go-xmp/models/ps"
+)
+
+// makeICC builds a minimal ICC profile with a version 2 or 4 description.
+func makeICC(name string, v4 bool) []byte {
+	var tag bytes.Buffer
+	if v4 {
+		u := utf16.Encode([]rune(name))
+		tag.WriteString("mluc\x00\x00\x00\x00")
+		binary.Write(&tag, binary.BigEndian, []uint32{1, 12})
+		tag.WriteString("enUS")
+		binary.Write(&tag, binary.BigEndian, []uint32{uint32(len(u) * 2), 28})
+		binary.Write(&tag, binary.BigEndian, u)
+	} else {
+		tag.WriteString("desc\x00\x00\x00\x00")
+		binary.Write(&tag, binary.BigEndian, uint32(len(name)+1))
+		tag.WriteString(name + "\x00")
+	}
+	b := make([]byte, 144)
+	copy(b[36:], "acsp")
+	binary.BigEndian.PutUint32(b[128:], 1)
+	copy(b[132:], "desc")
+	binary.BigEndian.PutUint32(b[136:], 144)
+	binary.BigEndian.PutUint32(b[140:], uint32(tag.Len()))
+	b = append(b, tag.Bytes()...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// makeSlices builds a version 6 slices resource with a single slice.
+func makeSlices(group, name, url string) []byte {
+	var buf bytes.Buffer
+	str := func(s string) {
+		u := utf16.Encode([]rune(s))
+		binary.Write(&buf, binary.BigEndian, uint32(len(u)))
+		binary.Write(&buf, binary.BigEndian, u)
+	}
+	binary.Write(&buf, binary.BigEndian, []uint32{6, 0, 0, 16, 32})
+	str(group)
+	binary.Write(&buf, binary.BigEndian, []uint32{1, 1, 7, 0})
+	str(name)
+	binary.Write(&buf, binary.BigEndian, []uint32{1, 0, 0, 32, 16})
+	str(url)
+	str("")
+	str("")
+	str("")
+	buf.WriteByte(0)
+	str("")
+	binary.Write(&buf, binary.BigEndian, []uint32{0, 0})
+	buf.Write([]byte{0xff, 1, 2, 3})
+	return buf.Bytes()
+}
+
+func TestIrbResources(T *testing.T) {
+	thumb := irb.NewThumbnail(testThumbnail, 160, 120)
+	l := irb.Resources{
+		{ID: irb.ResolutionInfo, Data: []byte("odd")},
+		{Signature: "MeSa", ID: 0x0fa0, Name: "ab", Data: []byte("meta")},
+		{ID: irb.ICCProfile, Data: makeICC("sRGB IEC61966-2.1", false)},
+		{ID: irb.Slices, Data: makeSlices("image", "image_01", "http://example.com")},
+		thumb,
+	}
+	b := l.Bytes()
+	if len(b)&1 == 1 {
+		T.Errorf("resource blocks not padded to even size")
+	}
+	l2, err := irb.Parse(b)
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	if len(l2) != len(l) || l2[1].Signature != "MeSa" || l2[1].Name != "ab" || string(l2[0].Data) != "odd" {
+		T.Fatalf("resources do not round-trip")
+	}
+	if v := l2.Find(irb.ICCProfile).ICCProfileName(); v != "sRGB IEC61966-2.1" {
+		T.Errorf("invalid ICC profile name %q", v)
+	}
+	res := &irb.Resource{ID: irb.ICCProfile, Data: makeICC("Display P3", true)}
+	if v := res.ICCProfileName(); v != "Display P3" {
+		T.Errorf("invalid v4 ICC profile name %q", v)
+	}
+	v, err := l2.Find(irb.Thumbnail).Value()
+	if err != nil {
+		T.Fatalf("thumbnail decoding failed: %v", err)
+	}
+	if t, ok := v.(*irb.ThumbnailImage); !ok || t.Width != 160 || t.WidthBytes != 480 || !bytes.Equal(t.Data, testThumbnail) {
+		T.Errorf("invalid thumbnail %+v", v)
+	}
+	s, err := l2.Find(irb.Slices).Slices()
+	if err != nil {
+		T.Fatalf("slices decoding failed: %v", err)
+	}
+	if s.Name != "image" || s.Right != 32 || len(s.Slices) != 1 {
+		T.Fatalf("invalid slices %+v", s)
+	}
+	if v := s.Slices[0]; v.Name != "image_01" || v.URL != "http://example.com" || v.GroupID != 7 || v.Color != [4]byte{0xff, 1, 2, 3} {
+		T.Errorf("invalid slice %+v", v)
+	}
+	if _, err := irb.Parse(b[:len(b)-4]); err == nil {
+		T.Errorf("expected error for truncated resources")
+	}
+
+	l2 = l2.Set(irb.ResolutionInfo, nil).Set(irb.URL, []byte("http://example.com"))
+	if len(l2) != len(l) || l2[0].Signature != "MeSa" || l2.Find(irb.URL) == nil {
+		T.Errorf("set failed")
+	}
+}
+
+func TestIrbJPEG(T *testing.T) {
+	raw := iptc.DataSets{
+		{Record: 2, ID: 5, Data: []byte("Legacy")},
+		{Record: 2, ID: 90, Data: []byte("Berlin")},
+	}.Encode()
+	l := irb.Resources{
+		{ID: irb.IPTC, Data: raw},
+		{ID: 0x0fa0, Data: []byte(strings.Repeat("x", 70000))},
+		{ID: irb.ICCProfile, Data: makeICC("Adobe RGB (1998)", false)},
+	}
+	segs := l.JPEG()
+	if len(segs) != 3 {
+		T.Fatalf("expected 3 APP13 segments, got %d", len(segs))
+	}
+	var app13 bytes.Buffer
+	for _, v := range segs {
+		if len(v) > 65533 {
+			T.Errorf("APP13 segment too large (%d bytes)", len(v))
+		}
+		app13.Write([]byte{0xff, 0xed, byte((len(v) + 2) >> 8), byte(len(v) + 2)})
+		app13.Write(v)
+	}
+
+	var buf bytes.Buffer
+	if err := xmpjpeg.Write(&buf, bytes.NewReader(makeJPEG(T)), makeDocument("XMP")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	b := buf.Bytes()
+	b = append(append(append([]byte{}, b[:2]...), app13.Bytes()...), b[2:]...)
+
+	l2, err := xmpjpeg.ReadResources(bytes.NewReader(b))
+	if err != nil || len(l2) != 3 || len(l2[1].Data) != 70000 {
+		T.Fatalf("reading APP13 resources failed: %v", err)
+	}
+	d, err := xmpjpeg.Read(bytes.NewReader(b))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	// no digest, so XMP wins and IIM fills missing values
+	checkTitle(T, d, "XMP")
+	p := ps.FindModel(d)
+	if p == nil || p.City != "Berlin" || p.ICCProfile != "Adobe RGB (1998)" {
+		T.Errorf("invalid photoshop model %+v", p)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	xmpjpeg "github.com/trimmer-io/go-xmp/formats/jpeg"
+	_ "github.com/trimmer-io/go-xmp/models"
+	"github.com/trimmer-io/go-xmp/models/dc"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func makeJPEG(T *testing.T) []byte {
+	var buf bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		T.Fatalf("encoding jpeg failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func makeDocument(title string) *xmp.Document {
+	d := xmp.NewDocument()
+	d.AddModel(&dc.DublinCore{
+		Title:   xmp.NewAltString(title),
+		Creator: xmp.NewStringList("Alexander Eichhorn"),
+	})
+	return d
+}
+
+func checkTitle(T *testing.T, d *xmp.Document, title string) {
+	if d == nil {
+		T.Errorf("missing document")
+		return
+	}
+	m := dc.FindModel(d)
+	if m == nil {
+		T.Errorf("missing dc model")
+		return
+	}
+	if v := m.Title.Default(); v != title {
+		T.Errorf("invalid title, expected=%s got=%s", title, v)
+	}
+}
+
+func TestJpegNoXMP(T *testing.T) {
+	if _, err := xmpjpeg.Read(bytes.NewReader(makeJPEG(T))); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestJpegRoundtrip(T *testing.T) {
+	src := makeJPEG(T)
+	var buf bytes.Buffer
+	if err := xmpjpeg.Write(&buf, bytes.NewReader(src), makeDocument("first")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	d, err := xmpjpeg.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "first")
+
+	// replace the existing segment
+	var buf2 bytes.Buffer
+	if err := xmpjpeg.Write(&buf2, bytes.NewReader(buf.Bytes()), makeDocument("second")); err != nil {
+		T.Fatalf("rewrite failed: %v", err)
+	}
+	d, err = xmpjpeg.Read(bytes.NewReader(buf2.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "second")
+	if n := bytes.Count(buf2.Bytes(), []byte("http://ns.adobe.com/xap/1.0/\x00")); n != 1 {
+		T.Errorf("expected 1 xmp segment, found %d", n)
+	}
+
+	// image data must still decode
+	if _, err := jpeg.Decode(bytes.NewReader(buf2.Bytes())); err != nil {
+		T.Errorf("decoding image failed: %v", err)
+	}
+
+	// image data must remain unchanged
+	if !bytes.HasSuffix(buf2.Bytes(), src[len(src)-64:]) {
+		T.Errorf("image data changed")
+	}
+}
+
+func TestJpegExtendedXMP(T *testing.T) {
+	f, err := os.Open("../samples/dynamic-parts.xmp")
+	if err != nil {
+		T.Fatalf("cannot open sample: %v", err)
+	}
+	defer f.Close()
+	doc, err := xmp.Read(f)
+	if err != nil {
+		T.Fatalf("decoding sample failed: %v", err)
+	}
+	defer doc.Close()
+	packet, err := xmp.Marshal(doc)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if len(packet) < 0xFFFF {
+		T.Fatalf("sample too small for extended xmp: %d bytes", len(packet))
+	}
+	var buf bytes.Buffer
+	if err := xmpjpeg.WritePacket(&buf, bytes.NewReader(makeJPEG(T)), packet); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("http://ns.adobe.com/xmp/extension/\x00")); n < 1 {
+		T.Errorf("missing extended xmp segments")
+	}
+	d, err := xmpjpeg.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	defer d.Close()
+	if v, _ := d.GetPath("xmpNote:HasExtendedXMP"); v != "" {
+		T.Errorf("xmpNote:HasExtendedXMP should be removed after merge, got %s", v)
+	}
+	p1, err := doc.ListPaths()
+	if err != nil {
+		T.Fatalf("listing paths failed: %v", err)
+	}
+	p2, err := d.ListPaths()
+	if err != nil {
+		T.Fatalf("listing paths failed: %v", err)
+	}
+	if diff := p1.Diff(p2); len(diff) > 0 {
+		T.Errorf("roundtrip lost %d properties, first: %s", len(diff), diff[0].Path)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+		T.Errorf("decoding image failed: %v", err)
+	}
+}
+
+func TestJpegBrokenExtendedXMP(T *testing.T) {
+	f, err := os.Open("../samples/dynamic-parts.xmp")
+	if err != nil {
+		T.Fatalf("cannot open sample: %v", err)
+	}
+	defer f.Close()
+	doc, err := xmp.Read(f)
+	if err != nil {
+		T.Fatalf("decoding sample failed: %v", err)
+	}
+	defer doc.Close()
+	packet, err := xmp.Marshal(doc)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := xmpjpeg.WritePacket(&buf, bytes.NewReader(makeJPEG(T)), packet); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	// claim a full length far beyond the stored chunks
+	b := buf.Bytes()
+	i := bytes.Index(b, []byte("http://ns.adobe.com/xmp/extension/\x00"))
+	if i < 0 {
+		T.Fatalf("missing extended xmp segments")
+	}
+	copy(b[i+35+32:], []byte{0xff, 0xff, 0xff, 0xff})
+	d, err := xmpjpeg.Read(bytes.NewReader(b))
+	if err != nil {
+		T.Fatalf("read should fall back to StandardXMP, got %v", err)
+	}
+	defer d.Close()
+	if v, _ := d.GetPath("xmpNote:HasExtendedXMP"); v == "" {
+		T.Errorf("expected StandardXMP packet with xmpNote:HasExtendedXMP")
+	}
+}
+
+// app1 encodes an APP1 segment with the given payload.
+func app1(data ...[]byte) []byte {
+	b := []byte{0xff, 0xe1, 0, 0}
+	for _, v := range data {
+		b = append(b, v...)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-2))
+	return b
+}
+
+func TestJpegExtendedNamespaces(T *testing.T) {
+	const head = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:dc="http://purl.org/dc/elements/1.1/"`
+	ext := []byte(head + ` xmlns:ex="http://ns.example.com/ext/">` +
+		`<rdf:Description rdf:about="" dc:source="ext" ex:v="1"/></rdf:RDF></x:xmpmeta>`)
+	sum := md5.Sum(ext)
+	guid := strings.ToUpper(hex.EncodeToString(sum[:]))
+	std := []byte(head + ` xmlns:ex="http://ns.example.com/std/" xmlns:xmpNote="http://ns.adobe.com/xmp/note/">` +
+		`<rdf:Description rdf:about="" dc:format="image/jpeg" ex:v="0" xmpNote:HasExtendedXMP="` + guid + `"/></rdf:RDF></x:xmpmeta>`)
+
+	var size [8]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(ext)))
+	src := makeJPEG(T)
+	var buf bytes.Buffer
+	buf.Write(src[:2])
+	buf.Write(app1([]byte("http://ns.adobe.com/xap/1.0/\x00"), std))
+	buf.Write(app1([]byte("http://ns.adobe.com/xmp/extension/\x00"), []byte(guid), size[:], ext))
+	buf.Write(src[2:])
+
+	b, err := xmpjpeg.ReadPacket(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if n := bytes.Count(b, []byte(`xmlns:dc=`)); n != 1 {
+		T.Errorf("expected 1 dc namespace declaration, found %d in %s", n, string(b))
+	}
+	if bytes.Contains(b, []byte("HasExtendedXMP")) {
+		T.Errorf("xmpNote:HasExtendedXMP should be removed after merge")
+	}
+
+	// the ex prefix must still resolve to its own namespace in each part
+	found := make(map[string]string)
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			T.Fatalf("merged packet is invalid: %v %s", err, string(b))
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			for _, a := range se.Attr {
+				if a.Name.Local == "v" {
+					found[a.Value] = a.Name.Space
+				}
+			}
+		}
+	}
+	if found["0"] != "http://ns.example.com/std/" || found["1"] != "http://ns.example.com/ext/" {
+		T.Errorf("invalid namespaces after merge: %v", found)
+	}
+	d := &xmp.Document{}
+	if err := xmp.Unmarshal(b, d); err != nil {
+		T.Fatalf("decoding merged packet failed: %v", err)
+	}
+	defer d.Close()
+	if v, _ := d.GetPath("dc:source"); v != "ext" {
+		T.Errorf("missing extended property, got %q", v)
+	}
+}
@@ -0,0 +1,509 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/trimmer-io/go-xmp/formats/mp3"
+	"github.com/trimmer-io/go-xmp/models/id3"
+	"github.com/trimmer-io/go-xmp/models/xmp_dm"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// fake MPEG audio frames, contains a false sync to test unsynchronisation
+var mp3Audio = []byte("\xff\xfb\x90\x44\x00\x00\x00\x00\xff\xe0\x01\x02")
+
+func syncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+func makeFrame(version byte, id string, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(id)
+	if version == 4 {
+		buf.Write(syncsafe(len(data)))
+	} else {
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	}
+	buf.Write([]byte{0, 0})
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func makeID3(version, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	if flags&0x80 > 0 {
+		body = bytes.Replace(body, []byte{0xff}, []byte{0xff, 0}, -1)
+	}
+	body = append(body, make([]byte, 16)...)
+	hdr := append([]byte{'I', 'D', '3', version, 0, flags}, syncsafe(len(body))...)
+	return append(append(hdr, body...), mp3Audio...)
+}
+
+// makeMP3v23 builds a v2.3 tag with UTF-16 text and unsynchronisation.
+func makeMP3v23() []byte {
+	return makeID3(3, 0x80,
+		makeFrame(3, "TIT2", []byte("\x01\xff\xfeS\x00\xfc\x00\xdf\x00")),
+		makeFrame(3, "TPE1", []byte("\x00Artist")),
+		makeFrame(3, "TCON", []byte("\x00(17)(13)")),
+		makeFrame(3, "TYER", []byte("\x002017")),
+		makeFrame(3, "APIC", []byte("\x00image/png\x00\x03cover\x00\x89PNG\xff\xe0")),
+	)
+}
+
+// makeMP3v24 builds a v2.4 tag with chapters, rating and an XMP packet.
+func makeMP3v24(packet []byte) []byte {
+	chap := append([]byte("ch0\x00\x00\x00\x00\x00\x00\x00\x03\xe8\xff\xff\xff\xff\xff\xff\xff\xff"),
+		makeFrame(4, "TIT2", []byte("\x03Intro"))...)
+	toc := append([]byte("toc\x00\x03\x01ch0\x00"), makeFrame(4, "TIT2", []byte("\x03Chapters"))...)
+	return makeID3(4, 0,
+		makeFrame(4, "TIT2", []byte("\x03Song\x00")),
+		makeFrame(4, "TPE1", []byte("\x03A\x00B")),
+		makeFrame(4, "TDRC", []byte("\x032018-03-04T10:11")),
+		makeFrame(4, "TXXX", []byte("\x00mood\x00happy")),
+		makeFrame(4, "COMM", []byte("\x00eng\x00nice")),
+		makeFrame(4, "POPM", []byte("me@example.com\x00\xc4\x00\x00\x00\x07")),
+		makeFrame(4, "CHAP", chap),
+		makeFrame(4, "CTOC", toc),
+		makeFrame(4, "AENC", []byte("owner\x00\x00\x01\x00\x02")),
+		makeFrame(4, "PRIV", append([]byte("XMP\x00"), packet...)),
+	)
+}
+
+func checkAudio(T *testing.T, b []byte) {
+	if !bytes.HasSuffix(b, mp3Audio) {
+		T.Errorf("audio data changed")
+	}
+	t, err := mp3.ReadTag(bytes.NewReader(b))
+	if err != nil {
+		T.Fatalf("reading tag failed: %v", err)
+	}
+	if t.Size != len(b)-len(mp3Audio) {
+		T.Errorf("invalid tag size %d", t.Size)
+	}
+}
+
+func TestMp3NoTag(T *testing.T) {
+	if _, err := mp3.ReadPacket(bytes.NewReader(mp3Audio)); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	if _, err := mp3.ReadPacket(bytes.NewReader(makeMP3v23())); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := mp3.Write(&buf, bytes.NewReader(mp3Audio), makeDocument("Title")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	checkAudio(T, buf.Bytes())
+	d, err := mp3.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "Title")
+}
+
+func TestMp3TruncatedTag(T *testing.T) {
+	// maximum syncsafe size in a short file
+	b := []byte("ID3\x04\x00\x00\x7f\x7f\x7f\x7fTIT2")
+	if _, err := mp3.ReadTag(bytes.NewReader(b)); err == nil || err == io.EOF {
+		T.Errorf("expected read error, got %v", err)
+	}
+}
+
+func TestMp3ReadV23(T *testing.T) {
+	d, err := mp3.Read(bytes.NewReader(makeMP3v23()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	m := id3.FindModel(d)
+	if m == nil {
+		T.Fatalf("missing id3 model")
+	}
+	if m.TitleDescription != "Süß" || m.LeadPerformer != "Artist" || m.Year_v23 != 2017 {
+		T.Errorf("invalid text frames: %q %q %d", m.TitleDescription, m.LeadPerformer, m.Year_v23)
+	}
+	if m.ContentType.String() != "Rock, Pop" {
+		T.Errorf("invalid genre %q", m.ContentType.String())
+	}
+	if len(m.AttachedPicture) != 1 {
+		T.Fatalf("missing picture")
+	}
+	p := m.AttachedPicture[0]
+	if p.Mimetype != "image/png" || p.Type != id3.PictureTypeFrontCover || p.Description != "cover" || !bytes.Equal(p.Data, []byte("\x89PNG\xff\xe0")) {
+		T.Errorf("invalid picture %v", p)
+	}
+}
+
+func TestMp3ReadV24(T *testing.T) {
+	src, _ := xmp.Marshal(makeDocument("Packet"))
+	d, err := mp3.Read(bytes.NewReader(makeMP3v24(src)))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "Packet")
+	m := id3.FindModel(d)
+	if m.TitleDescription != "Song" || m.LeadPerformer != "A/B" || m.Comments != "nice" {
+		T.Errorf("invalid text frames: %q %q %q", m.TitleDescription, m.LeadPerformer, m.Comments)
+	}
+	if m.RecordingTime.Value().Hour() != 10 {
+		T.Errorf("invalid recording time %v", m.RecordingTime)
+	}
+	if len(m.Extension) != 1 || m.Extension[0].Key != "mood" || m.Extension[0].Value != "happy" {
+		T.Errorf("invalid user text %v", m.Extension)
+	}
+	if len(m.Popularimeter) != 1 || m.Popularimeter[0].Rating != 0xc4 || m.Popularimeter[0].Counter != 7 {
+		T.Errorf("invalid rating %v", m.Popularimeter)
+	}
+	if len(m.Chapters) != 1 {
+		T.Fatalf("missing chapter")
+	}
+	c := m.Chapters[0]
+	if c.Name != "ch0" || c.Comment != "Intro" || c.StartTime.Count != 0 || c.Duration.Count != 1000 {
+		T.Errorf("invalid chapter %v", c)
+	}
+	if len(m.TableOfContents) != 1 || m.TableOfContents[0].Info != "Chapters" || len(m.TableOfContents[0].IDList) != 1 {
+		T.Errorf("invalid toc %v", m.TableOfContents)
+	}
+}
+
+func TestMp3Write(T *testing.T) {
+	for _, src := range [][]byte{makeMP3v23(), makeMP3v24(nil)} {
+		d, err := mp3.Read(bytes.NewReader(src))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		m := id3.FindModel(d)
+		m.AlbumTitle = "Album"
+		m.Chapters = append(m.Chapters, id3.Chapter{
+			Name:      "ch1",
+			StartTime: xmpdm.FrameCount{Count: 1000, Rate: xmpdm.FrameRate{Rate: 1000, Base: 1}},
+			Duration:  xmpdm.FrameCount{Count: 500, Rate: xmpdm.FrameRate{Rate: 1000, Base: 1}},
+			Comment:   "Outro",
+		})
+		var buf bytes.Buffer
+		if err := mp3.Write(&buf, bytes.NewReader(src), d); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		checkAudio(T, buf.Bytes())
+		t, _ := mp3.ReadTag(bytes.NewReader(buf.Bytes()))
+		if t.Packet() == nil {
+			T.Errorf("missing XMP frame")
+		}
+		if t.Version == 4 && t.Find("AENC") == nil {
+			T.Errorf("unknown frame dropped")
+		}
+		m2, err := t.Model()
+		if err != nil {
+			T.Fatalf("model failed: %v", err)
+		}
+		if m2.AlbumTitle != "Album" || m2.TitleDescription != m.TitleDescription || len(m2.Chapters) != len(m.Chapters) {
+			T.Errorf("v2.%d: frames not written: %q %q %d", t.Version, m2.AlbumTitle, m2.TitleDescription, len(m2.Chapters))
+		}
+		if len(m2.ContentType) > 2 || m2.ContentType.String() != m.ContentType.String() {
+			T.Errorf("v2.%d: genre mismatch %q", t.Version, m2.ContentType.String())
+		}
+		if len(m2.AttachedPicture) != len(m.AttachedPicture) {
+			T.Errorf("v2.%d: picture dropped", t.Version)
+		}
+	}
+}
+
+// makeMP3Frames builds a v2.4 tag with frames the id3 model represents
+// only partially: several comments, chapters with byte offsets and extra
+// embedded frames, and a table of contents with a custom element ID.
+func makeMP3Frames() []byte {
+	ch0 := append([]byte("ch0\x00\x00\x00\x00\x00\x00\x00\x03\xe8\x00\x00\x01\x00\x00\x00\x02\x00"),
+		append(makeFrame(4, "TIT2", []byte("\x03Intro")), makeFrame(4, "TIT3", []byte("\x03first"))...)...)
+	ch1 := append([]byte("ch1\x00\x00\x00\x03\xe8\x00\x00\x07\xd0\x00\x00\x02\x00\x00\x00\x03\x00"),
+		append(makeFrame(4, "TIT2", []byte("\x03Outro")), makeFrame(4, "WXXX", []byte("\x00\x00http://example.com"))...)...)
+	toc := append([]byte("main\x00\x03\x02ch0\x00ch1\x00"), makeFrame(4, "TIT2", []byte("\x03Chapters"))...)
+	return makeID3(4, 0,
+		makeFrame(4, "TIT2", []byte("\x03Song")),
+		makeFrame(4, "COMM", []byte("\x00engiTunNORM\x00 00000A2C 00000A2C")),
+		makeFrame(4, "COMM", []byte("\x00deuNotiz\x00Hallo")),
+		makeFrame(4, "COMM", []byte("\x00eng\x00nice")),
+		makeFrame(4, "USLT", []byte("\x00deu\x00la la")),
+		makeFrame(4, "UFID", []byte("http://musicbrainz.org\x00abc-123")),
+		makeFrame(4, "CHAP", ch0),
+		makeFrame(4, "CHAP", ch1),
+		makeFrame(4, "CTOC", toc),
+	)
+}
+
+// id3Frames returns all frames of the tag in b except the XMP frame.
+func id3Frames(T *testing.T, b []byte) []mp3.Frame {
+	t, err := mp3.ReadTag(bytes.NewReader(b))
+	if err != nil {
+		T.Fatalf("reading tag failed: %v", err)
+	}
+	t.Remove(func(f mp3.Frame) bool {
+		return f.ID == "PRIV" && bytes.HasPrefix(f.Data, []byte("XMP\x00"))
+	})
+	return t.Frames
+}
+
+func findFrame(l []mp3.Frame, id string, prefix string) *mp3.Frame {
+	for i := range l {
+		if l[i].ID == id && bytes.HasPrefix(l[i].Data, []byte(prefix)) {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+func TestMp3FrameRoundtrip(T *testing.T) {
+	src := makeMP3Frames()
+	orig := id3Frames(T, src)
+	d, err := mp3.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	m := id3.FindModel(d)
+	if m.Comments != "nice" || m.UniqueFileIdentifier != "abc-123" {
+		T.Errorf("invalid model: %q %q", m.Comments, m.UniqueFileIdentifier)
+	}
+
+	// unchanged models must keep all frames byte for byte
+	var buf bytes.Buffer
+	if err := mp3.Write(&buf, bytes.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if l := id3Frames(T, buf.Bytes()); !reflect.DeepEqual(l, orig) {
+		T.Errorf("unchanged frames rewritten:\n%q\n%q", l, orig)
+	}
+
+	// changed values only rewrite their own frames
+	if d, err = mp3.Read(bytes.NewReader(src)); err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	m = id3.FindModel(d)
+	m.Comments = "great"
+	m.UniqueFileIdentifier = "def-456"
+	m.Chapters[1].Comment = "End"
+	m.TableOfContents[0].Info = "Content"
+	buf.Reset()
+	if err := mp3.Write(&buf, bytes.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	l := id3Frames(T, buf.Bytes())
+	if len(l) != len(orig) {
+		T.Errorf("expected %d frames, got %d", len(orig), len(l))
+	}
+	for _, f := range []*mp3.Frame{&orig[1], &orig[2], &orig[4], &orig[6]} {
+		if x := findFrame(l, f.ID, string(f.Data)); x == nil {
+			T.Errorf("frame %s %q lost", f.ID, f.Data)
+		}
+	}
+	if f := findFrame(l, "COMM", "\x00eng\x00"); f == nil || string(f.Data[5:]) != "great" {
+		T.Errorf("invalid comment %v", f)
+	}
+	if f := findFrame(l, "UFID", "http://musicbrainz.org\x00"); f == nil || !bytes.HasSuffix(f.Data, []byte("def-456")) {
+		T.Errorf("invalid UFID %v", f)
+	}
+	f := findFrame(l, "CHAP", "ch1\x00")
+	if f == nil {
+		T.Fatalf("missing chapter ch1")
+	}
+	if !bytes.Equal(f.Data[12:20], []byte("\x00\x00\x02\x00\x00\x00\x03\x00")) {
+		T.Errorf("chapter byte offsets changed: %x", f.Data[12:20])
+	}
+	if !bytes.Contains(f.Data, []byte("End")) || !bytes.Contains(f.Data, []byte("http://example.com")) {
+		T.Errorf("invalid chapter sub-frames %q", f.Data)
+	}
+	if f := findFrame(l, "CTOC", "main\x00"); f == nil || !bytes.Contains(f.Data, []byte("Content")) {
+		T.Errorf("invalid table of contents %v", f)
+	}
+	m2, err := mp3.ReadTag(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("reading tag failed: %v", err)
+	}
+	if x, _ := m2.Model(); x.Comments != "great" || x.Chapters[0].Comment != "Intro" {
+		T.Errorf("invalid model after write: %q %v", x.Comments, x.Chapters)
+	}
+}
+
+func TestMp3UpgradeV22(T *testing.T) {
+	frame := func(id, data string) []byte {
+		n := len(data)
+		return append([]byte{id[0], id[1], id[2], byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+	}
+	src := makeID3(2, 0,
+		frame("TT2", "\x00Song"),
+		frame("TZZ", "\x00custom"),
+		frame("XYZ", "\x01\x02"),
+	)
+	d, err := mp3.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := mp3.Write(&buf, bytes.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	l := id3Frames(T, buf.Bytes())
+	if findFrame(l, "TIT2", "\x00Song") == nil {
+		T.Errorf("missing title")
+	}
+	if findFrame(l, "TXXX", "\x00TZZ\x00custom") == nil {
+		T.Errorf("unmapped v2.2 text frame dropped")
+	}
+	if findFrame(l, "PRIV", "ID3v2.2:XYZ\x00\x01\x02") == nil {
+		T.Errorf("unmapped v2.2 frame dropped")
+	}
+}
+
+// makeV1 builds a raw ID3v1.1 tag with Latin-1 text, optionally preceded
+// by a TAG+ block holding the continuation of the title.
+func makeV1(title, artist, year, comment string, track, genre byte, ext string) []byte {
+	field := func(s string, n int) []byte {
+		b := make([]byte, n)
+		copy(b, s)
+		return b
+	}
+	var buf bytes.Buffer
+	if ext != "" {
+		buf.WriteString("TAG+")
+		buf.Write(field(ext, 60))
+		buf.Write(make([]byte, 163))
+	}
+	buf.WriteString("TAG")
+	buf.Write(field(title, 30))
+	buf.Write(field(artist, 30))
+	buf.Write(field("", 30))
+	buf.Write(field(year, 4))
+	buf.Write(field(comment, 28))
+	buf.Write([]byte{0, track, genre})
+	return buf.Bytes()
+}
+
+func TestMp3ReadV1(T *testing.T) {
+	src := append(append([]byte{}, mp3Audio...), makeV1("Caf\xe9", "Artist  ", "1999", "old", 5, 17, "")...)
+	d, err := mp3.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	m := id3.FindModel(d)
+	if m == nil {
+		T.Fatalf("missing id3 model")
+	}
+	if m.TitleDescription != "Café" || m.LeadPerformer != "Artist" || m.Comments != "old" || m.Year_v23 != 1999 {
+		T.Errorf("invalid v1 text: %q %q %q %d", m.TitleDescription, m.LeadPerformer, m.Comments, m.Year_v23)
+	}
+	if m.TrackNumber.Track != 5 || m.ContentType.String() != "Rock" {
+		T.Errorf("invalid v1 track or genre: %v %q", m.TrackNumber, m.ContentType.String())
+	}
+
+	// TAG+ continues the title
+	long := "A title that is longer than thirty characters"
+	src = append(append([]byte{}, mp3Audio...), makeV1(long[:30], "", "", "", 0, 255, long[30:])...)
+	t, err := mp3.ReadTagV1(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if t.Title != long || t.Size != 355 || t.Genre != mp3.GenreNone || t.Track != 0 {
+		T.Errorf("invalid TAG+ tag %+v", t)
+	}
+	if _, err := mp3.ReadTagV1(bytes.NewReader(mp3Audio)); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestMp3WriteV1(T *testing.T) {
+	t := mp3.NewTagV1()
+	t.Title = strings.Repeat("t", 100)
+	t.Artist = "Ärtist"
+	t.Comment = strings.Repeat("c", 40)
+	t.Year = "20171"
+	t.Track = 3
+	t.SetModel(&id3.ID3{ContentType: id3.Genre{"Jazz"}})
+	b := t.Bytes()
+	if len(b) != 355 {
+		T.Fatalf("invalid tag size %d", len(b))
+	}
+	if b[227+33] != 0xc4 {
+		T.Errorf("artist not Latin-1 encoded")
+	}
+	x, err := mp3.ParseTagV1(b)
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	if x.Title != strings.Repeat("t", 90) || x.Comment != strings.Repeat("c", 28) || x.Year != "2017" || x.Track != 3 {
+		T.Errorf("invalid truncation %+v", x)
+	}
+	if x.Genre.String() != "Jazz" || x.GenreName != "" {
+		T.Errorf("invalid genre %d %q", x.Genre, x.GenreName)
+	}
+
+	// replace an existing tag and remove it
+	src := append(append([]byte{}, mp3Audio...), makeV1("Old", "", "", "", 0, 255, "")...)
+	var buf bytes.Buffer
+	if err := mp3.WriteTagV1(&buf, bytes.NewReader(src), x); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), append(append([]byte{}, mp3Audio...), b...)) {
+		T.Errorf("tag not replaced")
+	}
+	buf.Reset()
+	if err := mp3.WriteTagV1(&buf, bytes.NewReader(src), nil); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), mp3Audio) {
+		T.Errorf("tag not removed")
+	}
+}
+
+func TestMp3ReconcileV1(T *testing.T) {
+	src := append(makeMP3v23(), makeV1("Other", "Artist", "2017", "", 0, 13, "")...)
+	l, err := mp3.Reconcile(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("reconcile failed: %v", err)
+	}
+	if len(l) != 1 || l[0].Frame != "TIT2" || l[0].V1 != "Other" || l[0].V2 != "Süß" {
+		T.Errorf("invalid conflicts %v", l)
+	}
+
+	// v2 values win, missing values are taken from v1, and writes keep
+	// both tags in sync
+	src = append(makeMP3v23(), makeV1("Other", "", "", "from v1", 0, 13, "")...)
+	d, err := mp3.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	m := id3.FindModel(d)
+	if m.TitleDescription != "Süß" || m.Comments != "from v1" {
+		T.Errorf("invalid merge: %q %q", m.TitleDescription, m.Comments)
+	}
+	m.AlbumTitle = "Album"
+	var buf bytes.Buffer
+	if err := mp3.Write(&buf, bytes.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	t, err := mp3.ReadTagV1(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if t.Title != "Süß" || t.Album != "Album" || t.Year != "2017" {
+		T.Errorf("v1 tag not updated %+v", t)
+	}
+	if l, _ := mp3.Reconcile(bytes.NewReader(buf.Bytes())); len(l) != 0 {
+		T.Errorf("unexpected conflicts after write %v", l)
+	}
+}
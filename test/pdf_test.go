@@ -0,0 +1,255 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	xmppdf "github.com/trimmer-io/go-xmp/formats/pdf"
+	"github.com/trimmer-io/go-xmp/models/dc"
+	"github.com/trimmer-io/go-xmp/models/pdf"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// makePDF builds an empty document with Info dictionary and an optional
+// compressed metadata stream. With xrefStream set the catalog, pages and
+// Info are stored in an object stream and the file uses a predictor
+// encoded cross reference stream.
+func makePDF(xrefStream bool, packet []byte) []byte {
+	catalog := "<< /Type /Catalog /Pages 2 0 R >>"
+	if packet != nil {
+		catalog = "<< /Type /Catalog /Pages 2 0 R /Metadata 4 0 R >>"
+	}
+	objs := []string{
+		catalog,
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Title (Old \\(Info\\) Title) /Author (Jane; John) /Producer <FEFF0054006500730074> /CreationDate (D:20180102030405+01'00') >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make(map[int]int)
+	writeStream := func(num int, dict string, data []byte) {
+		offsets[num] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", num, dict, len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+	if packet != nil {
+		writeStream(4, "/Type /Metadata /Subtype /XML /Filter /FlateDecode", deflate(packet))
+	}
+	if !xrefStream {
+		for i, v := range objs {
+			offsets[i+1] = buf.Len()
+			fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, v)
+		}
+		xref := buf.Len()
+		buf.WriteString("xref\n0 5\n0000000000 65535 f\r\n")
+		for i := 1; i < 5; i++ {
+			fmt.Fprintf(&buf, "%010d 00000 n\r\n", offsets[i])
+		}
+		fmt.Fprintf(&buf, "trailer\n<< /Size 5 /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", xref)
+		return buf.Bytes()
+	}
+
+	// object stream 5 contains objects 1-3
+	var hdr, body bytes.Buffer
+	for i, v := range objs {
+		fmt.Fprintf(&hdr, "%d %d ", i+1, body.Len())
+		body.WriteString(v + "\n")
+	}
+	writeStream(5, fmt.Sprintf("/Type /ObjStm /N 3 /First %d /Filter /FlateDecode", hdr.Len()),
+		deflate(append(hdr.Bytes(), body.Bytes()...)))
+
+	// xref stream 6 with W [1 2 1] and PNG up predictor
+	xref := buf.Len()
+	rows := [][]byte{
+		{0, 0, 0, 255},
+		{2, 0, 5, 0},
+		{2, 0, 5, 1},
+		{2, 0, 5, 2},
+		{1, byte(offsets[4] >> 8), byte(offsets[4]), 0},
+		{1, byte(offsets[5] >> 8), byte(offsets[5]), 0},
+		{1, byte(xref >> 8), byte(xref), 0},
+	}
+	if packet == nil {
+		rows[4] = []byte{0, 0, 0, 0}
+	}
+	var data []byte
+	prev := make([]byte, 4)
+	for _, row := range rows {
+		data = append(data, 2)
+		for i, c := range row {
+			data = append(data, c-prev[i])
+		}
+		prev = row
+	}
+	writeStream(6, "/Type /XRef /Size 7 /W [1 2 1] /Root 1 0 R /Info 3 0 R /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 4 >>", deflate(data))
+	fmt.Fprintf(&buf, "startxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+func TestPdfRead(T *testing.T) {
+	packet, err := ioutil.ReadFile("../samples/issue-6-nuance-pdf.xmp")
+	if err != nil {
+		T.Fatalf("cannot read sample: %v", err)
+	}
+	for _, xs := range []bool{false, true} {
+		if _, err := xmppdf.ReadPacket(bytes.NewReader(makePDF(xs, nil))); err != io.EOF {
+			T.Errorf("expected io.EOF, got %v", err)
+		}
+		r := bytes.NewReader(makePDF(xs, packet))
+		b, err := xmppdf.ReadPacket(r)
+		if err != nil {
+			T.Fatalf("read packet failed: %v", err)
+		}
+		if !bytes.Equal(b, packet) {
+			T.Errorf("packet mismatch")
+		}
+		info, err := xmppdf.ReadInfo(r)
+		if err != nil {
+			T.Fatalf("read info failed: %v", err)
+		}
+		if info.Title.Default() != "Old (Info) Title" || len(info.Author) != 2 || info.Producer != "Test" || info.PDFVersion != "1.5" {
+			T.Errorf("invalid info %+v", info)
+		}
+		if _, ofs := info.CreationDate.Value().Zone(); ofs != 3600 || info.CreationDate.Value().Hour() != 3 {
+			T.Errorf("invalid creation date %v", info.CreationDate)
+		}
+
+		// XMP takes precedence over the Info dictionary
+		d, err := xmppdf.Read(r)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		if m := pdf.FindModel(d); m == nil || m.Producer != "Nuance PDF Create" {
+			T.Errorf("invalid pdf model %v", m)
+		}
+		if m := dc.FindModel(d); m == nil || len(m.Creator) != 1 || m.Creator[0] != "Mark.Brown" {
+			T.Errorf("invalid dc model %v", m)
+		}
+
+		// Info dictionary only
+		d, err = xmppdf.Read(bytes.NewReader(makePDF(xs, nil)))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d, "Old (Info) Title")
+	}
+}
+
+func TestPdfCircularObjectStream(T *testing.T) {
+	// the catalog is stored in object stream 2 which claims to be stored
+	// in itself
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	xref := buf.Len()
+	rows := []byte{0, 0, 0, 255, 2, 0, 2, 0, 2, 0, 2, 1, 1, byte(xref >> 8), byte(xref), 0}
+	fmt.Fprintf(&buf, "3 0 obj\n<< /Type /XRef /Size 4 /W [1 2 1] /Root 1 0 R /Length %d >>\nstream\n", len(rows))
+	buf.Write(rows)
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xref)
+	if _, err := xmppdf.ReadPacket(bytes.NewReader(buf.Bytes())); err == nil || err == io.EOF {
+		T.Errorf("expected error, got %v", err)
+	}
+}
+
+func TestPdfUpdate(T *testing.T) {
+	for _, xs := range []bool{false, true} {
+		for _, packet := range [][]byte{nil, []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"/>")} {
+			src := makePDF(xs, packet)
+			f := makeTempFile(T, src)
+			defer removeTempFile(f)
+
+			d := makeDocument("Neuer Titel")
+			if err := xmppdf.WriteWithInfo(f, d); err != nil {
+				T.Fatalf("write failed: %v", err)
+			}
+			checkPdfUpdate(T, f, src, "Neuer Titel")
+
+			// second update follows the /Prev chain
+			d = makeDocument("Título")
+			if err := xmppdf.Write(f, d); err != nil {
+				T.Fatalf("second write failed: %v", err)
+			}
+			d, err := xmppdf.Read(f)
+			if err != nil {
+				T.Fatalf("read failed: %v", err)
+			}
+			checkTitle(T, d, "Título")
+			info, _ := xmppdf.ReadInfo(f)
+			if info.Title.Default() != "Neuer Titel" {
+				T.Errorf("Info changed without sync: %q", info.Title.Default())
+			}
+		}
+	}
+}
+
+func checkPdfUpdate(T *testing.T, f io.ReadSeeker, src []byte, title string) {
+	f.Seek(0, io.SeekStart)
+	b, _ := ioutil.ReadAll(f)
+	if !bytes.HasPrefix(b, src) {
+		T.Errorf("original file content changed")
+	}
+	d, err := xmppdf.Read(f)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, title)
+	info, err := xmppdf.ReadInfo(f)
+	if err != nil {
+		T.Fatalf("read info failed: %v", err)
+	}
+	if info.Title.Default() != title || info.Producer != "Test" || len(info.Author) != 1 {
+		T.Errorf("invalid info after update %+v", info)
+	}
+	if _, err := xmp.Marshal(d); err != nil {
+		T.Errorf("marshal failed: %v", err)
+	}
+}
+
+func TestPdfHandlerInfo(T *testing.T) {
+	f := makeTempFile(T, makePDF(false, nil))
+	defer removeTempFile(f)
+	checkInfo := func(want string) {
+		info, err := xmppdf.ReadInfo(f)
+		if err != nil {
+			T.Fatalf("read info failed: %v", err)
+		}
+		if v := info.Title.Default(); v != want {
+			T.Errorf("expected Info title %q, got %q", want, v)
+		}
+	}
+	// the registered handler leaves the Info dictionary alone
+	if err := xmp.WriteFile(f.Name(), makeDocument("New Title")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	checkInfo("Old (Info) Title")
+	if err := xmppdf.NewHandler(true).WriteXMP(f, f, makeDocument("New Title")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	checkInfo("New Title")
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	xmppng "github.com/trimmer-io/go-xmp/formats/png"
+	_ "github.com/trimmer-io/go-xmp/models"
+)
+
+func makePNG(T *testing.T) []byte {
+	var buf bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	if err := png.Encode(&buf, img); err != nil {
+		T.Fatalf("encoding png failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// insert a compressed XMP iTXt chunk after IHDR
+func makeCompressedPNG(T *testing.T, packet []byte) []byte {
+	src := makePNG(T)
+	var data bytes.Buffer
+	data.WriteString("XML:com.adobe.xmp\x00\x01\x00\x00\x00")
+	zw := zlib.NewWriter(&data)
+	zw.Write(packet)
+	zw.Close()
+	var c bytes.Buffer
+	binary.Write(&c, binary.BigEndian, uint32(data.Len()))
+	c.WriteString("iTXt")
+	c.Write(data.Bytes())
+	binary.Write(&c, binary.BigEndian, crc32.ChecksumIEEE(c.Bytes()[4:]))
+	// signature (8) + IHDR chunk (25)
+	out := append([]byte{}, src[:33]...)
+	out = append(out, c.Bytes()...)
+	return append(out, src[33:]...)
+}
+
+func TestPngNoXMP(T *testing.T) {
+	if _, err := xmppng.Read(bytes.NewReader(makePNG(T))); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestPngTruncatedChunk(T *testing.T) {
+	src := makePNG(T)
+	// declare a 2GB chunk after IHDR but end the file right after its header
+	b := append([]byte{}, src[:33]...)
+	b = append(b, 0x7f, 0xff, 0xff, 0xff, 't', 'E', 'X', 't', 'a', 'b', 'c')
+	if _, err := xmppng.ReadPacket(bytes.NewReader(b)); err == nil || err == io.EOF {
+		T.Errorf("expected read error, got %v", err)
+	}
+}
+
+func TestPngRoundtrip(T *testing.T) {
+	packet, err := ioutil.ReadFile("../samples/bluesquare.png.xmp")
+	if err != nil {
+		T.Fatalf("cannot read sample: %v", err)
+	}
+	src := makePNG(T)
+	var buf bytes.Buffer
+	if err := xmppng.WritePacket(&buf, bytes.NewReader(src), packet); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	b, err := xmppng.ReadPacket(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(b, packet) {
+		T.Errorf("packet changed during roundtrip")
+	}
+	d, err := xmppng.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	d.Close()
+
+	var buf2 bytes.Buffer
+	if err := xmppng.Write(&buf2, bytes.NewReader(buf.Bytes()), makeDocument("png")); err != nil {
+		T.Fatalf("rewrite failed: %v", err)
+	}
+	d, err = xmppng.Read(bytes.NewReader(buf2.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "png")
+	if n := bytes.Count(buf2.Bytes(), []byte("XML:com.adobe.xmp")); n != 1 {
+		T.Errorf("expected 1 xmp chunk, found %d", n)
+	}
+	if _, err := png.Decode(bytes.NewReader(buf2.Bytes())); err != nil {
+		T.Errorf("decoding image failed: %v", err)
+	}
+	if !bytes.HasSuffix(buf2.Bytes(), src[bytes.Index(src, []byte("IDAT"))-4:]) {
+		T.Errorf("image data changed")
+	}
+}
+
+func TestPngCompressed(T *testing.T) {
+	packet, err := ioutil.ReadFile("../samples/bluesquare.png.xmp")
+	if err != nil {
+		T.Fatalf("cannot read sample: %v", err)
+	}
+	src := makeCompressedPNG(T, packet)
+	b, err := xmppng.ReadPacket(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(b, packet) {
+		T.Errorf("compressed packet mismatch")
+	}
+	var buf bytes.Buffer
+	if err := xmppng.Write(&buf, bytes.NewReader(src), makeDocument("compressed")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("compressed")) {
+		T.Errorf("expected compressed text in rewritten chunk")
+	}
+	d, err := xmppng.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "compressed")
+}
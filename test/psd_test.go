@@ -0,0 +1,104 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/trimmer-io/go-xmp/formats/psd"
+)
+
+var psdImageData = []byte("\x00\x00layer-and-image-data")
+
+// makePSD builds a PSD (version 1) or PSB (version 2) file with a color
+// mode section and the given image resources.
+func makePSD(version uint16, res ...*psd.Resource) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("8BPS")
+	binary.Write(&buf, binary.BigEndian, version)
+	buf.Write(make([]byte, 6))
+	binary.Write(&buf, binary.BigEndian, []uint16{3})
+	binary.Write(&buf, binary.BigEndian, []uint32{16, 16})
+	binary.Write(&buf, binary.BigEndian, []uint16{8, 3})
+	binary.Write(&buf, binary.BigEndian, uint32(3))
+	buf.WriteString("cmd")
+	b := psd.EncodeResources(res)
+	binary.Write(&buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+	buf.Write(psdImageData)
+	return buf.Bytes()
+}
+
+func TestPsdResources(T *testing.T) {
+	src := makePSD(1,
+		&psd.Resource{ID: 0x03ed, Data: []byte("odd")},
+		&psd.Resource{ID: psd.ResourceIPTC, Name: "iptc", Data: []byte("\x1c\x02\x00\x00\x02\x00\x04")},
+		&psd.Resource{ID: psd.ResourceICCProfile, Name: "a", Data: []byte("icc-profile")},
+	)
+	l, err := psd.ReadResources(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if len(l) != 3 || l[1].Name != "iptc" || l[0].Signature != "8BIM" || string(l[0].Data) != "odd" {
+		T.Fatalf("unexpected resources %v", l)
+	}
+	if b, err := psd.ReadIPTC(bytes.NewReader(src)); err != nil || len(b) != 7 {
+		T.Errorf("reading IPTC failed: %v", err)
+	}
+	if b, err := psd.ReadICCProfile(bytes.NewReader(src)); err != nil || string(b) != "icc-profile" {
+		T.Errorf("reading ICC profile failed: %v", err)
+	}
+	if _, err := psd.Read(bytes.NewReader(src)); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	if l2, err := psd.ParseResources(psd.EncodeResources(l)); err != nil || len(l2) != 3 || string(l2[2].Data) != "icc-profile" {
+		T.Errorf("resource encoding does not roundtrip: %v", err)
+	}
+	if _, err := psd.Read(bytes.NewReader(makeJPEG(T))); err != psd.ErrInvalidFile {
+		T.Errorf("expected invalid file error, got %v", err)
+	}
+}
+
+func TestPsdRoundtrip(T *testing.T) {
+	for _, version := range []uint16{1, 2} {
+		src := makePSD(version, &psd.Resource{ID: psd.ResourceIPTC, Data: []byte("iptc")})
+		var buf bytes.Buffer
+		if err := psd.Write(&buf, bytes.NewReader(src), makeDocument("first")); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), psdImageData) || !bytes.Equal(buf.Bytes()[:26], src[:26]) {
+			T.Errorf("header or image data changed")
+		}
+		var buf2 bytes.Buffer
+		if err := psd.Write(&buf2, bytes.NewReader(buf.Bytes()), makeDocument("second")); err != nil {
+			T.Fatalf("rewrite failed: %v", err)
+		}
+		l, err := psd.ReadResources(bytes.NewReader(buf2.Bytes()))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		if len(l) != 2 || l[0].ID != psd.ResourceIPTC || l[1].ID != psd.ResourceXMP {
+			T.Errorf("unexpected resources after write %v", l)
+		}
+		d, err := psd.Read(bytes.NewReader(buf2.Bytes()))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d, "second")
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	xmpriff "github.com/trimmer-io/go-xmp/formats/riff"
+	_ "github.com/trimmer-io/go-xmp/models"
+	"github.com/trimmer-io/go-xmp/models/ixml"
+	"github.com/trimmer-io/go-xmp/models/riff"
+	"github.com/trimmer-io/go-xmp/models/xmp_dm"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+var wavSamples = []byte("\x01\x00\x02\x00\x03\x00\x04\x00\x05\x00\x06\x00\x07\x00\x08\x00")
+
+const testIXML = `<?xml version="1.0" encoding="UTF-8"?>
+<BWFXML><IXML_VERSION>2.0</IXML_VERSION><PROJECT>Feature</PROJECT><SCENE>12A</SCENE><TAPE>R1</TAPE><TAKE>3</TAKE></BWFXML>`
+
+func makeChunk(id string, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(id)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)&1 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// makeWAV builds a 16bit mono PCM wave file with INFO and iXML chunks.
+// RF64 files use a ds64 chunk and 0xffffffff size fields.
+func makeWAV(rf64 bool) []byte {
+	fmtChunk := []byte{1, 0, 1, 0, 0x80, 0xbb, 0, 0, 0, 0x77, 1, 0, 2, 0, 16, 0}
+	var info bytes.Buffer
+	info.WriteString("INFO")
+	info.Write(makeChunk("INAM", []byte("Scene 12A\x00")))
+	info.Write(makeChunk("IART", []byte("Mixer\x00")))
+	ds := make([]byte, 28)
+	binary.LittleEndian.PutUint64(ds[8:], uint64(len(wavSamples)))
+	var body bytes.Buffer
+	body.WriteString("WAVE")
+	if rf64 {
+		body.Write(makeChunk("ds64", ds))
+	} else {
+		body.Write(makeChunk("JUNK", ds))
+	}
+	body.Write(makeChunk("fmt ", fmtChunk))
+	body.Write(makeChunk("LIST", info.Bytes()))
+	body.Write(makeChunk("iXML", []byte(testIXML)))
+	data := makeChunk("data", wavSamples)
+	if rf64 {
+		binary.LittleEndian.PutUint32(data[4:], 0xffffffff)
+	}
+	body.Write(data)
+	out := body.Bytes()
+	if rf64 {
+		binary.LittleEndian.PutUint64(out[12:], uint64(len(out)))
+		return append(append([]byte("RF64"), 0xff, 0xff, 0xff, 0xff), out...)
+	}
+	return append(makeChunk("RIFF", nil)[:4], append(makeChunk("RIFF", out)[4:8], out...)...)
+}
+
+func checkSamples(T *testing.T, r io.ReadSeeker) {
+	x, err := xmpriff.ReadFile(r)
+	if err != nil {
+		T.Fatalf("reading file failed: %v", err)
+	}
+	c := x.Find("data")
+	if c == nil {
+		T.Fatalf("missing data chunk")
+	}
+	b, err := c.ReadData(r)
+	if err != nil {
+		T.Fatalf("reading data failed: %v", err)
+	}
+	if !bytes.Equal(b, wavSamples) {
+		T.Errorf("sample data changed")
+	}
+}
+
+func TestWavRead(T *testing.T) {
+	for _, rf64 := range []bool{false, true} {
+		r := bytes.NewReader(makeWAV(rf64))
+		if _, err := xmpriff.ReadPacket(r); err != io.EOF {
+			T.Errorf("expected io.EOF, got %v", err)
+		}
+		d, err := xmpriff.Read(r)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		info := riff.FindModel(d)
+		if info == nil || info.Artist != "Mixer" {
+			T.Fatalf("invalid INFO model %v", info)
+		}
+		x := ixml.FindModel(d)
+		if x == nil || x.SceneName != "12A" || x.Take != 3 {
+			T.Fatalf("invalid iXML model %v", x)
+		}
+		// native metadata is synced into XMP on write
+		if _, err := xmp.Marshal(d); err != nil {
+			T.Fatalf("marshal failed: %v", err)
+		}
+		if dm := xmpdm.FindModel(d); dm == nil || dm.Scene != "12A" || dm.TapeName != "R1" {
+			T.Errorf("iXML not synced to xmpDM: %v", dm)
+		}
+		checkSamples(T, r)
+	}
+}
+
+func TestRiffInfoPadding(T *testing.T) {
+	// odd sized final tag without pad byte
+	b := append([]byte("INFO"), makeChunk("INAM", []byte("Take"))...)
+	b = append(b, "IART\x05\x00\x00\x00Mixer"...)
+	m, err := xmpriff.DecodeInfo(b)
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	if m.Artist != "Mixer" {
+		T.Errorf("invalid artist %q", m.Artist)
+	}
+	// broken INFO lists must not fail the whole file
+	src := makeWAV(false)
+	i := bytes.Index(src, []byte("INAM"))
+	binary.LittleEndian.PutUint32(src[i+4:], 0xffff)
+	d, err := xmpriff.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if x := ixml.FindModel(d); x == nil || x.SceneName != "12A" {
+		T.Errorf("invalid iXML model %v", x)
+	}
+}
+
+func TestWavWrite(T *testing.T) {
+	for _, rf64 := range []bool{false, true} {
+		f := makeTempFile(T, makeWAV(rf64))
+		defer removeTempFile(f)
+
+		d, err := xmpriff.Read(f)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		ixml.FindModel(d).Take = 4
+		riff.FindModel(d).Artist = "Production Sound Mixer"
+		if err := xmpriff.Write(f, d); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		if _, err := xmpriff.ReadPacket(f); err != nil {
+			T.Errorf("missing packet: %v", err)
+		}
+		x, err := xmpriff.ReadIXML(f)
+		if err != nil || x.Take != 4 || x.SceneName != "12A" {
+			T.Errorf("invalid iXML after write: %v %v", x, err)
+		}
+		info, err := xmpriff.ReadInfo(f)
+		if err != nil || info.Artist != "Production Sound Mixer" {
+			T.Errorf("invalid INFO after write: %v %v", info, err)
+		}
+		if len(info.Title) == 0 || info.Title[0].Value != "Scene 12A" {
+			T.Errorf("invalid INFO title %v", info.Title)
+		}
+
+		// shrink the packet in place
+		size, _ := f.Seek(0, io.SeekEnd)
+		if err := xmpriff.WritePacket(f, []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"/>")); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		if s, _ := f.Seek(0, io.SeekEnd); s != size {
+			T.Errorf("in-place update changed file size from %d to %d", size, s)
+		}
+		checkSamples(T, f)
+	}
+}
+
+func TestWavBext(T *testing.T) {
+	f := makeTempFile(T, makeWAV(false))
+	defer removeTempFile(f)
+	if _, err := xmpriff.ReadBext(f); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	src := &xmpriff.Bext{
+		Description:     "Scene 12A Take 3",
+		Originator:      "Recorder",
+		OriginationDate: "2018-01-02",
+		OriginationTime: "10:11:12",
+		TimeReference:   1728000000,
+		Version:         2,
+		LoudnessValue:   -2300,
+		CodingHistory:   "A=PCM,F=48000,W=16,M=mono,T=test\r\n",
+	}
+	if err := xmpriff.WriteBext(f, src); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	b, err := xmpriff.ReadBext(f)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if b.Description != src.Description || b.TimeReference != src.TimeReference || b.LoudnessValue != src.LoudnessValue || b.CodingHistory != "A=PCM,F=48000,W=16,M=mono,T=test" {
+		T.Errorf("bext mismatch: %+v", b)
+	}
+	checkSamples(T, f)
+}
+
+func TestWavShrinkLastChunk(T *testing.T) {
+	f := makeTempFile(T, makeWAV(false))
+	defer removeTempFile(f)
+	m := &xmpriff.Bext{Description: "Scene 12A", CodingHistory: "A=PCM,F=48000,W=16,M=mono\r\n"}
+	if err := xmpriff.WriteBext(f, m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	size, _ := f.Seek(0, io.SeekEnd)
+
+	// bext is the last chunk, shrink it by less than a JUNK chunk
+	m.CodingHistory = "A=PCM,F=48000,W=16,M\r\n"
+	if err := xmpriff.WriteBext(f, m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if s, _ := f.Seek(0, io.SeekEnd); s != size-6 {
+		T.Errorf("expected file size %d, got %d", size-6, s)
+	}
+	x, err := xmpriff.ReadFile(f)
+	if err != nil {
+		T.Fatalf("reading file failed: %v", err)
+	}
+	if s, _ := f.Seek(0, io.SeekEnd); x.End() != s {
+		T.Errorf("stale data after form end %d, file size %d", x.End(), s)
+	}
+
+	// appending must still work
+	if err := xmpriff.WritePacket(f, []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"/>")); err != nil {
+		T.Fatalf("append failed: %v", err)
+	}
+	if b, err := xmpriff.ReadBext(f); err != nil || b.CodingHistory != "A=PCM,F=48000,W=16,M" {
+		T.Errorf("invalid bext after write: %+v %v", b, err)
+	}
+	checkSamples(T, f)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trimmer-io/go-xmp/models/xmp_base"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func TestScanLargePacket(T *testing.T) {
+	title := strings.Repeat("x", 200000)
+	packet, err := xmp.Marshal(makeDocument(title))
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	junk := bytes.Repeat([]byte("<?xpacket begin "), 10000)
+	src := append(append(append([]byte{}, junk...), packet...), junk...)
+	l, err := xmp.FindPackets(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("scan failed: %v", err)
+	}
+	if len(l) != 1 {
+		T.Fatalf("expected 1 packet, got %d", len(l))
+	}
+	if p := l[0]; p.Offset != int64(len(junk)) || p.Length != int64(len(packet)) || !p.Writable || p.Encoding != xmp.EncodingUTF8 {
+		T.Errorf("invalid packet info %d %d %v %v", p.Offset, p.Length, p.Writable, p.Encoding)
+	}
+	d, err := xmp.Scan(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	checkTitle(T, d, title)
+	if _, err := xmp.FindPackets(bytes.NewReader(junk)); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestScanEncodings(T *testing.T) {
+	for _, enc := range []xmp.Encoding{
+		xmp.EncodingUTF8,
+		xmp.EncodingUTF16BE,
+		xmp.EncodingUTF16LE,
+		xmp.EncodingUTF32BE,
+		xmp.EncodingUTF32LE,
+	} {
+		size := int64(4096 * len(enc.Encode([]byte(" "))))
+		packet, err := xmp.MarshalPacketEncoding(makeDocument("Grüße"), size, enc)
+		if err != nil {
+			T.Fatalf("%s: marshal failed: %v", enc, err)
+		}
+		if int64(len(packet)) != size {
+			T.Fatalf("%s: invalid packet size %d", enc, len(packet))
+		}
+		ro := bytes.Replace(packet, enc.Encode([]byte("end=\"w\"")), enc.Encode([]byte("end=\"r\"")), 1)
+		src := append(append([]byte("\x00\x01\x02"), packet...), ro...)
+		l, err := xmp.FindPackets(bytes.NewReader(src))
+		if err != nil {
+			T.Fatalf("%s: scan failed: %v", enc, err)
+		}
+		if len(l) != 2 {
+			T.Fatalf("%s: expected 2 packets, got %d", enc, len(l))
+		}
+		for i, p := range l {
+			if p.Encoding != enc {
+				T.Errorf("%s: detected encoding %s", enc, p.Encoding)
+			}
+			if p.Offset != 3+int64(i)*size || p.Length != size {
+				T.Errorf("%s: invalid packet position %d+%d", enc, p.Offset, p.Length)
+			}
+			if p.Writable != (i == 0) {
+				T.Errorf("%s: invalid writable flag for packet %d", enc, i)
+			}
+			if p.Padding < 1000 {
+				T.Errorf("%s: invalid padding %d", enc, p.Padding)
+			}
+			d, err := p.Decode()
+			if err != nil {
+				T.Fatalf("%s: decode failed: %v", enc, err)
+			}
+			checkTitle(T, d, "Grüße")
+		}
+
+		// update keeps encoding and size
+		f := makeTempFile(T, src)
+		defer removeTempFile(f)
+		if err := xmp.UpdatePacket(f, l[0].Offset, l[0].Length, makeDocument("Neu")); err != nil {
+			T.Fatalf("%s: update failed: %v", enc, err)
+		}
+		if err := xmp.UpdatePacket(f, l[1].Offset, l[1].Length, makeDocument("Neu")); err != xmp.ErrReadOnlyPacket {
+			T.Errorf("%s: expected read-only error, got %v", enc, err)
+		}
+		f.Seek(0, io.SeekStart)
+		b, _ := ioutil.ReadAll(f)
+		if len(b) != len(src) {
+			T.Errorf("%s: file size changed", enc)
+		}
+		l, _ = xmp.FindPackets(bytes.NewReader(b))
+		if len(l) != 2 || l[0].Encoding != enc {
+			T.Fatalf("%s: packets changed after update", enc)
+		}
+		d, _ := l[0].Decode()
+		checkTitle(T, d, "Neu")
+	}
+}
+
+func TestScanMainPacket(T *testing.T) {
+	var src []byte
+	for i, v := range []int{2, 3, 1} {
+		d := makeDocument(strings.Repeat("v", i+1))
+		d.AddModel(&xmpbase.XmpBase{MetadataDate: xmp.NewDate(time.Date(2018, 1, v, 0, 0, 0, 0, time.UTC))})
+		b, err := xmp.Marshal(d)
+		if err != nil {
+			T.Fatalf("marshal failed: %v", err)
+		}
+		src = append(append(src, "junk"...), b...)
+	}
+	d, err := xmp.Scan(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("scan failed: %v", err)
+	}
+	checkTitle(T, d, "vv")
+
+	// without dates the last packet wins
+	src = append(append([]byte{}, "junk"...), "junk"...)
+	for _, v := range []string{"a", "b"} {
+		b, _ := xmp.Marshal(makeDocument(v))
+		src = append(src, b...)
+	}
+	d, err = xmp.Scan(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("scan failed: %v", err)
+	}
+	checkTitle(T, d, "b")
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/trimmer-io/go-xmp/models/dc"
+	"github.com/trimmer-io/go-xmp/models/ps"
+	"github.com/trimmer-io/go-xmp/models/xmp_base"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func makeSidecarDoc(T *testing.T, title, ext string, date time.Time) []byte {
+	d := makeDocument(title)
+	d.AddModel(&xmpbase.XmpBase{MetadataDate: xmp.NewDate(date)})
+	if ext != "" {
+		d.AddModel(&ps.PhotoshopInfo{SidecarForExtension: ext})
+	}
+	b, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	return b
+}
+
+func writeSidecarFile(T *testing.T, name string, b []byte) {
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+}
+
+func TestSidecarFind(T *testing.T) {
+	dir, err := ioutil.TempDir("", "go-xmp-test")
+	if err != nil {
+		T.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	media := filepath.Join(dir, "IMG_1234.CR2")
+	writeSidecarFile(T, media, []byte("raw"))
+	if _, err := xmp.FindSidecar(media); !os.IsNotExist(err) {
+		T.Errorf("expected not exist error, got %v", err)
+	}
+
+	// short form declared for another file type is skipped
+	short := filepath.Join(dir, "IMG_1234.XMP")
+	writeSidecarFile(T, short, makeSidecarDoc(T, "short", "JPG", now))
+	if _, err := xmp.FindSidecar(media); !os.IsNotExist(err) {
+		T.Errorf("expected not exist error, got %v", err)
+	}
+	writeSidecarFile(T, short, makeSidecarDoc(T, "short", "cr2", now))
+	if p, err := xmp.FindSidecar(media); err != nil || p != short {
+		T.Errorf("expected %s, got %s %v", short, p, err)
+	}
+
+	// long form takes precedence
+	long := filepath.Join(dir, "img_1234.cr2.xmp")
+	writeSidecarFile(T, long, makeSidecarDoc(T, "long", "", now))
+	if p, err := xmp.FindSidecar(media); err != nil || p != long {
+		T.Errorf("expected %s, got %s %v", long, p, err)
+	}
+}
+
+func TestSidecarPrecedence(T *testing.T) {
+	dir, err := ioutil.TempDir("", "go-xmp-test")
+	if err != nil {
+		T.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	media := filepath.Join(dir, "IMG_1234.CR2")
+	old := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	embedded := makeSidecarDoc(T, "embedded", "", old)
+	packet := append([]byte("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>"), embedded...)
+	packet = append(packet, []byte("<?xpacket end=\"w\"?>")...)
+	writeSidecarFile(T, media, append([]byte("raw"), packet...))
+
+	if _, err := xmp.ReadWithSidecar(filepath.Join(dir, "missing.CR2"), nil); err == nil {
+		T.Errorf("expected error for missing file")
+	}
+	d, err := xmp.ReadWithSidecar(media, nil)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "embedded")
+
+	// sidecar is newer and adds rights
+	sc := makeDocument("sidecar")
+	sc.AddModel(&xmpbase.XmpBase{MetadataDate: xmp.NewDate(old.Add(time.Hour))})
+	dc.FindModel(sc).Rights = xmp.NewAltString("(c) Sidecar")
+	b, err := xmp.Marshal(sc)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	writeSidecarFile(T, filepath.Join(dir, "IMG_1234.xmp"), b)
+
+	for _, v := range []struct {
+		prec  xmp.Precedence
+		title string
+	}{
+		{xmp.PreferNewer, "sidecar"},
+		{xmp.PreferEmbedded, "embedded"},
+		{xmp.PreferSidecar, "sidecar"},
+	} {
+		d, err := xmp.ReadWithSidecar(media, &xmp.SidecarOptions{Precedence: v.prec})
+		if err != nil {
+			T.Fatalf("%s: read failed: %v", v.prec, err)
+		}
+		checkTitle(T, d, v.title)
+		if m := dc.FindModel(d); m == nil || m.Rights.Default() != "(c) Sidecar" {
+			T.Errorf("%s: rights not merged", v.prec)
+		}
+	}
+
+	// older sidecar loses against embedded
+	sc.AddModel(&xmpbase.XmpBase{MetadataDate: xmp.NewDate(old.Add(-time.Hour))})
+	b, _ = xmp.Marshal(sc)
+	writeSidecarFile(T, filepath.Join(dir, "IMG_1234.xmp"), b)
+	d, err = xmp.ReadWithSidecar(media, nil)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "embedded")
+
+	// no metadata at all
+	bare := filepath.Join(dir, "bare.jpg")
+	writeSidecarFile(T, bare, []byte("jpeg"))
+	if _, err := xmp.ReadWithSidecar(bare, nil); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+}
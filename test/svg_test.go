@@ -0,0 +1,115 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	xmpsvg "github.com/trimmer-io/go-xmp/formats/svg"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+const svgHead = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- Generator: test -->
+<svg xmlns="http://www.w3.org/2000/svg"
+     xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+     xmlns:dc="http://purl.org/dc/elements/1.1/"
+     width="16" height="16">
+  <metadata>
+    <!-- keep me -->
+    `
+
+const svgTail = `
+  </metadata>
+  <g id="layer1">   <rect x="1" y="1" width="14" height="14"/>	</g>
+</svg>
+`
+
+const svgRDF = `<rdf:RDF>
+      <rdf:Description rdf:about="">
+        <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Icon</rdf:li></rdf:Alt></dc:title>
+      </rdf:Description>
+    </rdf:RDF>`
+
+func writeSVG(T *testing.T, src string, d *xmp.Document) []byte {
+	var buf bytes.Buffer
+	if err := xmpsvg.Write(&buf, strings.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSvgRead(T *testing.T) {
+	d, err := xmpsvg.Read(strings.NewReader(svgHead + svgRDF + svgTail))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "Icon")
+
+	src := `<svg xmlns="http://www.w3.org/2000/svg"><metadata/></svg>`
+	if _, err := xmpsvg.Read(strings.NewReader(src)); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	if _, err := xmpsvg.Read(strings.NewReader("<html></html>")); err != xmpsvg.ErrInvalidFile {
+		T.Errorf("expected invalid file error, got %v", err)
+	}
+}
+
+func TestSvgRoundtrip(T *testing.T) {
+	// bare rdf:RDF is replaced in place, everything else is preserved
+	b := writeSVG(T, svgHead+svgRDF+svgTail, makeDocument("Updated"))
+	if !bytes.HasPrefix(b, []byte(svgHead+"<rdf:RDF")) || !bytes.HasSuffix(b, []byte("</rdf:RDF>"+svgTail)) {
+		T.Fatalf("bytes outside the XMP element changed:\n%s", b)
+	}
+	if bytes.Contains(b, []byte("x:xmpmeta")) {
+		T.Errorf("unexpected x:xmpmeta wrapper")
+	}
+	d, err := xmpsvg.Read(bytes.NewReader(b))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "Updated")
+
+	// new metadata elements become the first child of the root element
+	for _, v := range []struct {
+		src  string
+		want string
+	}{
+		{`<svg xmlns="http://www.w3.org/2000/svg"><g/></svg>`, `<svg xmlns="http://www.w3.org/2000/svg">` + "\n<metadata><x:xmpmeta"},
+		{`<s:svg xmlns:s="http://www.w3.org/2000/svg"> </s:svg>`, `<s:svg xmlns:s="http://www.w3.org/2000/svg">` + "\n<s:metadata><x:xmpmeta"},
+		{`<svg><metadata id="m"/><g/></svg>`, `<svg><metadata><x:xmpmeta`},
+		{`<svg><metadata id="m"> </metadata></svg>`, `<svg><metadata id="m"><x:xmpmeta`},
+	} {
+		b := writeSVG(T, v.src, makeDocument("New"))
+		if !bytes.HasPrefix(b, []byte(v.want)) {
+			T.Errorf("unexpected output %s", b)
+			continue
+		}
+		d, err := xmpsvg.Read(bytes.NewReader(b))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d, "New")
+
+		// rewriting keeps the x:xmpmeta wrapper and size
+		b2 := writeSVG(T, string(b), makeDocument("New"))
+		if !bytes.Equal(b, b2) {
+			T.Errorf("rewrite changed file:\n%s\n%s", b, b2)
+		}
+	}
+}
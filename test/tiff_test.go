@@ -0,0 +1,186 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	xmptiff "github.com/trimmer-io/go-xmp/formats/tiff"
+	_ "github.com/trimmer-io/go-xmp/models"
+	"github.com/trimmer-io/go-xmp/models/tiff"
+)
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// makeTIFF builds an 8x8 pixel uncompressed grayscale TIFF file
+func makeTIFF(order binary.ByteOrder) []byte {
+	short := func(v uint16) []byte {
+		b := make([]byte, 2)
+		order.PutUint16(b, v)
+		return b
+	}
+	long := func(v uint32) []byte {
+		b := make([]byte, 4)
+		order.PutUint32(b, v)
+		return b
+	}
+	camera := []byte("Trimmer Test Camera\x00")
+	entries := []tiffEntry{
+		{0x0100, 3, 1, short(8)},
+		{0x0101, 3, 1, short(8)},
+		{0x0102, 3, 1, short(8)},
+		{0x0103, 3, 1, short(1)},
+		{0x0106, 3, 1, short(1)},
+		{0x010f, 2, uint32(len(camera)), camera},
+		{0x0111, 4, 1, nil}, // strip offset, patched below
+		{0x0112, 3, 1, short(6)},
+		{0x0115, 3, 1, short(1)},
+		{0x0116, 3, 1, short(8)},
+		{0x0117, 4, 1, long(64)},
+	}
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	buf.Write(short(42))
+	buf.Write(long(8))
+	ifdSize := 2 + len(entries)*12 + 4
+	extra := uint32(8 + ifdSize)
+	strip := extra + uint32(len(camera))
+	buf.Write(short(uint16(len(entries))))
+	for _, e := range entries {
+		buf.Write(short(e.tag))
+		buf.Write(short(e.typ))
+		buf.Write(long(e.count))
+		switch {
+		case e.tag == 0x0111:
+			buf.Write(long(strip))
+		case len(e.value) > 4:
+			buf.Write(long(extra))
+		default:
+			v := append(append([]byte{}, e.value...), 0, 0, 0, 0)
+			buf.Write(v[:4])
+		}
+	}
+	buf.Write(long(0))
+	buf.Write(camera)
+	buf.Write(bytes.Repeat([]byte{0x80}, 64))
+	return buf.Bytes()
+}
+
+func makeTempFile(T *testing.T, b []byte) *os.File {
+	f, err := ioutil.TempFile("", "go-xmp-test")
+	if err != nil {
+		T.Fatalf("creating temp file failed: %v", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		T.Fatalf("writing temp file failed: %v", err)
+	}
+	return f
+}
+
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func TestTiffRoundtrip(T *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		src := makeTIFF(order)
+		f := makeTempFile(T, src)
+		defer removeTempFile(f)
+
+		if _, err := xmptiff.Read(f); err != io.EOF {
+			T.Errorf("%v: expected io.EOF, got %v", order, err)
+		}
+
+		// insert a new XMLPacket entry
+		if err := xmptiff.Write(f, makeDocument("first")); err != nil {
+			T.Fatalf("%v: write failed: %v", order, err)
+		}
+		d, err := xmptiff.Read(f)
+		if err != nil {
+			T.Fatalf("%v: read failed: %v", order, err)
+		}
+		checkTitle(T, d, "first")
+
+		// grow the existing packet
+		if err := xmptiff.Write(f, makeDocument("a much longer second title")); err != nil {
+			T.Fatalf("%v: write failed: %v", order, err)
+		}
+		d, err = xmptiff.Read(f)
+		if err != nil {
+			T.Fatalf("%v: read failed: %v", order, err)
+		}
+		checkTitle(T, d, "a much longer second title")
+
+		// shrink in place
+		size, _ := f.Seek(0, io.SeekEnd)
+		if err := xmptiff.Write(f, makeDocument("third")); err != nil {
+			T.Fatalf("%v: write failed: %v", order, err)
+		}
+		d, err = xmptiff.Read(f)
+		if err != nil {
+			T.Fatalf("%v: read failed: %v", order, err)
+		}
+		checkTitle(T, d, "third")
+		if s, _ := f.Seek(0, io.SeekEnd); s != size {
+			T.Errorf("%v: in-place update changed file size from %d to %d", order, size, s)
+		}
+
+		// image data must remain in place
+		b := make([]byte, len(src))
+		f.ReadAt(b, 0)
+		if !bytes.Equal(b[len(b)-64:], src[len(src)-64:]) {
+			T.Errorf("%v: image data changed", order)
+		}
+
+		info, err := xmptiff.ReadInfo(f)
+		if err != nil {
+			T.Fatalf("%v: read info failed: %v", order, err)
+		}
+		if info.Orientation != tiff.OrientationRightTop {
+			T.Errorf("%v: invalid orientation %d", order, info.Orientation)
+		}
+		if info.Compression != tiff.CompressionUncompressed {
+			T.Errorf("%v: invalid compression %d", order, info.Compression)
+		}
+		if info.Make != "Trimmer Test Camera" {
+			T.Errorf("%v: invalid make %q", order, info.Make)
+		}
+		if info.ImageWidth != 8 || info.ImageLength != 8 {
+			T.Errorf("%v: invalid dimensions %dx%d", order, info.ImageWidth, info.ImageLength)
+		}
+
+		// Read must carry the same baseline tags
+		if m := tiff.FindModel(d); m == nil {
+			T.Errorf("%v: missing tiff model", order)
+		} else if m.Make != info.Make || m.Orientation != info.Orientation {
+			T.Errorf("%v: tiff model mismatch: %q %d", order, m.Make, m.Orientation)
+		}
+	}
+}
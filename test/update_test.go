@@ -0,0 +1,166 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	xmpjpeg "github.com/trimmer-io/go-xmp/formats/jpeg"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+func makePaddedPacket(T *testing.T, title string, size int64) []byte {
+	b, err := xmp.MarshalPacket(makeDocument(title), size)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	return b
+}
+
+func TestUpdatePacket(T *testing.T) {
+	packet := makePaddedPacket(T, "old", 2048)
+	if len(packet) != 2048 {
+		T.Fatalf("invalid packet size %d", len(packet))
+	}
+	head := bytes.Repeat([]byte{0xaa}, 40000)
+	tail := []byte("\x00\x01\x02\x03")
+	src := append(append(append([]byte{}, head...), packet...), tail...)
+	f := makeTempFile(T, src)
+	defer removeTempFile(f)
+
+	if err := xmp.UpdateFile(f, makeDocument("new")); err != nil {
+		T.Fatalf("update failed: %v", err)
+	}
+	f.Seek(0, io.SeekStart)
+	b, _ := ioutil.ReadAll(f)
+	if len(b) != len(src) || !bytes.HasPrefix(b, head) || !bytes.HasSuffix(b, tail) {
+		T.Fatalf("update changed bytes outside the packet")
+	}
+	f.Seek(0, io.SeekStart)
+	d, err := xmp.Scan(f)
+	if err != nil {
+		T.Fatalf("scan failed: %v", err)
+	}
+	checkTitle(T, d, "new")
+
+	// document too large for the padding
+	large := makeDocument(strings.Repeat("x", 4096))
+	if err := xmp.UpdateFile(f, large); err != xmp.ErrOverflow {
+		T.Errorf("expected overflow error, got %v", err)
+	}
+
+	// read-only packets are refused
+	ro := bytes.Replace(packet, []byte("end=\"w\""), []byte("end=\"r\""), 1)
+	g := makeTempFile(T, append(append([]byte{}, head...), ro...))
+	defer removeTempFile(g)
+	if err := xmp.UpdateFile(g, makeDocument("new")); err != xmp.ErrReadOnlyPacket {
+		T.Errorf("expected read-only error, got %v", err)
+	}
+}
+
+func TestUpdateFileFallback(T *testing.T) {
+	dir, err := ioutil.TempDir("", "go-xmp-test")
+	if err != nil {
+		T.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	if err := xmpjpeg.WritePacket(&buf, bytes.NewReader(makeJPEG(T)), makePaddedPacket(T, "old", 4096)); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	name := filepath.Join(dir, "image.jpg")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+
+	// fits into padding
+	if err := xmp.WriteFile(name, makeDocument("new")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if fi, _ := os.Stat(name); fi.Size() != int64(buf.Len()) {
+		T.Errorf("file size changed from %d to %d", buf.Len(), fi.Size())
+	}
+	d, err := xmp.ReadFile(name)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "new")
+
+	// full rewrite
+	title := strings.Repeat("x", 8192)
+	if err := xmp.WriteFile(name, makeDocument(title)); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if d, err = xmp.ReadFile(name); err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, title)
+
+	// unknown formats without space fail
+	other := filepath.Join(dir, "file.bin")
+	if err := ioutil.WriteFile(other, append([]byte("\x00\x01"), makePaddedPacket(T, "old", 2048)...), 0644); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if err := xmp.WriteFile(other, makeDocument(title)); err != xmp.ErrOverflow {
+		T.Errorf("expected overflow error, got %v", err)
+	}
+	if err := xmp.WriteFile(other, makeDocument("new")); err != nil {
+		T.Errorf("write failed: %v", err)
+	}
+}
+
+func TestUpdateFileMultiplePackets(T *testing.T) {
+	dir, err := ioutil.TempDir("", "go-xmp-test")
+	if err != nil {
+		T.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	if err := xmpjpeg.WritePacket(&buf, bytes.NewReader(makeJPEG(T)), makePaddedPacket(T, "old", 4096)); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	// add a second packet in a comment segment after the XMP segment, the
+	// scanner prefers it as the last one in the file
+	src := buf.Bytes()
+	i := bytes.Index(src, []byte("http://ns.adobe.com/xap/1.0/\x00")) - 4
+	end := i + 2 + (int(src[i+2])<<8 | int(src[i+3]))
+	thumb := makePaddedPacket(T, "thumb", 2048)
+	com := append([]byte{0xff, 0xfe, byte((len(thumb) + 2) >> 8), byte(len(thumb) + 2)}, thumb...)
+	b := append(append(append([]byte{}, src[:end]...), com...), src[end:]...)
+	name := filepath.Join(dir, "image.jpg")
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if err := xmp.WriteFile(name, makeDocument("new")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	d, err := xmp.ReadFile(name)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "new")
+	out, _ := ioutil.ReadFile(name)
+	if !bytes.Contains(out, thumb) {
+		T.Errorf("comment packet changed")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/trimmer-io/go-xmp/formats/webp"
+	"github.com/trimmer-io/go-xmp/models/dc"
+	"github.com/trimmer-io/go-xmp/models/xmp_rights"
+	"github.com/trimmer-io/go-xmp/xmp"
+)
+
+// minimal bitstreams for a 16x8 image, only the headers are valid
+var (
+	webpVP8  = []byte("\x10\x02\x00\x9d\x01\x2a\x10\x00\x08\x00\xaa\xbb\xcc")
+	webpVP8L = []byte("\x2f\x0f\xc0\x01\x10\xaa\xbb")
+)
+
+func makeWebP(id string, data []byte) []byte {
+	body := append([]byte("WEBP"), makeChunk(id, data)...)
+	return append(append([]byte("RIFF"), makeChunk("RIFF", body)[4:8]...), body...)
+}
+
+func checkVP8X(T *testing.T, b []byte, alpha bool) {
+	if binary.LittleEndian.Uint32(b[4:]) != uint32(len(b)-8) {
+		T.Errorf("invalid RIFF size %d for file size %d", binary.LittleEndian.Uint32(b[4:]), len(b))
+	}
+	if string(b[12:16]) != "VP8X" {
+		T.Fatalf("missing VP8X chunk, got %q", b[12:16])
+	}
+	x := b[20:30]
+	if x[0]&0x04 == 0 {
+		T.Errorf("XMP flag not set")
+	}
+	if (x[0]&0x10 > 0) != alpha {
+		T.Errorf("invalid alpha flag")
+	}
+	w := int(x[4]) | int(x[5])<<8 | int(x[6])<<16
+	h := int(x[7]) | int(x[8])<<8 | int(x[9])<<16
+	if w != 15 || h != 7 {
+		T.Errorf("invalid canvas size %dx%d", w+1, h+1)
+	}
+}
+
+func TestWebpNoXMP(T *testing.T) {
+	if _, err := webp.ReadPacket(bytes.NewReader(makeWebP("VP8 ", webpVP8))); err != io.EOF {
+		T.Errorf("expected io.EOF, got %v", err)
+	}
+	if _, err := webp.ReadPacket(bytes.NewReader([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00"))); err != webp.ErrInvalidFile {
+		T.Errorf("expected invalid file error, got %v", err)
+	}
+	// chunk size beyond the RIFF size
+	b := makeWebP("XMP ", []byte("<x/>"))
+	binary.LittleEndian.PutUint32(b[16:], 0xfffffff0)
+	if _, err := webp.ReadPacket(bytes.NewReader(b)); err != webp.ErrInvalidFile {
+		T.Errorf("expected invalid file error, got %v", err)
+	}
+	// huge declared sizes in a short file
+	for _, id := range []string{"XMP ", "VP8 "} {
+		b = makeWebP(id, []byte("<x/>"))
+		binary.LittleEndian.PutUint32(b[4:], 0xffffffff)
+		binary.LittleEndian.PutUint32(b[16:], 0xfffffff0)
+		if _, err := webp.ReadPacket(bytes.NewReader(b)); err != webp.ErrInvalidFile {
+			T.Errorf("%s: expected invalid file error, got %v", id, err)
+		}
+		if err := webp.WritePacket(ioutil.Discard, bytes.NewReader(b), []byte("<x/>")); err != webp.ErrInvalidFile {
+			T.Errorf("%s: expected invalid file error, got %v", id, err)
+		}
+	}
+}
+
+func TestWebpRoundtrip(T *testing.T) {
+	for _, v := range []struct {
+		id    string
+		data  []byte
+		alpha bool
+	}{
+		{"VP8 ", webpVP8, false},
+		{"VP8L", webpVP8L, true},
+	} {
+		d := makeDocument("Title")
+		d.AddModel(&xmprights.XmpRights{
+			Marked:       xmp.True,
+			WebStatement: "https://example.com/license",
+			UsageTerms:   xmp.NewAltString("All rights reserved"),
+		})
+		dc.FindModel(d).Rights = xmp.NewAltString("(c) Example")
+
+		var buf bytes.Buffer
+		if err := webp.Write(&buf, bytes.NewReader(makeWebP(v.id, v.data)), d); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		b := buf.Bytes()
+		checkVP8X(T, b, v.alpha)
+		if !bytes.Contains(b, makeChunk(v.id, v.data)) {
+			T.Errorf("image data changed")
+		}
+
+		// update in extended format
+		buf2 := bytes.Buffer{}
+		if err := webp.Write(&buf2, bytes.NewReader(b), d); err != nil {
+			T.Fatalf("rewrite failed: %v", err)
+		}
+		if buf2.Len() != len(b) {
+			T.Errorf("rewrite changed size from %d to %d", len(b), buf2.Len())
+		}
+		d2, err := webp.Read(bytes.NewReader(buf2.Bytes()))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d2, "Title")
+		if m := dc.FindModel(d2); m == nil || m.Rights.Default() != "(c) Example" {
+			T.Errorf("dc:rights lost")
+		}
+		if m := xmprights.FindModel(d2); m == nil || m.WebStatement != "https://example.com/license" || !m.Marked.Value() {
+			T.Errorf("xmpRights lost")
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("xmp: unsupported file format")
+	ErrNotSeekable       = errors.New("xmp: file handler requires a seekable read-write file")
+)
+
+// number of bytes read from the start of a file for content sniffing
+const sniffLen = 512
+
+type Capabilities int
+
+const (
+	CapRead         Capabilities = 1 << iota // handler can read XMP
+	CapWrite                                 // handler can write XMP
+	CapInPlace                               // writes modify the original file
+	CapNative                                // handler maps native metadata to models
+	CapPacketUpdate                          // packets may be overwritten in place by UpdateFile
+)
+
+// interface for file format handlers
+//
+// CanHandle inspects the first bytes of a file. ReadXMP returns io.EOF
+// when the file contains no metadata. WriteXMP copies the file from r to
+// w and embeds d. Handlers with CapInPlace receive the same file as r and
+// w and must type-assert w to io.ReadWriteSeeker.
+type FileHandler interface {
+	CanHandle(head []byte) bool
+	ReadXMP(r io.ReadSeeker) (*Document, error)
+	WriteXMP(w io.Writer, r io.ReadSeeker, d *Document) error
+	Capabilities() Capabilities
+}
+
+// Magic is a byte signature at a fixed offset from the start of a file.
+type Magic struct {
+	Offset int
+	Value  []byte
+}
+
+func (m Magic) Match(head []byte) bool {
+	if m.Offset+len(m.Value) > len(head) {
+		return false
+	}
+	return bytes.Equal(head[m.Offset:m.Offset+len(m.Value)], m.Value)
+}
+
+type FileFormat struct {
+	Name       string
+	Extensions []string // lower case including the dot
+	Magic      []Magic
+	Handler    FileHandler
+}
+
+func (f *FileFormat) matchMagic(head []byte) bool {
+	for _, v := range f.Magic {
+		if v.Match(head) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FileFormat) matchExt(ext string) bool {
+	for _, v := range f.Extensions {
+		if v == ext {
+			return true
+		}
+	}
+	return false
+}
+
+type HandlerRegistry struct {
+	formats []*FileFormat
+	m       sync.RWMutex
+}
+
+var FileRegistry HandlerRegistry = HandlerRegistry{
+	formats: make([]*FileFormat, 0),
+}
+
+func RegisterFormat(f FileFormat) {
+	FileRegistry.RegisterFormat(f)
+}
+
+func LookupFormat(head []byte, filename string) *FileFormat {
+	return FileRegistry.Lookup(head, filename)
+}
+
+// RegisterFormat adds a file format. A format with the same name replaces
+// the existing registration so that applications can override built-in
+// handlers.
+func (r *HandlerRegistry) RegisterFormat(f FileFormat) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for i, v := range r.formats {
+		if v.Name == f.Name {
+			r.formats = append(r.formats[:i], r.formats[i+1:]...)
+			break
+		}
+	}
+	r.formats = append(r.formats, &f)
+}
+
+// Lookup returns the format for a file starting with head. Formats are
+// matched by magic bytes first and by file extension second. In both
+// cases the handler must accept the content. Later registrations take
+// precedence. Lookup returns nil when no format matches.
+func (r *HandlerRegistry) Lookup(head []byte, filename string) *FileFormat {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	for i := len(r.formats) - 1; i >= 0; i-- {
+		if f := r.formats[i]; f.matchMagic(head) && f.Handler.CanHandle(head) {
+			return f
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		return nil
+	}
+	for i := len(r.formats) - 1; i >= 0; i-- {
+		if f := r.formats[i]; f.matchExt(ext) && f.Handler.CanHandle(head) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (r *HandlerRegistry) Names() []string {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	l := make([]string, len(r.formats))
+	for i, v := range r.formats {
+		l[i] = v.Name
+	}
+	return l
+}
+
+func sniff(r io.ReadSeeker) ([]byte, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// ReadFile reads the XMP document from the file at filename using the
+// registered file format handlers. Files of unknown format are scanned
+// for XMP packets. ReadFile returns io.EOF when the file contains no
+// metadata.
+func ReadFile(filename string) (*Document, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head, err := sniff(f)
+	if err != nil {
+		return nil, err
+	}
+	if ff := LookupFormat(head, filename); ff != nil && ff.Handler.Capabilities()&CapRead > 0 {
+		return ff.Handler.ReadXMP(f)
+	}
+	return Scan(f)
+}
+
+// WriteFile embeds d into the file at filename using the registered file
+// format handlers. Handlers which cannot update files in place write to a
+// temporary file that replaces the original on success. For formats with
+// CapPacketUpdate the existing packet is overwritten first when it is the
+// only packet in the file and d fits into its padding. Files of unknown
+// format can only be updated this way.
+func WriteFile(filename string, d *Document) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head, err := sniff(f)
+	if err != nil {
+		return err
+	}
+	ff := LookupFormat(head, filename)
+	if ff == nil || ff.Handler.Capabilities()&CapPacketUpdate > 0 {
+		var err error
+		if ff == nil {
+			err = UpdateFile(f, d)
+		} else {
+			err = updateSinglePacket(f, d)
+		}
+		switch {
+		case err == nil:
+			return nil
+		case ff == nil && err == io.EOF:
+			return ErrUnsupportedFormat
+		case ff == nil:
+			return err
+		case err != io.EOF && err != ErrOverflow && err != ErrReadOnlyPacket && err != ErrInvalidPacket && err != errMultiplePackets:
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if ff.Handler.Capabilities()&CapWrite == 0 {
+		return ErrUnsupportedFormat
+	}
+	if ff.Handler.Capabilities()&CapInPlace > 0 {
+		return ff.Handler.WriteXMP(f, f, d)
+	}
+	return rewriteFile(f, filename, ff.Handler, d)
+}
+
+var errMultiplePackets = errors.New("xmp: multiple packets")
+
+// updateSinglePacket overwrites the packet in f when it is the only one.
+// With more packets the scanner cannot tell which one the format handler
+// reads, the main packet may as well sit in a thumbnail or layer.
+func updateSinglePacket(f io.ReadWriteSeeker, d *Document) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l, err := FindPackets(f)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(l) == 0:
+		return io.EOF
+	case len(l) > 1:
+		return errMultiplePackets
+	}
+	return UpdatePacket(f, l[0].Offset, l[0].Length, d)
+}
+
+func rewriteFile(f *os.File, filename string, h FileHandler, d *Document) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := h.WriteXMP(tmp, f, d); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// xmpHandler reads and writes plain XMP files like sidecars.
+type xmpHandler struct{}
+
+// CanHandle accepts empty files so that new sidecars can be written.
+func (xmpHandler) CanHandle(head []byte) bool {
+	if len(head) == 0 {
+		return true
+	}
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	for _, v := range [][]byte{packet_start, []byte("<x:xmpmeta"), []byte("<x:xapmeta"), []byte("<rdf:RDF")} {
+		if bytes.HasPrefix(head, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (xmpHandler) ReadXMP(r io.ReadSeeker) (*Document, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, io.EOF
+	}
+	d := NewDocument()
+	if err := Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (xmpHandler) WriteXMP(w io.Writer, r io.ReadSeeker, d *Document) error {
+	b, err := Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (xmpHandler) Capabilities() Capabilities {
+	return CapRead | CapWrite
+}
+
+func init() {
+	RegisterFormat(FileFormat{
+		Name:       "xmp",
+		Extensions: []string{".xmp"},
+		Magic: []Magic{
+			{0, packet_start},
+			{0, []byte("<x:xmpmeta")},
+			{3, packet_start},
+		},
+		Handler: xmpHandler{},
+	})
+}
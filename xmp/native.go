@@ -285,7 +285,7 @@ func ListNativeFields(v Model) (TagList, error) {
 		}
 
 		// Check for text marshaler and marshal as node value
-		if fv.CanInterface() && typ.Implements(textMarshalerType) {
+		if fv.CanInterface() && fv.Type().Implements(textMarshalerType) {
 			b, err := fv.Interface().(encoding.TextMarshaler).MarshalText()
 			if err != nil {
 				return nil, err
@@ -332,7 +332,7 @@ func ListNativeFields(v Model) (TagList, error) {
 
 		// simple values are just fine, but any other type (slice, array, struct)
 		// without textmarshaler will fail here
-		if s, b, err := marshalSimple(typ, fv); err != nil {
+		if s, b, err := marshalSimple(fv.Type(), fv); err != nil {
 			return nil, err
 		} else {
 			if b != nil {
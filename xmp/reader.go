@@ -15,8 +15,6 @@
 package xmp
 
 import (
-	"bufio"
-	"bytes"
 	"io"
 )
 
@@ -29,63 +27,49 @@ func Read(r io.Reader) (*Document, error) {
 	return x, nil
 }
 
+// Scan decodes the main packet found in r. See MainPacket for details.
 func Scan(r io.Reader) (*Document, error) {
-	pp, err := ScanPackets(r)
+	l, err := FindPackets(r)
 	if err != nil {
 		return nil, err
 	}
-	x := &Document{}
-	if err := Unmarshal(pp[0], x); err != nil {
-		return nil, err
+	p := MainPacket(l)
+	if p == nil {
+		p = l[0]
 	}
-	return x, nil
+	return p.Decode()
 }
 
+// ScanPackets returns all packets in r converted to UTF-8.
 func ScanPackets(r io.Reader) ([][]byte, error) {
-	packets := make([][]byte, 0)
-	s := bufio.NewScanner(r)
-	s.Split(splitPacket)
-	for s.Scan() {
-		b := s.Bytes()
-		if isXmpPacket(b) {
-			x := make([]byte, len(b))
-			copy(x, b)
-			packets = append(packets, x)
-		}
+	l, err := FindPackets(r)
+	if err != nil {
+		return nil, err
+	}
+	packets := make([][]byte, len(l))
+	for i, v := range l {
+		packets[i] = v.Text()
+	}
+	return packets, nil
+}
+
+// FindPackets returns all packets in r. It returns io.EOF when r contains
+// no packet.
+func FindPackets(r io.Reader) ([]*PacketInfo, error) {
+	l := make([]*PacketInfo, 0)
+	s := NewPacketScanner(r)
+	for s.Next() {
+		l = append(l, s.Packet())
 	}
 	if err := s.Err(); err != nil {
 		return nil, err
 	}
-	if len(packets) == 0 {
+	if len(l) == 0 {
 		return nil, io.EOF
 	}
-	return packets, nil
+	return l, nil
 }
 
 var packet_start = []byte("<?xpacket begin")
 var packet_end = []byte("<?xpacket end")       // plus suffix `"w"?>`
 var magic = []byte("W5M0MpCehiHzreSzNTczkc9d") // len 24
-
-func isXmpPacket(b []byte) bool {
-	return bytes.Index(b[:51], magic) > -1
-}
-
-func splitPacket(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	start := bytes.Index(data, packet_start)
-	if start == -1 {
-		ofs := len(data) - len(packet_start)
-		if ofs > 0 {
-			return ofs, nil, nil
-		}
-		return len(data), nil, nil
-	}
-	end := bytes.Index(data[start:], packet_end)
-	last := start + end + len(packet_end) + 6
-	if end == -1 || last > len(data) {
-		if atEOF {
-			return len(data), nil, nil
-		}
-		return 0, nil, nil
-	}
-	return last, data[start:last], nil
-}
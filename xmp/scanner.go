@@ -0,0 +1,410 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding is the character encoding of an XMP packet.
+type Encoding int
+
+const (
+	EncodingUTF8 Encoding = iota
+	EncodingUTF16BE
+	EncodingUTF16LE
+	EncodingUTF32BE
+	EncodingUTF32LE
+)
+
+var encodings = []Encoding{
+	EncodingUTF8,
+	EncodingUTF16BE,
+	EncodingUTF16LE,
+	EncodingUTF32BE,
+	EncodingUTF32LE,
+}
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingUTF16BE:
+		return "UTF-16BE"
+	case EncodingUTF16LE:
+		return "UTF-16LE"
+	case EncodingUTF32BE:
+		return "UTF-32BE"
+	case EncodingUTF32LE:
+		return "UTF-32LE"
+	default:
+		return "UTF-8"
+	}
+}
+
+// unitSize returns the size of a code unit in bytes.
+func (e Encoding) unitSize() int {
+	switch e {
+	case EncodingUTF16BE, EncodingUTF16LE:
+		return 2
+	case EncodingUTF32BE, EncodingUTF32LE:
+		return 4
+	default:
+		return 1
+	}
+}
+
+func (e Encoding) order() binary.ByteOrder {
+	switch e {
+	case EncodingUTF16LE, EncodingUTF32LE:
+		return binary.LittleEndian
+	default:
+		return binary.BigEndian
+	}
+}
+
+// Encode converts UTF-8 text into encoding e.
+func (e Encoding) Encode(s []byte) []byte {
+	switch e.unitSize() {
+	case 2:
+		u := utf16.Encode(bytes.Runes(s))
+		b := make([]byte, 2*len(u))
+		for i, v := range u {
+			e.order().PutUint16(b[2*i:], v)
+		}
+		return b
+	case 4:
+		r := bytes.Runes(s)
+		b := make([]byte, 4*len(r))
+		for i, v := range r {
+			e.order().PutUint32(b[4*i:], uint32(v))
+		}
+		return b
+	default:
+		return s
+	}
+}
+
+// Decode converts text in encoding e into UTF-8.
+func (e Encoding) Decode(b []byte) []byte {
+	switch e.unitSize() {
+	case 2:
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = e.order().Uint16(b[2*i:])
+		}
+		return []byte(string(utf16.Decode(u)))
+	case 4:
+		buf := make([]byte, 0, len(b)/4)
+		var tmp [utf8.UTFMax]byte
+		for i := 0; i+4 <= len(b); i += 4 {
+			n := utf8.EncodeRune(tmp[:], rune(e.order().Uint32(b[i:])))
+			buf = append(buf, tmp[:n]...)
+		}
+		return buf
+	default:
+		return b
+	}
+}
+
+// isSpaceAt checks whether the code unit at offset i is XML whitespace.
+func (e Encoding) isSpaceAt(b []byte, i int) bool {
+	var c uint32
+	switch e.unitSize() {
+	case 2:
+		c = uint32(e.order().Uint16(b[i:]))
+	case 4:
+		c = e.order().Uint32(b[i:])
+	default:
+		c = uint32(b[i])
+	}
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// PacketInfo describes an XMP packet found by the packet scanner. Offset
+// and Length refer to the raw packet bytes in the scanned stream from the
+// start of the header to the end of the trailer.
+type PacketInfo struct {
+	Offset   int64
+	Length   int64
+	Padding  int64 // bytes of whitespace before the trailer
+	Writable bool  // trailer is end="w"
+	Encoding Encoding
+	Data     []byte // raw packet bytes in the packet encoding
+}
+
+// Text returns the packet converted to UTF-8.
+func (p *PacketInfo) Text() []byte {
+	return p.Encoding.Decode(p.Data)
+}
+
+// Decode parses the packet into a new document.
+func (p *PacketInfo) Decode() (*Document, error) {
+	d := NewDocument()
+	if err := Unmarshal(p.Text(), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// maximum size of a single packet, larger candidates are skipped
+const maxPacketSize = 64 << 20
+
+// size of blocks read from the underlying stream
+const scanBlockSize = 64 << 10
+
+var (
+	packetStarts = make(map[Encoding][]byte)
+	packetEnds   = make(map[Encoding][]byte)
+	packetCloses = make(map[Encoding][]byte)
+	packetIds    = make(map[Encoding][]byte)
+	maxStartLen  int
+)
+
+func init() {
+	for _, e := range encodings {
+		packetStarts[e] = e.Encode(packet_start)
+		packetEnds[e] = e.Encode(packet_end)
+		packetCloses[e] = e.Encode([]byte("?>"))
+		packetIds[e] = e.Encode(magic)
+		if l := len(packetStarts[e]); l > maxStartLen {
+			maxStartLen = l
+		}
+	}
+}
+
+// PacketScanner finds XMP packets in a stream of arbitrary data as defined
+// by XMP Specification Part 3. Packets may be encoded in UTF-8, UTF-16 or
+// UTF-32. The encoding is detected from the packet header whose begin
+// attribute carries the byte order mark U+FEFF in the packet encoding.
+// Packet size is not limited by the scanner buffer.
+type PacketScanner struct {
+	r      io.Reader
+	buf    []byte
+	pos    int64 // stream offset of buf[0]
+	eof    bool
+	err    error
+	packet *PacketInfo
+
+	// search state to avoid rescanning the buffer after each read
+	hits    map[Encoding]int64 // offset of the next header or -1
+	scanned map[Encoding]int64 // offset up to which no header was found
+	endScan int64              // offset up to which no trailer was found
+}
+
+func NewPacketScanner(r io.Reader) *PacketScanner {
+	return &PacketScanner{
+		r:       r,
+		hits:    make(map[Encoding]int64),
+		scanned: make(map[Encoding]int64),
+	}
+}
+
+// Packet returns the most recent packet found by Next.
+func (s *PacketScanner) Packet() *PacketInfo {
+	return s.packet
+}
+
+// Err returns the first non-EOF error that occurred while scanning.
+func (s *PacketScanner) Err() error {
+	return s.err
+}
+
+func (s *PacketScanner) discard(n int) {
+	s.buf = s.buf[n:]
+	s.pos += int64(n)
+}
+
+func (s *PacketScanner) fill() bool {
+	if s.eof || s.err != nil {
+		return false
+	}
+	tmp := make([]byte, scanBlockSize)
+	n, err := io.ReadFull(s.r, tmp)
+	s.buf = append(s.buf, tmp[:n]...)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		s.eof = true
+	default:
+		s.err = err
+	}
+	return n > 0
+}
+
+// index searches sep in the buffer starting at stream offset from and
+// returns the stream offset of the match or -1.
+func (s *PacketScanner) index(sep []byte, from int64) int64 {
+	if from < s.pos {
+		from = s.pos
+	}
+	if i := bytes.Index(s.buf[from-s.pos:], sep); i >= 0 {
+		return from + int64(i)
+	}
+	return -1
+}
+
+// resume returns the offset where a search for sep continues when the
+// buffer up to end contained no match.
+func resume(end int64, sep []byte) int64 {
+	return end - int64(len(sep)) + 1
+}
+
+// findStart returns the buffer position and encoding of the first packet
+// header. Headers in different encodings never match at the same offset,
+// so the earliest match wins.
+func (s *PacketScanner) findStart() (int, Encoding) {
+	pos, enc := int64(-1), EncodingUTF8
+	end := s.pos + int64(len(s.buf))
+	for _, e := range encodings {
+		hit, ok := s.hits[e]
+		if !ok || hit < s.pos {
+			hit = s.index(packetStarts[e], s.scanned[e])
+			if hit < 0 {
+				s.scanned[e] = resume(end, packetStarts[e])
+			}
+			s.hits[e] = hit
+		}
+		if hit >= 0 && (pos < 0 || hit < pos) {
+			pos, enc = hit, e
+		}
+	}
+	if pos < 0 {
+		return -1, enc
+	}
+	return int(pos - s.pos), enc
+}
+
+// Next advances to the next packet, which is then available through
+// Packet. It returns false at the end of input or on error.
+func (s *PacketScanner) Next() bool {
+	s.packet = nil
+	for {
+		start, enc := s.findStart()
+		if start < 0 {
+			if k := len(s.buf) - maxStartLen; k > 0 {
+				s.discard(k)
+			}
+			if !s.fill() {
+				return false
+			}
+			continue
+		}
+		if start > 0 {
+			s.discard(start)
+			s.endScan = s.pos
+		}
+		n, ok := s.match(enc)
+		if ok && n > 0 {
+			s.packet = parsePacket(append([]byte(nil), s.buf[:n]...), enc)
+			s.packet.Offset = s.pos
+			s.discard(n)
+			s.endScan = s.pos
+			return true
+		}
+		if !ok && len(s.buf) < maxPacketSize && s.fill() {
+			continue
+		}
+		// not a valid packet or truncated, skip this header
+		s.discard(len(packetStarts[enc]))
+		s.endScan = s.pos
+	}
+}
+
+// match returns the length of the packet at the start of the buffer. The
+// boolean result is false when more data is needed to decide. A valid
+// header is a single processing instruction carrying the packet id.
+func (s *PacketScanner) match(enc Encoding) (int, bool) {
+	hdr := s.buf
+	if l := 128 * enc.unitSize(); len(hdr) > l {
+		hdr = hdr[:l]
+	}
+	cl := bytes.Index(hdr, packetCloses[enc])
+	if cl < 0 {
+		return 0, len(hdr) < len(s.buf) || s.eof
+	}
+	hdr = hdr[len(packetStarts[enc]):cl]
+	if !bytes.Contains(hdr, packetIds[enc]) || bytes.Contains(hdr, enc.Encode([]byte("<"))) {
+		return 0, true
+	}
+	end := s.index(packetEnds[enc], s.endScan)
+	if end < 0 {
+		s.endScan = resume(s.pos+int64(len(s.buf)), packetEnds[enc])
+		return 0, false
+	}
+	s.endScan = end
+	cl = bytes.Index(s.buf[end-s.pos:], packetCloses[enc])
+	if cl < 0 {
+		return 0, false
+	}
+	return int(end-s.pos) + cl + len(packetCloses[enc]), true
+}
+
+// parsePacket fills packet properties from raw packet bytes.
+func parsePacket(b []byte, enc Encoding) *PacketInfo {
+	p := &PacketInfo{
+		Length:   int64(len(b)),
+		Encoding: enc,
+		Data:     b,
+	}
+
+	end := bytes.LastIndex(b, packetEnds[enc])
+	if end < 0 {
+		return p
+	}
+	trailer := enc.Decode(b[end+len(packetEnds[enc]):])
+	trailer = bytes.TrimLeft(trailer, " \t\r\n=")
+	p.Writable = bytes.HasPrefix(trailer, []byte("\"w\"")) || bytes.HasPrefix(trailer, []byte("'w'"))
+
+	u := enc.unitSize()
+	for i := end - u; i >= 0 && enc.isSpaceAt(b, i); i -= u {
+		p.Padding += int64(u)
+	}
+	return p
+}
+
+// MainPacket selects the main packet of a file from a list of scanned
+// packets. Following the advice in XMP Specification Part 3 the packet
+// with the most recent xmp:MetadataDate (or xmp:ModifyDate) is chosen.
+// Packets without dates lose against dated packets, and on ties the
+// last packet in the file wins since incremental updates append new
+// packets. Packets that fail to parse are ignored.
+func MainPacket(l []*PacketInfo) *PacketInfo {
+	var (
+		main *PacketInfo
+		best Date
+	)
+	for _, p := range l {
+		d, err := p.Decode()
+		if err != nil {
+			continue
+		}
+		var date Date
+		for _, path := range []Path{pathMetadataDate, pathModifyDate} {
+			if v, err := d.GetPath(path); err == nil && v != "" {
+				if err := date.UnmarshalText([]byte(v)); err == nil {
+					break
+				}
+			}
+		}
+		d.Close()
+		if main == nil || !date.Value().Before(best.Value()) {
+			main, best = p, date
+		}
+	}
+	return main
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Precedence selects which of the embedded and sidecar packets wins when
+// both define the same property.
+type Precedence int
+
+const (
+	PreferNewer    Precedence = iota // packet with later xmp:MetadataDate wins
+	PreferEmbedded                   // embedded packet always wins
+	PreferSidecar                    // sidecar packet always wins
+)
+
+func ParsePrecedence(s string) Precedence {
+	switch strings.ToLower(s) {
+	case "embedded":
+		return PreferEmbedded
+	case "sidecar":
+		return PreferSidecar
+	default:
+		return PreferNewer
+	}
+}
+
+func (p Precedence) String() string {
+	switch p {
+	case PreferEmbedded:
+		return "embedded"
+	case PreferSidecar:
+		return "sidecar"
+	default:
+		return "newer"
+	}
+}
+
+// ReadFunc loads the XMP document embedded in a media file and returns
+// io.EOF when the file contains no metadata.
+type ReadFunc func(filename string) (*Document, error)
+
+type SidecarOptions struct {
+	// Precedence decides which packet is the merge base.
+	Precedence Precedence
+
+	// Flags control how properties of the losing packet are merged into
+	// the winner. Zero defaults to MERGE which only adds missing values.
+	Flags SyncFlags
+
+	// Embedded reads metadata from the media file. When nil, ReadFile is
+	// used.
+	Embedded ReadFunc
+}
+
+var (
+	pathMetadataDate        = Path("xmp:MetadataDate")
+	pathModifyDate          = Path("xmp:ModifyDate")
+	pathSidecarForExtension = Path("photoshop:SidecarForExtension")
+)
+
+// SidecarNames returns the sidecar file names that may belong to a media
+// file in order of preference. Names that carry the full media file name
+// like IMG_1234.CR2.xmp are unambiguous and come first, followed by the
+// short form IMG_1234.xmp which may be shared by several media files.
+func SidecarNames(filename string) []string {
+	base := filepath.Base(filename)
+	ext := filepath.Ext(base)
+	names := []string{base + ".xmp"}
+	if ext != "" {
+		names = append(names, strings.TrimSuffix(base, ext)+".xmp")
+	}
+	return names
+}
+
+// FindSidecar returns the path of the sidecar file for the media file at
+// filename. Names are matched case-insensitive so that IMG_1234.XMP or
+// img_1234.cr2.xmp are found as well. Short form sidecars which declare
+// photoshop:SidecarForExtension for a different media file type are
+// skipped. When no sidecar exists FindSidecar returns os.ErrNotExist.
+func FindSidecar(filename string) (string, error) {
+	dir := filepath.Dir(filename)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	for _, name := range SidecarNames(filename) {
+		for _, v := range entries {
+			if v.IsDir() || !strings.EqualFold(v.Name(), name) {
+				continue
+			}
+			path := filepath.Join(dir, v.Name())
+			if !isSidecarFor(path, ext) {
+				Log.Debugf("xmp: sidecar %s does not match extension %s", path, ext)
+				continue
+			}
+			return path, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// isSidecarFor checks whether the sidecar at path is declared for media
+// files with extension ext. Sidecars that cannot be parsed or do not
+// declare photoshop:SidecarForExtension are accepted.
+func isSidecarFor(path, ext string) bool {
+	d, err := readSidecar(path)
+	if err != nil {
+		return true
+	}
+	defer d.Close()
+	v, err := d.GetPath(pathSidecarForExtension)
+	if err != nil || v == "" {
+		return true
+	}
+	return strings.EqualFold(strings.TrimPrefix(v, "."), ext)
+}
+
+func readSidecar(path string) (*Document, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := NewDocument()
+	if err := Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ReadWithSidecar reads the metadata embedded in the media file at filename
+// and from its sidecar file and merges both according to opts. When only
+// one of them exists it is returned unchanged. When neither exists
+// ReadWithSidecar returns io.EOF.
+func ReadWithSidecar(filename string, opts *SidecarOptions) (*Document, error) {
+	if opts == nil {
+		opts = &SidecarOptions{}
+	}
+	read := opts.Embedded
+	if read == nil {
+		read = ReadFile
+	}
+	embedded, err := read(filename)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var sidecar *Document
+	path, err := FindSidecar(filename)
+	switch {
+	case err == nil:
+		if sidecar, err = readSidecar(path); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	switch {
+	case embedded == nil && sidecar == nil:
+		return nil, io.EOF
+	case sidecar == nil:
+		return embedded, nil
+	case embedded == nil:
+		return sidecar, nil
+	}
+
+	winner, loser := sidecar, embedded
+	switch opts.Precedence {
+	case PreferEmbedded:
+		winner, loser = embedded, sidecar
+	case PreferNewer:
+		if metadataTime(embedded, filename).After(metadataTime(sidecar, path)) {
+			winner, loser = embedded, sidecar
+		}
+	}
+	flags := opts.Flags
+	if flags == 0 {
+		flags = MERGE
+	}
+	if err := winner.Merge(loser, flags); err != nil {
+		return nil, err
+	}
+	loser.Close()
+	return winner, nil
+}
+
+// metadataTime returns xmp:MetadataDate of d or the modification time of
+// the file at path when the document has no metadata date.
+func metadataTime(d *Document, path string) time.Time {
+	if v, err := d.GetPath(pathMetadataDate); err == nil && v != "" {
+		var t Date
+		if err := t.UnmarshalText([]byte(v)); err == nil && !t.IsZero() {
+			return t.Value()
+		}
+	}
+	if fi, err := os.Stat(path); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
@@ -83,7 +83,10 @@ func (d *Decoder) Decode(x *Document) error {
 	}
 
 	// 2  skip top-level `x:xmpmeta` (optional) and `rdf:RDF` nodes
+	//    keeping namespaces declared on them
+	outer := make([]*Node, 0, 2)
 	if root.FullName() == "x:xmpmeta" {
+		outer = append(outer, root)
 		if a := root.GetAttr(nsX.GetURI(), "xmptk"); len(a) > 0 {
 			x.toolkit = strings.TrimSpace(a[0].Value)
 		}
@@ -101,7 +104,8 @@ func (d *Decoder) Decode(x *Document) error {
 	}
 
 	// 3  extract document namespaces
-	for _, n := range root.Nodes {
+	outer = append(outer, root)
+	for _, n := range append(outer, root.Nodes...) {
 		for _, v := range n.GetAttr("xmlns", "") {
 			d.addNamespace(v.Name.Local, v.Value)
 		}
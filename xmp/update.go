@@ -0,0 +1,140 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var (
+	ErrReadOnlyPacket = errors.New("xmp: packet is read-only")
+	ErrInvalidPacket  = errors.New("xmp: invalid packet")
+)
+
+var extendedXmpTag = []byte("HasExtendedXMP")
+
+// MarshalPacket encodes d as XMP packet of exactly size bytes. Remaining
+// space is filled with whitespace padding. It returns ErrOverflow when the
+// document does not fit.
+func MarshalPacket(d *Document, size int64) ([]byte, error) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	enc.SetFlags(Xpacket | Xpadding)
+	enc.SetMaxSize(size)
+	if err := enc.Encode(d); err != nil {
+		return nil, err
+	}
+	if int64(b.Len()) != size {
+		return nil, ErrOverflow
+	}
+	return b.Bytes(), nil
+}
+
+// MarshalPacketEncoding works like MarshalPacket but encodes the packet
+// in UTF-16 or UTF-32 when enc requires it.
+func MarshalPacketEncoding(d *Document, size int64, enc Encoding) ([]byte, error) {
+	if enc == EncodingUTF8 {
+		return MarshalPacket(d, size)
+	}
+	b, err := Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSuffix(b, xmp_packet_footer)
+	b = bytes.Replace(b, []byte("begin=\"\""), []byte("begin=\"\ufeff\""), 1)
+	body, footer := enc.Encode(b), enc.Encode(xmp_packet_footer)
+	pad := (size - int64(len(body)+len(footer))) / int64(enc.unitSize())
+	if pad < 0 || (size-int64(len(body)+len(footer)))%int64(enc.unitSize()) != 0 {
+		return nil, ErrOverflow
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	buf.Write(body)
+	for i := int64(0); i < pad; i++ {
+		if i%80 == 0 {
+			buf.Write(enc.Encode([]byte("\n")))
+		} else {
+			buf.Write(enc.Encode([]byte(" ")))
+		}
+	}
+	buf.Write(footer)
+	return buf.Bytes(), nil
+}
+
+// identifyPacket parses b when it is a complete packet.
+func identifyPacket(b []byte) *PacketInfo {
+	for _, e := range encodings {
+		if !bytes.HasPrefix(b, packetStarts[e]) {
+			continue
+		}
+		s := NewPacketScanner(bytes.NewReader(b))
+		if s.Next() && s.Packet().Length == int64(len(b)) {
+			return s.Packet()
+		}
+	}
+	return nil
+}
+
+// UpdatePacket re-encodes d into the space of the existing packet that
+// starts at offset and is length bytes long and overwrites only these
+// bytes. The packet keeps its character encoding. Read-only packets are
+// refused with ErrReadOnlyPacket. When the document does not fit
+// UpdatePacket returns ErrOverflow and leaves the file unchanged. Packets
+// that refer to extended XMP stored elsewhere in the file are treated as
+// read-only because an update would orphan the extension.
+func UpdatePacket(f io.ReadWriteSeeker, offset, length int64, d *Document) error {
+	old := make([]byte, length)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(f, old); err != nil {
+		return err
+	}
+	p := identifyPacket(old)
+	if p == nil {
+		return ErrInvalidPacket
+	}
+	if !p.Writable || bytes.Contains(p.Text(), extendedXmpTag) {
+		return ErrReadOnlyPacket
+	}
+	b, err := MarshalPacketEncoding(d, length, p.Encoding)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+// UpdateFile embeds d into f by overwriting the main XMP packet found by
+// the packet scanner. It returns io.EOF when f contains no packet and
+// ErrInvalidPacket when packets exist but none of them can be parsed.
+func UpdateFile(f io.ReadWriteSeeker, d *Document) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l, err := FindPackets(f)
+	if err != nil {
+		return err
+	}
+	p := MainPacket(l)
+	if p == nil {
+		return ErrInvalidPacket
+	}
+	return UpdatePacket(f, p.Offset, p.Length, d)
+}
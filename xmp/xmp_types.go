@@ -161,6 +161,7 @@ var illegalZero StringList = StringList{
 // "00/00/00T00:00:00+00:00", // ARRI zero time
 // "2011-02-15T10:15:14+1:00"
 // "2011-02-15T10:15:14+1"
+// "2011-02-15T10:15:14+02"
 // "2017-09-15T20:17:41+00200", // seen from iPhone5s iOS10 video, ffprobe
 func repairTZ(value string) string {
 	if illegalZero.Contains(value) {
@@ -173,7 +174,10 @@ func repairTZ(value string) string {
 	a, b, c := value[l-5], value[l-2], value[l-6]
 	switch a {
 	case '+', '-', 'Z':
-		return value[:l-4] + "0" + value[l-4:]
+		// single digit hours "+1:00", but not "+0200"
+		if strings.Contains(value[l-4:], ":") {
+			return value[:l-4] + "0" + value[l-4:]
+		}
 	}
 	switch b {
 	case '+', '-', 'Z':
@@ -185,6 +189,11 @@ func repairTZ(value string) string {
 			return value[:l-5] + value[l-4:]
 		}
 	}
+	// hour-only offsets "+02"
+	switch value[l-3] {
+	case '+', '-':
+		return value + ":00"
+	}
 	return value
 }
 